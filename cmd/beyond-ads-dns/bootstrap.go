@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -21,6 +22,7 @@ import (
 	"github.com/tternquist/beyond-ads-dns/internal/localrecords"
 	"github.com/tternquist/beyond-ads-dns/internal/logging"
 	"github.com/tternquist/beyond-ads-dns/internal/metrics"
+	"github.com/tternquist/beyond-ads-dns/internal/proxyproto"
 	"github.com/tternquist/beyond-ads-dns/internal/querystore"
 	"github.com/tternquist/beyond-ads-dns/internal/requestlog"
 	"github.com/tternquist/beyond-ads-dns/internal/sync"
@@ -188,6 +190,7 @@ func runServer(configPath string) error {
 	resolver.SetTraceEvents(traceEvents)
 	resolver.StartGroupBlocklists(ctx)
 	resolver.StartRefreshSweeper(ctx)
+	resolver.StartHealthChecks(ctx)
 
 	controlServer := control.Start(control.Config{
 		ControlCfg:   cfg.Control,
@@ -200,6 +203,16 @@ func runServer(configPath string) error {
 		TraceEvents:  traceEvents,
 	})
 
+	// Load balancers and reverse proxies allowed to report the real client
+	trustedProxies, err := proxyproto.ParseTrusted(cfg.Server.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	var proxyProtocol proxyproto.Trusted // PROXY headers required from these on TCP listeners (nil = off)
+	if cfg.Server.ProxyProtocol != nil && *cfg.Server.ProxyProtocol {
+		proxyProtocol = trustedProxies
+	}
+
 	// DoH/DoT
 	dohEnabled := cfg.DoHDotServer.Enabled != nil && *cfg.DoHDotServer.Enabled
 	if env := strings.TrimSpace(os.Getenv("DOH_DOT_ENABLED")); env == "true" || env == "1" {
@@ -227,16 +240,26 @@ func runServer(configPath string) error {
 	if dohDoHListen == "" && dohEnabled {
 		dohDoHListen = "0.0.0.0:8443"
 	}
+	// DoQ is opt-in (no default address): it needs UDP 853 open in addition to DoT's TCP 853.
+	dohDoQListen := strings.TrimSpace(os.Getenv("DOH_DOT_DOQ_LISTEN"))
+	if dohDoQListen == "" {
+		dohDoQListen = cfg.DoHDotServer.DoQListen
+	}
 
 	var dohServer *http.Server
+	var doqServer *dohdot.DoQServer
 	if dohEnabled && dohCertFile != "" && dohKeyFile != "" {
 		dohPath := cfg.DoHDotServer.DoHPath
 		if dohPath == "" {
 			dohPath = "/dns-query"
 		}
+		// Encrypted transports identify clients by ID: DoH path /dns-query/<id>, or server name <id>.<client_id_domain>.
+		encHandler := dohdot.ClientIDFromSNI(resolver, cfg.DoHDotServer.ClientIDDomain)
+		// Clients the ACL denies by address are turned away before any query (see acl in config).
+		aclAllow := dohdot.AllowFunc(resolver.AllowsClient)
 		if dohDotListen != "" {
 			go func() {
-				if err := dohdot.DoTServer(ctx, dohDotListen, dohCertFile, dohKeyFile, resolver, logger); err != nil && ctx.Err() == nil {
+				if err := dohdot.DoTServer(ctx, dohDotListen, dohCertFile, dohKeyFile, encHandler, proxyProtocol, aclAllow, logger); err != nil && ctx.Err() == nil {
 					logger.Error("DoT server error", "err", err)
 				}
 			}()
@@ -247,18 +270,40 @@ func runServer(configPath string) error {
 				logger.Error("DoH server: failed to load TLS cert", "err", err)
 			} else {
 				dohMux := http.NewServeMux()
-				dohMux.Handle(dohPath, dohdot.DoHHandler(resolver, dohPath))
+				dohHandler := dohdot.DoHHandler(encHandler, dohPath, trustedProxies, aclAllow)
+				dohMux.Handle(dohPath, dohHandler)
+				dohMux.Handle(dohPath+"/", dohHandler)
 				dohServer = &http.Server{
 					Addr:      dohDoHListen,
 					Handler:   dohMux,
 					TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
 				}
 				go func() {
-					if err := dohServer.ListenAndServeTLS(dohCertFile, dohKeyFile); err != nil && err != http.ErrServerClosed {
+					ln, err := net.Listen("tcp", dohDoHListen)
+					if err == nil {
+						if len(proxyProtocol) > 0 {
+							ln = proxyproto.NewListener(ln, proxyProtocol)
+						}
+						err = dohServer.ServeTLS(ln, dohCertFile, dohKeyFile)
+					}
+					if err != nil && err != http.ErrServerClosed {
 						logger.Error("DoH server error", "err", err)
 					}
 				}()
-				logger.Info("DoH server listening", "addr", dohDoHListen, "path", dohPath)
+				logger.Info("DoH server listening", "addr", dohDoHListen, "path", dohPath, "proxy_protocol", len(proxyProtocol) > 0)
+			}
+		}
+		if dohDoQListen != "" {
+			doqServer, err = dohdot.NewDoQServer(dohDoQListen, dohCertFile, dohKeyFile, encHandler, logger)
+			if err != nil {
+				logger.Error("DoQ server: failed to load TLS cert", "err", err)
+			} else {
+				doqServer.Allow = aclAllow
+				go func() {
+					if err := doqServer.ListenAndServe(); err != nil {
+						logger.Error("DoQ server error", "err", err)
+					}
+				}()
 			}
 		}
 	}
@@ -293,6 +338,23 @@ func runServer(configPath string) error {
 	}
 	for _, listen := range cfg.Server.Listen {
 		for _, proto := range cfg.Server.Protocols {
+			if proto == "tcp" && len(proxyProtocol) > 0 {
+				// One listener reading PROXY headers: accepting is not the bottleneck for TCP,
+				// and SO_REUSEPORT still spreads UDP.
+				ln, err := net.Listen("tcp", listen)
+				if err != nil {
+					return err
+				}
+				servers = append(servers, &dns.Server{
+					Listener:     proxyproto.NewListener(ln, proxyProtocol),
+					Addr:         listen,
+					Net:          proto,
+					Handler:      resolver,
+					ReadTimeout:  cfg.Server.ReadTimeout.Duration,
+					WriteTimeout: cfg.Server.WriteTimeout.Duration,
+				})
+				continue
+			}
 			for i := 0; i < nListeners; i++ {
 				server := &dns.Server{
 					Addr:         listen,
@@ -311,8 +373,12 @@ func runServer(configPath string) error {
 	seenAddr := make(map[string]bool)
 	for _, server := range servers {
 		srv := server
+		serve := srv.ListenAndServe
+		if srv.Listener != nil {
+			serve = srv.ActivateAndServe
+		}
 		go func() {
-			if err := srv.ListenAndServe(); err != nil {
+			if err := serve(); err != nil {
 				select {
 				case <-ctx.Done():
 					return
@@ -324,7 +390,9 @@ func runServer(configPath string) error {
 		key := srv.Addr + " " + srv.Net
 		if !seenAddr[key] {
 			seenAddr[key] = true
-			if srv.ReusePort {
+			if srv.Listener != nil {
+				logger.Info("listening", "addr", srv.Addr, "proto", srv.Net, "proxy_protocol", true)
+			} else if srv.ReusePort {
 				logger.Info("listening", "addr", srv.Addr, "proto", srv.Net, "reuse_port_listeners", nListeners)
 			} else {
 				logger.Info("listening", "addr", srv.Addr, "proto", srv.Net)
@@ -348,6 +416,12 @@ func runServer(configPath string) error {
 	if dohServer != nil {
 		_ = dohServer.Shutdown(ctx)
 	}
+	if doqServer != nil {
+		// ctx is already done: give queries in flight a few seconds to be answered.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_ = doqServer.Shutdown(shutdownCtx)
+		cancel()
+	}
 
 	return nil
 }
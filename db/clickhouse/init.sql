@@ -14,7 +14,8 @@ CREATE TABLE IF NOT EXISTS beyond_ads.dns_queries
     duration_ms Float64,
     cache_lookup_ms Float64 DEFAULT 0,
     network_write_ms Float64 DEFAULT 0,
-    upstream_address LowCardinality(String) DEFAULT ''
+    upstream_address LowCardinality(String) DEFAULT '',
+    blocked_by String DEFAULT ''
 )
 ENGINE = MergeTree
 PARTITION BY toDate(ts)
@@ -0,0 +1,5 @@
+-- Migration: Add blocked_by column to dns_queries table
+-- Records what matched for blocked outcomes (e.g. the CNAME link for blocked_cname)
+
+ALTER TABLE beyond_ads.dns_queries
+ADD COLUMN IF NOT EXISTS blocked_by String DEFAULT '';
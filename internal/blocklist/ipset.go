@@ -0,0 +1,133 @@
+package blocklist
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// IPMatch describes the blocklist entry that matched an address.
+type IPMatch struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Source string       `json:"source"`
+}
+
+// ipRange is one prefix of an ipSet with its last address precomputed for lookups.
+type ipRange struct {
+	prefix netip.Prefix
+	last   netip.Addr
+	source string
+}
+
+// ipSet is an immutable set of IPv4 and IPv6 prefixes. CIDR blocks either nest or are
+// disjoint, so dropping every prefix covered by a wider one leaves sorted, non-overlapping
+// ranges that are searched in O(log n) without the per-bit nodes of a trie.
+type ipSet struct {
+	v4 []ipRange
+	v6 []ipRange
+}
+
+// ipSetEntry is a prefix together with the name of the source that listed it.
+type ipSetEntry struct {
+	prefix netip.Prefix
+	source string
+}
+
+// newIPSet builds a set from entries. When prefixes nest, the widest one (and its source) is kept.
+func newIPSet(entries []ipSetEntry) *ipSet {
+	if len(entries) == 0 {
+		return nil
+	}
+	var v4, v6 []ipSetEntry
+	for _, e := range entries {
+		p := e.prefix.Masked()
+		if !p.IsValid() {
+			continue
+		}
+		e.prefix = p
+		if p.Addr().Is4() {
+			v4 = append(v4, e)
+		} else {
+			v6 = append(v6, e)
+		}
+	}
+	set := &ipSet{v4: compactRanges(v4), v6: compactRanges(v6)}
+	if len(set.v4) == 0 && len(set.v6) == 0 {
+		return nil
+	}
+	return set
+}
+
+func compactRanges(entries []ipSetEntry) []ipRange {
+	if len(entries) == 0 {
+		return nil
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if c := entries[i].prefix.Addr().Compare(entries[j].prefix.Addr()); c != 0 {
+			return c < 0
+		}
+		return entries[i].prefix.Bits() < entries[j].prefix.Bits()
+	})
+	ranges := make([]ipRange, 0, len(entries))
+	for _, e := range entries {
+		if n := len(ranges); n > 0 && ranges[n-1].prefix.Contains(e.prefix.Addr()) {
+			continue
+		}
+		ranges = append(ranges, ipRange{prefix: e.prefix, last: lastAddr(e.prefix), source: e.source})
+	}
+	return ranges
+}
+
+// lastAddr returns the highest address in p (p must be masked).
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - uint(i%8))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// lookup returns the prefix containing addr. IPv4-mapped IPv6 addresses match IPv4 prefixes.
+func (s *ipSet) lookup(addr netip.Addr) (IPMatch, bool) {
+	if s == nil || !addr.IsValid() {
+		return IPMatch{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	ranges := s.v6
+	if addr.Is4() {
+		ranges = s.v4
+	}
+	// First range starting after addr; the candidate is the one before it.
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].prefix.Addr().Compare(addr) > 0 })
+	if i == 0 {
+		return IPMatch{}, false
+	}
+	r := ranges[i-1]
+	if addr.Compare(r.last) > 0 {
+		return IPMatch{}, false
+	}
+	return IPMatch{Prefix: r.prefix, Source: r.source}, true
+}
+
+func (s *ipSet) len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.v4) + len(s.v6)
+}
+
+// parseIPEntry parses a single address or CIDR. Single addresses become /32 or /128 prefixes.
+func parseIPEntry(s string) (netip.Prefix, bool) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), max(p.Bits()-96, 0))
+		}
+		return p.Masked(), true
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
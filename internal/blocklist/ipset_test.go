@@ -0,0 +1,77 @@
+package blocklist
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestIPSetLookup(t *testing.T) {
+	set := newIPSet([]ipSetEntry{
+		{prefix: netip.MustParsePrefix("203.0.113.0/24"), source: "feed-a"},
+		{prefix: netip.MustParsePrefix("203.0.113.128/25"), source: "feed-b"}, // nested, dropped
+		{prefix: netip.MustParsePrefix("198.51.100.7/32"), source: "feed-b"},
+		{prefix: netip.MustParsePrefix("10.1.2.3/8"), source: "feed-c"}, // masked to 10.0.0.0/8
+		{prefix: netip.MustParsePrefix("2001:db8:bad::/48"), source: "feed-a"},
+	})
+	if got := set.len(); got != 4 {
+		t.Fatalf("len = %d, want 4", got)
+	}
+
+	tests := []struct {
+		addr   string
+		prefix string
+		source string
+	}{
+		{"203.0.113.0", "203.0.113.0/24", "feed-a"},
+		{"203.0.113.200", "203.0.113.0/24", "feed-a"},
+		{"203.0.113.255", "203.0.113.0/24", "feed-a"},
+		{"203.0.114.0", "", ""},
+		{"198.51.100.7", "198.51.100.7/32", "feed-b"},
+		{"198.51.100.8", "", ""},
+		{"10.255.0.1", "10.0.0.0/8", "feed-c"},
+		{"9.255.255.255", "", ""},
+		{"::ffff:203.0.113.9", "203.0.113.0/24", "feed-a"},
+		{"2001:db8:bad:1::1", "2001:db8:bad::/48", "feed-a"},
+		{"2001:db8:bae::1", "", ""},
+		{"::1", "", ""},
+	}
+	for _, tt := range tests {
+		match, ok := set.lookup(netip.MustParseAddr(tt.addr))
+		if ok != (tt.prefix != "") {
+			t.Errorf("lookup(%s) ok = %v, want %v", tt.addr, ok, tt.prefix != "")
+			continue
+		}
+		if ok && (match.Prefix.String() != tt.prefix || match.Source != tt.source) {
+			t.Errorf("lookup(%s) = %s (%s), want %s (%s)", tt.addr, match.Prefix, match.Source, tt.prefix, tt.source)
+		}
+	}
+
+	var empty *ipSet
+	if _, ok := empty.lookup(netip.MustParseAddr("203.0.113.1")); ok {
+		t.Error("nil set should not match")
+	}
+	if newIPSet(nil) != nil {
+		t.Error("newIPSet(nil) should be nil")
+	}
+}
+
+func TestParseIPEntry(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"192.0.2.1/24", "192.0.2.0/24"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"::ffff:192.0.2.0/120", "192.0.2.0/24"},
+		{"example.com", ""},
+		{"192.0.2.1/33", ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseIPEntry(tt.in)
+		if ok != (tt.want != "") || (ok && got.String() != tt.want) {
+			t.Errorf("parseIPEntry(%q) = %s, %v; want %q", tt.in, got, ok, tt.want)
+		}
+	}
+}
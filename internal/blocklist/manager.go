@@ -6,6 +6,7 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"regexp"
 	"strings"
 	"sync"
@@ -18,20 +19,24 @@ import (
 type domainMatcher struct {
 	exact map[string]struct{}
 	regex []*regexp.Regexp
+	ips   *ipSet // IP and CIDR entries, matched against answer addresses
 }
 
 type Snapshot struct {
-	blocked     map[string]struct{}
+	blocked     map[string]uint16 // domain -> index into sourceNames
+	sourceNames []string
+	blockedIPs  *ipSet // from sources with type "ip"
 	allow       *domainMatcher
 	deny        *domainMatcher
 	bloomFilter *BloomFilter
 }
 
 type Stats struct {
-	Blocked int                `json:"blocked"`
-	Allow   int                `json:"allow"`
-	Deny    int                `json:"deny"`
-	Bloom   *BloomStats        `json:"bloom,omitempty"`
+	Blocked    int                `json:"blocked"`
+	BlockedIPs int                `json:"blocked_ips"`
+	Allow      int                `json:"allow"`
+	Deny       int                `json:"deny"`
+	Bloom      *BloomStats        `json:"bloom,omitempty"`
 }
 
 type Manager struct {
@@ -74,7 +79,7 @@ func NewManager(cfg config.BlocklistConfig, logger *slog.Logger, logAttrs ...any
 		lastAppliedCfg: ptr(blocklistConfigCopy(cfg)),
 	}
 	manager.snapshot.Store(&Snapshot{
-		blocked: map[string]struct{}{},
+		blocked: map[string]uint16{},
 		allow:   manager.allowMatcher,
 		deny:    manager.denyMatcher,
 	})
@@ -319,7 +324,7 @@ func (m *Manager) LoadOnce(ctx context.Context) error {
 
 	if len(sources) == 0 {
 		m.snapshot.Store(&Snapshot{
-			blocked:     map[string]struct{}{},
+			blocked:     map[string]uint16{},
 			allow:       allowMatcher,
 			deny:        denyMatcher,
 			bloomFilter: nil,
@@ -330,7 +335,9 @@ func (m *Manager) LoadOnce(ctx context.Context) error {
 	// We no longer do a separate pre-flight HTTP round-trip; fetch errors are
 	// handled inline so each URL is only fetched once.
 	failOnAny := healthCfg != nil && healthCfg.FailOnAny != nil && *healthCfg.FailOnAny
-	blocked := make(map[string]struct{})
+	blocked := make(map[string]uint16)
+	var sourceNames []string
+	var blockedIPs []ipSetEntry
 	failures := 0
 	emptySources := 0
 	sourceCounts := make([]string, 0, len(sources))
@@ -366,6 +373,27 @@ func (m *Manager) LoadOnce(ctx context.Context) error {
 			}
 			continue
 		}
+		if source.Type == config.BlocklistSourceTypeIP {
+			prefixes, err := ParseIPs(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				failures++
+				m.logf(slog.LevelError, "blocklist source parse failed", "source", source.Name, "err", err)
+				if failOnAny {
+					return fmt.Errorf("blocklist %q parse failed: %w", source.Name, err)
+				}
+				continue
+			}
+			if len(prefixes) == 0 {
+				emptySources++
+				m.logf(slog.LevelWarn, "blocklist source returned no addresses", "source", source.Name, "hint", "source may have returned error page or empty content; reapply to retry")
+			}
+			sourceCounts = append(sourceCounts, source.Name+":"+fmt.Sprintf("%d", len(prefixes)))
+			for _, prefix := range prefixes {
+				blockedIPs = append(blockedIPs, ipSetEntry{prefix: prefix, source: source.Name})
+			}
+			continue
+		}
 		entries, err := ParseDomains(resp.Body)
 		resp.Body.Close()
 		if err != nil {
@@ -381,15 +409,19 @@ func (m *Manager) LoadOnce(ctx context.Context) error {
 			m.logf(slog.LevelWarn, "blocklist source returned no domains", "source", source.Name, "hint", "source may have returned error page or empty content; reapply to retry")
 		}
 		sourceCounts = append(sourceCounts, source.Name+":"+fmt.Sprintf("%d", len(entries)))
+		index := uint16(len(sourceNames))
+		sourceNames = append(sourceNames, source.Name)
 		for domain := range entries {
-			blocked[domain] = struct{}{}
+			if _, ok := blocked[domain]; !ok {
+				blocked[domain] = index
+			}
 		}
 	}
 	if failures == len(sources) {
 		return fmt.Errorf("all blocklist sources failed")
 	}
 	if (failures > 0 || emptySources > 0) && m.logger != nil {
-		m.logf(slog.LevelWarn, "blocklist partial load", "failed_sources", failures, "empty_sources", emptySources, "loaded_domains", len(blocked), "hint", "some sources failed or returned no domains; reapply blocklists or check logs")
+		m.logf(slog.LevelWarn, "blocklist partial load", "failed_sources", failures, "empty_sources", emptySources, "loaded_domains", len(blocked), "loaded_ip_prefixes", len(blockedIPs), "hint", "some sources failed or returned no domains; reapply blocklists or check logs")
 	}
 
 	// Create bloom filter for fast negative lookups
@@ -415,6 +447,8 @@ func (m *Manager) LoadOnce(ctx context.Context) error {
 	
 	m.snapshot.Store(&Snapshot{
 		blocked:     blocked,
+		sourceNames: sourceNames,
+		blockedIPs:  newIPSet(blockedIPs),
 		allow:       allowMatcher,
 		deny:        denyMatcher,
 		bloomFilter: bloom,
@@ -465,7 +499,7 @@ func blocklistConfigEqual(a, b config.BlocklistConfig) bool {
 		return false
 	}
 	for i := range a.Sources {
-		if a.Sources[i].Name != b.Sources[i].Name || a.Sources[i].URL != b.Sources[i].URL {
+		if a.Sources[i].Name != b.Sources[i].Name || a.Sources[i].URL != b.Sources[i].URL || a.Sources[i].Type != b.Sources[i].Type {
 			return false
 		}
 	}
@@ -575,9 +609,16 @@ func stringSlicesEqual(a, b []string) bool {
 }
 
 func (m *Manager) IsBlocked(qname string) bool {
+	_, blocked := m.BlockedBy(qname)
+	return blocked
+}
+
+// BlockedBy reports whether qname is blocked and names the list that blocked it: the source
+// name for domains from blocklist sources, "denylist" or "family_time".
+func (m *Manager) BlockedBy(qname string) (string, bool) {
 	normalized := normalizeQueryName(qname)
 	if normalized == "" {
-		return false
+		return "", false
 	}
 
 	// Family time: block specified services during scheduled window
@@ -585,25 +626,25 @@ func (m *Manager) IsBlocked(qname string) bool {
 	if ft != nil {
 		fi := ft.(*familyTimeInfo)
 		if fi != nil && fi.inWindow(time.Now()) && domainMatch(fi.domains, normalized) {
-			return true
+			return "family_time", true
 		}
 	}
 
 	// Check if blocking is paused (scheduled pause or manual pause)
 	if m.IsPaused() {
-		return false
+		return "", false
 	}
 
 	snap := m.snapshot.Load()
 	if snap == nil {
-		return false
+		return "", false
 	}
 	snapshot := snap.(*Snapshot)
 	if domainMatch(snapshot.allow, normalized) {
-		return false
+		return "", false
 	}
 	if domainMatch(snapshot.deny, normalized) {
-		return true
+		return "denylist", true
 	}
 	
 	// Fast path: Use bloom filter for quick negative lookups
@@ -625,12 +666,59 @@ func (m *Manager) IsBlocked(qname string) bool {
 		}
 		// If bloom filter says definitely not blocked, skip map lookup
 		if !inBloom {
-			return false
+			return "", false
 		}
 	}
 	
 	// Check blocked domains from sources (exact match with subdomain support)
-	return domainMatchExact(snapshot.blocked, normalized)
+	index, ok := domainMatchExact(snapshot.blocked, normalized)
+	if !ok {
+		return "", false
+	}
+	if int(index) < len(snapshot.sourceNames) {
+		return snapshot.sourceNames[index], true
+	}
+	return "", true
+}
+
+// IsAllowed reports whether qname (or a parent domain) is on the allowlist. Unlike IsBlocked
+// it ignores pauses and family time; it tells whether the user explicitly trusts the name.
+func (m *Manager) IsAllowed(qname string) bool {
+	normalized := normalizeQueryName(qname)
+	if normalized == "" {
+		return false
+	}
+	snap := m.snapshot.Load()
+	if snap == nil {
+		return false
+	}
+	return domainMatch(snap.(*Snapshot).allow, normalized)
+}
+
+// MatchIP reports whether addr (an A/AAAA answer) falls inside a blocked range from an IP
+// source or the denylist, and which entry matched. IP and CIDR allowlist entries win, and
+// nothing matches while blocking is paused.
+func (m *Manager) MatchIP(addr netip.Addr) (IPMatch, bool) {
+	if !addr.IsValid() || m.IsPaused() {
+		return IPMatch{}, false
+	}
+	snap := m.snapshot.Load()
+	if snap == nil {
+		return IPMatch{}, false
+	}
+	snapshot := snap.(*Snapshot)
+	if snapshot.allow != nil {
+		if _, ok := snapshot.allow.ips.lookup(addr); ok {
+			return IPMatch{}, false
+		}
+	}
+	if snapshot.deny != nil {
+		if match, ok := snapshot.deny.ips.lookup(addr); ok {
+			match.Source = "denylist"
+			return match, true
+		}
+	}
+	return snapshot.blockedIPs.lookup(addr)
 }
 
 func (m *Manager) Pause(duration time.Duration) {
@@ -703,10 +791,10 @@ func (m *Manager) Stats() Stats {
 	allowCount := 0
 	denyCount := 0
 	if snapshot.allow != nil {
-		allowCount = len(snapshot.allow.exact) + len(snapshot.allow.regex)
+		allowCount = len(snapshot.allow.exact) + len(snapshot.allow.regex) + snapshot.allow.ips.len()
 	}
 	if snapshot.deny != nil {
-		denyCount = len(snapshot.deny.exact) + len(snapshot.deny.regex)
+		denyCount = len(snapshot.deny.exact) + len(snapshot.deny.regex) + snapshot.deny.ips.len()
 	}
 	
 	var bloomStats *BloomStats
@@ -716,10 +804,11 @@ func (m *Manager) Stats() Stats {
 	}
 	
 	return Stats{
-		Blocked: len(snapshot.blocked),
-		Allow:   allowCount,
-		Deny:    denyCount,
-		Bloom:   bloomStats,
+		Blocked:    len(snapshot.blocked),
+		BlockedIPs: snapshot.blockedIPs.len(),
+		Allow:      allowCount,
+		Deny:       denyCount,
+		Bloom:      bloomStats,
 	}
 }
 
@@ -728,11 +817,17 @@ func normalizeList(domains []string, logger *slog.Logger) *domainMatcher {
 		exact: make(map[string]struct{}),
 		regex: make([]*regexp.Regexp, 0),
 	}
+	var ips []ipSetEntry
 	for _, domain := range domains {
 		trimmed := strings.TrimSpace(domain)
 		if trimmed == "" {
 			continue
 		}
+		// IP addresses and CIDRs apply to answer addresses rather than query names
+		if prefix, ok := parseIPEntry(trimmed); ok {
+			ips = append(ips, ipSetEntry{prefix: prefix})
+			continue
+		}
 		// Check if it's a regex pattern (wrapped in /)
 		if strings.HasPrefix(trimmed, "/") && strings.HasSuffix(trimmed, "/") && len(trimmed) > 2 {
 			pattern := trimmed[1 : len(trimmed)-1]
@@ -760,6 +855,7 @@ func normalizeList(domains []string, logger *slog.Logger) *domainMatcher {
 			matcher.exact[normalized] = struct{}{}
 		}
 	}
+	matcher.ips = newIPSet(ips)
 	return matcher
 }
 
@@ -797,14 +893,16 @@ func domainMatch(matcher *domainMatcher, name string) bool {
 	return false
 }
 
-func domainMatchExact(set map[string]struct{}, name string) bool {
+// domainMatchExact looks up name and its parent domains in set and returns the source index
+// of the first match.
+func domainMatchExact(set map[string]uint16, name string) (uint16, bool) {
 	if len(set) == 0 {
-		return false
+		return 0, false
 	}
 	remaining := name
 	for {
-		if _, ok := set[remaining]; ok {
-			return true
+		if index, ok := set[remaining]; ok {
+			return index, true
 		}
 		index := strings.IndexByte(remaining, '.')
 		if index == -1 {
@@ -812,7 +910,7 @@ func domainMatchExact(set map[string]struct{}, name string) bool {
 		}
 		remaining = remaining[index+1:]
 	}
-	return false
+	return 0, false
 }
 
 func (m *Manager) logf(level slog.Level, msg string, args ...any) {
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
 	"testing"
 	"time"
@@ -52,6 +53,76 @@ func TestManagerIsBlocked(t *testing.T) {
 	}
 }
 
+func TestManagerBlockedBy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ads":
+			_, _ = io.WriteString(w, "ads.example.com\nshared.example.com\n")
+		default:
+			_, _ = io.WriteString(w, "tracker.example.com\nshared.example.com\n")
+		}
+	}))
+	defer server.Close()
+
+	cfg := config.BlocklistConfig{
+		RefreshInterval: config.Duration{Duration: time.Hour},
+		Sources: []config.BlocklistSource{
+			{Name: "ads", URL: server.URL + "/ads"},
+			{Name: "trackers", URL: server.URL + "/trackers"},
+		},
+		Denylist: []string{"deny.example.com"},
+	}
+	manager := NewManager(cfg, logging.NewDiscardLogger())
+	if err := manager.LoadOnce(context.Background()); err != nil {
+		t.Fatalf("LoadOnce returned error: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		list    string
+		blocked bool
+	}{
+		{name: "sub.ads.example.com", list: "ads", blocked: true},
+		{name: "tracker.example.com", list: "trackers", blocked: true},
+		{name: "shared.example.com", list: "ads", blocked: true}, // first source listing it
+		{name: "deny.example.com", list: "denylist", blocked: true},
+		{name: "example.com", blocked: false},
+	}
+	for _, tc := range cases {
+		list, blocked := manager.BlockedBy(tc.name)
+		if list != tc.list || blocked != tc.blocked {
+			t.Errorf("BlockedBy(%q) = %q, %v, want %q, %v", tc.name, list, blocked, tc.list, tc.blocked)
+		}
+	}
+}
+
+func TestManagerIsAllowed(t *testing.T) {
+	cfg := config.BlocklistConfig{
+		RefreshInterval: config.Duration{Duration: time.Hour},
+		Allowlist:       []string{"allow.example.com", "/^cdn[0-9]+\\.example\\.net$/"},
+		Denylist:        []string{"deny.example.com"},
+	}
+	manager := NewManager(cfg, logging.NewDiscardLogger())
+	manager.Pause(time.Hour)
+
+	cases := []struct {
+		name    string
+		allowed bool
+	}{
+		{name: "allow.example.com", allowed: true},
+		{name: "Sub.Allow.Example.com.", allowed: true},
+		{name: "cdn7.example.net", allowed: true},
+		{name: "deny.example.com", allowed: false},
+		{name: "example.com", allowed: false},
+		{name: "", allowed: false},
+	}
+	for _, tc := range cases {
+		if got := manager.IsAllowed(tc.name); got != tc.allowed {
+			t.Errorf("IsAllowed(%q) = %v, want %v", tc.name, got, tc.allowed)
+		}
+	}
+}
+
 func TestManagerRegexAllowlist(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, _ = io.WriteString(w, "ads.example.com\n")
@@ -305,6 +376,9 @@ func TestManagerFamilyTime(t *testing.T) {
 	if !manager.IsBlocked("custom-block.example.com") {
 		t.Error("expected custom-block.example.com blocked during family time")
 	}
+	if list, _ := manager.BlockedBy("youtube.com"); list != "family_time" {
+		t.Errorf("BlockedBy(youtube.com) list = %q, want family_time", list)
+	}
 	if manager.IsBlocked("example.com") {
 		t.Error("example.com should not be blocked (not in family time domains)")
 	}
@@ -488,3 +562,58 @@ func TestManagerStart_ExitsOnContextCancel(t *testing.T) {
 		t.Fatal("Start did not exit after context cancel")
 	}
 }
+
+func TestManagerMatchIP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "203.0.113.0/24\n2001:db8:bad::/48\n")
+	}))
+	defer server.Close()
+
+	cfg := config.BlocklistConfig{
+		RefreshInterval: config.Duration{Duration: time.Hour},
+		Sources: []config.BlocklistSource{
+			{Name: "threat-ips", URL: server.URL, Type: config.BlocklistSourceTypeIP},
+		},
+		Allowlist: []string{"203.0.113.10", "allow.example.com"},
+		Denylist:  []string{"198.51.100.0/28", "deny.example.com"},
+	}
+	manager := NewManager(cfg, logging.NewDiscardLogger())
+	if err := manager.LoadOnce(context.Background()); err != nil {
+		t.Fatalf("LoadOnce returned error: %v", err)
+	}
+
+	cases := []struct {
+		addr   string
+		source string
+	}{
+		{"203.0.113.5", "threat-ips"},
+		{"203.0.113.10", ""}, // allowlisted
+		{"2001:db8:bad::1", "threat-ips"},
+		{"198.51.100.3", "denylist"},
+		{"198.51.100.16", ""},
+		{"192.0.2.1", ""},
+	}
+	for _, tc := range cases {
+		match, ok := manager.MatchIP(netip.MustParseAddr(tc.addr))
+		if ok != (tc.source != "") || match.Source != tc.source {
+			t.Errorf("MatchIP(%s) = %+v, %v; want source %q", tc.addr, match, ok, tc.source)
+		}
+	}
+
+	// IP sources do not feed the domain set, and domain entries still work.
+	if manager.IsBlocked("203.0.113.0") {
+		t.Error("IP source entries must not block query names")
+	}
+	if !manager.IsBlocked("deny.example.com") {
+		t.Error("domain denylist entry should still block")
+	}
+	stats := manager.Stats()
+	if stats.BlockedIPs != 2 || stats.Blocked != 0 {
+		t.Errorf("Stats = %+v, want 2 blocked IP prefixes and no domains", stats)
+	}
+
+	manager.Pause(time.Minute)
+	if _, ok := manager.MatchIP(netip.MustParseAddr("203.0.113.5")); ok {
+		t.Error("MatchIP should not match while paused")
+	}
+}
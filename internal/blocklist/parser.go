@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	"net"
+	"net/netip"
 	"net/url"
 	"strings"
 )
@@ -91,3 +92,31 @@ func normalizeDomain(line string) (string, bool) {
 	}
 	return trimmed, true
 }
+
+// ParseIPs parses an IP blocklist: one IPv4/IPv6 address or CIDR per line. Comments starting
+// with # or ; (as in Spamhaus DROP and FireHOL lists) are ignored. Lines with more than one
+// field are skipped so a hosts file loaded by mistake does not block 0.0.0.0 or 127.0.0.1.
+func ParseIPs(reader io.Reader) ([]netip.Prefix, error) {
+	var result []netip.Prefix
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 4096), maxDomainLineLen)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexAny(line, "#;"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 1 {
+			continue
+		}
+		prefix, ok := parseIPEntry(fields[0])
+		if !ok {
+			continue
+		}
+		result = append(result, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -66,3 +66,30 @@ func TestParseDomainsExtendedAdBlock(t *testing.T) {
 	assertHas("api.ads.example.com")
 	assertHas("cdn.ads.example.com")
 }
+
+func TestParseIPs(t *testing.T) {
+	input := strings.Join([]string{
+		"# Spamhaus DROP style",
+		"192.0.2.0/24 ; SBL123",
+		"198.51.100.7",
+		"2001:db8:bad::/48 # comment",
+		"; comment only",
+		"not-an-ip",
+		"0.0.0.0 ads.example.com",
+		"",
+	}, "\n")
+
+	prefixes, err := ParseIPs(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseIPs returned error: %v", err)
+	}
+	want := []string{"192.0.2.0/24", "198.51.100.7/32", "2001:db8:bad::/48"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("ParseIPs = %v, want %v", prefixes, want)
+	}
+	for i, p := range prefixes {
+		if p.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, p, want[i])
+		}
+	}
+}
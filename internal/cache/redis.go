@@ -1219,6 +1219,10 @@ type CacheStats struct {
 	LRU          *LRUStats  `json:"lru,omitempty"`
 	RedisKeys    int64      `json:"redis_keys,omitempty"`    // L1 key count
 	RedisMaxKeys int        `json:"redis_max_keys,omitempty"` // L1 cap (0 = no cap). Restart or apply config for changes to take effect.
+	// UpstreamExchanges and Coalesced are filled in by the resolver, not the cache backend.
+	// Coalesced counts queries that waited on an identical in-flight upstream exchange instead of sending their own.
+	UpstreamExchanges uint64 `json:"upstream_exchanges"`
+	Coalesced         uint64 `json:"coalesced"`
 }
 
 // CleanLRUCache removes expired entries from the L0 cache
@@ -0,0 +1,87 @@
+package clientid
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NormalizeMAC returns the MAC address (EUI-48) in canonical form (aa:bb:cc:dd:ee:ff), and
+// whether it is valid. Colon, hyphen and dotted forms are accepted.
+func NormalizeMAC(mac string) (string, bool) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil || len(hw) != 6 {
+		return "", false
+	}
+	return hw.String(), true
+}
+
+// Neighbor table refresh: entries older than neighborMaxAge are re-read in the background,
+// and an address missing from the table triggers a re-read at most every neighborMissRefresh,
+// so a newly joined device is picked up quickly without a flood of reads.
+const (
+	neighborMaxAge      = 30 * time.Second
+	neighborMissRefresh = 5 * time.Second
+)
+
+// Neighbors resolves client IPs to MAC addresses from the host's neighbor table (ARP for IPv4,
+// NDP for IPv6). Only clients on a directly attached network are found. Lookups use a cached
+// copy of the table so they stay cheap on the query path.
+type Neighbors struct {
+	read func() (map[netip.Addr]string, error)
+
+	mu         sync.RWMutex
+	table      map[netip.Addr]string
+	loaded     time.Time
+	refreshing atomic.Bool
+}
+
+// NewNeighbors creates a neighbor table reader and loads the table, so queries never wait
+// for a read.
+func NewNeighbors() *Neighbors {
+	return newNeighbors(readNeighborTable)
+}
+
+func newNeighbors(read func() (map[netip.Addr]string, error)) *Neighbors {
+	n := &Neighbors{read: read}
+	n.refresh()
+	return n
+}
+
+// Lookup returns the MAC address of ip, or false if ip is not in the neighbor table. A stale
+// table is re-read in the background, one read at a time.
+func (n *Neighbors) Lookup(ip string) (string, bool) {
+	addr, err := netip.ParseAddr(normalizeIP(ip))
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap().WithZone("")
+	n.mu.RLock()
+	table, loaded := n.table, n.loaded
+	n.mu.RUnlock()
+	mac, ok := table[addr]
+	if age := time.Since(loaded); age > neighborMaxAge || (!ok && age > neighborMissRefresh) {
+		if n.refreshing.CompareAndSwap(false, true) {
+			go func() {
+				defer n.refreshing.Store(false)
+				n.refresh()
+			}()
+		}
+	}
+	return mac, ok
+}
+
+// refresh re-reads the neighbor table. A failed read keeps the previous table, and is not
+// retried before the next refresh is due.
+func (n *Neighbors) refresh() {
+	table, err := n.read()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err == nil || n.table == nil {
+		n.table = table
+	}
+	n.loaded = time.Now()
+}
@@ -0,0 +1,126 @@
+package clientid
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// procNetARP is the kernel's IPv4 ARP table.
+const procNetARP = "/proc/net/arp"
+
+// Netlink neighbor messages (linux/neighbour.h): struct ndmsg, then route attributes.
+const (
+	ndMsgLen       = 12
+	ndaDst         = 1 // NDA_DST: the neighbor's IP address
+	ndaLLAddr      = 2 // NDA_LLADDR: its link-layer address
+	nudIncomplete  = 0x01
+	nudFailed      = 0x20
+	rtaHeaderLen   = 4
+	rtaAlignment   = 4
+	arpFlagsInComp = "0x0" // ATF_COM unset: resolution in progress
+)
+
+// readNeighborTable reads IPv4 and IPv6 neighbors over netlink, falling back to /proc/net/arp
+// (IPv4 only) when netlink is unavailable.
+func readNeighborTable() (map[netip.Addr]string, error) {
+	table, err := readNetlinkNeighbors()
+	if err == nil {
+		return table, nil
+	}
+	f, ferr := os.Open(procNetARP)
+	if ferr != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcNetARP(bufio.NewScanner(f))
+}
+
+// parseProcNetARP parses /proc/net/arp:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func parseProcNetARP(sc *bufio.Scanner) (map[netip.Addr]string, error) {
+	table := make(map[netip.Addr]string)
+	first := true
+	for sc.Scan() {
+		if first {
+			first = false
+			continue
+		}
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[2] == arpFlagsInComp {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		if mac, ok := NormalizeMAC(fields[3]); ok && mac != "00:00:00:00:00:00" {
+			table[addr] = mac
+		}
+	}
+	return table, sc.Err()
+}
+
+// readNetlinkNeighbors dumps the kernel neighbor tables (RTM_GETNEIGH).
+func readNetlinkNeighbors() (map[netip.Addr]string, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+	table := make(map[netip.Addr]string)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH {
+			continue
+		}
+		if addr, mac, ok := parseNeighborMessage(m.Data); ok {
+			table[addr] = mac
+		}
+	}
+	return table, nil
+}
+
+// parseNeighborMessage returns the IP and MAC address of a usable neighbor entry.
+func parseNeighborMessage(data []byte) (netip.Addr, string, bool) {
+	if len(data) < ndMsgLen {
+		return netip.Addr{}, "", false
+	}
+	if state := binary.NativeEndian.Uint16(data[8:10]); state&(nudIncomplete|nudFailed) != 0 {
+		return netip.Addr{}, "", false
+	}
+	var addr netip.Addr
+	var mac string
+	for attrs := data[ndMsgLen:]; len(attrs) >= rtaHeaderLen; {
+		l := int(binary.NativeEndian.Uint16(attrs[0:2]))
+		if l < rtaHeaderLen || l > len(attrs) {
+			break
+		}
+		value := attrs[rtaHeaderLen:l]
+		switch binary.NativeEndian.Uint16(attrs[2:4]) {
+		case ndaDst:
+			addr, _ = netip.AddrFromSlice(value)
+		case ndaLLAddr:
+			if len(value) == 6 {
+				mac = net.HardwareAddr(value).String()
+			}
+		}
+		l = (l + rtaAlignment - 1) &^ (rtaAlignment - 1)
+		if l > len(attrs) {
+			break
+		}
+		attrs = attrs[l:]
+	}
+	if !addr.IsValid() || addr.IsMulticast() || mac == "" || mac == "00:00:00:00:00:00" {
+		return netip.Addr{}, "", false
+	}
+	return addr.Unmap(), mac, true
+}
@@ -0,0 +1,75 @@
+package clientid
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseProcNetARP(t *testing.T) {
+	const arp = `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         AA:BB:CC:DD:EE:FF     *        eth0
+192.168.1.11     0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.12     0x1         0x2         11:22:33:44:55:66     *        br0
+`
+	table, err := parseProcNetARP(bufio.NewScanner(strings.NewReader(arp)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[netip.Addr]string{
+		netip.MustParseAddr("192.168.1.10"): "aa:bb:cc:dd:ee:ff",
+		netip.MustParseAddr("192.168.1.12"): "11:22:33:44:55:66",
+	}
+	if len(table) != len(want) {
+		t.Fatalf("table = %v, want %v", table, want)
+	}
+	for addr, mac := range want {
+		if table[addr] != mac {
+			t.Errorf("table[%s] = %q, want %q", addr, table[addr], mac)
+		}
+	}
+}
+
+// neighborMessage builds an RTM_NEWNEIGH payload: struct ndmsg and NDA_DST/NDA_LLADDR attributes.
+func neighborMessage(state uint16, dst []byte, lladdr []byte) []byte {
+	msg := make([]byte, ndMsgLen)
+	binary.NativeEndian.PutUint16(msg[8:10], state)
+	for _, attr := range []struct {
+		typ   uint16
+		value []byte
+	}{{ndaDst, dst}, {ndaLLAddr, lladdr}} {
+		hdr := make([]byte, rtaHeaderLen)
+		binary.NativeEndian.PutUint16(hdr[0:2], uint16(rtaHeaderLen+len(attr.value)))
+		binary.NativeEndian.PutUint16(hdr[2:4], attr.typ)
+		msg = append(msg, hdr...)
+		msg = append(msg, attr.value...)
+		for len(msg)%rtaAlignment != 0 {
+			msg = append(msg, 0)
+		}
+	}
+	return msg
+}
+
+func TestParseNeighborMessage(t *testing.T) {
+	v6 := netip.MustParseAddr("2001:db8::1234").AsSlice()
+	mac := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr, got, ok := parseNeighborMessage(neighborMessage(0x02, v6, mac))
+	if !ok || addr != netip.MustParseAddr("2001:db8::1234") || got != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("parseNeighborMessage = %s, %q, %v", addr, got, ok)
+	}
+	v4 := netip.MustParseAddr("192.168.1.10").AsSlice()
+	if addr, _, ok := parseNeighborMessage(neighborMessage(0x04, v4, mac)); !ok || addr != netip.MustParseAddr("192.168.1.10") {
+		t.Errorf("parseNeighborMessage(IPv4) = %s, %v", addr, ok)
+	}
+	if _, _, ok := parseNeighborMessage(neighborMessage(nudFailed, v4, mac)); ok {
+		t.Error("failed neighbor entries should be skipped")
+	}
+	if _, _, ok := parseNeighborMessage(neighborMessage(0x02, v4, nil)); ok {
+		t.Error("entries without a link-layer address should be skipped")
+	}
+	if _, _, ok := parseNeighborMessage([]byte{1, 2}); ok {
+		t.Error("short message should be rejected")
+	}
+}
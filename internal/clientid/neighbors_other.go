@@ -0,0 +1,13 @@
+//go:build !linux
+
+package clientid
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// readNeighborTable is only implemented on Linux; elsewhere MACs come from EDNS only.
+func readNeighborTable() (map[netip.Addr]string, error) {
+	return nil, errors.New("neighbor table not supported on this platform")
+}
@@ -0,0 +1,117 @@
+package clientid
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ipv6MatchBits is the prefix an IPv6 client address stands for when IPv6 prefix matching is
+// on: the /64 within which the interface ID (privacy addresses) rotates.
+const ipv6MatchBits = 64
+
+// ParsePrefix parses a client address: an IP (a single-address prefix) or a CIDR range.
+// IPv4-mapped IPv6 addresses are unmapped and the prefix is masked.
+func ParsePrefix(s string) (netip.Prefix, bool) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		if addr := p.Addr(); addr.Is4In6() {
+			if p.Bits() < 96 {
+				return netip.Prefix{}, false
+			}
+			p = netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), true
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// prefixTable maps IP prefixes to values with longest-prefix-match lookups. Entries are keyed
+// by masked prefix and probed once per distinct prefix length in the table, longest first, so
+// a lookup costs a handful of map probes however many clients are configured.
+type prefixTable struct {
+	entries map[netip.Prefix]string
+	v4Bits  []int // distinct IPv4 prefix lengths, longest first
+	v6Bits  []int // distinct IPv6 prefix lengths, longest first
+}
+
+// add maps p to value unless p is already mapped.
+func (t *prefixTable) add(p netip.Prefix, value string) {
+	if t.entries == nil {
+		t.entries = make(map[netip.Prefix]string)
+	}
+	if _, ok := t.entries[p]; ok {
+		return
+	}
+	t.entries[p] = value
+	bits := &t.v6Bits
+	if p.Addr().Is4() {
+		bits = &t.v4Bits
+	}
+	if !slices.Contains(*bits, p.Bits()) {
+		*bits = append(*bits, p.Bits())
+		slices.SortFunc(*bits, func(a, b int) int { return b - a })
+	}
+}
+
+// lookup returns the value of the longest prefix containing addr.
+func (t *prefixTable) lookup(addr netip.Addr) (string, bool) {
+	if len(t.entries) == 0 {
+		return "", false
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := t.v6Bits
+	if addr.Is4() {
+		bits = t.v4Bits
+	}
+	for _, b := range bits {
+		p, err := addr.Prefix(b)
+		if err != nil {
+			continue
+		}
+		if v, ok := t.entries[p]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// buildPrefixTable builds a table from IP or CIDR keys. With ipv6Prefix, an IPv6 address also
+// stands for its /64; exact addresses and ranges still win by being longer or listed. Keys are
+// added in sorted order so overlapping entries resolve the same way on every reload.
+func buildPrefixTable(m map[string]string, ipv6Prefix bool) prefixTable {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var t prefixTable
+	var widened []netip.Prefix
+	var widenedValues []string
+	for _, k := range keys {
+		p, ok := ParsePrefix(k)
+		if !ok {
+			continue
+		}
+		t.add(p, m[k])
+		if ipv6Prefix && p.Addr().Is6() && p.Bits() > ipv6MatchBits {
+			w, _ := p.Addr().Prefix(ipv6MatchBits)
+			widened = append(widened, w)
+			widenedValues = append(widenedValues, m[k])
+		}
+	}
+	// Configured /64 ranges take precedence over those implied by single addresses.
+	for i, w := range widened {
+		t.add(w, widenedValues[i])
+	}
+	return t
+}
@@ -2,67 +2,94 @@ package clientid
 
 import (
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
 )
 
 // Resolver maps client IPs to friendly names and group IDs for per-device analytics and per-group policies.
+// Clients may be configured by IP, by CIDR range (a VLAN) or by MAC address; lookups by IP use the
+// longest matching prefix. Clients whose IP changes (e.g. phones on mobile data) can instead be
+// identified by a client ID they send over DoH (URL path) or DoT/DoQ (SNI).
 type Resolver struct {
-	mu      sync.RWMutex
-	clients map[string]string // IP -> name
-	groups  map[string]string // IP -> group_id
+	mu         sync.RWMutex
+	clients    map[string]string // IP or CIDR -> name
+	groups     map[string]string // IP or CIDR -> group_id
+	names      prefixTable       // clients by prefix
+	groupTable prefixTable       // groups by prefix
+	ipv6Prefix bool              // IPv6 addresses in clients/groups also match their /64
+	idNames    map[string]string // client ID -> name
+	idGroups   map[string]string // client ID -> group_id
+	macNames   map[string]string // MAC -> name
+	macGroups  map[string]string // MAC -> group_id
 }
 
-// New creates a Resolver with the given IP->name and optional IP->group mappings.
-func New(clients map[string]string, groups map[string]string) *Resolver {
-	r := &Resolver{
-		clients: make(map[string]string),
-		groups:  make(map[string]string),
-	}
-	if clients != nil {
-		for ip, name := range clients {
-			ip = strings.TrimSpace(ip)
-			name = strings.TrimSpace(name)
-			if ip != "" && name != "" {
-				r.clients[ip] = name
-			}
-		}
+// maxIDLength is the longest client ID: one DNS label, so that it fits in SNI.
+const maxIDLength = 63
+
+// NormalizeID returns the client ID in canonical (lower case) form, and whether it is valid:
+// 1-63 letters, digits, '-' or '_'.
+func NormalizeID(id string) (string, bool) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if id == "" || len(id) > maxIDLength {
+		return "", false
 	}
-	if groups != nil {
-		for ip, groupID := range groups {
-			ip = strings.TrimSpace(ip)
-			groupID = strings.TrimSpace(groupID)
-			if ip != "" && groupID != "" {
-				r.groups[ip] = groupID
-			}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return "", false
 		}
 	}
+	return id, true
+}
+
+// New creates a Resolver with the given IP->name and optional IP->group mappings. Keys may be
+// IPs or CIDR ranges.
+func New(clients map[string]string, groups map[string]string) *Resolver {
+	r := &Resolver{}
+	r.ApplyConfig(clients, groups)
 	return r
 }
 
-// Resolve returns the client name for the given IP, or the IP itself if no mapping exists.
+// Resolve returns the client name for the given IP (its longest matching IP or range), or the IP
+// itself if no mapping exists.
 func (r *Resolver) Resolve(ip string) string {
 	ip = normalizeIP(ip)
 	if ip == "" {
 		return ""
 	}
-	r.mu.RLock()
-	name, ok := r.clients[ip]
-	r.mu.RUnlock()
-	if ok {
-		return name
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		r.mu.RLock()
+		name, ok := r.names.lookup(addr)
+		r.mu.RUnlock()
+		if ok {
+			return name
+		}
 	}
 	return ip
 }
 
-// ResolveGroup returns the group ID for the given IP, or "" if no group is assigned.
-func (r *Resolver) ResolveGroup(ip string) string {
+// Name returns the client name configured for exactly this IP (not a range), or false if none
+// is configured.
+func (r *Resolver) Name(ip string) (string, bool) {
 	ip = normalizeIP(ip)
 	if ip == "" {
+		return "", false
+	}
+	r.mu.RLock()
+	name, ok := r.clients[ip]
+	r.mu.RUnlock()
+	return name, ok
+}
+
+// ResolveGroup returns the group ID for the given IP (its longest matching IP or range), or ""
+// if no group is assigned.
+func (r *Resolver) ResolveGroup(ip string) string {
+	addr, err := netip.ParseAddr(normalizeIP(ip))
+	if err != nil {
 		return ""
 	}
 	r.mu.RLock()
-	groupID := r.groups[ip]
+	groupID, _ := r.groupTable.lookup(addr)
 	r.mu.RUnlock()
 	return groupID
 }
@@ -78,28 +105,120 @@ func normalizeIP(ip string) string {
 	return ip
 }
 
-// ApplyConfig updates the resolver with new IP->name and IP->group mappings.
+// ResolveID returns the name and group ID of the client with the given client ID, or false
+// if the ID is not configured.
+func (r *Resolver) ResolveID(id string) (name, groupID string, ok bool) {
+	id, valid := NormalizeID(id)
+	if !valid {
+		return "", "", false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, hasName := r.idNames[id]
+	groupID, hasGroup := r.idGroups[id]
+	return name, groupID, hasName || hasGroup
+}
+
+// ApplyIDConfig replaces the client ID->name and ID->group mappings.
+func (r *Resolver) ApplyIDConfig(names map[string]string, groups map[string]string) {
+	idNames := make(map[string]string, len(names))
+	for id, name := range names {
+		name = strings.TrimSpace(name)
+		if id, ok := NormalizeID(id); ok && name != "" {
+			idNames[id] = name
+		}
+	}
+	idGroups := make(map[string]string, len(groups))
+	for id, groupID := range groups {
+		groupID = strings.TrimSpace(groupID)
+		if id, ok := NormalizeID(id); ok && groupID != "" {
+			idGroups[id] = groupID
+		}
+	}
+	r.mu.Lock()
+	r.idNames, r.idGroups = idNames, idGroups
+	r.mu.Unlock()
+}
+
+// ApplyConfig updates the resolver with new IP->name and IP->group mappings. Keys may be IPs
+// or CIDR ranges.
 func (r *Resolver) ApplyConfig(clients map[string]string, groups map[string]string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.clients = make(map[string]string)
-	r.groups = make(map[string]string)
-	if clients != nil {
-		for ip, name := range clients {
-			ip = strings.TrimSpace(ip)
-			name = strings.TrimSpace(name)
-			if ip != "" && name != "" {
-				r.clients[ip] = name
-			}
+	r.clients = trimmedMap(clients)
+	r.groups = trimmedMap(groups)
+	r.rebuild()
+}
+
+// SetIPv6PrefixMatch sets whether an IPv6 client address also matches the rest of its /64, so
+// a device keeps its name and group as its privacy address rotates.
+func (r *Resolver) SetIPv6PrefixMatch(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ipv6Prefix != enabled {
+		r.ipv6Prefix = enabled
+		r.rebuild()
+	}
+}
+
+// rebuild recomputes the prefix tables. Callers hold r.mu.
+func (r *Resolver) rebuild() {
+	r.names = buildPrefixTable(r.clients, r.ipv6Prefix)
+	r.groupTable = buildPrefixTable(r.groups, r.ipv6Prefix)
+}
+
+// ResolveMAC returns the name and group ID of the client with the given MAC address, or false
+// if the MAC is not configured.
+func (r *Resolver) ResolveMAC(mac string) (name, groupID string, ok bool) {
+	mac, valid := NormalizeMAC(mac)
+	if !valid {
+		return "", "", false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, hasName := r.macNames[mac]
+	groupID, hasGroup := r.macGroups[mac]
+	return name, groupID, hasName || hasGroup
+}
+
+// HasMACs reports whether any client is configured by MAC address, i.e. whether looking up the
+// client's MAC is worth it.
+func (r *Resolver) HasMACs() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.macNames) > 0 || len(r.macGroups) > 0
+}
+
+// ApplyMACConfig replaces the MAC->name and MAC->group mappings.
+func (r *Resolver) ApplyMACConfig(names map[string]string, groups map[string]string) {
+	macNames := make(map[string]string, len(names))
+	for mac, name := range names {
+		name = strings.TrimSpace(name)
+		if mac, ok := NormalizeMAC(mac); ok && name != "" {
+			macNames[mac] = name
+		}
+	}
+	macGroups := make(map[string]string, len(groups))
+	for mac, groupID := range groups {
+		groupID = strings.TrimSpace(groupID)
+		if mac, ok := NormalizeMAC(mac); ok && groupID != "" {
+			macGroups[mac] = groupID
 		}
 	}
-	if groups != nil {
-		for ip, groupID := range groups {
-			ip = strings.TrimSpace(ip)
-			groupID = strings.TrimSpace(groupID)
-			if ip != "" && groupID != "" {
-				r.groups[ip] = groupID
-			}
+	r.mu.Lock()
+	r.macNames, r.macGroups = macNames, macGroups
+	r.mu.Unlock()
+}
+
+// trimmedMap returns m with keys and values trimmed, dropping empty ones.
+func trimmedMap(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		k = strings.TrimSpace(k)
+		v = strings.TrimSpace(v)
+		if k != "" && v != "" {
+			out[k] = v
 		}
 	}
+	return out
 }
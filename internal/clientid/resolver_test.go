@@ -1,6 +1,13 @@
 package clientid
 
-import "testing"
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestResolver_Resolve(t *testing.T) {
 	r := New(map[string]string{
@@ -27,6 +34,19 @@ func TestResolver_Resolve(t *testing.T) {
 	}
 }
 
+func TestResolver_Name(t *testing.T) {
+	r := New(map[string]string{"192.168.1.10": "kids-phone"}, nil)
+	if name, ok := r.Name("192.168.1.10"); !ok || name != "kids-phone" {
+		t.Errorf("Name(192.168.1.10) = %q, %v, want kids-phone, true", name, ok)
+	}
+	if name, ok := r.Name("192.168.1.10:5353"); !ok || name != "kids-phone" {
+		t.Errorf("Name(192.168.1.10:5353) = %q, %v, want kids-phone, true", name, ok)
+	}
+	if name, ok := r.Name("192.168.1.11"); ok {
+		t.Errorf("Name(192.168.1.11) = %q, want no name", name)
+	}
+}
+
 func TestResolver_ResolveGroup(t *testing.T) {
 	r := New(
 		map[string]string{"192.168.1.10": "kids-phone"},
@@ -93,3 +113,208 @@ func TestResolver_New_NilInputs(t *testing.T) {
 		t.Errorf("ResolveGroup with nil groups should return empty, got %q", r.ResolveGroup("1.2.3.4"))
 	}
 }
+
+func TestResolver_ResolveID(t *testing.T) {
+	r := New(map[string]string{"192.168.1.10": "laptop"}, nil)
+	r.ApplyIDConfig(
+		map[string]string{"Kids-Phone": "Kids Phone", "tablet": "Tablet"},
+		map[string]string{"kids-phone": "kids"},
+	)
+	if name, group, ok := r.ResolveID("KIDS-PHONE"); !ok || name != "Kids Phone" || group != "kids" {
+		t.Errorf("ResolveID(KIDS-PHONE) = %q, %q, %v, want Kids Phone, kids, true", name, group, ok)
+	}
+	if name, group, ok := r.ResolveID("tablet"); !ok || name != "Tablet" || group != "" {
+		t.Errorf("ResolveID(tablet) = %q, %q, %v, want Tablet without group", name, group, ok)
+	}
+	if _, _, ok := r.ResolveID("unknown"); ok {
+		t.Error("ResolveID(unknown) found a client")
+	}
+	// IDs and IPs are separate namespaces.
+	if r.Resolve("kids-phone") != "kids-phone" {
+		t.Errorf("Resolve(kids-phone) = %q, want no IP mapping", r.Resolve("kids-phone"))
+	}
+}
+
+func TestNormalizeID(t *testing.T) {
+	for id, want := range map[string]string{
+		"phone":      "phone",
+		" My_Phone ": "my_phone",
+		"a-1":        "a-1",
+		"":           "",
+		"a.b":        "",
+		"a/b":        "",
+		"ünicode":    "",
+	} {
+		got, ok := NormalizeID(id)
+		if got != want || ok != (want != "") {
+			t.Errorf("NormalizeID(%q) = %q, %v, want %q", id, got, ok, want)
+		}
+	}
+	if _, ok := NormalizeID(strings.Repeat("a", 64)); ok {
+		t.Error("NormalizeID accepted a 64-character ID")
+	}
+}
+
+func TestResolver_LongestPrefixMatch(t *testing.T) {
+	r := New(
+		map[string]string{
+			"192.168.20.0/24":   "Kids VLAN",
+			"192.168.20.50":     "Family TV",
+			"192.168.0.0/16":    "LAN",
+			"2001:db8:1:2::/64": "Kids IPv6",
+		},
+		map[string]string{
+			"192.168.20.0/24": "kids",
+			"192.168.20.50":   "adults",
+		},
+	)
+	tests := []struct {
+		ip, name, group string
+	}{
+		{"192.168.20.7", "Kids VLAN", "kids"},
+		{"192.168.20.50", "Family TV", "adults"},
+		{"192.168.21.1", "LAN", ""},
+		{"::ffff:192.168.20.7", "Kids VLAN", "kids"},
+		{"[2001:db8:1:2:a:b:c:d]:5353", "Kids IPv6", ""},
+		{"10.0.0.1", "10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		if got := r.Resolve(tt.ip); got != tt.name {
+			t.Errorf("Resolve(%q) = %q, want %q", tt.ip, got, tt.name)
+		}
+		if got := r.ResolveGroup(tt.ip); got != tt.group {
+			t.Errorf("ResolveGroup(%q) = %q, want %q", tt.ip, got, tt.group)
+		}
+	}
+	// A range has no single hostname for reverse lookups.
+	if name, ok := r.Name("192.168.20.7"); ok {
+		t.Errorf("Name(192.168.20.7) = %q, want none for a range member", name)
+	}
+}
+
+func TestResolver_IPv6PrefixMatch(t *testing.T) {
+	r := New(
+		map[string]string{"2001:db8::1:2:3:4": "Phone", "2001:db8::9": "Laptop"},
+		map[string]string{"2001:db8::1:2:3:4": "kids"},
+	)
+	if got := r.ResolveGroup("2001:db8::5:6:7:8"); got != "" {
+		t.Fatalf("ResolveGroup without prefix match = %q, want empty", got)
+	}
+	r.SetIPv6PrefixMatch(true)
+	if got := r.ResolveGroup("2001:db8:0:1:5:6:7:8"); got != "" {
+		t.Errorf("ResolveGroup in another /64 = %q, want empty", got)
+	}
+	// Both addresses are in 2001:db8::/64; exact addresses keep their own names, the rest
+	// of the /64 goes to the first client in sorted order.
+	if got := r.Resolve("2001:db8::9"); got != "Laptop" {
+		t.Errorf("Resolve(exact) = %q, want Laptop", got)
+	}
+	if got := r.Resolve("2001:db8::5:6:7:8"); got != "Phone" {
+		t.Errorf("Resolve(rotated address) = %q, want Phone", got)
+	}
+	if got := r.ResolveGroup("2001:db8::5:6:7:8"); got != "kids" {
+		t.Errorf("ResolveGroup(rotated address) = %q, want kids", got)
+	}
+	// Settings survive a reload.
+	r.ApplyConfig(map[string]string{"2001:db8::1": "Tablet"}, nil)
+	if got := r.Resolve("2001:db8::ffff"); got != "Tablet" {
+		t.Errorf("Resolve after ApplyConfig = %q, want Tablet", got)
+	}
+}
+
+func TestResolver_ResolveMAC(t *testing.T) {
+	r := New(nil, nil)
+	if r.HasMACs() {
+		t.Fatal("HasMACs with no MAC clients")
+	}
+	r.ApplyMACConfig(
+		map[string]string{"AA-BB-CC-DD-EE-FF": "Kids iPad", "bad": "Ignored"},
+		map[string]string{"aa:bb:cc:dd:ee:ff": "kids"},
+	)
+	if !r.HasMACs() {
+		t.Fatal("HasMACs = false")
+	}
+	name, group, ok := r.ResolveMAC("aabb.ccdd.eeff")
+	if !ok || name != "Kids iPad" || group != "kids" {
+		t.Errorf("ResolveMAC = %q, %q, %v, want Kids iPad, kids, true", name, group, ok)
+	}
+	if _, _, ok := r.ResolveMAC("00:11:22:33:44:55"); ok {
+		t.Error("ResolveMAC for an unknown MAC should fail")
+	}
+}
+
+func TestNormalizeMAC(t *testing.T) {
+	for in, want := range map[string]string{
+		"AA:BB:CC:DD:EE:FF": "aa:bb:cc:dd:ee:ff",
+		"aa-bb-cc-dd-ee-ff": "aa:bb:cc:dd:ee:ff",
+		" aabb.ccdd.eeff ":  "aa:bb:cc:dd:ee:ff",
+	} {
+		if got, ok := NormalizeMAC(in); !ok || got != want {
+			t.Errorf("NormalizeMAC(%q) = %q, %v, want %q", in, got, ok, want)
+		}
+	}
+	for _, in := range []string{"", "aa:bb:cc", "00:00:5e:10:00:00:00:01", "zz:bb:cc:dd:ee:ff"} {
+		if got, ok := NormalizeMAC(in); ok {
+			t.Errorf("NormalizeMAC(%q) = %q, want invalid", in, got)
+		}
+	}
+}
+
+func TestNeighbors_Lookup(t *testing.T) {
+	reads := 0
+	n := newNeighbors(func() (map[netip.Addr]string, error) {
+		reads++
+		return map[netip.Addr]string{netip.MustParseAddr("192.168.1.10"): "aa:bb:cc:dd:ee:ff"}, nil
+	})
+	if mac, ok := n.Lookup("192.168.1.10:5353"); !ok || mac != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Lookup = %q, %v", mac, ok)
+	}
+	if mac, ok := n.Lookup("::ffff:192.168.1.10"); !ok || mac != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Lookup(mapped) = %q, %v", mac, ok)
+	}
+	// A fresh table is not re-read on a miss.
+	if _, ok := n.Lookup("192.168.1.11"); ok {
+		t.Error("Lookup(192.168.1.11) should miss")
+	}
+	if reads != 1 {
+		t.Errorf("neighbor table read %d times, want 1", reads)
+	}
+}
+
+func TestNeighbors_RefreshInBackground(t *testing.T) {
+	var reads atomic.Int32
+	release := make(chan struct{})
+	n := newNeighbors(func() (map[netip.Addr]string, error) {
+		if reads.Add(1) > 1 {
+			<-release
+		}
+		return map[netip.Addr]string{netip.MustParseAddr("192.168.1.10"): "aa:bb:cc:dd:ee:ff"}, nil
+	})
+	if reads.Load() != 1 {
+		t.Fatalf("neighbor table read %d times at creation, want 1", reads.Load())
+	}
+
+	// A stale table is served while one background read runs, however many lookups ask for it.
+	n.mu.Lock()
+	n.loaded = time.Now().Add(-2 * neighborMaxAge)
+	n.mu.Unlock()
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := n.Lookup("192.168.1.10"); !ok {
+				t.Error("Lookup missed while the table was refreshing")
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for n.refreshing.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := reads.Load(); got != 2 {
+		t.Errorf("neighbor table read %d times, want 2", got)
+	}
+}
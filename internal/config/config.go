@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"runtime"
@@ -10,6 +11,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/clientid"
 	"gopkg.in/yaml.v3"
 )
 
@@ -57,18 +60,62 @@ type NetworkConfig struct {
 	UpstreamConnPoolIdleTimeout *Duration `yaml:"upstream_conn_pool_idle_timeout"`
 	// UpstreamConnPoolValidateBeforeReuse: validate pooled connections before use (default: false).
 	UpstreamConnPoolValidateBeforeReuse *bool `yaml:"upstream_conn_pool_validate_before_reuse"`
+	// UpstreamPipelining: send many queries at once over each TCP/TLS upstream connection, answered
+	// in any order (RFC 7766), instead of one query per pooled connection (default: true).
+	// The idle timeout above applies to both; validate_before_reuse only to the pool.
+	UpstreamPipelining *bool `yaml:"upstream_pipelining"`
+	// UpstreamRaceCount: resolver_strategy "race" queries this many upstreams, fastest first (default: 2).
+	UpstreamRaceCount int `yaml:"upstream_race_count"`
+	// UpstreamHedgeDelay: race strategy delay before each additional upstream is queried (default: 0 = all at once).
+	UpstreamHedgeDelay Duration `yaml:"upstream_hedge_delay"`
+	// RecursionTimeout: total time a protocol "recursive" upstream may spend on one query, across
+	// every referral and name server lookup (default: 30s). Each authoritative query is bounded
+	// by upstream_timeout.
+	RecursionTimeout Duration `yaml:"recursion_timeout"`
+}
+
+// UpstreamHealthCheckConfig configures active health probing: every upstream (global, routes and
+// private reverse) is sent a canary query on an interval. An upstream is marked down after
+// FailureThreshold consecutive failed probes and up again after SuccessThreshold consecutive
+// successful ones; down upstreams are skipped like upstreams in backoff, unless all are down.
+type UpstreamHealthCheckConfig struct {
+	// Enabled: probe upstreams in the background (default: false).
+	Enabled *bool `yaml:"enabled"`
+	// Interval: time between probe rounds (default: 10s).
+	Interval Duration `yaml:"interval"`
+	// Timeout: probe timeout (default: 2s).
+	Timeout Duration `yaml:"timeout"`
+	// QueryName / QueryType: the canary query (default: ". NS"). SERVFAIL and REFUSED count as failures.
+	QueryName string `yaml:"query_name"`
+	QueryType string `yaml:"query_type"`
+	// FailureThreshold / SuccessThreshold: consecutive probes needed to mark an upstream down / up (default: 3 / 2).
+	FailureThreshold int `yaml:"failure_threshold"`
+	SuccessThreshold int `yaml:"success_threshold"`
+	// Window: number of recent probes used for success rate and p50/p95 latency (default: 20).
+	Window int `yaml:"window"`
 }
 
 type Config struct {
 	Server           ServerConfig     `yaml:"server"`
 	Upstreams        []UpstreamConfig `yaml:"upstreams"`
 	ResolverStrategy string          `yaml:"resolver_strategy"`
+	// UpstreamRoutes: conditional forwarding. Queries under a route's suffixes go to its
+	// upstreams instead of the global ones; the longest matching suffix wins.
+	UpstreamRoutes   []UpstreamRouteConfig `yaml:"upstream_routes"`
+	// UpstreamHealthCheck: background canary queries that mark upstreams down before users hit them.
+	UpstreamHealthCheck UpstreamHealthCheckConfig `yaml:"upstream_health_check"`
 	// Legacy top-level fields; migrated to Network in applyDefaults for backward compatibility.
 	UpstreamTimeout  Duration        `yaml:"upstream_timeout"`
 	UpstreamBackoff  *Duration       `yaml:"upstream_backoff"`
 	UpstreamConnPoolIdleTimeout *Duration `yaml:"upstream_conn_pool_idle_timeout"`
 	UpstreamConnPoolValidateBeforeReuse *bool `yaml:"upstream_conn_pool_validate_before_reuse"`
 	Network          NetworkConfig   `yaml:"network"`
+	EDNSClientSubnet EDNSClientSubnetConfig `yaml:"edns_client_subnet"`
+	DNSSEC           DNSSECConfig    `yaml:"dnssec"`
+	PrivateReverse   PrivateReverseConfig `yaml:"private_reverse"`
+	DNS64            DNS64Config     `yaml:"dns64"`
+	RateLimit        RateLimitConfig `yaml:"rate_limit"`
+	ACL              ACLConfig       `yaml:"acl"`
 	Blocklists       BlocklistConfig  `yaml:"blocklists"`
 	LocalRecords     []LocalRecordEntry `yaml:"local_records"`
 	Cache            CacheConfig     `yaml:"cache"`
@@ -86,6 +133,132 @@ type Config struct {
 	SafeSearch       SafeSearchConfig `yaml:"safe_search"`
 }
 
+// EDNSClientSubnetConfig controls EDNS Client Subnet (RFC 7871) handling on upstream queries.
+type EDNSClientSubnetConfig struct {
+	// Mode: "strip" (default) removes ECS from upstream queries; "passthrough" forwards the client's
+	// ECS option unchanged; "synthesize" sends the client's subnet truncated to the prefix lengths below.
+	Mode string `yaml:"mode"`
+	// IPv4Prefix / IPv6Prefix: source prefix length sent in synthesize mode (default: 24 / 56).
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+	// TrustedForwarders: IPs or CIDRs of downstream forwarders whose full-length ECS address (/32 or /128)
+	// or EDNS0 MAC option (65001) identifies the real client for client identification, group policies and logging.
+	TrustedForwarders []string `yaml:"trusted_forwarders"`
+}
+
+// DNSSECConfig configures DNSSEC validation of upstream answers.
+type DNSSECConfig struct {
+	// Validate: set DO and CD on upstream queries and validate answers up to a trust anchor (default: false).
+	// Validated answers get AD; bogus answers return SERVFAIL with Extended DNS Error 6 (DNSSEC Bogus).
+	Validate *bool `yaml:"validate"`
+	// TrustAnchors: DS or DNSKEY records in zone file format (default: the IANA root zone KSKs).
+	TrustAnchors []string `yaml:"trust_anchors"`
+}
+
+// PrivateReverseConfig controls reverse lookups (PTR) for private address space: RFC 1918,
+// CGNAT (100.64.0.0/10), ULA (fc00::/7) and link-local. These are answered locally instead
+// of being sent to the public upstreams.
+type PrivateReverseConfig struct {
+	// Enabled: answer private reverse lookups locally (default: true).
+	Enabled *bool `yaml:"enabled"`
+	// Upstreams: local DNS server(s), typically the router, asked for names that cannot be
+	// synthesized from local_records or client_identification. Empty = answer NXDOMAIN.
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	// Domain: suffix appended to client_identification names in synthesized PTR answers
+	// (e.g. "home.arpa" turns "Kids iPad" into kids-ipad.home.arpa). Empty = bare name.
+	Domain string `yaml:"domain"`
+}
+
+// DNS64Config configures DNS64 (RFC 6147) for IPv6-only clients behind NAT64: AAAA queries
+// for names with no AAAA records get AAAA answers synthesized from their A records.
+// In client_groups it overrides the global setting for the group's clients.
+type DNS64Config struct {
+	// Enabled: synthesize AAAA answers (default: false). In a group, nil inherits the global setting.
+	Enabled *bool `yaml:"enabled"`
+	// Prefix: NAT64 prefix; /32, /40, /48, /56, /64 or /96 (RFC 6052). Default: 64:ff9b::/96.
+	// In a group, empty inherits the global prefix.
+	Prefix string `yaml:"prefix"`
+	// ExcludeAAAA: AAAA records in these ranges are treated as absent, so the answer is
+	// synthesized (RFC 6147 section 5.1.4). Default: ::ffff:0:0/96. Global only.
+	ExcludeAAAA []string `yaml:"exclude_aaaa"`
+}
+
+// ACLConfig restricts which clients may query the server, so an instance exposed on a public
+// address is not an open resolver. Clients are matched by the address the query arrives from
+// (after PROXY protocol or forwarded headers from server.trusted_proxies): the most specific
+// allow or deny entry decides. Denied queries are logged with outcome acl_denied.
+type ACLConfig struct {
+	// Enabled: check every query against the lists below before anything else (default: false).
+	Enabled *bool `yaml:"enabled"`
+	// Allow: IPs or CIDRs that may query. When allow and allow_groups are both empty, every
+	// client not denied may query.
+	Allow []string `yaml:"allow"`
+	// Deny: IPs or CIDRs that may not query (e.g. a subnet carved out of an allowed range).
+	Deny []string `yaml:"deny"`
+	// AllowGroups: client group IDs whose members may query from any address not denied, e.g.
+	// roaming phones identified by DoH/DoT client ID.
+	AllowGroups []string `yaml:"allow_groups"`
+	// DenyGroups: client group IDs whose members may not query, whatever their address.
+	DenyGroups []string `yaml:"deny_groups"`
+	// DefaultAction for queries that are not allowed: "refuse" (default; REFUSED response) or
+	// "drop" (no response).
+	DefaultAction string `yaml:"default_action"`
+}
+
+// RateLimitConfig throttles clients with token buckets keyed by client address, truncated to
+// the prefix lengths below so a device with many addresses shares one bucket. UDP and TCP
+// (including DoT and DoH) have separate limits.
+type RateLimitConfig struct {
+	// Enabled: apply per-client query limits (default: false).
+	Enabled *bool `yaml:"enabled"`
+	// UDPQPS / UDPBurst: sustained queries per second and bucket size for UDP (default: 50 / 200).
+	UDPQPS   float64 `yaml:"udp_qps"`
+	UDPBurst int     `yaml:"udp_burst"`
+	// TCPQPS / TCPBurst: same for TCP, DoT and DoH (default: 100 / 400).
+	TCPQPS   float64 `yaml:"tcp_qps"`
+	TCPBurst int     `yaml:"tcp_burst"`
+	// Action for queries over the limit: "drop" (default), "truncate" (empty answer with TC=1,
+	// so real clients retry over TCP; TCP queries are dropped instead) or "refuse".
+	Action string `yaml:"action"`
+	// IPv4PrefixLength / IPv6PrefixLength: clients in the same prefix share a bucket (default: 32 / 64).
+	IPv4PrefixLength int `yaml:"ipv4_prefix_length"`
+	IPv6PrefixLength int `yaml:"ipv6_prefix_length"`
+	// Exempt: IPs or CIDRs that are never rate limited (e.g. a downstream forwarder).
+	Exempt []string `yaml:"exempt"`
+	// RRL: response rate limiting for UDP.
+	RRL RRLConfig `yaml:"rrl"`
+}
+
+// RRLConfig configures BIND-style response rate limiting: identical UDP responses (same name,
+// type and rcode; NXDOMAIN per zone) to one client prefix are limited, which stops the server
+// being used to reflect traffic at a spoofed victim address.
+type RRLConfig struct {
+	// Enabled: limit identical UDP responses (default: false).
+	Enabled *bool `yaml:"enabled"`
+	// ResponsesPerSecond / Burst: identical responses allowed per prefix (default: 5 / 5).
+	ResponsesPerSecond float64 `yaml:"responses_per_second"`
+	Burst              int     `yaml:"burst"`
+	// Slip: every Nth suppressed response is sent truncated (TC=1) instead of dropped, so real
+	// clients behind the prefix can retry over TCP (default: 2). 0 = drop all, 1 = truncate all.
+	Slip *int `yaml:"slip"`
+	// IPv4PrefixLength / IPv6PrefixLength: responses are accounted per prefix (default: 24 / 56).
+	IPv4PrefixLength int `yaml:"ipv4_prefix_length"`
+	IPv6PrefixLength int `yaml:"ipv6_prefix_length"`
+}
+
+// GroupRateLimitConfig overrides the per-client query limits for a client group. Zero or empty
+// fields inherit the global value.
+type GroupRateLimitConfig struct {
+	// Enabled: nil inherits rate_limit.enabled; false exempts the group's clients; true limits
+	// them even when global rate limiting is off.
+	Enabled  *bool   `yaml:"enabled"`
+	UDPQPS   float64 `yaml:"udp_qps"`
+	UDPBurst int     `yaml:"udp_burst"`
+	TCPQPS   float64 `yaml:"tcp_qps"`
+	TCPBurst int     `yaml:"tcp_burst"`
+	Action   string  `yaml:"action"`
+}
+
 // LoggingConfig configures structured logging (log/slog).
 type LoggingConfig struct {
 	// Format: "text" (human-readable, default) or "json" (for production/observability pipelines).
@@ -126,8 +299,9 @@ type syncSafeSearchConfig struct {
 // syncClientIdentificationConfig is the sync payload for client identification.
 // Includes enabled flag and list format clients (IP, name, group_id).
 type syncClientIdentificationConfig struct {
-	Enabled *bool         `json:"enabled,omitempty"`
-	Clients []ClientEntry `json:"clients,omitempty"`
+	Enabled         *bool         `json:"enabled,omitempty"`
+	Clients         []ClientEntry `json:"clients,omitempty"`
+	IPv6PrefixMatch *bool         `json:"ipv6_prefix_match,omitempty"`
 }
 
 // DNSAffectingConfig is the subset of config that affects DNS resolution.
@@ -136,6 +310,10 @@ type syncClientIdentificationConfig struct {
 type DNSAffectingConfig struct {
 	Upstreams           []UpstreamConfig               `json:"upstreams"`
 	ResolverStrategy    string                         `json:"resolver_strategy"`
+	UpstreamRoutes      []UpstreamRouteConfig          `json:"upstream_routes,omitempty"`
+	PrivateReverse      PrivateReverseConfig           `json:"private_reverse"`
+	DNS64               DNS64Config                    `json:"dns64"`
+	RateLimit           RateLimitConfig                `json:"rate_limit"`
 	UpstreamTimeout     string                         `json:"upstream_timeout,omitempty"`
 	Blocklists          syncBlocklistConfig            `json:"blocklists"`
 	ClientGroups        []syncClientGroupConfig        `json:"client_groups,omitempty"`
@@ -153,6 +331,9 @@ type syncClientGroupConfig struct {
 	Blocklist    *syncGroupBlocklistConfig `json:"blocklist,omitempty"`
 	SafeSearch   *syncSafeSearchConfig     `json:"safe_search,omitempty"`
 	DisableCache *bool                     `json:"disable_cache,omitempty"`
+	DNS64        *DNS64Config              `json:"dns64,omitempty"`
+	RateLimit    *GroupRateLimitConfig     `json:"rate_limit,omitempty"`
+	Response     *GroupResponseConfig      `json:"response,omitempty"`
 }
 
 type syncGroupBlocklistConfig struct {
@@ -175,8 +356,10 @@ type syncBlocklistConfig struct {
 }
 
 type syncResponseConfig struct {
-	Blocked    string `json:"blocked"`
-	BlockedTTL string `json:"blocked_ttl"`
+	Blocked     string `json:"blocked"`
+	BlockedIPv4 string `json:"blocked_ipv4,omitempty"`
+	BlockedIPv6 string `json:"blocked_ipv6,omitempty"`
+	BlockedTTL  string `json:"blocked_ttl"`
 }
 
 // DNSAffecting extracts the DNS-affecting config for sync to replicas.
@@ -219,11 +402,18 @@ func (c *Config) DNSAffecting() DNSAffectingConfig {
 			Blocklist:    bl,
 			SafeSearch:   ss,
 			DisableCache: g.DisableCache,
+			DNS64:        g.DNS64,
+			RateLimit:    g.RateLimit,
+			Response:     g.Response,
 		})
 	}
 	return DNSAffectingConfig{
 		Upstreams:        c.Upstreams,
 		ResolverStrategy: c.ResolverStrategy,
+		UpstreamRoutes:   c.UpstreamRoutes,
+		PrivateReverse:   c.PrivateReverse,
+		DNS64:            c.DNS64,
+		RateLimit:        c.RateLimit,
 		UpstreamTimeout:  timeoutStr,
 		Blocklists: syncBlocklistConfig{
 			RefreshInterval: c.Blocklists.RefreshInterval.Duration.String(),
@@ -236,13 +426,16 @@ func (c *Config) DNSAffecting() DNSAffectingConfig {
 		},
 		ClientGroups: clientGroups,
 		ClientIdentification: syncClientIdentificationConfig{
-			Enabled: c.ClientIdentification.Enabled,
-			Clients: c.ClientIdentification.Clients,
+			Enabled:         c.ClientIdentification.Enabled,
+			Clients:         c.ClientIdentification.Clients,
+			IPv6PrefixMatch: c.ClientIdentification.IPv6PrefixMatch,
 		},
 		LocalRecords: c.LocalRecords,
 		Response: syncResponseConfig{
-			Blocked:    c.Response.Blocked,
-			BlockedTTL: c.Response.BlockedTTL.Duration.String(),
+			Blocked:     c.Response.Blocked,
+			BlockedIPv4: c.Response.BlockedIPv4,
+			BlockedIPv6: c.Response.BlockedIPv6,
+			BlockedTTL:  c.Response.BlockedTTL.Duration.String(),
 		},
 		SafeSearch: syncSafeSearchConfig{
 			Enabled: c.SafeSearch.Enabled,
@@ -295,12 +488,49 @@ type ServerConfig struct {
 	WriteTimeout       Duration `yaml:"write_timeout"`
 	ReusePort          *bool    `yaml:"reuse_port"`           // SO_REUSEPORT: multiple listeners on same port for UDP/TCP (default: true)
 	ReusePortListeners int      `yaml:"reuse_port_listeners"` // Number of listeners per address when reuse_port is true (default: NumCPU capped 1-16)
+	// TrustedProxies: IPs or CIDRs of load balancers and reverse proxies in front of the server.
+	// Only these may report the real client: with a PROXY protocol header (see ProxyProtocol),
+	// or on DoH with X-Forwarded-For / Forwarded.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// ProxyProtocol: connections from trusted_proxies to the TCP, DoT and DoH listeners must start
+	// with a PROXY protocol v1/v2 header, whose client address is used (default: false). UDP is not affected.
+	ProxyProtocol *bool `yaml:"proxy_protocol"`
 }
 
 type UpstreamConfig struct {
 	Name     string `yaml:"name"`
 	Address  string `yaml:"address"`
 	Protocol string `yaml:"protocol"`
+	// RootHints: for protocol "recursive", root server addresses ("ip" or "ip:port") to start
+	// iterative resolution from (default: the IANA root servers). A port other than 53 is also
+	// used for delegated name servers, which is only useful for lab and test setups.
+	RootHints []string `yaml:"root_hints"`
+	// MaxInflight / MaxQPS: optional limits on concurrent queries and queries per second to this
+	// upstream (0 = unlimited). At the limit, queries go to the next upstream instead of waiting.
+	// Cache refresh may use only half of each limit, so it never starves client queries.
+	MaxInflight int     `yaml:"max_inflight"`
+	MaxQPS      float64 `yaml:"max_qps"`
+	// Use0x20: protocol "udp" only. Randomize the case of the query name (DNS 0x20) and reject
+	// answers that do not echo it exactly, for cache-poisoning resistance on untrusted networks.
+	// Queries are retried once on a mismatch; leave off for upstreams that do not preserve case.
+	Use0x20 bool `yaml:"use_0x20"`
+	// Bootstrap: protocol "https" only. IP addresses to connect to instead of resolving the URL
+	// host, which stays in use for TLS. Set it when the system resolver is this server itself,
+	// or resolving the DoH hostname would loop (and hang startup).
+	Bootstrap []string `yaml:"bootstrap"`
+	// DoHMethod: protocol "https" only. "post" (default) or "get" (RFC 8484 GET with message ID 0,
+	// so that HTTP caches between here and the upstream can serve repeated queries).
+	DoHMethod string `yaml:"doh_method"`
+	// HTTP3: protocol "https" only. Query over HTTP/3 (QUIC) instead of HTTP/2.
+	HTTP3 bool `yaml:"http3"`
+}
+
+// UpstreamRouteConfig sends queries for names at or below Suffixes (e.g. "corp.example.com",
+// "home.arpa", "10.in-addr.arpa") to Upstreams, selected with Strategy (default: failover).
+type UpstreamRouteConfig struct {
+	Suffixes  []string         `yaml:"suffixes"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	Strategy  string           `yaml:"strategy"`
 }
 
 type BlocklistConfig struct {
@@ -351,8 +581,14 @@ type BlocklistHealthCheckConfig struct {
 type BlocklistSource struct {
 	Name string `yaml:"name"`
 	URL  string `yaml:"url"`
+	// Type is "domains" (default) or "ip" for feeds of IPv4/IPv6 addresses and CIDRs;
+	// answers pointing into an ip source's ranges are blocked.
+	Type string `yaml:"type,omitempty"`
 }
 
+// BlocklistSourceTypeIP marks a blocklist source that lists IP addresses and CIDRs.
+const BlocklistSourceTypeIP = "ip"
+
 type CacheConfig struct {
 	Redis            RedisConfig   `yaml:"redis"`
 	MinTTL           Duration      `yaml:"min_ttl"`
@@ -431,10 +667,31 @@ type RefreshConfig struct {
 }
 
 type ResponseConfig struct {
-	Blocked    string   `yaml:"blocked"`
-	BlockedTTL Duration `yaml:"blocked_ttl"`
+	// Blocked is the answer for blocked names: "nxdomain" (default), "nodata", "refused",
+	// "null" (0.0.0.0 and ::), "custom" (blocked_ipv4/blocked_ipv6), or a single IP address.
+	// Only A/AAAA queries get addresses; other qtypes (HTTPS, SVCB, MX, TXT, ...) get NODATA
+	// with a SOA in address modes.
+	Blocked     string   `yaml:"blocked"`
+	BlockedIPv4 string   `yaml:"blocked_ipv4"` // A answer when blocked is "custom"; empty = NODATA
+	BlockedIPv6 string   `yaml:"blocked_ipv6"` // AAAA answer when blocked is "custom"; empty = NODATA
+	BlockedTTL  Duration `yaml:"blocked_ttl"`
+}
+
+// GroupResponseConfig overrides the blocked answer for a client group. Empty blocked = global.
+type GroupResponseConfig struct {
+	Blocked     string `yaml:"blocked"`
+	BlockedIPv4 string `yaml:"blocked_ipv4"`
+	BlockedIPv6 string `yaml:"blocked_ipv6"`
 }
 
+// Blocked response modes besides "nxdomain" (defaultBlockedResponse) and a literal IP address.
+const (
+	BlockedResponseNODATA  = "nodata"
+	BlockedResponseRefused = "refused"
+	BlockedResponseNull    = "null"
+	BlockedResponseCustom  = "custom"
+)
+
 type RequestLogConfig struct {
 	Enabled        *bool  `yaml:"enabled"`
 	Directory      string `yaml:"directory"`
@@ -477,6 +734,17 @@ type ClientEntry struct {
 	IP      string `yaml:"ip"`
 	Name    string `yaml:"name"`
 	GroupID string `yaml:"group_id"`
+	// IDs: client IDs that identify this client whatever its IP, sent as the DoH path
+	// (/dns-query/<id>) or the DoT/DoQ server name (<id>.<doh_dot_server.client_id_domain>).
+	// 1-63 letters, digits, '-' or '_'; case-insensitive. ip may be empty when ids are set.
+	IDs []string `yaml:"ids"`
+	// CIDRs: address ranges (e.g. a VLAN "192.168.20.0/24", or an IPv6 "/64") that belong to this
+	// client. The most specific matching ip or range wins. ip may be empty when cidrs are set.
+	CIDRs []string `yaml:"cidrs"`
+	// MACs: MAC addresses of this client, from the host's neighbor table (ARP/NDP, Linux, same
+	// network only) or the EDNS0 MAC option (65001) sent by trusted forwarders such as dnsmasq
+	// --add-mac (see edns_client_subnet.trusted_forwarders). ip may be empty when macs are set.
+	MACs []string `yaml:"macs"`
 }
 
 // ClientEntries supports both legacy map format (IP->name) and list format (ip, name, group_id).
@@ -511,27 +779,85 @@ func (c *ClientEntries) UnmarshalYAML(value *yaml.Node) error {
 	return nil
 }
 
-// ToNameMap returns IP -> name for the clientid resolver.
+// ToNameMap returns IP or CIDR -> name for the clientid resolver.
 func (c ClientEntries) ToNameMap() map[string]string {
 	m := make(map[string]string)
 	for _, e := range c {
-		ip := strings.TrimSpace(e.IP)
 		name := strings.TrimSpace(e.Name)
-		if ip != "" && name != "" {
-			m[ip] = name
+		for _, ip := range append([]string{e.IP}, e.CIDRs...) {
+			if ip = strings.TrimSpace(ip); ip != "" && name != "" {
+				m[ip] = name
+			}
 		}
 	}
 	return m
 }
 
-// ToGroupMap returns IP -> group_id.
+// ToGroupMap returns IP or CIDR -> group_id.
 func (c ClientEntries) ToGroupMap() map[string]string {
 	m := make(map[string]string)
 	for _, e := range c {
-		ip := strings.TrimSpace(e.IP)
 		groupID := strings.TrimSpace(e.GroupID)
-		if ip != "" && groupID != "" {
-			m[ip] = groupID
+		for _, ip := range append([]string{e.IP}, e.CIDRs...) {
+			if ip = strings.TrimSpace(ip); ip != "" && groupID != "" {
+				m[ip] = groupID
+			}
+		}
+	}
+	return m
+}
+
+// ToMACNameMap returns MAC -> name.
+func (c ClientEntries) ToMACNameMap() map[string]string {
+	m := make(map[string]string)
+	for _, e := range c {
+		name := strings.TrimSpace(e.Name)
+		for _, mac := range e.MACs {
+			if mac = strings.TrimSpace(mac); mac != "" && name != "" {
+				m[mac] = name
+			}
+		}
+	}
+	return m
+}
+
+// ToMACGroupMap returns MAC -> group_id.
+func (c ClientEntries) ToMACGroupMap() map[string]string {
+	m := make(map[string]string)
+	for _, e := range c {
+		groupID := strings.TrimSpace(e.GroupID)
+		for _, mac := range e.MACs {
+			if mac = strings.TrimSpace(mac); mac != "" && groupID != "" {
+				m[mac] = groupID
+			}
+		}
+	}
+	return m
+}
+
+// ToIDNameMap returns client ID -> name.
+func (c ClientEntries) ToIDNameMap() map[string]string {
+	m := make(map[string]string)
+	for _, e := range c {
+		name := strings.TrimSpace(e.Name)
+		for _, id := range e.IDs {
+			if id = strings.TrimSpace(id); id != "" && name != "" {
+				m[id] = name
+			}
+		}
+	}
+	return m
+}
+
+// ToIDGroupMap returns client ID -> group_id.
+func (c ClientEntries) ToIDGroupMap() map[string]string {
+	m := make(map[string]string)
+	for _, e := range c {
+		groupID := strings.TrimSpace(e.GroupID)
+		for _, id := range e.IDs {
+			if id = strings.TrimSpace(id); id != "" && groupID != "" {
+				m[id] = groupID
+			}
 		}
 	}
 	return m
@@ -542,6 +868,9 @@ func (c ClientEntries) ToGroupMap() map[string]string {
 type ClientIdentificationConfig struct {
 	Enabled *bool         `yaml:"enabled"`
 	Clients ClientEntries `yaml:"clients"` // IP -> name (legacy map) or list of {ip, name, group_id}
+	// IPv6PrefixMatch: an IPv6 client ip also matches the rest of its /64, so devices keep their
+	// name and group as privacy addresses rotate (default: false).
+	IPv6PrefixMatch *bool `yaml:"ipv6_prefix_match"`
 }
 
 // GroupBlocklistConfig defines per-group blocklist (Phase 3). When InheritGlobal is true or nil,
@@ -562,6 +891,9 @@ type ClientGroup struct {
 	Description string                 `yaml:"description"`
 	Blocklist   *GroupBlocklistConfig   `yaml:"blocklist"`
 	SafeSearch  *SafeSearchConfig       `yaml:"safe_search"` // Phase 4: per-group safe search override
+	DNS64       *DNS64Config            `yaml:"dns64"`       // per-group DNS64 override (enabled, prefix)
+	RateLimit   *GroupRateLimitConfig   `yaml:"rate_limit"`  // per-group query rate limits
+	Response    *GroupResponseConfig    `yaml:"response"`    // per-group blocked response mode
 	// DisableCache, when true, bypasses the DNS cache for clients in this group.
 	// Queries pass through directly to upstream on every request and responses are not cached.
 	// Nil or false = use cache normally.
@@ -614,8 +946,8 @@ type ErrorPersistenceConfig struct {
 	LogLevel        string `yaml:"log_level"`        // Deprecated: use logging.level. Kept for backward compat when reading config.
 }
 
-// DoHDotServerConfig enables DoH (DNS over HTTPS) and DoT (DNS over TLS) server modes.
-// Requires TLS certificates. When enabled, clients can use encrypted DNS.
+// DoHDotServerConfig enables DoH (DNS over HTTPS), DoT (DNS over TLS) and DoQ (DNS over QUIC)
+// server modes. Requires TLS certificates. When enabled, clients can use encrypted DNS.
 type DoHDotServerConfig struct {
 	Enabled   *bool  `yaml:"enabled"`
 	CertFile  string `yaml:"cert_file"`
@@ -623,6 +955,11 @@ type DoHDotServerConfig struct {
 	DoTListen string `yaml:"dot_listen"`  // e.g. "0.0.0.0:853"
 	DoHListen string `yaml:"doh_listen"`  // e.g. "0.0.0.0:443" (HTTPS)
 	DoHPath   string `yaml:"doh_path"`    // e.g. "/dns-query" (default)
+	DoQListen string `yaml:"doq_listen"`  // e.g. "0.0.0.0:853" (UDP; RFC 9250). Off when empty.
+	// ClientIDDomain: DoT and DoQ clients connecting with server name <id>.<client_id_domain>
+	// are identified by client ID <id> (see client_identification.clients[].ids), e.g.
+	// "dns.example.com". The certificate must cover *.<client_id_domain>.
+	ClientIDDomain string `yaml:"client_id_domain"`
 }
 
 type UIConfig struct {
@@ -661,7 +998,8 @@ type WebhookOnBlockConfig struct {
 }
 
 // WebhookOnErrorConfig fires HTTP POST when a DNS query results in an error outcome
-// (upstream_error, servfail, servfail_backoff, invalid).
+// (upstream_error, servfail, servfail_backoff, invalid), and when upstream health checks mark an
+// upstream down or up (upstream_down, upstream_up).
 type WebhookOnErrorConfig struct {
 	Enabled              *bool           `yaml:"enabled"`
 	URL                  string          `yaml:"url"`
@@ -874,6 +1212,9 @@ func applyDefaults(cfg *Config) {
 	if cfg.Server.ReusePort == nil {
 		cfg.Server.ReusePort = boolPtr(true)
 	}
+	if cfg.Server.ProxyProtocol == nil {
+		cfg.Server.ProxyProtocol = boolPtr(false)
+	}
 	if cfg.Server.ReusePort != nil && *cfg.Server.ReusePort && cfg.Server.ReusePortListeners <= 0 {
 		n := runtime.NumCPU()
 		if n < 1 {
@@ -1121,6 +1462,79 @@ func applyDefaults(cfg *Config) {
 	if cfg.ResolverStrategy == "" {
 		cfg.ResolverStrategy = "failover"
 	}
+	if cfg.DNS64.Enabled == nil {
+		cfg.DNS64.Enabled = boolPtr(false)
+	}
+	if cfg.DNS64.Prefix == "" {
+		cfg.DNS64.Prefix = "64:ff9b::/96"
+	}
+	if cfg.DNS64.ExcludeAAAA == nil {
+		cfg.DNS64.ExcludeAAAA = []string{"::ffff:0:0/96"}
+	}
+	if cfg.PrivateReverse.Enabled == nil {
+		cfg.PrivateReverse.Enabled = boolPtr(true)
+	}
+	if cfg.ACL.Enabled == nil {
+		cfg.ACL.Enabled = boolPtr(false)
+	}
+	if cfg.ACL.DefaultAction == "" {
+		cfg.ACL.DefaultAction = "refuse"
+	}
+	if cfg.RateLimit.Enabled == nil {
+		cfg.RateLimit.Enabled = boolPtr(false)
+	}
+	if cfg.RateLimit.UDPQPS == 0 {
+		cfg.RateLimit.UDPQPS = 50
+	}
+	if cfg.RateLimit.UDPBurst == 0 {
+		cfg.RateLimit.UDPBurst = 200
+	}
+	if cfg.RateLimit.TCPQPS == 0 {
+		cfg.RateLimit.TCPQPS = 100
+	}
+	if cfg.RateLimit.TCPBurst == 0 {
+		cfg.RateLimit.TCPBurst = 400
+	}
+	if cfg.RateLimit.Action == "" {
+		cfg.RateLimit.Action = "drop"
+	}
+	if cfg.RateLimit.IPv4PrefixLength == 0 {
+		cfg.RateLimit.IPv4PrefixLength = 32
+	}
+	if cfg.RateLimit.IPv6PrefixLength == 0 {
+		cfg.RateLimit.IPv6PrefixLength = 64
+	}
+	if cfg.RateLimit.RRL.Enabled == nil {
+		cfg.RateLimit.RRL.Enabled = boolPtr(false)
+	}
+	if cfg.RateLimit.RRL.ResponsesPerSecond == 0 {
+		cfg.RateLimit.RRL.ResponsesPerSecond = 5
+	}
+	if cfg.RateLimit.RRL.Burst == 0 {
+		cfg.RateLimit.RRL.Burst = 5
+	}
+	if cfg.RateLimit.RRL.Slip == nil {
+		slip := 2
+		cfg.RateLimit.RRL.Slip = &slip
+	}
+	if cfg.RateLimit.RRL.IPv4PrefixLength == 0 {
+		cfg.RateLimit.RRL.IPv4PrefixLength = 24
+	}
+	if cfg.RateLimit.RRL.IPv6PrefixLength == 0 {
+		cfg.RateLimit.RRL.IPv6PrefixLength = 56
+	}
+	if cfg.DNSSEC.Validate == nil {
+		cfg.DNSSEC.Validate = boolPtr(false)
+	}
+	if cfg.EDNSClientSubnet.Mode == "" {
+		cfg.EDNSClientSubnet.Mode = "strip"
+	}
+	if cfg.EDNSClientSubnet.IPv4Prefix == 0 {
+		cfg.EDNSClientSubnet.IPv4Prefix = 24
+	}
+	if cfg.EDNSClientSubnet.IPv6Prefix == 0 {
+		cfg.EDNSClientSubnet.IPv6Prefix = 56
+	}
 	// Migrate legacy top-level network fields to NetworkConfig for backward compatibility.
 	if cfg.Network.UpstreamTimeout.Duration <= 0 && cfg.UpstreamTimeout.Duration > 0 {
 		cfg.Network.UpstreamTimeout = cfg.UpstreamTimeout
@@ -1146,6 +1560,39 @@ func applyDefaults(cfg *Config) {
 	if cfg.Network.UpstreamConnPoolValidateBeforeReuse == nil {
 		cfg.Network.UpstreamConnPoolValidateBeforeReuse = boolPtr(false)
 	}
+	if cfg.Network.UpstreamPipelining == nil {
+		cfg.Network.UpstreamPipelining = boolPtr(true)
+	}
+	if cfg.Network.UpstreamRaceCount == 0 {
+		cfg.Network.UpstreamRaceCount = 2
+	}
+	if cfg.Network.RecursionTimeout.Duration == 0 {
+		cfg.Network.RecursionTimeout.Duration = 30 * time.Second
+	}
+	if cfg.UpstreamHealthCheck.Enabled == nil {
+		cfg.UpstreamHealthCheck.Enabled = boolPtr(false)
+	}
+	if cfg.UpstreamHealthCheck.Interval.Duration == 0 {
+		cfg.UpstreamHealthCheck.Interval.Duration = 10 * time.Second
+	}
+	if cfg.UpstreamHealthCheck.Timeout.Duration == 0 {
+		cfg.UpstreamHealthCheck.Timeout.Duration = 2 * time.Second
+	}
+	if strings.TrimSpace(cfg.UpstreamHealthCheck.QueryName) == "" {
+		cfg.UpstreamHealthCheck.QueryName = "."
+	}
+	if strings.TrimSpace(cfg.UpstreamHealthCheck.QueryType) == "" {
+		cfg.UpstreamHealthCheck.QueryType = "NS"
+	}
+	if cfg.UpstreamHealthCheck.FailureThreshold == 0 {
+		cfg.UpstreamHealthCheck.FailureThreshold = 3
+	}
+	if cfg.UpstreamHealthCheck.SuccessThreshold == 0 {
+		cfg.UpstreamHealthCheck.SuccessThreshold = 2
+	}
+	if cfg.UpstreamHealthCheck.Window == 0 {
+		cfg.UpstreamHealthCheck.Window = 20
+	}
 	if cfg.Sync.Enabled == nil {
 		cfg.Sync.Enabled = boolPtr(false)
 	}
@@ -1167,6 +1614,9 @@ func applyDefaults(cfg *Config) {
 	if cfg.ClientIdentification.Clients == nil {
 		cfg.ClientIdentification.Clients = ClientEntries{}
 	}
+	if cfg.ClientIdentification.IPv6PrefixMatch == nil {
+		cfg.ClientIdentification.IPv6PrefixMatch = boolPtr(false)
+	}
 	if cfg.Blocklists.HealthCheck != nil && cfg.Blocklists.HealthCheck.Enabled == nil {
 		cfg.Blocklists.HealthCheck.Enabled = boolPtr(true)
 	}
@@ -1317,28 +1767,114 @@ func applyControlEnvOverrides(cfg *Config) {
 	cfg.Control.Listen = fmt.Sprintf("%s:%s", host, port)
 }
 
+// normalizeUpstream trims an upstream entry and infers its protocol from the address.
+func normalizeUpstream(u *UpstreamConfig) {
+	u.Address = strings.TrimSpace(u.Address)
+	u.Name = strings.TrimSpace(u.Name)
+	proto := strings.ToLower(strings.TrimSpace(u.Protocol))
+	if proto == "" {
+		if strings.HasPrefix(u.Address, "tls://") {
+			proto = "tls"
+		} else if strings.HasPrefix(u.Address, "https://") {
+			proto = "https"
+		} else if strings.HasPrefix(u.Address, "quic://") {
+			proto = "quic"
+		} else {
+			proto = "udp"
+		}
+	}
+	u.Protocol = proto
+	if proto == "recursive" && u.Address == "" {
+		u.Address = "recursive"
+	}
+	for j := range u.RootHints {
+		u.RootHints[j] = strings.TrimSpace(u.RootHints[j])
+	}
+}
+
+func normalizeBlocklistSources(sources []BlocklistSource) {
+	for i := range sources {
+		sources[i].Type = strings.ToLower(strings.TrimSpace(sources[i].Type))
+		if sources[i].Type == "domains" {
+			sources[i].Type = ""
+		}
+	}
+}
+
+func validateBlocklistSourceType(source BlocklistSource) error {
+	switch source.Type {
+	case "", BlocklistSourceTypeIP:
+		return nil
+	default:
+		return fmt.Errorf("blocklist source %q: type must be domains or ip (got %q)", source.Name, source.Type)
+	}
+}
+
 func normalize(cfg *Config) {
 	cfg.ResolverStrategy = strings.ToLower(strings.TrimSpace(cfg.ResolverStrategy))
+	cfg.EDNSClientSubnet.Mode = strings.ToLower(strings.TrimSpace(cfg.EDNSClientSubnet.Mode))
+	for i := range cfg.EDNSClientSubnet.TrustedForwarders {
+		cfg.EDNSClientSubnet.TrustedForwarders[i] = strings.TrimSpace(cfg.EDNSClientSubnet.TrustedForwarders[i])
+	}
 	cfg.Response.Blocked = strings.ToLower(strings.TrimSpace(cfg.Response.Blocked))
+	cfg.Response.BlockedIPv4 = strings.TrimSpace(cfg.Response.BlockedIPv4)
+	cfg.Response.BlockedIPv6 = strings.TrimSpace(cfg.Response.BlockedIPv6)
 	for i := range cfg.Server.Protocols {
 		cfg.Server.Protocols[i] = strings.ToLower(strings.TrimSpace(cfg.Server.Protocols[i]))
 	}
+	for i := range cfg.Server.TrustedProxies {
+		cfg.Server.TrustedProxies[i] = strings.TrimSpace(cfg.Server.TrustedProxies[i])
+	}
 	for i := range cfg.Upstreams {
-		cfg.Upstreams[i].Address = strings.TrimSpace(cfg.Upstreams[i].Address)
-		cfg.Upstreams[i].Name = strings.TrimSpace(cfg.Upstreams[i].Name)
-		proto := strings.ToLower(strings.TrimSpace(cfg.Upstreams[i].Protocol))
-		if proto == "" {
-			if strings.HasPrefix(cfg.Upstreams[i].Address, "tls://") {
-				proto = "tls"
-			} else if strings.HasPrefix(cfg.Upstreams[i].Address, "https://") {
-				proto = "https"
-			} else if strings.HasPrefix(cfg.Upstreams[i].Address, "quic://") {
-				proto = "quic"
-			} else {
-				proto = "udp"
-			}
+		normalizeUpstream(&cfg.Upstreams[i])
+	}
+	cfg.DNS64.Prefix = strings.TrimSpace(cfg.DNS64.Prefix)
+	for i := range cfg.DNS64.ExcludeAAAA {
+		cfg.DNS64.ExcludeAAAA[i] = strings.TrimSpace(cfg.DNS64.ExcludeAAAA[i])
+	}
+	cfg.ACL.DefaultAction = strings.ToLower(strings.TrimSpace(cfg.ACL.DefaultAction))
+	for _, list := range [][]string{cfg.ACL.Allow, cfg.ACL.Deny, cfg.ACL.AllowGroups, cfg.ACL.DenyGroups} {
+		for i := range list {
+			list[i] = strings.TrimSpace(list[i])
+		}
+	}
+	cfg.RateLimit.Action = strings.ToLower(strings.TrimSpace(cfg.RateLimit.Action))
+	for i := range cfg.RateLimit.Exempt {
+		cfg.RateLimit.Exempt[i] = strings.TrimSpace(cfg.RateLimit.Exempt[i])
+	}
+	normalizeBlocklistSources(cfg.Blocklists.Sources)
+	for i := range cfg.ClientGroups {
+		if cfg.ClientGroups[i].Blocklist != nil {
+			normalizeBlocklistSources(cfg.ClientGroups[i].Blocklist.Sources)
+		}
+		if cfg.ClientGroups[i].DNS64 != nil {
+			cfg.ClientGroups[i].DNS64.Prefix = strings.TrimSpace(cfg.ClientGroups[i].DNS64.Prefix)
+		}
+		if cfg.ClientGroups[i].RateLimit != nil {
+			cfg.ClientGroups[i].RateLimit.Action = strings.ToLower(strings.TrimSpace(cfg.ClientGroups[i].RateLimit.Action))
+		}
+		if resp := cfg.ClientGroups[i].Response; resp != nil {
+			resp.Blocked = strings.ToLower(strings.TrimSpace(resp.Blocked))
+			resp.BlockedIPv4 = strings.TrimSpace(resp.BlockedIPv4)
+			resp.BlockedIPv6 = strings.TrimSpace(resp.BlockedIPv6)
+		}
+	}
+	for i := range cfg.PrivateReverse.Upstreams {
+		normalizeUpstream(&cfg.PrivateReverse.Upstreams[i])
+	}
+	cfg.PrivateReverse.Domain = strings.Trim(strings.ToLower(strings.TrimSpace(cfg.PrivateReverse.Domain)), ".")
+	for i := range cfg.UpstreamRoutes {
+		route := &cfg.UpstreamRoutes[i]
+		route.Strategy = strings.ToLower(strings.TrimSpace(route.Strategy))
+		if route.Strategy == "" {
+			route.Strategy = "failover"
+		}
+		for j := range route.Suffixes {
+			route.Suffixes[j] = strings.Trim(strings.ToLower(strings.TrimSpace(route.Suffixes[j])), ".")
+		}
+		for j := range route.Upstreams {
+			normalizeUpstream(&route.Upstreams[j])
 		}
-		cfg.Upstreams[i].Protocol = proto
 	}
 	cfg.Cache.Redis.Address = strings.TrimSpace(cfg.Cache.Redis.Address)
 	cfg.Cache.Redis.Mode = strings.ToLower(strings.TrimSpace(cfg.Cache.Redis.Mode))
@@ -1386,6 +1922,23 @@ func normalize(cfg *Config) {
 	cfg.DoHDotServer.KeyFile = strings.TrimSpace(cfg.DoHDotServer.KeyFile)
 	cfg.DoHDotServer.DoTListen = strings.TrimSpace(cfg.DoHDotServer.DoTListen)
 	cfg.DoHDotServer.DoHListen = strings.TrimSpace(cfg.DoHDotServer.DoHListen)
+	cfg.DoHDotServer.DoQListen = strings.TrimSpace(cfg.DoHDotServer.DoQListen)
+	cfg.DoHDotServer.ClientIDDomain = strings.Trim(strings.ToLower(strings.TrimSpace(cfg.DoHDotServer.ClientIDDomain)), ".")
+	for i := range cfg.ClientIdentification.Clients {
+		for j, id := range cfg.ClientIdentification.Clients[i].IDs {
+			cfg.ClientIdentification.Clients[i].IDs[j] = strings.ToLower(strings.TrimSpace(id))
+		}
+		for j, cidr := range cfg.ClientIdentification.Clients[i].CIDRs {
+			cfg.ClientIdentification.Clients[i].CIDRs[j] = strings.TrimSpace(cidr)
+		}
+		for j, mac := range cfg.ClientIdentification.Clients[i].MACs {
+			mac = strings.TrimSpace(mac)
+			if normalized, ok := clientid.NormalizeMAC(mac); ok {
+				mac = normalized
+			}
+			cfg.ClientIdentification.Clients[i].MACs[j] = mac
+		}
+	}
 	if cfg.DoHDotServer.DoHPath != "" && !strings.HasPrefix(cfg.DoHDotServer.DoHPath, "/") {
 		cfg.DoHDotServer.DoHPath = "/" + cfg.DoHDotServer.DoHPath
 	}
@@ -1397,6 +1950,159 @@ func normalize(cfg *Config) {
 	}
 }
 
+func validRateLimitAction(action string) bool {
+	return action == "drop" || action == "truncate" || action == "refuse"
+}
+
+// validateRateLimit checks rate_limit; defaults have been applied.
+// validateBlockedResponse checks a blocked response mode and, for "custom", its addresses.
+func validateBlockedResponse(blocked, ipv4, ipv6 string) error {
+	switch blocked {
+	case defaultBlockedResponse, BlockedResponseNODATA, BlockedResponseRefused, BlockedResponseNull:
+		return nil
+	case BlockedResponseCustom:
+		if ipv4 == "" && ipv6 == "" {
+			return fmt.Errorf("blocked_ipv4 or blocked_ipv6 is required when blocked is custom")
+		}
+		if ip := net.ParseIP(ipv4); ipv4 != "" && (ip == nil || ip.To4() == nil) {
+			return fmt.Errorf("blocked_ipv4 must be an IPv4 address (got %q)", ipv4)
+		}
+		if ip := net.ParseIP(ipv6); ipv6 != "" && (ip == nil || ip.To4() != nil) {
+			return fmt.Errorf("blocked_ipv6 must be an IPv6 address (got %q)", ipv6)
+		}
+		return nil
+	}
+	if net.ParseIP(blocked) == nil {
+		return fmt.Errorf("blocked must be nxdomain, nodata, refused, null, custom or an IP address (got %q)", blocked)
+	}
+	return nil
+}
+
+func validateRateLimit(rl RateLimitConfig) error {
+	if rl.UDPQPS < 0 || rl.UDPBurst < 0 || rl.TCPQPS < 0 || rl.TCPBurst < 0 {
+		return fmt.Errorf("rate_limit: limits must not be negative")
+	}
+	if !validRateLimitAction(rl.Action) {
+		return fmt.Errorf("rate_limit.action must be drop, truncate or refuse")
+	}
+	if rl.IPv4PrefixLength < 1 || rl.IPv4PrefixLength > 32 || rl.RRL.IPv4PrefixLength < 1 || rl.RRL.IPv4PrefixLength > 32 {
+		return fmt.Errorf("rate_limit: ipv4_prefix_length must be between 1 and 32")
+	}
+	if rl.IPv6PrefixLength < 1 || rl.IPv6PrefixLength > 128 || rl.RRL.IPv6PrefixLength < 1 || rl.RRL.IPv6PrefixLength > 128 {
+		return fmt.Errorf("rate_limit: ipv6_prefix_length must be between 1 and 128")
+	}
+	for _, exempt := range rl.Exempt {
+		if _, _, err := net.ParseCIDR(exempt); err != nil && net.ParseIP(exempt) == nil {
+			return fmt.Errorf("rate_limit.exempt: %q is not an IP or CIDR", exempt)
+		}
+	}
+	if rl.RRL.ResponsesPerSecond < 0 || rl.RRL.Burst < 0 {
+		return fmt.Errorf("rate_limit.rrl: limits must not be negative")
+	}
+	if rl.RRL.Slip != nil && *rl.RRL.Slip < 0 {
+		return fmt.Errorf("rate_limit.rrl.slip must not be negative")
+	}
+	return nil
+}
+
+// validateACL checks acl; defaults have been applied.
+func validateACL(acl ACLConfig) error {
+	if acl.DefaultAction != "refuse" && acl.DefaultAction != "drop" {
+		return fmt.Errorf("acl.default_action: %q must be refuse or drop", acl.DefaultAction)
+	}
+	for field, list := range map[string][]string{"allow": acl.Allow, "deny": acl.Deny} {
+		for _, entry := range list {
+			if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+				return fmt.Errorf("acl.%s: %q is not an IP or CIDR", field, entry)
+			}
+		}
+	}
+	for field, list := range map[string][]string{"allow_groups": acl.AllowGroups, "deny_groups": acl.DenyGroups} {
+		for _, id := range list {
+			if id == "" {
+				return fmt.Errorf("acl.%s: group IDs must not be empty", field)
+			}
+		}
+	}
+	return nil
+}
+
+// validateNAT64Prefix checks a DNS64 prefix: an IPv6 CIDR with one of the RFC 6052 lengths.
+func validateNAT64Prefix(s string) error {
+	pfx, err := netip.ParsePrefix(s)
+	if err != nil || !pfx.Addr().Is6() || pfx.Addr().Is4In6() {
+		return fmt.Errorf("%q is not an IPv6 CIDR", s)
+	}
+	switch pfx.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("%q: prefix length must be 32, 40, 48, 56, 64 or 96", s)
+	}
+	if pfx.Masked().Addr().As16()[8] != 0 {
+		return fmt.Errorf("%q: bits 64-71 must be zero (RFC 6052)", s)
+	}
+	return nil
+}
+
+// validateUpstream checks a normalized upstream entry.
+func validateUpstream(upstream UpstreamConfig) error {
+	if upstream.Address == "" {
+		return fmt.Errorf("upstream address must not be empty")
+	}
+	if upstream.MaxInflight < 0 || upstream.MaxQPS < 0 {
+		return fmt.Errorf("upstream %q: max_inflight and max_qps must not be negative", upstream.Address)
+	}
+	if upstream.Use0x20 && upstream.Protocol != "udp" {
+		return fmt.Errorf("upstream %q: use_0x20 is only supported for plain udp upstreams", upstream.Address)
+	}
+	if (len(upstream.Bootstrap) > 0 || upstream.DoHMethod != "" || upstream.HTTP3) && upstream.Protocol != "https" {
+		return fmt.Errorf("upstream %q: bootstrap, doh_method and http3 are only supported for DoH (https) upstreams", upstream.Address)
+	}
+	for _, ip := range upstream.Bootstrap {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid bootstrap %q for upstream %q: must be an IP address", ip, upstream.Address)
+		}
+	}
+	if m := strings.ToLower(upstream.DoHMethod); m != "" && m != "get" && m != "post" {
+		return fmt.Errorf("upstream %q: doh_method must be get or post", upstream.Address)
+	}
+	if upstream.Protocol == "recursive" {
+		// Address is only an identifier (backoff, stats); resolution starts at the root hints.
+		for _, hint := range upstream.RootHints {
+			host := hint
+			if h, _, err := net.SplitHostPort(hint); err == nil {
+				host = h
+			}
+			if net.ParseIP(host) == nil {
+				return fmt.Errorf("invalid root hint %q for upstream %q: must be an IP address or IP:port", hint, upstream.Address)
+			}
+		}
+		return nil
+	}
+	// Allow tls://host:port, quic://host:port, https://host/path, or host:port
+	if strings.HasPrefix(upstream.Address, "tls://") {
+		hostPort := strings.TrimPrefix(upstream.Address, "tls://")
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			return fmt.Errorf("invalid DoT upstream address %q: %w", upstream.Address, err)
+		}
+	} else if strings.HasPrefix(upstream.Address, "quic://") {
+		hostPort := strings.TrimPrefix(upstream.Address, "quic://")
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			return fmt.Errorf("invalid DoQ upstream address %q: %w", upstream.Address, err)
+		}
+	} else if strings.HasPrefix(upstream.Address, "https://") {
+		if _, err := url.Parse(upstream.Address); err != nil {
+			return fmt.Errorf("invalid DoH upstream address %q: %w", upstream.Address, err)
+		}
+	} else if _, _, err := net.SplitHostPort(upstream.Address); err != nil {
+		return fmt.Errorf("invalid upstream address %q: %w", upstream.Address, err)
+	}
+	if upstream.Protocol != "" && upstream.Protocol != "udp" && upstream.Protocol != "tcp" && upstream.Protocol != "tls" && upstream.Protocol != "https" && upstream.Protocol != "quic" {
+		return fmt.Errorf("unsupported upstream protocol %q", upstream.Protocol)
+	}
+	return nil
+}
+
 func validate(cfg *Config) error {
 	if len(cfg.Server.Protocols) == 0 {
 		return fmt.Errorf("server.protocols must not be empty")
@@ -1411,45 +2117,155 @@ func validate(cfg *Config) error {
 			return fmt.Errorf("unsupported protocol %q", proto)
 		}
 	}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("server.trusted_proxies: %q is not an IP or CIDR", proxy)
+		}
+	}
+	if cfg.Server.ProxyProtocol != nil && *cfg.Server.ProxyProtocol && len(cfg.Server.TrustedProxies) == 0 {
+		return fmt.Errorf("server.proxy_protocol requires server.trusted_proxies")
+	}
 	if len(cfg.Upstreams) == 0 {
 		return fmt.Errorf("at least one upstream is required")
 	}
 	switch cfg.ResolverStrategy {
-	case "failover", "load_balance", "weighted":
+	case "failover", "load_balance", "weighted", "race":
 		// valid
 	default:
-		return fmt.Errorf("resolver_strategy must be failover, load_balance, or weighted (got %q)", cfg.ResolverStrategy)
+		return fmt.Errorf("resolver_strategy must be failover, load_balance, weighted, or race (got %q)", cfg.ResolverStrategy)
+	}
+	if cfg.Network.UpstreamRaceCount < 0 {
+		return fmt.Errorf("network.upstream_race_count must not be negative")
+	}
+	if cfg.Network.UpstreamHedgeDelay.Duration < 0 {
+		return fmt.Errorf("network.upstream_hedge_delay must not be negative")
+	}
+	if cfg.Network.RecursionTimeout.Duration < 0 {
+		return fmt.Errorf("network.recursion_timeout must not be negative")
+	}
+	if hc := cfg.UpstreamHealthCheck; hc.Enabled != nil && *hc.Enabled {
+		if hc.Interval.Duration <= 0 || hc.Timeout.Duration <= 0 {
+			return fmt.Errorf("upstream_health_check.interval and timeout must be positive")
+		}
+		if _, ok := dns.IsDomainName(hc.QueryName); !ok {
+			return fmt.Errorf("upstream_health_check.query_name %q is not a valid domain name", hc.QueryName)
+		}
+		if _, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(hc.QueryType))]; !ok {
+			return fmt.Errorf("upstream_health_check.query_type %q is not a known record type", hc.QueryType)
+		}
+		if hc.FailureThreshold < 1 || hc.SuccessThreshold < 1 || hc.Window < 1 {
+			return fmt.Errorf("upstream_health_check.failure_threshold, success_threshold and window must be at least 1")
+		}
+	}
+	switch cfg.EDNSClientSubnet.Mode {
+	case "strip", "passthrough", "synthesize":
+		// valid
+	default:
+		return fmt.Errorf("edns_client_subnet.mode must be strip, passthrough, or synthesize (got %q)", cfg.EDNSClientSubnet.Mode)
+	}
+	if cfg.EDNSClientSubnet.IPv4Prefix < 1 || cfg.EDNSClientSubnet.IPv4Prefix > 32 {
+		return fmt.Errorf("edns_client_subnet.ipv4_prefix must be between 1 and 32 (got %d)", cfg.EDNSClientSubnet.IPv4Prefix)
+	}
+	if cfg.EDNSClientSubnet.IPv6Prefix < 1 || cfg.EDNSClientSubnet.IPv6Prefix > 128 {
+		return fmt.Errorf("edns_client_subnet.ipv6_prefix must be between 1 and 128 (got %d)", cfg.EDNSClientSubnet.IPv6Prefix)
+	}
+	for _, fwd := range cfg.EDNSClientSubnet.TrustedForwarders {
+		if _, _, err := net.ParseCIDR(fwd); err != nil && net.ParseIP(fwd) == nil {
+			return fmt.Errorf("edns_client_subnet.trusted_forwarders: %q is not an IP or CIDR", fwd)
+		}
+	}
+	for _, anchor := range cfg.DNSSEC.TrustAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil || rr == nil {
+			return fmt.Errorf("dnssec.trust_anchors: invalid record %q", anchor)
+		}
+		if t := rr.Header().Rrtype; t != dns.TypeDS && t != dns.TypeDNSKEY {
+			return fmt.Errorf("dnssec.trust_anchors: %q must be a DS or DNSKEY record", anchor)
+		}
 	}
 	for _, upstream := range cfg.Upstreams {
-		if upstream.Address == "" {
-			return fmt.Errorf("upstream address must not be empty")
-		}
-		// Allow tls://host:port, quic://host:port, https://host/path, or host:port
-		if strings.HasPrefix(upstream.Address, "tls://") {
-			hostPort := strings.TrimPrefix(upstream.Address, "tls://")
-			if _, _, err := net.SplitHostPort(hostPort); err != nil {
-				return fmt.Errorf("invalid DoT upstream address %q: %w", upstream.Address, err)
+		if err := validateUpstream(upstream); err != nil {
+			return err
+		}
+	}
+	if err := validateNAT64Prefix(cfg.DNS64.Prefix); err != nil {
+		return fmt.Errorf("dns64.prefix: %w", err)
+	}
+	for _, excl := range cfg.DNS64.ExcludeAAAA {
+		if pfx, err := netip.ParsePrefix(excl); err != nil || !pfx.Addr().Is6() {
+			return fmt.Errorf("dns64.exclude_aaaa: %q is not an IPv6 CIDR", excl)
+		}
+	}
+	for _, g := range cfg.ClientGroups {
+		if g.DNS64 != nil && g.DNS64.Prefix != "" {
+			if err := validateNAT64Prefix(g.DNS64.Prefix); err != nil {
+				return fmt.Errorf("client_groups[%s].dns64.prefix: %w", g.ID, err)
+			}
+		}
+		if rl := g.RateLimit; rl != nil {
+			if rl.UDPQPS < 0 || rl.UDPBurst < 0 || rl.TCPQPS < 0 || rl.TCPBurst < 0 {
+				return fmt.Errorf("client_groups[%s].rate_limit: limits must not be negative", g.ID)
+			}
+			if rl.Action != "" && !validRateLimitAction(rl.Action) {
+				return fmt.Errorf("client_groups[%s].rate_limit.action must be drop, truncate or refuse", g.ID)
+			}
+		}
+	}
+	if err := validateRateLimit(cfg.RateLimit); err != nil {
+		return err
+	}
+	if err := validateACL(cfg.ACL); err != nil {
+		return err
+	}
+	for _, upstream := range cfg.PrivateReverse.Upstreams {
+		if err := validateUpstream(upstream); err != nil {
+			return fmt.Errorf("private_reverse: %w", err)
+		}
+	}
+	if d := cfg.PrivateReverse.Domain; d != "" {
+		if _, ok := dns.IsDomainName(d); !ok {
+			return fmt.Errorf("private_reverse.domain: invalid domain %q", d)
+		}
+	}
+	seenSuffixes := make(map[string]bool)
+	for i, route := range cfg.UpstreamRoutes {
+		if len(route.Suffixes) == 0 {
+			return fmt.Errorf("upstream_routes[%d]: at least one suffix is required", i)
+		}
+		for _, suffix := range route.Suffixes {
+			if suffix == "" {
+				return fmt.Errorf("upstream_routes[%d]: suffix must not be empty", i)
 			}
-		} else if strings.HasPrefix(upstream.Address, "quic://") {
-			hostPort := strings.TrimPrefix(upstream.Address, "quic://")
-			if _, _, err := net.SplitHostPort(hostPort); err != nil {
-				return fmt.Errorf("invalid DoQ upstream address %q: %w", upstream.Address, err)
+			if _, ok := dns.IsDomainName(suffix); !ok {
+				return fmt.Errorf("upstream_routes[%d]: invalid suffix %q", i, suffix)
 			}
-		} else if strings.HasPrefix(upstream.Address, "https://") {
-			if _, err := url.Parse(upstream.Address); err != nil {
-				return fmt.Errorf("invalid DoH upstream address %q: %w", upstream.Address, err)
+			if seenSuffixes[suffix] {
+				return fmt.Errorf("upstream_routes[%d]: suffix %q is already routed", i, suffix)
 			}
-		} else if _, _, err := net.SplitHostPort(upstream.Address); err != nil {
-			return fmt.Errorf("invalid upstream address %q: %w", upstream.Address, err)
+			seenSuffixes[suffix] = true
+		}
+		if len(route.Upstreams) == 0 {
+			return fmt.Errorf("upstream_routes[%d]: at least one upstream is required", i)
+		}
+		switch route.Strategy {
+		case "failover", "load_balance", "weighted", "race":
+			// valid
+		default:
+			return fmt.Errorf("upstream_routes[%d]: strategy must be failover, load_balance, weighted, or race (got %q)", i, route.Strategy)
 		}
-		if upstream.Protocol != "" && upstream.Protocol != "udp" && upstream.Protocol != "tcp" && upstream.Protocol != "tls" && upstream.Protocol != "https" && upstream.Protocol != "quic" {
-			return fmt.Errorf("unsupported upstream protocol %q", upstream.Protocol)
+		for _, upstream := range route.Upstreams {
+			if err := validateUpstream(upstream); err != nil {
+				return fmt.Errorf("upstream_routes[%d]: %w", i, err)
+			}
 		}
 	}
 	for _, source := range cfg.Blocklists.Sources {
 		if strings.TrimSpace(source.URL) == "" {
 			return fmt.Errorf("blocklist source url must not be empty")
 		}
+		if err := validateBlocklistSourceType(source); err != nil {
+			return err
+		}
 	}
 	if cfg.Blocklists.ScheduledPause != nil && cfg.Blocklists.ScheduledPause.Enabled != nil && *cfg.Blocklists.ScheduledPause.Enabled {
 		if err := validateTimeWindow(cfg.Blocklists.ScheduledPause.Start, cfg.Blocklists.ScheduledPause.End); err != nil {
@@ -1472,6 +2288,13 @@ func validate(cfg *Config) error {
 		}
 	}
 	for i, g := range cfg.ClientGroups {
+		if g.Blocklist != nil {
+			for _, source := range g.Blocklist.Sources {
+				if err := validateBlocklistSourceType(source); err != nil {
+					return fmt.Errorf("client_groups[%d].blocklist: %w", i, err)
+				}
+			}
+		}
 		if g.Blocklist != nil && g.Blocklist.FamilyTime != nil && g.Blocklist.FamilyTime.Enabled != nil && *g.Blocklist.FamilyTime.Enabled {
 			if err := validateTimeWindow(g.Blocklist.FamilyTime.Start, g.Blocklist.FamilyTime.End); err != nil {
 				return fmt.Errorf("client_groups[%d].blocklist.family_time: %w", i, err)
@@ -1520,9 +2343,14 @@ func validate(cfg *Config) error {
 	if cfg.Cache.RefreshUpstreamFailLogInterval.Duration < 0 {
 		return fmt.Errorf("cache.refresh_upstream_fail_log_interval must be zero or greater")
 	}
-	if cfg.Response.Blocked != defaultBlockedResponse {
-		if net.ParseIP(cfg.Response.Blocked) == nil {
-			return fmt.Errorf("response.blocked must be %q or an IP address", defaultBlockedResponse)
+	if err := validateBlockedResponse(cfg.Response.Blocked, cfg.Response.BlockedIPv4, cfg.Response.BlockedIPv6); err != nil {
+		return fmt.Errorf("response.%w", err)
+	}
+	for _, g := range cfg.ClientGroups {
+		if g.Response != nil && g.Response.Blocked != "" {
+			if err := validateBlockedResponse(g.Response.Blocked, g.Response.BlockedIPv4, g.Response.BlockedIPv6); err != nil {
+				return fmt.Errorf("client_groups[%s].response.%w", g.ID, err)
+			}
 		}
 	}
 	if cfg.RequestLog.Enabled != nil && *cfg.RequestLog.Enabled {
@@ -1616,8 +2444,8 @@ func validate(cfg *Config) error {
 		if cfg.DoHDotServer.CertFile == "" || cfg.DoHDotServer.KeyFile == "" {
 			return fmt.Errorf("doh_dot_server.cert_file and doh_dot_server.key_file are required when doh_dot_server.enabled is true")
 		}
-		if cfg.DoHDotServer.DoTListen == "" && cfg.DoHDotServer.DoHListen == "" {
-			return fmt.Errorf("doh_dot_server: at least one of dot_listen or doh_listen must be set")
+		if cfg.DoHDotServer.DoTListen == "" && cfg.DoHDotServer.DoHListen == "" && cfg.DoHDotServer.DoQListen == "" {
+			return fmt.Errorf("doh_dot_server: at least one of dot_listen, doh_listen or doq_listen must be set")
 		}
 		if cfg.DoHDotServer.DoTListen != "" {
 			if _, _, err := net.SplitHostPort(cfg.DoHDotServer.DoTListen); err != nil {
@@ -1629,6 +2457,45 @@ func validate(cfg *Config) error {
 				return fmt.Errorf("invalid doh_dot_server.doh_listen %q: %w", cfg.DoHDotServer.DoHListen, err)
 			}
 		}
+		if cfg.DoHDotServer.DoQListen != "" {
+			if _, _, err := net.SplitHostPort(cfg.DoHDotServer.DoQListen); err != nil {
+				return fmt.Errorf("invalid doh_dot_server.doq_listen %q: %w", cfg.DoHDotServer.DoQListen, err)
+			}
+		}
+	}
+	if d := cfg.DoHDotServer.ClientIDDomain; d != "" {
+		if _, ok := dns.IsDomainName(d); !ok {
+			return fmt.Errorf("doh_dot_server.client_id_domain: %q is not a domain name", d)
+		}
+	}
+	seenIDs := make(map[string]bool)
+	for i, c := range cfg.ClientIdentification.Clients {
+		for _, id := range c.IDs {
+			if _, ok := clientid.NormalizeID(id); !ok {
+				return fmt.Errorf("client_identification.clients[%d].ids: %q must be 1-63 letters, digits, '-' or '_'", i, id)
+			}
+			if seenIDs[id] {
+				return fmt.Errorf("client_identification.clients[%d].ids: %q is used by another client", i, id)
+			}
+			seenIDs[id] = true
+		}
+	}
+	seenMACs := make(map[string]bool)
+	for i, c := range cfg.ClientIdentification.Clients {
+		for _, cidr := range c.CIDRs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				return fmt.Errorf("client_identification.clients[%d].cidrs: %q is not a CIDR (e.g. 192.168.20.0/24)", i, cidr)
+			}
+		}
+		for _, mac := range c.MACs {
+			if _, ok := clientid.NormalizeMAC(mac); !ok {
+				return fmt.Errorf("client_identification.clients[%d].macs: %q is not a MAC address (e.g. aa:bb:cc:dd:ee:ff)", i, mac)
+			}
+			if seenMACs[mac] {
+				return fmt.Errorf("client_identification.clients[%d].macs: %q is used by another client", i, mac)
+			}
+			seenMACs[mac] = true
+		}
 	}
 	for i, rec := range cfg.LocalRecords {
 		if rec.Name == "" {
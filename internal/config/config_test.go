@@ -952,6 +952,55 @@ server:
 		}
 	})
 
+	t.Run("race valid", func(t *testing.T) {
+		overridePath := writeTempConfig(t, []byte(`
+resolver_strategy: race
+network:
+  upstream_hedge_delay: "25ms"
+`))
+		cfg, err := LoadWithFiles(defaultPath, overridePath)
+		if err != nil {
+			t.Fatalf("Load returned error: %v", err)
+		}
+		if cfg.ResolverStrategy != "race" {
+			t.Fatalf("expected resolver_strategy race, got %q", cfg.ResolverStrategy)
+		}
+		if cfg.Network.UpstreamRaceCount != 2 || cfg.Network.UpstreamHedgeDelay.Duration != 25*time.Millisecond {
+			t.Fatalf("expected race count 2 and hedge delay 25ms, got %d and %v", cfg.Network.UpstreamRaceCount, cfg.Network.UpstreamHedgeDelay.Duration)
+		}
+		if cfg.Network.UpstreamPipelining == nil || !*cfg.Network.UpstreamPipelining {
+			t.Fatalf("expected upstream_pipelining on by default")
+		}
+	})
+
+	t.Run("negative race count rejected", func(t *testing.T) {
+		overridePath := writeTempConfig(t, []byte(`
+resolver_strategy: race
+network:
+  upstream_race_count: -1
+`))
+		if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+			t.Fatalf("expected error for negative upstream_race_count")
+		}
+	})
+
+	t.Run("recursion timeout", func(t *testing.T) {
+		cfg, err := LoadWithFiles(defaultPath, "")
+		if err != nil {
+			t.Fatalf("Load returned error: %v", err)
+		}
+		if cfg.Network.RecursionTimeout.Duration != 30*time.Second {
+			t.Fatalf("expected recursion_timeout 30s by default, got %v", cfg.Network.RecursionTimeout.Duration)
+		}
+		overridePath := writeTempConfig(t, []byte(`
+network:
+  recursion_timeout: "-1s"
+`))
+		if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+			t.Fatalf("expected error for negative recursion_timeout")
+		}
+	})
+
 	t.Run("invalid strategy rejected", func(t *testing.T) {
 		overridePath := writeTempConfig(t, []byte(`resolver_strategy: random`))
 		if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
@@ -960,6 +1009,56 @@ server:
 	})
 }
 
+func TestUpstreamHealthCheck(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+upstreams:
+  - name: test
+    address: "1.1.1.1:53"
+`))
+
+	t.Run("defaults", func(t *testing.T) {
+		overridePath := writeTempConfig(t, []byte(`
+upstream_health_check:
+  enabled: true
+`))
+		cfg, err := LoadWithFiles(defaultPath, overridePath)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		hc := cfg.UpstreamHealthCheck
+		if hc.Interval.Duration != 10*time.Second || hc.Timeout.Duration != 2*time.Second || hc.QueryName != "." || hc.QueryType != "NS" {
+			t.Fatalf("unexpected defaults %+v", hc)
+		}
+		if hc.FailureThreshold != 3 || hc.SuccessThreshold != 2 || hc.Window != 20 {
+			t.Fatalf("unexpected thresholds %+v", hc)
+		}
+	})
+
+	t.Run("invalid query type rejected", func(t *testing.T) {
+		overridePath := writeTempConfig(t, []byte(`
+upstream_health_check:
+  enabled: true
+  query_type: BOGUS
+`))
+		if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+			t.Fatal("expected error for unknown query_type")
+		}
+	})
+
+	t.Run("negative threshold rejected", func(t *testing.T) {
+		overridePath := writeTempConfig(t, []byte(`
+upstream_health_check:
+  enabled: true
+  failure_threshold: -1
+`))
+		if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+			t.Fatal("expected error for negative failure_threshold")
+		}
+	})
+}
+
 func TestUpstreamBackoff(t *testing.T) {
 	defaultPath := writeTempConfig(t, []byte(`
 server:
@@ -1002,6 +1101,363 @@ upstreams:
 	})
 }
 
+func TestEDNSClientSubnetConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := LoadWithFiles(defaultPath, "")
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		ecs := cfg.EDNSClientSubnet
+		if ecs.Mode != "strip" || ecs.IPv4Prefix != 24 || ecs.IPv6Prefix != 56 {
+			t.Fatalf("expected strip /24 /56 defaults, got mode=%q v4=%d v6=%d", ecs.Mode, ecs.IPv4Prefix, ecs.IPv6Prefix)
+		}
+	})
+
+	t.Run("synthesize with trusted forwarders", func(t *testing.T) {
+		overridePath := writeTempConfig(t, []byte(`
+edns_client_subnet:
+  mode: " Synthesize "
+  ipv4_prefix: 20
+  ipv6_prefix: 48
+  trusted_forwarders: ["192.168.1.1", "10.0.0.0/8"]
+`))
+		cfg, err := LoadWithFiles(defaultPath, overridePath)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		ecs := cfg.EDNSClientSubnet
+		if ecs.Mode != "synthesize" || ecs.IPv4Prefix != 20 || ecs.IPv6Prefix != 48 || len(ecs.TrustedForwarders) != 2 {
+			t.Fatalf("unexpected edns_client_subnet: %+v", ecs)
+		}
+	})
+
+	for name, override := range map[string]string{
+		"invalid mode":      "edns_client_subnet:\n  mode: rewrite\n",
+		"ipv4 prefix range": "edns_client_subnet:\n  ipv4_prefix: 33\n",
+		"ipv6 prefix range": "edns_client_subnet:\n  ipv6_prefix: 129\n",
+		"invalid forwarder": "edns_client_subnet:\n  trusted_forwarders: [\"router\"]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			overridePath := writeTempConfig(t, []byte(override))
+			if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+				t.Fatalf("expected error for %s", name)
+			}
+		})
+	}
+}
+
+func TestRecursiveUpstreamConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	overridePath := writeTempConfig(t, []byte(`
+upstreams:
+  - name: root
+    protocol: Recursive
+    root_hints: [" 198.41.0.4 ", "127.0.0.1:5353"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	u := cfg.Upstreams[0]
+	if u.Protocol != "recursive" || u.Address != "recursive" || len(u.RootHints) != 2 || u.RootHints[0] != "198.41.0.4" {
+		t.Fatalf("unexpected recursive upstream: %+v", u)
+	}
+
+	overridePath = writeTempConfig(t, []byte(`
+upstreams:
+  - name: root
+    protocol: recursive
+    root_hints: ["a.root-servers.net"]
+`))
+	if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+		t.Fatal("expected error for root hint that is not an IP address")
+	}
+}
+
+func TestUpstreamLimitsConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	overridePath := writeTempConfig(t, []byte(`
+upstreams:
+  - name: nextdns
+    address: tls://45.90.28.0:853
+    max_inflight: 20
+    max_qps: 2.5
+  - address: 1.1.1.1:53
+`))
+	cfg, err := LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if u := cfg.Upstreams[0]; u.MaxInflight != 20 || u.MaxQPS != 2.5 {
+		t.Fatalf("unexpected limits: %+v", u)
+	}
+	if u := cfg.Upstreams[1]; u.MaxInflight != 0 || u.MaxQPS != 0 {
+		t.Fatalf("expected no limits by default, got %+v", u)
+	}
+
+	overridePath = writeTempConfig(t, []byte(`
+upstreams:
+  - address: 1.1.1.1:53
+    max_qps: -1
+`))
+	if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+		t.Fatal("expected error for negative max_qps")
+	}
+}
+
+func TestUpstream0x20Config(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	overridePath := writeTempConfig(t, []byte(`
+upstreams:
+  - address: 192.0.2.53:53
+    use_0x20: true
+`))
+	cfg, err := LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if u := cfg.Upstreams[0]; !u.Use0x20 || u.Protocol != "udp" {
+		t.Fatalf("unexpected upstream: %+v", u)
+	}
+
+	overridePath = writeTempConfig(t, []byte(`
+upstreams:
+  - address: tls://192.0.2.53:853
+    use_0x20: true
+`))
+	if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+		t.Fatal("expected error for use_0x20 on a DoT upstream")
+	}
+}
+
+func TestDoHDotServerDoQListen(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	overridePath := writeTempConfig(t, []byte(`
+doh_dot_server:
+  enabled: true
+  cert_file: /etc/certs/fullchain.pem
+  key_file: /etc/certs/privkey.pem
+  doq_listen: " 0.0.0.0:853 "
+`))
+	cfg, err := LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DoHDotServer.DoQListen != "0.0.0.0:853" {
+		t.Fatalf("doq_listen = %q", cfg.DoHDotServer.DoQListen)
+	}
+
+	overridePath = writeTempConfig(t, []byte(`
+doh_dot_server:
+  enabled: true
+  cert_file: /etc/certs/fullchain.pem
+  key_file: /etc/certs/privkey.pem
+  doq_listen: "853"
+`))
+	if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+		t.Fatal("expected error for doq_listen without host:port")
+	}
+}
+
+func TestUpstreamDoHConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	overridePath := writeTempConfig(t, []byte(`
+upstreams:
+  - address: https://dns.example/dns-query
+    bootstrap: ["192.0.2.1", "2001:db8::1"]
+    doh_method: get
+    http3: true
+`))
+	cfg, err := LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if u := cfg.Upstreams[0]; len(u.Bootstrap) != 2 || u.DoHMethod != "get" || !u.HTTP3 {
+		t.Fatalf("unexpected upstream: %+v", u)
+	}
+
+	for _, bad := range []string{
+		"upstreams:\n  - address: https://dns.example/dns-query\n    bootstrap: [dns.example]\n",
+		"upstreams:\n  - address: https://dns.example/dns-query\n    doh_method: put\n",
+		"upstreams:\n  - address: tls://192.0.2.1:853\n    bootstrap: [192.0.2.1]\n",
+		"upstreams:\n  - address: 192.0.2.1:53\n    http3: true\n",
+	} {
+		if _, err := LoadWithFiles(defaultPath, writeTempConfig(t, []byte(bad))); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUpstreamRoutesConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	overridePath := writeTempConfig(t, []byte(`
+upstream_routes:
+  - suffixes: [" Corp.Example.COM. ", "home.arpa"]
+    upstreams:
+      - name: corp-dns
+        address: " 10.0.0.53:53 "
+      - address: tls://10.0.0.54:853
+  - suffixes: ["8.10.in-addr.arpa"]
+    strategy: Load_Balance
+    upstreams:
+      - address: 10.8.0.1:53
+`))
+	cfg, err := LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cfg.UpstreamRoutes) != 2 {
+		t.Fatalf("expected 2 routes, got %+v", cfg.UpstreamRoutes)
+	}
+	corp := cfg.UpstreamRoutes[0]
+	if corp.Suffixes[0] != "corp.example.com" || corp.Strategy != "failover" {
+		t.Errorf("unexpected normalized route: %+v", corp)
+	}
+	if corp.Upstreams[0].Address != "10.0.0.53:53" || corp.Upstreams[0].Protocol != "udp" || corp.Upstreams[1].Protocol != "tls" {
+		t.Errorf("unexpected route upstreams: %+v", corp.Upstreams)
+	}
+	if cfg.UpstreamRoutes[1].Strategy != "load_balance" {
+		t.Errorf("strategy = %q, want load_balance", cfg.UpstreamRoutes[1].Strategy)
+	}
+
+	for name, routes := range map[string]string{
+		"no suffixes": `
+upstream_routes:
+  - upstreams: [{address: "10.0.0.53:53"}]
+`,
+		"no upstreams": `
+upstream_routes:
+  - suffixes: ["corp.example.com"]
+`,
+		"duplicate suffix": `
+upstream_routes:
+  - suffixes: ["corp.example.com"]
+    upstreams: [{address: "10.0.0.53:53"}]
+  - suffixes: ["CORP.example.com."]
+    upstreams: [{address: "10.0.0.54:53"}]
+`,
+		"bad strategy": `
+upstream_routes:
+  - suffixes: ["corp.example.com"]
+    strategy: random
+    upstreams: [{address: "10.0.0.53:53"}]
+`,
+		"bad upstream": `
+upstream_routes:
+  - suffixes: ["corp.example.com"]
+    upstreams: [{address: "10.0.0.53"}]
+`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			overridePath := writeTempConfig(t, []byte(routes))
+			if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+				t.Fatal("expected validation error")
+			}
+		})
+	}
+}
+
+func TestPrivateReverseConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, "")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.PrivateReverse.Enabled == nil || !*cfg.PrivateReverse.Enabled {
+		t.Fatalf("expected private_reverse.enabled to default to true, got %v", cfg.PrivateReverse.Enabled)
+	}
+
+	overridePath := writeTempConfig(t, []byte(`
+private_reverse:
+  domain: " Home.Arpa. "
+  upstreams:
+    - name: router
+      address: "192.168.1.1:53"
+`))
+	cfg, err = LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.PrivateReverse.Domain != "home.arpa" || cfg.PrivateReverse.Upstreams[0].Protocol != "udp" {
+		t.Fatalf("unexpected private_reverse: %+v", cfg.PrivateReverse)
+	}
+
+	overridePath = writeTempConfig(t, []byte(`
+private_reverse:
+  upstreams:
+    - address: "192.168.1.1"
+`))
+	if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+		t.Fatal("expected error for router upstream without port")
+	}
+}
+
+func TestDNSSECConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, "")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DNSSEC.Validate == nil || *cfg.DNSSEC.Validate {
+		t.Fatalf("expected dnssec.validate to default to false, got %v", cfg.DNSSEC.Validate)
+	}
+
+	overridePath := writeTempConfig(t, []byte(`
+dnssec:
+  validate: true
+  trust_anchors:
+    - ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+`))
+	cfg, err = LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !*cfg.DNSSEC.Validate || len(cfg.DNSSEC.TrustAnchors) != 1 {
+		t.Fatalf("unexpected dnssec: %+v", cfg.DNSSEC)
+	}
+
+	for name, anchor := range map[string]string{
+		"not a record":  "not a record",
+		"wrong rr type": "example. IN A 192.0.2.1",
+	} {
+		t.Run(name, func(t *testing.T) {
+			overridePath := writeTempConfig(t, []byte("dnssec:\n  trust_anchors: [\""+anchor+"\"]\n"))
+			if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+				t.Fatalf("expected error for trust anchor %q", anchor)
+			}
+		})
+	}
+}
+
 func TestLoadWebhookContext(t *testing.T) {
 	defaultPath := writeTempConfig(t, []byte(`
 server:
@@ -1415,3 +1871,374 @@ func writeTempConfig(t *testing.T, data []byte) string {
 	}
 	return path
 }
+
+func TestDNS64Config(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, "")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DNS64.Enabled == nil || *cfg.DNS64.Enabled {
+		t.Fatalf("expected dns64 to be disabled by default, got %v", cfg.DNS64.Enabled)
+	}
+	if cfg.DNS64.Prefix != "64:ff9b::/96" || len(cfg.DNS64.ExcludeAAAA) != 1 || cfg.DNS64.ExcludeAAAA[0] != "::ffff:0:0/96" {
+		t.Fatalf("unexpected dns64 defaults: %+v", cfg.DNS64)
+	}
+
+	overridePath := writeTempConfig(t, []byte(`
+dns64:
+  enabled: true
+  prefix: " 2001:db8:64::/64 "
+client_groups:
+  - id: v6only
+    name: IPv6-only
+    dns64:
+      enabled: true
+      prefix: "2001:db8:100::/40"
+`))
+	cfg, err = LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DNS64.Prefix != "2001:db8:64::/64" || cfg.ClientGroups[0].DNS64.Prefix != "2001:db8:100::/40" {
+		t.Fatalf("unexpected dns64 config: %+v, group %+v", cfg.DNS64, cfg.ClientGroups[0].DNS64)
+	}
+
+	for _, bad := range []string{
+		"dns64:\n  prefix: \"64:ff9b::/80\"\n",           // unsupported length
+		"dns64:\n  prefix: \"192.0.2.0/24\"\n",           // not IPv6
+		"dns64:\n  prefix: \"2001:db8:0:0:ff00::/96\"\n", // bits 64-71 must be zero
+		"dns64:\n  exclude_aaaa: [\"10.0.0.0/8\"]\n",
+		"client_groups:\n  - id: g\n    name: g\n    dns64:\n      prefix: \"64:ff9b::/33\"\n",
+	} {
+		overridePath = writeTempConfig(t, []byte(bad))
+		if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, "")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	rl := cfg.RateLimit
+	if rl.Enabled == nil || *rl.Enabled || rl.UDPQPS != 50 || rl.UDPBurst != 200 || rl.TCPQPS != 100 || rl.TCPBurst != 400 || rl.Action != "drop" {
+		t.Fatalf("unexpected rate_limit defaults: %+v", rl)
+	}
+	if rl.IPv4PrefixLength != 32 || rl.IPv6PrefixLength != 64 {
+		t.Fatalf("unexpected rate_limit prefix defaults: %+v", rl)
+	}
+	if rl.RRL.Enabled == nil || *rl.RRL.Enabled || rl.RRL.ResponsesPerSecond != 5 || rl.RRL.Slip == nil || *rl.RRL.Slip != 2 || rl.RRL.IPv4PrefixLength != 24 || rl.RRL.IPv6PrefixLength != 56 {
+		t.Fatalf("unexpected rrl defaults: %+v", rl.RRL)
+	}
+
+	overridePath := writeTempConfig(t, []byte(`
+rate_limit:
+  enabled: true
+  action: " Truncate "
+  exempt: ["10.0.0.0/8", "192.168.1.1"]
+  rrl:
+    enabled: true
+    slip: 0
+client_groups:
+  - id: iot
+    name: IoT
+    rate_limit:
+      udp_qps: 5
+      action: REFUSE
+`))
+	cfg, err = LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.RateLimit.Action != "truncate" || *cfg.RateLimit.RRL.Slip != 0 || cfg.ClientGroups[0].RateLimit.Action != "refuse" {
+		t.Fatalf("unexpected rate_limit: %+v, group %+v", cfg.RateLimit, cfg.ClientGroups[0].RateLimit)
+	}
+
+	for _, bad := range []string{
+		"rate_limit:\n  action: block\n",
+		"rate_limit:\n  udp_qps: -1\n",
+		"rate_limit:\n  ipv4_prefix_length: 33\n",
+		"rate_limit:\n  exempt: [\"not-an-ip\"]\n",
+		"rate_limit:\n  rrl:\n    slip: -1\n",
+		"client_groups:\n  - id: g\n    name: g\n    rate_limit:\n      action: block\n",
+	} {
+		overridePath = writeTempConfig(t, []byte(bad))
+		if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestBlocklistSourceType(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+blocklists:
+  sources:
+    - name: ads
+      url: https://example.com/ads.txt
+    - name: drop
+      url: https://example.com/drop.txt
+      type: " IP "
+    - name: hosts
+      url: https://example.com/hosts.txt
+      type: domains
+client_groups:
+  - id: lab
+    name: Lab
+    blocklist:
+      inherit_global: false
+      sources:
+        - name: c2
+          url: https://example.com/c2.txt
+          type: ip
+`))
+	cfg, err := LoadWithFiles(defaultPath, "")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	sources := cfg.Blocklists.Sources
+	if sources[0].Type != "" || sources[1].Type != BlocklistSourceTypeIP || sources[2].Type != "" {
+		t.Fatalf("unexpected source types: %+v", sources)
+	}
+	if cfg.ClientGroups[0].Blocklist.Sources[0].Type != BlocklistSourceTypeIP {
+		t.Fatalf("unexpected group source type: %+v", cfg.ClientGroups[0].Blocklist.Sources)
+	}
+
+	badPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+blocklists:
+  sources:
+    - name: drop
+      url: https://example.com/drop.txt
+      type: cidr
+`))
+	if _, err := LoadWithFiles(badPath, ""); err == nil {
+		t.Fatalf("expected source type error, got %v", err)
+	}
+}
+
+func TestBlockedResponseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{"nodata", "response:\n  blocked: NODATA\n", false},
+		{"refused", "response:\n  blocked: refused\n", false},
+		{"null", "response:\n  blocked: \"null\"\n", false},
+		{"single ip", "response:\n  blocked: 0.0.0.0\n", false},
+		{"custom", "response:\n  blocked: custom\n  blocked_ipv4: 192.0.2.1\n  blocked_ipv6: 2001:db8::1\n", false},
+		{"custom without addresses", "response:\n  blocked: custom\n", true},
+		{"custom swapped families", "response:\n  blocked: custom\n  blocked_ipv4: 2001:db8::1\n", true},
+		{"unknown mode", "response:\n  blocked: sinkhole\n", true},
+		{"group", "client_groups:\n  - id: tv\n    name: TV\n    response:\n      blocked: \" Null \"\n", false},
+		{"group invalid", "client_groups:\n  - id: tv\n    name: TV\n    response:\n      blocked: sinkhole\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTempConfig(t, []byte("server:\n  listen: [\"127.0.0.1:53\"]\n"+tt.yaml))
+			cfg, err := LoadWithFiles(path, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadWithFiles error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.name == "group" && cfg.ClientGroups[0].Response.Blocked != BlockedResponseNull {
+				t.Errorf("group blocked = %q, want normalized null", cfg.ClientGroups[0].Response.Blocked)
+			}
+		})
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, "")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Server.ProxyProtocol == nil || *cfg.Server.ProxyProtocol {
+		t.Fatalf("proxy_protocol should default to false, got %v", cfg.Server.ProxyProtocol)
+	}
+
+	overridePath := writeTempConfig(t, []byte(`
+server:
+  proxy_protocol: true
+  trusted_proxies: [" 10.0.0.0/8 ", "192.0.2.1"]
+`))
+	cfg, err = LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !*cfg.Server.ProxyProtocol || len(cfg.Server.TrustedProxies) != 2 || cfg.Server.TrustedProxies[0] != "10.0.0.0/8" {
+		t.Fatalf("server = %+v", cfg.Server)
+	}
+
+	for _, bad := range []string{
+		"server:\n  proxy_protocol: true\n",
+		"server:\n  trusted_proxies: [\"lb.internal\"]\n",
+	} {
+		if _, err := LoadWithFiles(defaultPath, writeTempConfig(t, []byte(bad))); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestClientIdentificationIDs(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	overridePath := writeTempConfig(t, []byte(`
+doh_dot_server:
+  client_id_domain: " DNS.Example.com. "
+client_identification:
+  enabled: true
+  clients:
+    - ip: "192.168.1.10"
+      name: "Laptop"
+    - name: "Kids Phone"
+      group_id: kids
+      ids: [" Kids-Phone ", "kids_tablet"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DoHDotServer.ClientIDDomain != "dns.example.com" {
+		t.Errorf("client_id_domain = %q", cfg.DoHDotServer.ClientIDDomain)
+	}
+	names, groups := cfg.ClientIdentification.Clients.ToIDNameMap(), cfg.ClientIdentification.Clients.ToIDGroupMap()
+	if len(names) != 2 || names["kids-phone"] != "Kids Phone" || groups["kids_tablet"] != "kids" {
+		t.Errorf("ID maps = %v, %v", names, groups)
+	}
+	if ips := cfg.ClientIdentification.Clients.ToNameMap(); len(ips) != 1 {
+		t.Errorf("IP map = %v, want only the laptop", ips)
+	}
+
+	for _, bad := range []string{
+		"client_identification:\n  clients:\n    - name: a\n      ids: [\"a.b\"]\n",
+		"client_identification:\n  clients:\n    - name: a\n      ids: [x]\n    - name: b\n      ids: [X]\n",
+	} {
+		if _, err := LoadWithFiles(defaultPath, writeTempConfig(t, []byte(bad))); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestClientIdentificationCIDRsAndMACs(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	overridePath := writeTempConfig(t, []byte(`
+client_identification:
+  enabled: true
+  ipv6_prefix_match: true
+  clients:
+    - name: "Kids VLAN"
+      group_id: kids
+      cidrs: [" 192.168.20.0/24 ", "2001:db8:20::/64"]
+    - name: "Kids iPad"
+      group_id: kids
+      macs: ["AA-BB-CC-DD-EE-FF"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.ClientIdentification.IPv6PrefixMatch == nil || !*cfg.ClientIdentification.IPv6PrefixMatch {
+		t.Error("ipv6_prefix_match should be true")
+	}
+	if groups := cfg.ClientIdentification.Clients.ToGroupMap(); len(groups) != 2 || groups["192.168.20.0/24"] != "kids" {
+		t.Errorf("group map = %v, want both ranges", groups)
+	}
+	if macs := cfg.ClientIdentification.Clients.ToMACNameMap(); macs["aa:bb:cc:dd:ee:ff"] != "Kids iPad" {
+		t.Errorf("MAC map = %v, want the normalized MAC", macs)
+	}
+
+	defaults, err := LoadWithFiles(defaultPath, "")
+	if err != nil {
+		t.Fatalf("Load defaults: %v", err)
+	}
+	if defaults.ClientIdentification.IPv6PrefixMatch == nil || *defaults.ClientIdentification.IPv6PrefixMatch {
+		t.Error("ipv6_prefix_match should default to false")
+	}
+
+	for _, bad := range []string{
+		"client_identification:\n  clients:\n    - name: a\n      cidrs: [\"192.168.20.0\"]\n",
+		"client_identification:\n  clients:\n    - name: a\n      macs: [\"aa:bb:cc\"]\n",
+		"client_identification:\n  clients:\n    - name: a\n      macs: [\"aa:bb:cc:dd:ee:ff\"]\n    - name: b\n      macs: [\"AA:BB:CC:DD:EE:FF\"]\n",
+	} {
+		if _, err := LoadWithFiles(defaultPath, writeTempConfig(t, []byte(bad))); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestACLConfig(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+`))
+	cfg, err := LoadWithFiles(defaultPath, "")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.ACL.Enabled == nil || *cfg.ACL.Enabled {
+		t.Fatalf("expected acl to be disabled by default, got %v", cfg.ACL.Enabled)
+	}
+	if cfg.ACL.DefaultAction != "refuse" {
+		t.Fatalf("expected default_action refuse by default, got %q", cfg.ACL.DefaultAction)
+	}
+
+	for _, tc := range []struct{ in, want string }{
+		{"refuse", "refuse"},
+		{"drop", "drop"},
+		{" DROP ", "drop"},
+	} {
+		overridePath := writeTempConfig(t, []byte(`
+acl:
+  enabled: true
+  allow: [" 192.168.0.0/16 ", "::1"]
+  deny: ["192.168.50.0/24"]
+  allow_groups: [" roaming "]
+  deny_groups: ["guest"]
+  default_action: "`+tc.in+`"
+`))
+		cfg, err := LoadWithFiles(defaultPath, overridePath)
+		if err != nil {
+			t.Fatalf("Load with default_action %q: %v", tc.in, err)
+		}
+		if cfg.ACL.DefaultAction != tc.want {
+			t.Errorf("default_action %q = %q, want %q", tc.in, cfg.ACL.DefaultAction, tc.want)
+		}
+		if cfg.ACL.Allow[0] != "192.168.0.0/16" || cfg.ACL.AllowGroups[0] != "roaming" {
+			t.Errorf("expected trimmed acl entries, got %+v", cfg.ACL)
+		}
+	}
+
+	for _, bad := range []string{
+		"acl:\n  default_action: reject\n",      // unknown action
+		"acl:\n  allow: [\"192.168.0.0/33\"]\n", // invalid CIDR
+		"acl:\n  deny: [\"not-an-ip\"]\n",       // neither IP nor CIDR
+		"acl:\n  deny_groups: [\" \"]\n",        // empty group ID
+	} {
+		overridePath := writeTempConfig(t, []byte(bad))
+		if _, err := LoadWithFiles(defaultPath, overridePath); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -74,6 +74,29 @@ func handleClientGroupsList(w http.ResponseWriter, configPath string) {
 		if g.DisableCache != nil {
 			grp["disable_cache"] = *g.DisableCache
 		}
+		if g.DNS64 != nil {
+			grp["dns64"] = map[string]any{
+				"enabled": g.DNS64.Enabled,
+				"prefix":  g.DNS64.Prefix,
+			}
+		}
+		if g.RateLimit != nil {
+			grp["rate_limit"] = map[string]any{
+				"enabled":   g.RateLimit.Enabled,
+				"udp_qps":   g.RateLimit.UDPQPS,
+				"udp_burst": g.RateLimit.UDPBurst,
+				"tcp_qps":   g.RateLimit.TCPQPS,
+				"tcp_burst": g.RateLimit.TCPBurst,
+				"action":    g.RateLimit.Action,
+			}
+		}
+		if g.Response != nil {
+			grp["response"] = map[string]any{
+				"blocked":      g.Response.Blocked,
+				"blocked_ipv4": g.Response.BlockedIPv4,
+				"blocked_ipv6": g.Response.BlockedIPv6,
+			}
+		}
 		groups = append(groups, grp)
 	}
 	writeJSON(w, http.StatusOK, map[string]any{"client_groups": groups})
@@ -107,6 +130,9 @@ func handleClientGroupsCreateOrUpdate(w http.ResponseWriter, r *http.Request, re
 		Blocklist    map[string]any `json:"blocklist"`
 		SafeSearch   map[string]any `json:"safe_search"`
 		DisableCache *bool          `json:"disable_cache"`
+		DNS64        map[string]any `json:"dns64"`
+		RateLimit    map[string]any `json:"rate_limit"`
+		Response     map[string]any `json:"response"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid JSON: " + err.Error()})
@@ -140,14 +166,14 @@ func handleClientGroupsCreateOrUpdate(w http.ResponseWriter, r *http.Request, re
 		}
 		id, _ := m["id"].(string)
 		if id == body.ID {
-			groups = append(groups, buildGroupMap(body.ID, body.Name, body.Description, body.Blocklist, body.SafeSearch, body.DisableCache))
+			groups = append(groups, buildGroupMap(body.ID, body.Name, body.Description, body.Blocklist, body.SafeSearch, body.DisableCache, body.DNS64, body.RateLimit, body.Response))
 			found = true
 		} else {
 			groups = append(groups, m)
 		}
 	}
 	if !found {
-		groups = append(groups, buildGroupMap(body.ID, body.Name, body.Description, body.Blocklist, body.SafeSearch, body.DisableCache))
+		groups = append(groups, buildGroupMap(body.ID, body.Name, body.Description, body.Blocklist, body.SafeSearch, body.DisableCache, body.DNS64, body.RateLimit, body.Response))
 	}
 	override["client_groups"] = groups
 	if err := config.WriteOverrideMap(configPath, override); err != nil {
@@ -157,7 +183,7 @@ func handleClientGroupsCreateOrUpdate(w http.ResponseWriter, r *http.Request, re
 	reloadClientGroups(w, resolver, configPath)
 }
 
-func buildGroupMap(id, name, desc string, blocklist, safeSearch map[string]any, disableCache *bool) map[string]any {
+func buildGroupMap(id, name, desc string, blocklist, safeSearch map[string]any, disableCache *bool, dns64, rateLimit, response map[string]any) map[string]any {
 	m := map[string]any{"id": id, "name": name, "description": desc}
 	if len(blocklist) > 0 {
 		m["blocklist"] = blocklist
@@ -168,6 +194,15 @@ func buildGroupMap(id, name, desc string, blocklist, safeSearch map[string]any,
 	if disableCache != nil {
 		m["disable_cache"] = *disableCache
 	}
+	if len(dns64) > 0 {
+		m["dns64"] = dns64
+	}
+	if len(rateLimit) > 0 {
+		m["rate_limit"] = rateLimit
+	}
+	if len(response) > 0 {
+		m["response"] = response
+	}
 	return m
 }
 
@@ -226,6 +261,9 @@ func reloadClientGroups(w http.ResponseWriter, resolver *dnsresolver.Resolver, c
 		resolver.ApplyBlocklistConfig(context.Background(), cfg)
 		resolver.ApplySafeSearchConfig(cfg)
 		resolver.ApplyGroupCacheControl(cfg)
+		resolver.ApplyDNS64Config(cfg)
+		resolver.ApplyRateLimitConfig(cfg)
+		resolver.ApplyResponseConfig(cfg)
 	}
 	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 }
@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
 
+	"github.com/tternquist/beyond-ads-dns/internal/clientid"
 	"github.com/tternquist/beyond-ads-dns/internal/config"
 	"github.com/tternquist/beyond-ads-dns/internal/dnsresolver"
 )
@@ -33,7 +36,8 @@ func handleClientsCRUD(resolver *dnsresolver.Resolver, configPath, token string)
 	}
 }
 
-// handleClientsDeleteHandler returns handler for DELETE /clients/{ip} (Phase 6).
+// handleClientsDeleteHandler returns handler for DELETE /clients/{ip} (Phase 6), or
+// /clients/{name} for clients without ip (identified by ids, cidrs or macs).
 func handleClientsDeleteHandler(resolver *dnsresolver.Resolver, configPath, token string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if token != "" && !authorize(token, r) {
@@ -60,16 +64,26 @@ func handleClientsList(w http.ResponseWriter, configPath string) {
 	}
 	clients := make([]map[string]any, 0, len(cfg.ClientIdentification.Clients))
 	for _, e := range cfg.ClientIdentification.Clients {
-		clients = append(clients, map[string]any{"ip": e.IP, "name": e.Name, "group_id": e.GroupID})
+		clients = append(clients, map[string]any{
+			"ip":       e.IP,
+			"name":     e.Name,
+			"group_id": e.GroupID,
+			"ids":      nonNilStrings(e.IDs),
+			"cidrs":    nonNilStrings(e.CIDRs),
+			"macs":     nonNilStrings(e.MACs),
+		})
 	}
 	writeJSON(w, http.StatusOK, map[string]any{"clients": clients})
 }
 
 func handleClientsCreateOrUpdate(w http.ResponseWriter, r *http.Request, resolver *dnsresolver.Resolver, configPath string) {
 	var body struct {
-		IP      string `json:"ip"`
-		Name    string `json:"name"`
-		GroupID string `json:"group_id"`
+		IP      string   `json:"ip"`
+		Name    string   `json:"name"`
+		GroupID string   `json:"group_id"`
+		IDs     []string `json:"ids"`
+		CIDRs   []string `json:"cidrs"`
+		MACs    []string `json:"macs"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid JSON: " + err.Error()})
@@ -78,10 +92,64 @@ func handleClientsCreateOrUpdate(w http.ResponseWriter, r *http.Request, resolve
 	body.IP = strings.TrimSpace(body.IP)
 	body.Name = strings.TrimSpace(body.Name)
 	body.GroupID = strings.TrimSpace(body.GroupID)
-	if body.IP == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "ip is required"})
+	ids := make([]any, 0, len(body.IDs))
+	for _, raw := range body.IDs {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		id, ok := clientid.NormalizeID(raw)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid client id " + strconv.Quote(raw) + ": use 1-63 letters, digits, '-' or '_'"})
+			return
+		}
+		ids = append(ids, id)
+	}
+	cidrs := make([]any, 0, len(body.CIDRs))
+	for _, raw := range body.CIDRs {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		pfx, err := netip.ParsePrefix(raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid cidr " + strconv.Quote(raw) + " (e.g. 192.168.20.0/24)"})
+			return
+		}
+		cidrs = append(cidrs, pfx.Masked().String())
+	}
+	macs := make([]any, 0, len(body.MACs))
+	for _, raw := range body.MACs {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		mac, ok := clientid.NormalizeMAC(raw)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid mac " + strconv.Quote(raw) + " (e.g. aa:bb:cc:dd:ee:ff)"})
+			return
+		}
+		macs = append(macs, mac)
+	}
+	if body.IP == "" && len(ids) == 0 && len(cidrs) == 0 && len(macs) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "ip, ids, cidrs or macs is required"})
 		return
 	}
+	if body.IP == "" && body.Name == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "name is required for clients without ip"})
+		return
+	}
+	entry := map[string]any{"ip": body.IP, "name": body.Name, "group_id": body.GroupID}
+	if len(ids) > 0 {
+		entry["ids"] = ids
+	}
+	if len(cidrs) > 0 {
+		entry["cidrs"] = cidrs
+	}
+	if len(macs) > 0 {
+		entry["macs"] = macs
+	}
+	key := body.IP
+	if key == "" {
+		key = body.Name
+	}
 	override, err := config.ReadOverrideMap(configPath)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
@@ -95,14 +163,14 @@ func handleClientsCreateOrUpdate(w http.ResponseWriter, r *http.Request, resolve
 	clients := normalizeClientsToList(ci["clients"])
 	found := false
 	for i, c := range clients {
-		if getClientIP(c) == body.IP {
-			clients[i] = map[string]any{"ip": body.IP, "name": body.Name, "group_id": body.GroupID}
+		if clientKey(c) == key {
+			clients[i] = entry
 			found = true
 			break
 		}
 	}
 	if !found {
-		clients = append(clients, map[string]any{"ip": body.IP, "name": body.Name, "group_id": body.GroupID})
+		clients = append(clients, entry)
 	}
 	ci["clients"] = clients
 	if err := config.WriteOverrideMap(configPath, override); err != nil {
@@ -119,6 +187,23 @@ func getClientIP(m map[string]any) string {
 	return ""
 }
 
+// nonNilStrings returns s, or an empty slice so that JSON lists are never null.
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// clientKey identifies a client entry: its IP, or its name for clients without one.
+func clientKey(m map[string]any) string {
+	if ip := getClientIP(m); ip != "" {
+		return ip
+	}
+	name, _ := m["name"].(string)
+	return name
+}
+
 // normalizeClientsToList converts clients from legacy map or list format to list of map[string]any.
 func normalizeClientsToList(raw any) []map[string]any {
 	if raw == nil {
@@ -154,7 +239,7 @@ func handleClientsDelete(w http.ResponseWriter, r *http.Request, resolver *dnsre
 	}
 	ip = strings.TrimSpace(ip)
 	if ip == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "client IP required (e.g. /clients/192.168.1.10)"})
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "client IP required (e.g. /clients/192.168.1.10), or the name of a client without ip"})
 		return
 	}
 	override, err := config.ReadOverrideMap(configPath)
@@ -170,7 +255,7 @@ func handleClientsDelete(w http.ResponseWriter, r *http.Request, resolver *dnsre
 	clients := normalizeClientsToList(ci["clients"])
 	filtered := make([]map[string]any, 0, len(clients))
 	for _, c := range clients {
-		if getClientIP(c) != ip {
+		if clientKey(c) != ip {
 			filtered = append(filtered, c)
 		}
 	}
@@ -248,6 +248,96 @@ func TestHandleClientsCreateOrUpdate_UpdatesExistingClient(t *testing.T) {
 	}
 }
 
+func TestHandleClientsCreateOrUpdate_ClientIDs(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`server:
+  listen: ["127.0.0.1:53"]
+`))
+	os.Setenv("DEFAULT_CONFIG_PATH", defaultPath)
+	defer os.Unsetenv("DEFAULT_CONFIG_PATH")
+
+	cfgPath := writeTempConfig(t, []byte(``))
+	handler := handleClientsCRUD(nil, cfgPath, "")
+	deleteHandler := handleClientsDeleteHandler(nil, cfgPath, "")
+
+	// A client without IP, identified by its DoH/DoT client ID; posting again updates it.
+	for _, payload := range []string{
+		`{"name": "Kids Phone", "group_id": "kids", "ids": ["Kids-Phone"]}`,
+		`{"name": "Kids Phone", "group_id": "kids", "ids": ["kids-phone", "kids-tablet"]}`,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/clients", bytes.NewBufferString(payload)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	getRec := httptest.NewRecorder()
+	handler.ServeHTTP(getRec, httptest.NewRequest(http.MethodGet, "/clients", nil))
+	var getBody struct {
+		Clients []struct {
+			IP  string   `json:"ip"`
+			IDs []string `json:"ids"`
+		} `json:"clients"`
+	}
+	if err := json.NewDecoder(getRec.Body).Decode(&getBody); err != nil {
+		t.Fatalf("decode GET response: %v", err)
+	}
+	if len(getBody.Clients) != 1 || len(getBody.Clients[0].IDs) != 2 || getBody.Clients[0].IDs[0] != "kids-phone" {
+		t.Fatalf("clients = %+v, want one client with 2 ids", getBody.Clients)
+	}
+
+	delRec := httptest.NewRecorder()
+	deleteHandler.ServeHTTP(delRec, httptest.NewRequest(http.MethodDelete, "/clients/Kids%20Phone", nil))
+	if delRec.Code != http.StatusOK {
+		t.Fatalf("delete by name: %d %s", delRec.Code, delRec.Body.String())
+	}
+	getRec = httptest.NewRecorder()
+	handler.ServeHTTP(getRec, httptest.NewRequest(http.MethodGet, "/clients", nil))
+	if err := json.NewDecoder(getRec.Body).Decode(&getBody); err != nil || len(getBody.Clients) != 0 {
+		t.Errorf("clients after delete = %+v (%v)", getBody.Clients, err)
+	}
+}
+
+func TestHandleClientsCreateOrUpdate_RangesAndMACs(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`server:
+  listen: ["127.0.0.1:53"]
+`))
+	os.Setenv("DEFAULT_CONFIG_PATH", defaultPath)
+	defer os.Unsetenv("DEFAULT_CONFIG_PATH")
+
+	cfgPath := writeTempConfig(t, []byte(``))
+	handler := handleClientsCRUD(nil, cfgPath, "")
+
+	for _, tc := range []struct {
+		payload string
+		want    int
+	}{
+		{`{"name": "Kids VLAN", "group_id": "kids", "cidrs": ["192.168.20.1/24"], "macs": ["AA-BB-CC-DD-EE-FF"]}`, http.StatusOK},
+		{`{"name": "Bad", "cidrs": ["192.168.20.0"]}`, http.StatusBadRequest},
+		{`{"name": "Bad", "macs": ["aa:bb"]}`, http.StatusBadRequest},
+		{`{"cidrs": ["10.0.0.0/8"]}`, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/clients", bytes.NewBufferString(tc.payload)))
+		if rec.Code != tc.want {
+			t.Errorf("POST %s: got %d, want %d: %s", tc.payload, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+	getRec := httptest.NewRecorder()
+	handler.ServeHTTP(getRec, httptest.NewRequest(http.MethodGet, "/clients", nil))
+	var getBody struct {
+		Clients []struct {
+			CIDRs []string `json:"cidrs"`
+			MACs  []string `json:"macs"`
+		} `json:"clients"`
+	}
+	if err := json.NewDecoder(getRec.Body).Decode(&getBody); err != nil {
+		t.Fatalf("decode GET response: %v", err)
+	}
+	if len(getBody.Clients) != 1 || getBody.Clients[0].CIDRs[0] != "192.168.20.0/24" || getBody.Clients[0].MACs[0] != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("clients = %+v, want the masked range and normalized MAC", getBody.Clients)
+	}
+}
+
 // --- handleClientsDeleteHandler ---
 
 func TestHandleClientsDelete_MethodNotAllowed(t *testing.T) {
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strings"
@@ -453,6 +454,54 @@ func TestHandleBlockedCheck(t *testing.T) {
 	}
 }
 
+func TestHandleBlockedCheckIP(t *testing.T) {
+	blCfg := config.BlocklistConfig{
+		Sources:   []config.BlocklistSource{},
+		Allowlist: []string{"203.0.113.10"},
+		Denylist:  []string{"203.0.113.0/24"},
+	}
+	manager := blocklist.NewManager(blCfg, logging.NewDiscardLogger())
+	if err := manager.LoadOnce(nil); err != nil {
+		t.Fatalf("LoadOnce: %v", err)
+	}
+	handler := handleBlockedCheck(manager, "")
+
+	tests := []struct {
+		ip     string
+		code   int
+		want   bool
+		prefix string
+	}{
+		{"203.0.113.5", http.StatusOK, true, "203.0.113.0/24"},
+		{"203.0.113.10", http.StatusOK, false, ""},
+		{"192.0.2.1", http.StatusOK, false, ""},
+		{"not-an-ip", http.StatusBadRequest, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/blocked/check?ip="+tt.ip, nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("expected %d, got %d: %s", tt.code, rec.Code, rec.Body.String())
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var body map[string]any
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got, ok := body["blocked"].(bool); !ok || got != tt.want {
+				t.Errorf("blocked = %v, want %v", body["blocked"], tt.want)
+			}
+			if tt.prefix != "" && (body["prefix"] != tt.prefix || body["source"] != "denylist") {
+				t.Errorf("prefix = %v, source = %v; want %s from denylist", body["prefix"], body["source"], tt.prefix)
+			}
+		})
+	}
+}
+
 func TestExtractSyncToken(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -1046,6 +1095,9 @@ func TestHandleUpstreams_WithResolver(t *testing.T) {
 		Server:           config.ServerConfig{Listen: []string{"127.0.0.1:53"}},
 		Upstreams:        []config.UpstreamConfig{{Name: "cloudflare", Address: "1.1.1.1:53"}, {Name: "google", Address: "8.8.8.8:53"}},
 		ResolverStrategy: "failover",
+		UpstreamRoutes: []config.UpstreamRouteConfig{
+			{Suffixes: []string{"corp.example.com", "home.arpa"}, Upstreams: []config.UpstreamConfig{{Name: "corp", Address: "10.0.0.53:53"}}, Strategy: "failover"},
+		},
 		Blocklists:       blCfg,
 		Cache: config.CacheConfig{
 			MinTTL:      config.Duration{Duration: 5 * time.Minute},
@@ -1078,6 +1130,121 @@ func TestHandleUpstreams_WithResolver(t *testing.T) {
 	if !ok || len(upstreams) != 2 {
 		t.Errorf("expected 2 upstreams, got %v", body)
 	}
+	routes, ok := body["upstream_routes"].([]any)
+	if !ok || len(routes) != 1 {
+		t.Fatalf("expected 1 upstream route, got %v", body["upstream_routes"])
+	}
+	route, _ := routes[0].(map[string]any)
+	if suffixes, _ := route["suffixes"].([]any); len(suffixes) != 2 || suffixes[0] != "corp.example.com" {
+		t.Errorf("unexpected route suffixes: %v", route)
+	}
+	if routeUpstreams, _ := route["upstreams"].([]any); len(routeUpstreams) != 1 {
+		t.Errorf("unexpected route upstreams: %v", route)
+	}
+}
+
+func TestHandleRateLimitClientsAndReload(t *testing.T) {
+	handler := handleRateLimitClients(nil, "")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rate-limit/clients", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"enabled":false`) {
+		t.Fatalf("nil resolver: got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rate-limit/clients", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: expected 405, got %d", rec.Code)
+	}
+
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+blocklists:
+  sources: []
+`))
+	configPath := writeTempConfig(t, []byte(`
+rate_limit:
+  enabled: true
+  udp_qps: 10
+`))
+	os.Setenv("DEFAULT_CONFIG_PATH", defaultPath)
+	defer os.Unsetenv("DEFAULT_CONFIG_PATH")
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	cfg.RateLimit.Enabled = ptr(false)
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	reqLog := requestlog.NewWriter(&bytes.Buffer{}, "text")
+	resolver := dnsresolver.New(cfg, cache.NewMockCache(), localrecords.New(nil, logging.NewDiscardLogger()), blMgr, logging.NewDiscardLogger(), reqLog, nil)
+	if _, enabled := resolver.RateLimitedClients(); enabled {
+		t.Fatal("expected rate limiting to start disabled")
+	}
+
+	rec = httptest.NewRecorder()
+	handleRateLimitReload(resolver, configPath, "").ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rate-limit/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reload: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handleRateLimitClients(resolver, "").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rate-limit/clients", nil))
+	var body map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body["enabled"] != true {
+		t.Errorf("expected enabled after reload, got %v", body)
+	}
+	if clients, ok := body["clients"].([]any); !ok || len(clients) != 0 {
+		t.Errorf("expected empty client list, got %v", body["clients"])
+	}
+}
+
+func TestHandleACLReload(t *testing.T) {
+	defaultPath := writeTempConfig(t, []byte(`
+server:
+  listen: ["127.0.0.1:53"]
+blocklists:
+  sources: []
+`))
+	configPath := writeTempConfig(t, []byte(`
+acl:
+  enabled: true
+  allow: ["10.0.0.0/8"]
+`))
+	os.Setenv("DEFAULT_CONFIG_PATH", defaultPath)
+	defer os.Unsetenv("DEFAULT_CONFIG_PATH")
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	cfg.ACL.Enabled = ptr(false)
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	reqLog := requestlog.NewWriter(&bytes.Buffer{}, "text")
+	resolver := dnsresolver.New(cfg, cache.NewMockCache(), localrecords.New(nil, logging.NewDiscardLogger()), blMgr, logging.NewDiscardLogger(), reqLog, nil)
+	public := netip.MustParseAddr("192.0.2.1")
+	if !resolver.AllowsClient(public) {
+		t.Fatal("expected the ACL to start disabled")
+	}
+
+	rec := httptest.NewRecorder()
+	handleACLReload(resolver, configPath, "").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/acl/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected 405, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handleACLReload(resolver, configPath, "").ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/acl/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reload: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resolver.AllowsClient(public) {
+		t.Error("expected 192.0.2.1 to be denied after reload")
+	}
+	if !resolver.AllowsClient(netip.MustParseAddr("10.1.2.3")) {
+		t.Error("expected 10.1.2.3 to be allowed after reload")
+	}
 }
 
 func ptr(b bool) *bool {
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/pprof"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -71,6 +72,9 @@ func Start(cfg Config) *http.Server {
 	mux.HandleFunc("/local-records/reload", rateLimitHandler(handleLocalRecordsReload(cfg.LocalRecords, cfg.ConfigPath, token), rate.Every(10*time.Second), 2))
 	mux.HandleFunc("/upstreams", handleUpstreams(cfg.Resolver, token))
 	mux.HandleFunc("/upstreams/reload", rateLimitHandler(handleUpstreamsReload(cfg.Resolver, cfg.ConfigPath, token), rate.Every(10*time.Second), 2))
+	mux.HandleFunc("/rate-limit/clients", handleRateLimitClients(cfg.Resolver, token))
+	mux.HandleFunc("/rate-limit/reload", rateLimitHandler(handleRateLimitReload(cfg.Resolver, cfg.ConfigPath, token), rate.Every(10*time.Second), 2))
+	mux.HandleFunc("/acl/reload", rateLimitHandler(handleACLReload(cfg.Resolver, cfg.ConfigPath, token), rate.Every(10*time.Second), 2))
 	mux.HandleFunc("/response/reload", rateLimitHandler(handleResponseReload(cfg.Resolver, cfg.ConfigPath, token), rate.Every(10*time.Second), 2))
 	mux.HandleFunc("/safe-search/reload", rateLimitHandler(handleSafeSearchReload(cfg.Resolver, cfg.ConfigPath, token), rate.Every(10*time.Second), 2))
 	mux.HandleFunc("/client-identification/reload", rateLimitHandler(handleClientIdentificationReload(cfg.Resolver, cfg.ConfigPath, token), rate.Every(10*time.Second), 2))
@@ -519,9 +523,23 @@ func handleBlockedCheck(manager *blocklist.Manager, token string) http.HandlerFu
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		if ipParam := strings.TrimSpace(r.URL.Query().Get("ip")); ipParam != "" {
+			addr, err := netip.ParseAddr(ipParam)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid ip parameter"})
+				return
+			}
+			match, blocked := manager.MatchIP(addr)
+			if !blocked {
+				writeJSON(w, http.StatusOK, map[string]any{"blocked": false})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"blocked": true, "prefix": match.Prefix.String(), "source": match.Source})
+			return
+		}
 		domain := strings.TrimSpace(r.URL.Query().Get("domain"))
 		if domain == "" {
-			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "domain parameter required"})
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "domain or ip parameter required"})
 			return
 		}
 		blocked := manager.IsBlocked(domain)
@@ -580,15 +598,64 @@ func handleUpstreams(resolver *dnsresolver.Resolver, token string) http.HandlerF
 			return
 		}
 		if resolver == nil {
-			writeJSON(w, http.StatusOK, map[string]any{"upstreams": []any{}, "resolver_strategy": "failover"})
+			writeJSON(w, http.StatusOK, map[string]any{"upstreams": []any{}, "resolver_strategy": "failover", "upstream_routes": []any{}})
 			return
 		}
 		upstreams, strategy := resolver.UpstreamConfig()
+		var race map[string]dnsresolver.UpstreamRaceStats
+		if strategy == dnsresolver.StrategyRace {
+			race = resolver.UpstreamRaceStats()
+		}
+		var weighted map[string]dnsresolver.UpstreamScore
+		if strategy == dnsresolver.StrategyWeighted {
+			weighted = resolver.UpstreamScores()
+		}
+		health := resolver.UpstreamHealth()
+		doh := resolver.DoHStats()
 		list := make([]map[string]any, len(upstreams))
 		for i, u := range upstreams {
 			list[i] = map[string]any{"name": u.Name, "address": u.Address, "protocol": u.Protocol}
+			if race != nil {
+				list[i]["race"] = race[u.Address]
+			}
+			if weighted != nil {
+				list[i]["weighted"] = weighted[u.Address]
+			}
+			if health != nil {
+				list[i]["health"] = health[u.Address]
+			}
+			if limit := u.Limit(); limit != nil {
+				list[i]["limit"] = limit
+			}
+			if stats, ok := doh[dnsresolver.DoHTransportKey(u)]; ok {
+				list[i]["doh"] = stats
+			}
 		}
-		writeJSON(w, http.StatusOK, map[string]any{"upstreams": list, "resolver_strategy": strategy})
+		routes := resolver.UpstreamRoutes()
+		routeList := make([]map[string]any, len(routes))
+		for i, route := range routes {
+			routeUpstreams := make([]map[string]any, len(route.Upstreams))
+			for j, u := range route.Upstreams {
+				routeUpstreams[j] = map[string]any{"name": u.Name, "address": u.Address, "protocol": u.Protocol}
+				if route.Race != nil {
+					routeUpstreams[j]["race"] = route.Race[u.Address]
+				}
+				if route.Weighted != nil {
+					routeUpstreams[j]["weighted"] = route.Weighted[u.Address]
+				}
+				if route.Health != nil {
+					routeUpstreams[j]["health"] = route.Health[u.Address]
+				}
+				if limit := u.Limit(); limit != nil {
+					routeUpstreams[j]["limit"] = limit
+				}
+				if stats, ok := doh[dnsresolver.DoHTransportKey(u)]; ok {
+					routeUpstreams[j]["doh"] = stats
+				}
+			}
+			routeList[i] = map[string]any{"suffixes": route.Suffixes, "upstreams": routeUpstreams, "strategy": route.Strategy}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"upstreams": list, "resolver_strategy": strategy, "upstream_routes": routeList})
 	}
 }
 
@@ -613,6 +680,78 @@ func handleUpstreamsReload(resolver *dnsresolver.Resolver, configPath, token str
 	}
 }
 
+func handleRateLimitClients(resolver *dnsresolver.Resolver, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && !authorize(token, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if resolver == nil {
+			writeJSON(w, http.StatusOK, map[string]any{"enabled": false, "clients": []any{}})
+			return
+		}
+		clients, enabled := resolver.RateLimitedClients()
+		list := make([]map[string]any, len(clients))
+		for i, c := range clients {
+			list[i] = map[string]any{
+				"client":       c.Client,
+				"protocol":     c.Protocol,
+				"group_id":     c.GroupID,
+				"action":       c.Action,
+				"limited":      c.Limited,
+				"last_limited": c.LastLimited.UTC().Format(time.RFC3339),
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"enabled": enabled, "clients": list})
+	}
+}
+
+func handleRateLimitReload(resolver *dnsresolver.Resolver, configPath, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && !authorize(token, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		cfg, ok := loadConfigForReload(w, configPath)
+		if !ok {
+			return
+		}
+		if resolver != nil {
+			resolver.ApplyRateLimitConfig(cfg)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	}
+}
+
+func handleACLReload(resolver *dnsresolver.Resolver, configPath, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && !authorize(token, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		cfg, ok := loadConfigForReload(w, configPath)
+		if !ok {
+			return
+		}
+		if resolver != nil {
+			resolver.ApplyACLConfig(cfg)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	}
+}
+
 func handleResponseReload(resolver *dnsresolver.Resolver, configPath, token string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -673,6 +812,9 @@ func handleClientIdentificationReload(resolver *dnsresolver.Resolver, configPath
 			resolver.ApplyClientIdentificationConfig(cfg)
 			resolver.ApplyBlocklistConfig(r.Context(), cfg)
 			resolver.ApplyGroupCacheControl(cfg)
+			resolver.ApplyDNS64Config(cfg)
+			resolver.ApplyRateLimitConfig(cfg)
+			resolver.ApplyResponseConfig(cfg)
 		}
 		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 	}
@@ -0,0 +1,153 @@
+package dnsresolver
+
+import (
+	"net/netip"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/metrics"
+)
+
+// ACL actions for acl.default_action.
+const (
+	ACLActionRefuse = "refuse"
+	ACLActionDrop   = "drop"
+)
+
+// aclEntry is one allow or deny range.
+type aclEntry struct {
+	prefix netip.Prefix
+	allow  bool
+}
+
+// aclPolicy decides which clients may query (acl). Address entries are few, so they are
+// scanned for the most specific match; group lookups only happen when groups are listed.
+type aclPolicy struct {
+	entries     []aclEntry
+	allowGroups map[string]bool
+	denyGroups  map[string]bool
+	// allowAll: no allow entries, so any client not denied may query.
+	allowAll bool
+	drop     bool
+}
+
+// newACLPolicy returns the policy for cfg, or nil when the ACL is disabled.
+func newACLPolicy(cfg config.ACLConfig) *aclPolicy {
+	if cfg.Enabled == nil || !*cfg.Enabled {
+		return nil
+	}
+	p := &aclPolicy{
+		allowGroups: make(map[string]bool),
+		denyGroups:  make(map[string]bool),
+		drop:        cfg.DefaultAction == ACLActionDrop,
+	}
+	// Deny entries go first, so a range listed in both is denied.
+	for _, list := range []struct {
+		entries []string
+		allow   bool
+	}{{cfg.Deny, false}, {cfg.Allow, true}} {
+		for _, s := range list.entries {
+			if pfx, ok := parseACLPrefix(s); ok {
+				p.entries = append(p.entries, aclEntry{prefix: pfx, allow: list.allow})
+			}
+		}
+	}
+	for _, id := range cfg.AllowGroups {
+		p.allowGroups[id] = true
+	}
+	for _, id := range cfg.DenyGroups {
+		p.denyGroups[id] = true
+	}
+	p.allowAll = len(cfg.Allow) == 0 && len(cfg.AllowGroups) == 0
+	return p
+}
+
+func parseACLPrefix(s string) (netip.Prefix, bool) {
+	if pfx, err := netip.ParsePrefix(s); err == nil {
+		return pfx.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+// match returns whether the most specific entry containing addr allows it, and false for
+// found when no entry contains addr.
+func (p *aclPolicy) match(addr netip.Addr) (allow, found bool) {
+	bits := -1
+	for _, e := range p.entries {
+		if e.prefix.Bits() > bits && e.prefix.Contains(addr) {
+			allow, found, bits = e.allow, true, e.prefix.Bits()
+		}
+	}
+	return allow, found
+}
+
+// allowsAddr reports whether a client at addr may query as far as its address alone tells.
+// It is false only when the address is denied whatever the client's group, so transports
+// can reject connections before the TLS handshake.
+func (p *aclPolicy) allowsAddr(addr netip.Addr) bool {
+	if p == nil {
+		return true
+	}
+	addr = addr.Unmap()
+	if allow, found := p.match(addr); found {
+		return allow
+	}
+	return p.allowAll || len(p.allowGroups) > 0
+}
+
+// allows reports whether a query from addr by a client in groupID may be answered: members of
+// deny_groups are denied, then the most specific address entry decides, then allow_groups.
+// group is only called when groups are listed.
+func (p *aclPolicy) allows(addr netip.Addr, addrOK bool, group func() string) bool {
+	var groupID string
+	if len(p.denyGroups) > 0 || len(p.allowGroups) > 0 {
+		groupID = group()
+	}
+	if groupID != "" && p.denyGroups[groupID] {
+		return false
+	}
+	if addrOK {
+		if allow, found := p.match(addr.Unmap()); found {
+			return allow
+		}
+	}
+	if groupID != "" && p.allowGroups[groupID] {
+		return true
+	}
+	return p.allowAll
+}
+
+// aclReply checks the ACL for the query on w. When the client may not query it returns
+// denied=true and the reply to send (nil = drop). The client is the address the query arrived
+// from, not one claimed in ECS, so a forwarder cannot lift the ACL for its clients.
+func (r *Resolver) aclReply(p *aclPolicy, w dns.ResponseWriter, req *dns.Msg) (reply *dns.Msg, denied bool) {
+	addr, err := netip.ParseAddr(clientIPFromWriter(w))
+	if p.allows(addr, err == nil, func() string { return r.clientGroup(w) }) {
+		return nil, false
+	}
+	action := ACLActionRefuse
+	if p.drop {
+		action = ACLActionDrop
+	}
+	metrics.RecordACLDenied(action)
+	if !p.drop && req != nil {
+		reply = new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeRefused)
+	}
+	return reply, true
+}
+
+// AllowsClient reports whether the ACL lets a client at addr query, judging by its address
+// alone (see acl). DoT, DoQ and DoH use it to turn denied clients away before any query.
+func (r *Resolver) AllowsClient(addr netip.Addr) bool {
+	return r.acl.Load().allowsAddr(addr)
+}
+
+// ApplyACLConfig updates the access control lists at runtime (for hot-reload).
+func (r *Resolver) ApplyACLConfig(cfg config.Config) {
+	r.acl.Store(newACLPolicy(cfg.ACL))
+}
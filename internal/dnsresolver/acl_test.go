@@ -0,0 +1,126 @@
+package dnsresolver
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+func TestACLPolicy(t *testing.T) {
+	if p := newACLPolicy(config.ACLConfig{Enabled: ptr(false), Allow: []string{"10.0.0.0/8"}}); p != nil {
+		t.Fatal("disabled ACL should have no policy")
+	}
+	p := newACLPolicy(config.ACLConfig{
+		Enabled:     ptr(true),
+		Allow:       []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.10"},
+		Deny:        []string{"10.1.0.0/16", "192.168.1.10"},
+		AllowGroups: []string{"roaming"},
+		DenyGroups:  []string{"banned"},
+	})
+	group := func(id string) func() string { return func() string { return id } }
+	for _, tc := range []struct {
+		name, addr, group string
+		want              bool
+	}{
+		{"allowed range", "10.2.3.4", "", true},
+		{"IPv4-mapped", "::ffff:10.2.3.4", "", true},
+		{"denied subnet of an allowed range", "10.1.2.3", "", false},
+		{"listed in both", "192.168.1.10", "", false},
+		{"IPv6 range", "2001:db8::1", "", true},
+		{"not listed", "192.0.2.1", "", false},
+		{"allowed group from anywhere", "192.0.2.1", "roaming", true},
+		{"allowed group from a denied range", "10.1.2.3", "roaming", false},
+		{"denied group in an allowed range", "10.2.3.4", "banned", false},
+	} {
+		if got := p.allows(netip.MustParseAddr(tc.addr), true, group(tc.group)); got != tc.want {
+			t.Errorf("%s: allows(%s, %q) = %v, want %v", tc.name, tc.addr, tc.group, got, tc.want)
+		}
+	}
+	// Connections are only turned away when no group could let the client in.
+	if !p.allowsAddr(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("allowsAddr: an unlisted address may belong to an allowed group")
+	}
+	if p.allowsAddr(netip.MustParseAddr("10.1.2.3")) {
+		t.Error("allowsAddr: a denied range should be rejected")
+	}
+
+	denyOnly := newACLPolicy(config.ACLConfig{Enabled: ptr(true), Deny: []string{"203.0.113.0/24"}})
+	if !denyOnly.allows(netip.MustParseAddr("192.0.2.1"), true, group("")) {
+		t.Error("without allow entries, clients not denied may query")
+	}
+	if denyOnly.allows(netip.MustParseAddr("203.0.113.9"), true, group("")) || denyOnly.allowsAddr(netip.MustParseAddr("203.0.113.9")) {
+		t.Error("denied range should be denied")
+	}
+	allowOnly := newACLPolicy(config.ACLConfig{Enabled: ptr(true), Allow: []string{"127.0.0.1"}})
+	if allowOnly.allowsAddr(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("allowsAddr: unlisted address without allow_groups should be rejected")
+	}
+	if allowOnly.allows(netip.Addr{}, false, group("")) {
+		t.Error("client without a usable address should be denied when allow entries exist")
+	}
+}
+
+func TestResolverACL(t *testing.T) {
+	cfg := minimalResolverConfig("https://invalid.invalid/dns-query")
+	cfg.ACL = config.ACLConfig{
+		Enabled:       ptr(true),
+		Allow:         []string{"192.168.0.0/16"},
+		AllowGroups:   []string{"family"},
+		DefaultAction: ACLActionRefuse,
+	}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{Name: "Phone", GroupID: "family", IDs: []string{"phone"}}},
+	}
+	cfg.ClientGroups = []config.ClientGroup{{ID: "family", Name: "Family"}}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+	logs := &captureLog{}
+	r.requestLogWriter = logs
+
+	w := &mockResponseWriter{remoteAddr: "203.0.113.9"}
+	r.ServeDNS(w, udpQuery("nas.home.arpa."))
+	if w.written == nil || w.written.Rcode != dns.RcodeRefused {
+		t.Fatalf("public client: response %v, want REFUSED", w.written)
+	}
+	entries := logs.wait(t, 1)
+	if entries[0].Outcome != "acl_denied" || entries[0].ClientIP != "203.0.113.9" {
+		t.Errorf("log entry = %+v, want outcome acl_denied for 203.0.113.9", entries[0])
+	}
+
+	// A client ID in an allowed group may query from anywhere.
+	cw := &clientIDMockWriter{mockResponseWriter: mockResponseWriter{remoteAddr: "203.0.113.9"}, id: "phone"}
+	r.ServeDNS(cw, udpQuery("nas.home.arpa."))
+	if cw.written == nil || cw.written.Rcode == dns.RcodeRefused {
+		t.Errorf("allowed group: response %v, want the query resolved", cw.written)
+	}
+
+	// ECS from an untrusted source cannot claim an allowed address.
+	ecsReq := queryWithECS("192.168.1.50/32")
+	ecsReq.SetQuestion("nas.home.arpa.", dns.TypeA)
+	w = &mockResponseWriter{remoteAddr: "203.0.113.9"}
+	r.ServeDNS(w, ecsReq)
+	if w.written == nil || w.written.Rcode != dns.RcodeRefused {
+		t.Errorf("ECS claim: response %v, want REFUSED", w.written)
+	}
+
+	cfg.ACL.DefaultAction = ACLActionDrop
+	r.ApplyACLConfig(cfg)
+	w = &mockResponseWriter{remoteAddr: "203.0.113.9"}
+	r.ServeDNS(w, udpQuery("nas.home.arpa."))
+	if w.written != nil {
+		t.Errorf("drop: response %v, want none", w.written)
+	}
+	w = &mockResponseWriter{remoteAddr: "192.168.1.20"}
+	r.ServeDNS(w, udpQuery("nas.home.arpa."))
+	if w.written == nil || w.written.Rcode == dns.RcodeRefused {
+		t.Errorf("LAN client: response %v, want the query resolved", w.written)
+	}
+
+	cfg.ACL.Enabled = ptr(false)
+	r.ApplyACLConfig(cfg)
+	if !r.AllowsClient(netip.MustParseAddr("203.0.113.9")) {
+		t.Error("disabling the ACL should allow every client")
+	}
+}
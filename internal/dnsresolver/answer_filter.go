@@ -0,0 +1,97 @@
+package dnsresolver
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/metrics"
+	"github.com/tternquist/beyond-ads-dns/internal/tracelog"
+)
+
+// blockedAnswerIP returns the first A or AAAA record in resp's answer section whose address
+// falls in a blocked range for the client, formatted as "owner A addr in prefix (source)", and
+// the list that blocked it, or "" when there is none. Synthesized DNS64 answers are matched on the embedded IPv4 address
+// too. A query name on the allowlist is trusted along with its addresses.
+func (r *Resolver) blockedAnswerIP(w dns.ResponseWriter, qname string, resp *dns.Msg) (string, string) {
+	if resp == nil || len(resp.Answer) == 0 {
+		return "", ""
+	}
+	blMgr := r.blocklistForClient(w)
+	if blMgr == nil {
+		return "", ""
+	}
+	checked := false
+	dns64Checked := false
+	var dns64Prefix netip.Prefix
+	for _, rr := range resp.Answer {
+		var addr netip.Addr
+		switch v := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(v.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(v.AAAA.To16())
+		default:
+			continue
+		}
+		if !checked {
+			if blMgr.IsAllowed(qname) {
+				return "", ""
+			}
+			checked = true
+		}
+		match, ok := blMgr.MatchIP(addr)
+		if !ok && rr.Header().Rrtype == dns.TypeAAAA {
+			if !dns64Checked {
+				if p, enabled := r.dns64PrefixFor(w); enabled {
+					dns64Prefix = p
+				}
+				dns64Checked = true
+			}
+			if dns64Prefix.IsValid() && dns64Prefix.Contains(addr) {
+				match, ok = blMgr.MatchIP(embeddedIPv4(dns64Prefix, addr))
+			}
+		}
+		if ok {
+			link := normalizeQueryName(rr.Header().Name) + " " + dns.TypeToString[rr.Header().Rrtype] + " " + addr.String() + " in " + match.Prefix.String()
+			if match.Source != "" {
+				link += " (" + match.Source + ")"
+			}
+			return link, match.Source
+		}
+	}
+	return "", ""
+}
+
+// serveBlockedAnswer answers with the blocked reply when resp (from upstream or cache) has a
+// CNAME chain leading to a blocked name (outcome blocked_cname) or an address in a blocked
+// range (outcome blocked_ip). The matching record is logged in blocked_by and the list is sent
+// as EDE extra text. It reports whether the query was answered.
+func (r *Resolver) serveBlockedAnswer(w dns.ResponseWriter, req *dns.Msg, question dns.Question, resp *dns.Msg, start time.Time, upstreamAddr string) bool {
+	qname := normalizeQueryName(question.Name)
+	outcome := "blocked_cname"
+	blockedBy, list := r.cnameCloakedLink(w, qname, resp)
+	if blockedBy == "" {
+		outcome = "blocked_ip"
+		blockedBy, list = r.blockedAnswerIP(w, qname, resp)
+	}
+	if blockedBy == "" {
+		return false
+	}
+	metrics.RecordBlocked()
+	clientAddr := clientIPFromWriter(w)
+	for _, n := range r.webhookOnBlock {
+		n.FireOnBlock(qname, clientAddr)
+	}
+	response := r.blockedReply(w, req, question)
+	addEDE(response, req, r.blockEDECode(r.blocklistForClient(w), list), list)
+	if err := w.WriteMsg(response); err != nil {
+		r.logf(slog.LevelError, "failed to write blocked response", "err", err)
+	}
+	r.logBlockedRequest(w, question, outcome, response, time.Since(start), upstreamAddr, blockedBy)
+	if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
+		tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", outcome, "qname", qname, "qtype", dns.TypeToString[question.Qtype], "blocked_by", blockedBy, "duration_ms", time.Since(start).Milliseconds())
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package dnsresolver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/cache"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+	"github.com/tternquist/beyond-ads-dns/internal/querystore"
+)
+
+// answerFilterUpstream answers A queries for bad.* names with an address in 203.0.113.0/24
+// and everything else with 192.0.2.1. AAAA queries get NODATA, except for v6bad.example.
+func answerFilterUpstream(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	q := req.Question[0]
+	switch {
+	case q.Qtype == dns.TypeA && dns.SplitDomainName(q.Name)[0] == "bad":
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(203, 0, 113, 5)}}
+	case q.Qtype == dns.TypeA:
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}}
+	case q.Qtype == dns.TypeAAAA && q.Name == "v6bad.example.":
+		resp.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300}, AAAA: net.ParseIP("2001:db8:bad::1")}}
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func TestResolverBlockedAnswerIP(t *testing.T) {
+	upstreamAddr := newDNSServerUDP(t, dns.HandlerFunc(answerFilterUpstream))
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "test", Address: upstreamAddr, Protocol: "udp"}}
+	cfg.QueryStore = config.QueryStoreConfig{Enabled: ptr(true), SampleRate: 1.0}
+	cfg.Blocklists.Denylist = []string{"203.0.113.0/24", "2001:db8:bad::/48"}
+	cfg.Blocklists.Allowlist = []string{"bad.trusted.example"}
+	cfg.DNS64 = config.DNS64Config{Enabled: ptr(false), Prefix: "64:ff9b::/96"}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{
+			{IP: "192.168.1.50", Name: "lab", GroupID: "lab"},
+			{IP: "192.168.1.64", Name: "v6 phone", GroupID: "v6only"},
+		},
+	}
+	cfg.ClientGroups = []config.ClientGroup{
+		{ID: "lab", Name: "Lab", Blocklist: &config.GroupBlocklistConfig{InheritGlobal: ptr(false), Denylist: []string{"192.0.2.0/24"}}},
+		{ID: "v6only", Name: "IPv6-only", DNS64: &config.DNS64Config{Enabled: ptr(true)}},
+	}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	mockCache := cache.NewMockCache()
+	store := &mockQueryStore{events: make(chan querystore.Event, 16)}
+	resolver := buildTestResolverWithQueryStore(cfg, mockCache, blMgr, nil, store)
+
+	query := func(client, name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &mockResponseWriter{remoteAddr: client}
+		resolver.ServeDNS(w, req)
+		if w.written == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.written
+	}
+	expectEvent := func(outcome, blockedBy string) {
+		t.Helper()
+		select {
+		case e := <-store.events:
+			if e.Outcome != outcome || e.BlockedBy != blockedBy {
+				t.Errorf("event outcome=%q blocked_by=%q, want %q %q", e.Outcome, e.BlockedBy, outcome, blockedBy)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected query store event")
+		}
+	}
+
+	if resp := query("192.168.1.10", "bad.example.", dns.TypeA); resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Errorf("blocked range: expected NXDOMAIN, got %v", resp)
+	}
+	expectEvent("blocked_ip", "bad.example A 203.0.113.5 in 203.0.113.0/24 (denylist)")
+	waitForCacheEntry(t, mockCache, "dns:bad.example:1:1")
+	// The cached answer is filtered too.
+	if resp := query("192.168.1.10", "bad.example.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("cached blocked range: expected NXDOMAIN, got %v", resp)
+	}
+	expectEvent("blocked_ip", "bad.example A 203.0.113.5 in 203.0.113.0/24 (denylist)")
+
+	if resp := query("192.168.1.10", "v6bad.example.", dns.TypeAAAA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("blocked IPv6 range: expected NXDOMAIN, got %v", resp)
+	}
+	expectEvent("blocked_ip", "v6bad.example AAAA 2001:db8:bad::1 in 2001:db8:bad::/48 (denylist)")
+
+	// An allowlisted query name is trusted with its addresses.
+	if resp := query("192.168.1.10", "bad.trusted.example.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("allowlisted: expected answer, got %v", resp)
+	}
+	expectEvent("upstream", "")
+
+	// Group lists apply to their members only.
+	if resp := query("192.168.1.10", "good.example.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Errorf("global client: expected answer, got %v", resp)
+	}
+	expectEvent("upstream", "")
+	if resp := query("192.168.1.50", "good.example.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("group client: expected NXDOMAIN, got %v", resp)
+	}
+	expectEvent("blocked_ip", "good.example A 192.0.2.1 in 192.0.2.0/24 (denylist)")
+
+	// Synthesized DNS64 answers are matched on the embedded IPv4 address.
+	if resp := query("192.168.1.64", "bad.example.", dns.TypeAAAA); resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Errorf("DNS64: expected NXDOMAIN, got %v", resp)
+	}
+	expectEvent("blocked_ip", "bad.example AAAA 64:ff9b::cb00:7105 in 203.0.113.0/24 (denylist)")
+}
@@ -0,0 +1,96 @@
+package dnsresolver
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// blockPolicy is the answer for blocked names, from response.blocked or a client group's
+// response.blocked.
+type blockPolicy struct {
+	rcode int    // dns.RcodeNameError (nxdomain), dns.RcodeRefused, or dns.RcodeSuccess (nodata and address modes)
+	ipv4  net.IP // A answer; nil = NODATA
+	ipv6  net.IP // AAAA answer; nil = NODATA
+}
+
+// newBlockPolicy parses a blocked response mode. A single IP address answers queries of its
+// own family and gives NODATA for the other. Unknown modes fall back to NXDOMAIN.
+func newBlockPolicy(blocked, ipv4, ipv6 string) blockPolicy {
+	switch strings.ToLower(strings.TrimSpace(blocked)) {
+	case "", "nxdomain":
+		return blockPolicy{rcode: dns.RcodeNameError}
+	case config.BlockedResponseNODATA:
+		return blockPolicy{rcode: dns.RcodeSuccess}
+	case config.BlockedResponseRefused:
+		return blockPolicy{rcode: dns.RcodeRefused}
+	case config.BlockedResponseNull:
+		return blockPolicy{rcode: dns.RcodeSuccess, ipv4: net.IPv4zero.To4(), ipv6: net.IPv6zero}
+	case config.BlockedResponseCustom:
+		p := blockPolicy{rcode: dns.RcodeSuccess}
+		if ip := net.ParseIP(strings.TrimSpace(ipv4)); ip != nil && ip.To4() != nil {
+			p.ipv4 = ip.To4()
+		}
+		if ip := net.ParseIP(strings.TrimSpace(ipv6)); ip != nil && ip.To4() == nil {
+			p.ipv6 = ip
+		}
+		return p
+	}
+	ip := net.ParseIP(strings.TrimSpace(blocked))
+	if ip == nil {
+		return blockPolicy{rcode: dns.RcodeNameError}
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return blockPolicy{rcode: dns.RcodeSuccess, ipv4: v4}
+	}
+	return blockPolicy{rcode: dns.RcodeSuccess, ipv6: ip}
+}
+
+// buildGroupBlockPolicies returns the block policy of each client group that overrides
+// response.blocked.
+func buildGroupBlockPolicies(cfg config.Config) map[string]blockPolicy {
+	var groups map[string]blockPolicy
+	for _, g := range cfg.ClientGroups {
+		if g.ID == "" || g.Response == nil || strings.TrimSpace(g.Response.Blocked) == "" {
+			continue
+		}
+		if groups == nil {
+			groups = make(map[string]blockPolicy)
+		}
+		groups[g.ID] = newBlockPolicy(g.Response.Blocked, g.Response.BlockedIPv4, g.Response.BlockedIPv6)
+	}
+	return groups
+}
+
+// answer returns the address record for qtype, or nil when the reply is NODATA: always for
+// qtypes other than A and AAAA (HTTPS, SVCB, MX, TXT, ...), and for a family without an address.
+func (p blockPolicy) answer(question dns.Question, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	switch {
+	case question.Qtype == dns.TypeA && p.ipv4 != nil:
+		return &dns.A{Hdr: hdr, A: p.ipv4}
+	case question.Qtype == dns.TypeAAAA && p.ipv6 != nil:
+		return &dns.AAAA{Hdr: hdr, AAAA: p.ipv6}
+	}
+	return nil
+}
+
+// blockPolicyFor returns the block policy and TTL for the client making the request.
+func (r *Resolver) blockPolicyFor(w dns.ResponseWriter) (blockPolicy, uint32) {
+	r.responseMu.RLock()
+	policy := r.blockPolicy
+	groups := r.groupBlockPolicy
+	ttl := uint32(r.blockedTTL.Seconds())
+	r.responseMu.RUnlock()
+	if ttl == 0 {
+		ttl = 3600
+	}
+	if len(groups) > 0 && w != nil {
+		if p, ok := groups[r.clientGroup(w)]; ok {
+			policy = p
+		}
+	}
+	return policy, ttl
+}
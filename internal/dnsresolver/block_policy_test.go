@@ -0,0 +1,119 @@
+package dnsresolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+)
+
+func TestBlockedReplyPolicy(t *testing.T) {
+	type want struct {
+		rcode  int
+		answer string // address in the answer; "" = no answer
+		soa    bool
+	}
+	nxdomain := want{rcode: dns.RcodeNameError, soa: true}
+	nodata := want{rcode: dns.RcodeSuccess, soa: true}
+	tests := []struct {
+		name                    string
+		blocked, ipv4, ipv6     string
+		a, aaaa, https, mx, txt want
+	}{
+		{"nxdomain", "nxdomain", "", "", nxdomain, nxdomain, nxdomain, nxdomain, nxdomain},
+		{"nodata", "nodata", "", "", nodata, nodata, nodata, nodata, nodata},
+		{"refused", "refused", "", "", want{rcode: dns.RcodeRefused}, want{rcode: dns.RcodeRefused}, want{rcode: dns.RcodeRefused}, want{rcode: dns.RcodeRefused}, want{rcode: dns.RcodeRefused}},
+		{"null", "null", "", "", want{rcode: dns.RcodeSuccess, answer: "0.0.0.0"}, want{rcode: dns.RcodeSuccess, answer: "::"}, nodata, nodata, nodata},
+		{"custom", "custom", "192.0.2.1", "2001:db8::1", want{rcode: dns.RcodeSuccess, answer: "192.0.2.1"}, want{rcode: dns.RcodeSuccess, answer: "2001:db8::1"}, nodata, nodata, nodata},
+		{"custom v4 only", "custom", "192.0.2.1", "", want{rcode: dns.RcodeSuccess, answer: "192.0.2.1"}, nodata, nodata, nodata, nodata},
+		{"single IPv4", "0.0.0.0", "", "", want{rcode: dns.RcodeSuccess, answer: "0.0.0.0"}, nodata, nodata, nodata, nodata},
+		{"single IPv6", "::", "", "", nodata, want{rcode: dns.RcodeSuccess, answer: "::"}, nodata, nodata, nodata},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := minimalResolverConfig("")
+			cfg.Response = config.ResponseConfig{Blocked: tt.blocked, BlockedIPv4: tt.ipv4, BlockedIPv6: tt.ipv6, BlockedTTL: config.Duration{Duration: 10 * time.Minute}}
+			resolver := buildTestResolver(t, cfg, nil, nil, nil)
+			for qtype, w := range map[uint16]want{dns.TypeA: tt.a, dns.TypeAAAA: tt.aaaa, dns.TypeHTTPS: tt.https, dns.TypeMX: tt.mx, dns.TypeTXT: tt.txt} {
+				req := new(dns.Msg)
+				req.SetQuestion("ads.example.com.", qtype)
+				resp := resolver.blockedReply(&mockResponseWriter{}, req, req.Question[0])
+				qt := dns.TypeToString[qtype]
+				if resp.Rcode != w.rcode {
+					t.Errorf("%s: rcode = %s, want %s", qt, dns.RcodeToString[resp.Rcode], dns.RcodeToString[w.rcode])
+				}
+				var got string
+				for _, rr := range resp.Answer {
+					switch v := rr.(type) {
+					case *dns.A:
+						got = v.A.String()
+					case *dns.AAAA:
+						got = v.AAAA.String()
+					}
+					if rr.Header().Ttl != 600 {
+						t.Errorf("%s: answer TTL = %d, want 600", qt, rr.Header().Ttl)
+					}
+				}
+				if got != w.answer || len(resp.Answer) > 1 {
+					t.Errorf("%s: answer = %v, want %q", qt, resp.Answer, w.answer)
+				}
+				var soa *dns.SOA
+				if len(resp.Ns) == 1 {
+					soa, _ = resp.Ns[0].(*dns.SOA)
+				}
+				if (soa != nil) != w.soa || len(resp.Ns) > 1 {
+					t.Errorf("%s: authority = %v, want SOA %v", qt, resp.Ns, w.soa)
+				}
+				if soa != nil && (soa.Hdr.Ttl != 600 || soa.Minttl != 600) {
+					t.Errorf("%s: SOA TTL %d minimum %d, want 600", qt, soa.Hdr.Ttl, soa.Minttl)
+				}
+			}
+		})
+	}
+}
+
+func TestResolverGroupBlockPolicy(t *testing.T) {
+	cfg := minimalResolverConfig("")
+	cfg.Blocklists.Denylist = []string{"ads.example.com"}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{IP: "192.168.1.50", Name: "tv", GroupID: "tv"}},
+	}
+	cfg.ClientGroups = []config.ClientGroup{{ID: "tv", Name: "TV", Response: &config.GroupResponseConfig{Blocked: "null"}}}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	resolver := buildTestResolver(t, cfg, nil, blMgr, nil)
+
+	query := func(client string) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("ads.example.com.", dns.TypeA)
+		w := &mockResponseWriter{remoteAddr: client}
+		resolver.ServeDNS(w, req)
+		if w.written == nil {
+			t.Fatal("no response")
+		}
+		return w.written
+	}
+
+	if resp := query("192.168.1.10"); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("global client: expected NXDOMAIN, got %v", resp)
+	}
+	if resp := query("192.168.1.50"); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("group client: expected 0.0.0.0, got %v", resp)
+	}
+
+	// Hot-reload switches both the global and the group policy.
+	cfg.Response.Blocked = "refused"
+	cfg.ClientGroups[0].Response = &config.GroupResponseConfig{Blocked: "nodata"}
+	resolver.ApplyResponseConfig(cfg)
+	if resp := query("192.168.1.10"); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("global client after reload: expected REFUSED, got %v", resp)
+	}
+	if resp := query("192.168.1.50"); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Errorf("group client after reload: expected NODATA, got %v", resp)
+	}
+}
@@ -0,0 +1,186 @@
+package dnsresolver
+
+import (
+	"encoding/base64"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/clientid"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// ednsMACCode is the EDNS0 option dnsmasq (--add-mac) and similar forwarders use to pass on
+// the client's MAC address: 6 raw bytes, or the text or base64 form with --add-mac=text/base64.
+const ednsMACCode = 65001
+
+// clientIDWriter is implemented by the response writers of transports that carry a client ID:
+// DoH (/dns-query/<id>) and DoT/DoQ (server name <id>.<client_id_domain>).
+type clientIDWriter interface {
+	ClientID() string
+}
+
+// applyClientIdentification loads the client mappings of cfg into cr.
+func applyClientIdentification(cr *clientid.Resolver, cfg config.ClientIdentificationConfig) {
+	cr.SetIPv6PrefixMatch(cfg.IPv6PrefixMatch != nil && *cfg.IPv6PrefixMatch)
+	cr.ApplyConfig(cfg.Clients.ToNameMap(), cfg.Clients.ToGroupMap())
+	cr.ApplyIDConfig(cfg.Clients.ToIDNameMap(), cfg.Clients.ToIDGroupMap())
+	cr.ApplyMACConfig(cfg.Clients.ToMACNameMap(), cfg.Clients.ToMACGroupMap())
+}
+
+// unwrapWriter returns the writer that w, one of the writers ServeDNS wraps around the
+// listener's own, wraps; nil for any other writer.
+func unwrapWriter(w dns.ResponseWriter) dns.ResponseWriter {
+	switch cw := w.(type) {
+	case *finalizingWriter:
+		return cw.ResponseWriter
+	case *ecsClientWriter:
+		return cw.ResponseWriter
+	case *macClientWriter:
+		return cw.ResponseWriter
+	case *rrlWriter:
+		return cw.ResponseWriter
+	}
+	return nil
+}
+
+// clientIDFromWriter returns the client ID sent with the query, normalized, or "". It looks
+// through the writers ServeDNS wraps around the listener's own.
+func clientIDFromWriter(w dns.ResponseWriter) string {
+	for ; w != nil; w = unwrapWriter(w) {
+		if cw, ok := w.(clientIDWriter); ok {
+			id, _ := clientid.NormalizeID(cw.ClientID())
+			return id
+		}
+	}
+	return ""
+}
+
+// macClientWriter carries the client MAC address a trusted forwarder sent in EDNS.
+type macClientWriter struct {
+	dns.ResponseWriter
+	mac string
+}
+
+// macWriter returns w carrying the client MAC address from req's EDNS0 MAC option when the
+// query comes from a trusted forwarder (edns_client_subnet.trusted_forwarders).
+func (p *ecsPolicy) macWriter(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if p == nil || len(p.trustedForwarders) == 0 {
+		return w
+	}
+	mac, ok := findMAC(req)
+	if !ok {
+		return w
+	}
+	fwd, err := netip.ParseAddr(clientIPFromWriter(w))
+	if err != nil {
+		return w
+	}
+	fwd = fwd.Unmap()
+	for _, trusted := range p.trustedForwarders {
+		if trusted.Contains(fwd) {
+			return &macClientWriter{ResponseWriter: w, mac: mac}
+		}
+	}
+	return w
+}
+
+// findMAC returns the client MAC address from msg's EDNS0 MAC option.
+func findMAC(msg *dns.Msg) (string, bool) {
+	if msg == nil {
+		return "", false
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return "", false
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == ednsMACCode {
+			return parseMACOption(local.Data)
+		}
+	}
+	return "", false
+}
+
+// hasMACOption reports whether msg carries an EDNS0 MAC option.
+func hasMACOption(msg *dns.Msg) bool {
+	if opt := msg.IsEdns0(); opt != nil {
+		return slices.ContainsFunc(opt.Option, isMACOption)
+	}
+	return false
+}
+
+func isMACOption(o dns.EDNS0) bool {
+	return o.Option() == ednsMACCode
+}
+
+// parseMACOption decodes the EDNS0 MAC option in any of the forms dnsmasq sends.
+func parseMACOption(data []byte) (string, bool) {
+	switch len(data) {
+	case 6:
+		return net.HardwareAddr(data).String(), true
+	case 8:
+		raw, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil || len(raw) != 6 {
+			return "", false
+		}
+		return net.HardwareAddr(raw).String(), true
+	}
+	return clientid.NormalizeMAC(string(data))
+}
+
+// clientMAC returns the MAC address of the client making the request, from a trusted
+// forwarder's EDNS0 option or the neighbor table, or "". It is only looked up when a client
+// is configured by MAC.
+func (r *Resolver) clientMAC(w dns.ResponseWriter) string {
+	if !r.clientIDEnabled.Load() || r.clientIDResolver == nil || !r.clientIDResolver.HasMACs() {
+		return ""
+	}
+	for cw := w; cw != nil; cw = unwrapWriter(cw) {
+		if mw, ok := cw.(*macClientWriter); ok {
+			return mw.mac
+		}
+	}
+	n := r.neighbors.Load()
+	if n == nil {
+		return ""
+	}
+	mac, _ := n.Lookup(clientIPFromWriter(w))
+	return mac
+}
+
+// syncNeighbors loads the neighbor table when a client is configured by MAC, and drops it when
+// none is any more, so hosts without MAC clients never read ARP/NDP.
+func (r *Resolver) syncNeighbors() {
+	want := r.clientIDEnabled.Load() && r.clientIDResolver != nil && r.clientIDResolver.HasMACs()
+	switch n := r.neighbors.Load(); {
+	case want && n == nil:
+		r.neighbors.Store(clientid.NewNeighbors())
+	case !want && n != nil:
+		r.neighbors.Store(nil)
+	}
+}
+
+// clientGroup returns the group of the client making the request: that of its client ID when
+// the ID is configured, else that of its MAC address, else that of the most specific IP or
+// range containing its IP. "" without client identification or group.
+func (r *Resolver) clientGroup(w dns.ResponseWriter) string {
+	if !r.clientIDEnabled.Load() || r.clientIDResolver == nil {
+		return ""
+	}
+	if id := clientIDFromWriter(w); id != "" {
+		if _, groupID, ok := r.clientIDResolver.ResolveID(id); ok {
+			return groupID
+		}
+	}
+	if mac := r.clientMAC(w); mac != "" {
+		if _, groupID, ok := r.clientIDResolver.ResolveMAC(mac); ok {
+			return groupID
+		}
+	}
+	if clientAddr := clientIPFromWriter(w); clientAddr != "" {
+		return r.clientIDResolver.ResolveGroup(clientAddr)
+	}
+	return ""
+}
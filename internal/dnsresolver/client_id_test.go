@@ -0,0 +1,235 @@
+package dnsresolver
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+	"github.com/tternquist/beyond-ads-dns/internal/requestlog"
+)
+
+// clientIDMockWriter is a DoH/DoT writer carrying a client ID.
+type clientIDMockWriter struct {
+	mockResponseWriter
+	id string
+}
+
+func (w *clientIDMockWriter) ClientID() string { return w.id }
+
+// captureLog records request log entries.
+type captureLog struct {
+	mu      sync.Mutex
+	entries []requestlog.Entry
+}
+
+func (c *captureLog) Write(e requestlog.Entry) {
+	c.mu.Lock()
+	c.entries = append(c.entries, e)
+	c.mu.Unlock()
+}
+
+func (c *captureLog) wait(t *testing.T, n int) []requestlog.Entry {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		c.mu.Lock()
+		if len(c.entries) >= n {
+			out := append([]requestlog.Entry(nil), c.entries...)
+			c.mu.Unlock()
+			return out
+		}
+		c.mu.Unlock()
+	}
+	t.Fatalf("fewer than %d request log entries", n)
+	return nil
+}
+
+func TestClientIDFromWriter(t *testing.T) {
+	req := udpQuery("www.example.com.")
+	w := &clientIDMockWriter{mockResponseWriter: mockResponseWriter{remoteAddr: "192.0.2.1"}, id: "Kids-Phone"}
+	wrapped := &rrlWriter{ResponseWriter: &ecsClientWriter{ResponseWriter: finalizeWriter(w, req)}}
+	if got := clientIDFromWriter(wrapped); got != "kids-phone" {
+		t.Errorf("clientIDFromWriter = %q, want kids-phone", got)
+	}
+	if got := clientIDFromWriter(finalizeWriter(&mockResponseWriter{}, req)); got != "" {
+		t.Errorf("clientIDFromWriter without ID = %q", got)
+	}
+	if got := clientIDFromWriter(&clientIDMockWriter{id: "not/an/id"}); got != "" {
+		t.Errorf("clientIDFromWriter with an invalid ID = %q", got)
+	}
+}
+
+func TestResolverClientIDGroup(t *testing.T) {
+	kidsBlMgr := blocklist.NewManager(config.BlocklistConfig{
+		RefreshInterval: config.Duration{Duration: time.Hour},
+		Denylist:        []string{"kids-blocked.example.com"},
+	}, logging.NewDiscardLogger())
+	kidsBlMgr.LoadOnce(nil)
+
+	inheritFalse := false
+	cfg := minimalResolverConfig("https://invalid.invalid/dns-query")
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{
+			{Name: "Kids Phone", GroupID: "kids", IDs: []string{"kids-phone"}},
+			{IP: "192.168.1.11", Name: "Adults Laptop", GroupID: "adults"},
+		},
+	}
+	cfg.ClientGroups = []config.ClientGroup{
+		{ID: "kids", Name: "Kids", Blocklist: &config.GroupBlocklistConfig{InheritGlobal: &inheritFalse}},
+		{ID: "adults", Name: "Adults"},
+	}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+	r.groupBlocklistsMu.Lock()
+	r.groupBlocklists["kids"] = kidsBlMgr
+	r.groupBlocklistsMu.Unlock()
+	logs := &captureLog{}
+	r.requestLogWriter = logs
+
+	// The ID identifies the kids' phone whatever its IP.
+	w := &clientIDMockWriter{mockResponseWriter: mockResponseWriter{remoteAddr: "198.51.100.7"}, id: "Kids-Phone"}
+	r.ServeDNS(w, udpQuery("kids-blocked.example.com."))
+	if w.written == nil || w.written.Rcode != dns.RcodeNameError {
+		t.Fatalf("client ID kids-phone: response %v, want NXDOMAIN from the kids blocklist", w.written)
+	}
+	if got := r.clientGroup(w); got != "kids" {
+		t.Errorf("clientGroup = %q, want kids", got)
+	}
+	entries := logs.wait(t, 1)
+	if entries[0].ClientID != "kids-phone" {
+		t.Errorf("request log client_id = %q, want kids-phone", entries[0].ClientID)
+	}
+
+	// An unknown ID falls back to the IP.
+	w = &clientIDMockWriter{mockResponseWriter: mockResponseWriter{remoteAddr: "192.168.1.11"}, id: "someone-else"}
+	if got := r.clientGroup(w); got != "adults" {
+		t.Errorf("clientGroup for an unknown ID = %q, want the IP's group adults", got)
+	}
+
+	// Reloading picks up new IDs.
+	cfg.ClientIdentification.Clients[0].IDs = []string{"new-phone"}
+	r.ApplyClientIdentificationConfig(cfg)
+	if got := r.clientGroup(&clientIDMockWriter{id: "kids-phone"}); got != "" {
+		t.Errorf("clientGroup for a removed ID = %q", got)
+	}
+	if got := r.clientGroup(&clientIDMockWriter{id: "new-phone"}); got != "kids" {
+		t.Errorf("clientGroup for a new ID = %q, want kids", got)
+	}
+}
+
+// queryWithMAC returns a query carrying the EDNS0 MAC option with the given payload.
+func queryWithMAC(data []byte) *dns.Msg {
+	req := udpQuery("www.example.com.")
+	req.SetEdns0(1232, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsMACCode, Data: data})
+	return req
+}
+
+func TestParseMACOption(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"binary": {0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		"text":   []byte("AA:BB:CC:DD:EE:FF"),
+		"base64": []byte("qrvM3e7/"),
+	} {
+		if mac, ok := parseMACOption(data); !ok || mac != "aa:bb:cc:dd:ee:ff" {
+			t.Errorf("%s: parseMACOption = %q, %v", name, mac, ok)
+		}
+	}
+	if mac, ok := parseMACOption([]byte{1, 2, 3}); ok {
+		t.Errorf("parseMACOption(short) = %q, want invalid", mac)
+	}
+}
+
+func TestECSPolicy_MACWriter(t *testing.T) {
+	p := newECSPolicy(config.EDNSClientSubnetConfig{TrustedForwarders: []string{"192.168.1.1"}})
+	req := queryWithMAC([]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+
+	w := p.macWriter(&mockResponseWriter{remoteAddr: "192.168.1.1"}, req)
+	mw, ok := w.(*macClientWriter)
+	if !ok || mw.mac != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("trusted forwarder: writer %T without the MAC", w)
+	}
+	if got := clientIPFromWriter(w); got != "192.168.1.1" {
+		t.Errorf("MAC writer changed the client address to %q", got)
+	}
+	if w := p.macWriter(&mockResponseWriter{remoteAddr: "192.168.1.2"}, req); w != nil {
+		if _, ok := w.(*macClientWriter); ok {
+			t.Error("MAC option from an untrusted client should be ignored")
+		}
+	}
+
+	// The MAC never goes upstream.
+	out := withECS(req, netip.Prefix{}, false)
+	if hasMACOption(out) || !hasMACOption(req) {
+		t.Error("withECS should strip the MAC option from a copy of the request")
+	}
+}
+
+func TestResolverClientRangesAndMACs(t *testing.T) {
+	cfg := minimalResolverConfig("https://invalid.invalid/dns-query")
+	cfg.EDNSClientSubnet.TrustedForwarders = []string{"192.168.1.1"}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{
+			{Name: "Kids VLAN", GroupID: "kids", CIDRs: []string{"192.168.20.0/24"}},
+			{IP: "192.168.20.50", Name: "Family TV", GroupID: "adults"},
+			{Name: "Kids iPad", GroupID: "kids", MACs: []string{"aa:bb:cc:dd:ee:ff"}},
+		},
+	}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+	r.neighbors.Store(nil) // only the EDNS option here; the host's table is not the test's
+
+	for ip, want := range map[string]string{
+		"192.168.20.7":  "kids",
+		"192.168.20.50": "adults",
+		"192.168.30.1":  "",
+	} {
+		if got := r.clientGroup(&mockResponseWriter{remoteAddr: ip}); got != want {
+			t.Errorf("clientGroup(%s) = %q, want %q", ip, got, want)
+		}
+	}
+
+	// The forwarder's MAC option identifies the iPad behind it.
+	req := queryWithMAC([]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	w := r.ecs.Load().macWriter(&mockResponseWriter{remoteAddr: "192.168.1.1"}, req)
+	if got := r.clientGroup(w); got != "kids" {
+		t.Errorf("clientGroup via EDNS MAC = %q, want kids", got)
+	}
+	if got := r.clientGroup(&mockResponseWriter{remoteAddr: "192.168.1.1"}); got != "" {
+		t.Errorf("clientGroup of the forwarder itself = %q, want empty", got)
+	}
+}
+
+func TestResolverNeighborsOnlyWithMACClients(t *testing.T) {
+	cfg := minimalResolverConfig("https://invalid.invalid/dns-query")
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{IP: "192.168.20.50", Name: "Family TV"}},
+	}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+	if r.neighbors.Load() != nil {
+		t.Fatal("neighbor table loaded without MAC clients")
+	}
+
+	withMAC := cfg
+	withMAC.ClientIdentification.Clients = append(config.ClientEntries{{Name: "Kids iPad", MACs: []string{"aa:bb:cc:dd:ee:ff"}}}, cfg.ClientIdentification.Clients...)
+	r.ApplyClientIdentificationConfig(withMAC)
+	n := r.neighbors.Load()
+	if n == nil {
+		t.Fatal("neighbor table not loaded after adding a MAC client")
+	}
+	r.ApplyClientIdentificationConfig(withMAC)
+	if r.neighbors.Load() != n {
+		t.Error("reload with unchanged MAC clients replaced the neighbor table")
+	}
+
+	r.ApplyClientIdentificationConfig(cfg)
+	if r.neighbors.Load() != nil {
+		t.Error("neighbor table kept after removing the MAC clients")
+	}
+}
@@ -0,0 +1,42 @@
+package dnsresolver
+
+import (
+	"github.com/miekg/dns"
+)
+
+// cnameCloakedLink returns the first CNAME or DNAME link in resp's answer section whose target
+// is blocked for the client, formatted as "owner CNAME target", and the list that blocked
+// the target, or "" when there is none.
+// This catches trackers behind first-party names (metrics.news-site.com CNAME
+// news-site.tracker.net). A query name on the allowlist is trusted along with its chain.
+func (r *Resolver) cnameCloakedLink(w dns.ResponseWriter, qname string, resp *dns.Msg) (string, string) {
+	if resp == nil || len(resp.Answer) == 0 {
+		return "", ""
+	}
+	blMgr := r.blocklistForClient(w)
+	if blMgr == nil {
+		return "", ""
+	}
+	checked := false
+	for _, rr := range resp.Answer {
+		var target string
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			target = v.Target
+		case *dns.DNAME:
+			target = v.Target
+		default:
+			continue
+		}
+		if !checked {
+			if blMgr.IsAllowed(qname) {
+				return "", ""
+			}
+			checked = true
+		}
+		if list, blocked := blMgr.BlockedBy(target); blocked {
+			return normalizeQueryName(rr.Header().Name) + " " + dns.TypeToString[rr.Header().Rrtype] + " " + normalizeQueryName(target), list
+		}
+	}
+	return "", ""
+}
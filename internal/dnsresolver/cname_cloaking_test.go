@@ -0,0 +1,165 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/cache"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+	"github.com/tternquist/beyond-ads-dns/internal/querystore"
+)
+
+// cnameCloakingUpstream answers every A query with a two-step CNAME chain that ends at
+// <label>.tracker.example, e.g. metrics.news.example -> edge.metrics.example -> metrics.tracker.example.
+func cnameCloakingUpstream(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	q := req.Question[0]
+	label := dns.SplitDomainName(q.Name)[0]
+	edge := "edge." + label + ".example."
+	tracker := label + ".tracker.example."
+	resp.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: edge},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: edge, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: tracker},
+		&dns.A{Hdr: dns.RR_Header{Name: tracker, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 10)},
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func TestCNAMECloakedLink(t *testing.T) {
+	cfg := minimalResolverConfig("")
+	cfg.Blocklists.Denylist = []string{"tracker.example"}
+	cfg.Blocklists.Allowlist = []string{"trusted.example"}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	resolver := buildTestResolver(t, cfg, nil, blMgr, nil)
+	w := &mockResponseWriter{}
+
+	msg := func(rrs ...string) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("NewRR(%q): %v", s, err)
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name  string
+		qname string
+		resp  *dns.Msg
+		want  string
+	}{
+		{"nil", "a.example", nil, ""},
+		{"no chain", "a.example", msg("a.example. 60 IN A 192.0.2.1"), ""},
+		{"clean chain", "a.example", msg("a.example. 60 IN CNAME b.example.", "b.example. 60 IN A 192.0.2.1"), ""},
+		{"first link", "a.example", msg("a.example. 60 IN CNAME x.tracker.example.", "x.tracker.example. 60 IN A 192.0.2.1"), "a.example CNAME x.tracker.example"},
+		{"deep link", "a.example", msg("a.example. 60 IN CNAME b.example.", "b.example. 60 IN CNAME c.tracker.example.", "c.tracker.example. 60 IN A 192.0.2.1"), "b.example CNAME c.tracker.example"},
+		{"dname", "www.a.example", msg("a.example. 60 IN DNAME tracker.example.", "www.a.example. 60 IN CNAME www.tracker.example."), "a.example DNAME tracker.example"},
+		{"allowlisted qname", "cdn.trusted.example", msg("cdn.trusted.example. 60 IN CNAME x.tracker.example."), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := resolver.cnameCloakedLink(w, tt.qname, tt.resp); got != tt.want {
+				t.Errorf("cnameCloakedLink(%q) = %q, want %q", tt.qname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverCNAMECloaking(t *testing.T) {
+	upstreamAddr := newDNSServerUDP(t, dns.HandlerFunc(cnameCloakingUpstream))
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "test", Address: upstreamAddr, Protocol: "udp"}}
+	cfg.QueryStore = config.QueryStoreConfig{Enabled: ptr(true), SampleRate: 1.0}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{IP: "192.168.1.50", Name: "kids tablet", GroupID: "kids"}},
+	}
+	cfg.ClientGroups = []config.ClientGroup{{
+		ID:        "kids",
+		Name:      "Kids",
+		Blocklist: &config.GroupBlocklistConfig{InheritGlobal: ptr(false), Denylist: []string{"video.tracker.example"}},
+	}}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	mockCache := cache.NewMockCache()
+	store := &mockQueryStore{events: make(chan querystore.Event, 16)}
+	resolver := buildTestResolverWithQueryStore(cfg, mockCache, blMgr, nil, store)
+
+	query := func(client, name string) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := &mockResponseWriter{remoteAddr: client}
+		resolver.ServeDNS(w, req)
+		if w.written == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.written
+	}
+	nextEvent := func() querystore.Event {
+		t.Helper()
+		select {
+		case e := <-store.events:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected query store event")
+		}
+		return querystore.Event{}
+	}
+
+	// Nothing is blocked yet: the chain is answered and cached as is.
+	if resp := query("192.168.1.10", "metrics.news.example."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 3 {
+		t.Fatalf("expected full chain, got %v", resp)
+	}
+	if e := nextEvent(); e.Outcome != "upstream" || e.BlockedBy != "" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	waitForCacheEntry(t, mockCache, "dns:metrics.news.example:1:1")
+
+	// A blocklist update applies to the cached chain without flushing the cache.
+	blCfg := cfg.Blocklists
+	blCfg.Denylist = []string{"metrics.tracker.example"}
+	if err := blMgr.ApplyConfig(context.Background(), blCfg); err != nil {
+		t.Fatalf("ApplyConfig: %v", err)
+	}
+	resp := query("192.168.1.10", "metrics.news.example.")
+	if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Fatalf("cached chain: expected NXDOMAIN, got %v", resp)
+	}
+	e := nextEvent()
+	if e.Outcome != "blocked_cname" || e.BlockedBy != "edge.metrics.example CNAME metrics.tracker.example" {
+		t.Errorf("cached chain: unexpected event outcome=%q blocked_by=%q", e.Outcome, e.BlockedBy)
+	}
+
+	// The group denylist only applies to its members, on the upstream path.
+	if resp := query("192.168.1.10", "video.news.example."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 3 {
+		t.Errorf("global client: expected full chain, got %v", resp)
+	}
+	nextEvent()
+	if resp := query("192.168.1.50", "video.news.example."); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("group client: expected NXDOMAIN, got %v", resp)
+	}
+	if e := nextEvent(); e.Outcome != "blocked_cname" || e.BlockedBy != "edge.video.example CNAME video.tracker.example" {
+		t.Errorf("group client: unexpected event outcome=%q blocked_by=%q", e.Outcome, e.BlockedBy)
+	}
+
+	// Allowlisting the query name lets the whole chain through.
+	blCfg.Allowlist = []string{"metrics.news.example"}
+	if err := blMgr.ApplyConfig(context.Background(), blCfg); err != nil {
+		t.Fatalf("ApplyConfig: %v", err)
+	}
+	if resp := query("192.168.1.10", "metrics.news.example."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 3 {
+		t.Errorf("allowlisted: expected full chain, got %v", resp)
+	}
+}
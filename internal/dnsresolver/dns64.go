@@ -0,0 +1,385 @@
+package dnsresolver
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// dns64KeySep separates the native cache key from the NAT64 prefix in the cache keys of
+// synthesized answers, e.g. "dns:example.com:28:1:dns64=64:ff9b::/96". Synthesized answers
+// are cached apart from native ones so clients without DNS64 never see them.
+const dns64KeySep = ":dns64="
+
+// dns64WellKnownPrefix is the RFC 6052 well-known prefix. It must not be used to
+// translate non-global IPv4 addresses (RFC 6052 section 3.1).
+var dns64WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// dns64ExcludedA are A records never synthesized into AAAA: they cannot be reached
+// through NAT64 (this network, loopback, link-local, multicast, reserved, broadcast).
+var dns64ExcludedA = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// dns64Policy is the DNS64 configuration: a global NAT64 prefix and per-group overrides.
+type dns64Policy struct {
+	global      netip.Prefix            // invalid = disabled for clients without a group override
+	groups      map[string]netip.Prefix // group ID -> prefix; invalid prefix = disabled for the group
+	excludeAAAA []netip.Prefix          // AAAA records treated as absent (RFC 6147 section 5.1.4)
+}
+
+// newDNS64Policy builds the DNS64 policy from config, or returns nil when DNS64 is
+// disabled globally and in every group.
+func newDNS64Policy(cfg config.Config) *dns64Policy {
+	p := &dns64Policy{groups: make(map[string]netip.Prefix)}
+	globalPrefix, err := netip.ParsePrefix(strings.TrimSpace(cfg.DNS64.Prefix))
+	if err != nil {
+		globalPrefix = dns64WellKnownPrefix
+	}
+	globalPrefix = globalPrefix.Masked()
+	if cfg.DNS64.Enabled != nil && *cfg.DNS64.Enabled {
+		p.global = globalPrefix
+	}
+	enabled := p.global.IsValid()
+	for _, g := range cfg.ClientGroups {
+		if g.DNS64 == nil || (g.DNS64.Enabled == nil && g.DNS64.Prefix == "") {
+			continue
+		}
+		on := p.global.IsValid()
+		if g.DNS64.Enabled != nil {
+			on = *g.DNS64.Enabled
+		}
+		if !on {
+			p.groups[g.ID] = netip.Prefix{}
+			continue
+		}
+		prefix := globalPrefix
+		if pfx, err := netip.ParsePrefix(strings.TrimSpace(g.DNS64.Prefix)); err == nil {
+			prefix = pfx.Masked()
+		}
+		p.groups[g.ID] = prefix
+		enabled = true
+	}
+	if !enabled {
+		return nil
+	}
+	excludes := cfg.DNS64.ExcludeAAAA
+	if excludes == nil {
+		excludes = []string{"::ffff:0:0/96"}
+	}
+	for _, s := range excludes {
+		if pfx, err := netip.ParsePrefix(strings.TrimSpace(s)); err == nil {
+			p.excludeAAAA = append(p.excludeAAAA, pfx.Masked())
+		}
+	}
+	return p
+}
+
+// prefixFor returns the NAT64 prefix for a client in groupID ("" = no group), or false
+// when DNS64 is disabled for it.
+func (p *dns64Policy) prefixFor(groupID string) (netip.Prefix, bool) {
+	if p == nil {
+		return netip.Prefix{}, false
+	}
+	if prefix, ok := p.groups[groupID]; ok && groupID != "" {
+		return prefix, prefix.IsValid()
+	}
+	return p.global, p.global.IsValid()
+}
+
+// excluded reports whether a native AAAA address is in the exclusion set.
+func (p *dns64Policy) excluded(addr netip.Addr) bool {
+	for _, pfx := range p.excludeAAAA {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyDNS64Config updates the DNS64 settings at runtime (for hot-reload).
+func (r *Resolver) ApplyDNS64Config(cfg config.Config) {
+	r.dns64.Store(newDNS64Policy(cfg))
+}
+
+// dns64PrefixFor returns the NAT64 prefix for the client making the request, or false when
+// DNS64 does not apply to it.
+func (r *Resolver) dns64PrefixFor(w dns.ResponseWriter) (netip.Prefix, bool) {
+	p := r.dns64.Load()
+	if p == nil {
+		return netip.Prefix{}, false
+	}
+	groupID := ""
+	if len(p.groups) > 0 {
+		groupID = r.clientGroup(w)
+	}
+	return p.prefixFor(groupID)
+}
+
+// dns64Reply answers an AAAA query with AAAA records synthesized from the name's A records
+// when the name has no AAAA records outside the exclusion set. It returns nil when the native
+// answer applies (AAAA records exist, NXDOMAIN, errors, no usable A records); the query then
+// continues on the normal cache/upstream path. outcome is "cached" or "dns64".
+func (r *Resolver) dns64Reply(req *dns.Msg, question dns.Question, prefix netip.Prefix, useCache bool) (reply *dns.Msg, outcome, upstreamAddr string) {
+	ctx := context.Background()
+	key := dns64CacheKey(cacheKey(normalizeQueryName(question.Name), question.Qtype, question.Qclass), prefix)
+	useCache = useCache && r.cache != nil
+	if useCache {
+		cached, ttl, _, _, err := r.cache.GetWithTTL(ctx, key)
+		if err == nil && cached != nil && ttl > 0 {
+			reply = cached.Copy()
+			r.cache.ReleaseMsg(cached)
+			reply.Id = req.Id
+			reply.Question = req.Question
+			if r.clientTTLCap > 0 && ttl > r.clientTTLCap {
+				setMsgTTL(reply, r.clientTTLCap)
+			}
+			// Count hits so the sweeper keeps popular synthesized entries refreshed.
+			hitWin, sweepWin, refreshEnabled := r.refresh.hitWindow, r.refresh.sweepHitWindow, r.refresh.enabled
+			go func() {
+				hitCtx, hitCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer hitCancel()
+				if _, err := r.cache.IncrementHit(hitCtx, key, hitWin); err != nil {
+					r.logf(slog.LevelWarn, "cache hit counter failed", "err", err)
+				}
+				if refreshEnabled && sweepWin > 0 {
+					if _, err := r.cache.IncrementSweepHit(hitCtx, key, sweepWin); err != nil {
+						r.logf(slog.LevelWarn, "sweep hit counter failed", "err", err)
+					}
+				}
+			}()
+			return reply, "cached", ""
+		}
+	}
+	synth, upstreamAddr, ok := r.dns64Synthesize(ctx, question, prefix, useCache)
+	if !ok {
+		return nil, "", ""
+	}
+	if useCache {
+		authTTL := responseTTL(synth, r.negativeTTL)
+		if ttl := clampTTL(authTTL, r.minTTL, r.maxTTL, r.respectSourceTTL); ttl > 0 {
+			toCache := synth.Copy()
+			go func() {
+				cacheCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := r.cacheSet(cacheCtx, key, toCache, ttl, authTTL); err != nil {
+					r.logf(slog.LevelError, "dns64 cache set failed", "err", err)
+				}
+			}()
+		}
+	}
+	synth.Id = req.Id
+	synth.Question = req.Question
+	return synth, "dns64", upstreamAddr
+}
+
+// dns64Synthesize looks up the native AAAA and, when it has no usable records, the A records
+// of question's name and returns the synthesized AAAA answer. ok is false when the native
+// answer applies instead.
+func (r *Resolver) dns64Synthesize(ctx context.Context, question dns.Question, prefix netip.Prefix, useCache bool) (msg *dns.Msg, upstreamAddr string, ok bool) {
+	p := r.dns64.Load()
+	native, nativeAddr, err := r.dns64Lookup(ctx, question, useCache)
+	if err != nil || native == nil || native.Rcode != dns.RcodeSuccess {
+		return nil, "", false
+	}
+	for _, rr := range native.Answer {
+		if aaaa, isAAAA := rr.(*dns.AAAA); isAAAA {
+			if addr, valid := netip.AddrFromSlice(aaaa.AAAA); valid && (p == nil || !p.excluded(addr)) {
+				return nil, "", false
+			}
+		}
+	}
+	// RFC 6147 section 5.1.7: the TTL of synthesized records is capped by the SOA minimum of
+	// the negative AAAA answer.
+	var negTTL uint32
+	for _, rr := range native.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			negTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	aQuestion := dns.Question{Name: question.Name, Qtype: dns.TypeA, Qclass: question.Qclass}
+	aResp, aAddr, err := r.dns64Lookup(ctx, aQuestion, useCache)
+	if err != nil || aResp == nil || aResp.Rcode != dns.RcodeSuccess {
+		return nil, "", false
+	}
+	msg = new(dns.Msg)
+	msg.SetQuestion(question.Name, question.Qtype)
+	msg.Question[0].Qclass = question.Qclass
+	msg.Response = true
+	msg.RecursionDesired = true
+	msg.RecursionAvailable = true
+	synthesized := 0
+	for _, rr := range aResp.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			// Keep the alias chain so the client sees how the name was resolved.
+			msg.Answer = append(msg.Answer, dns.Copy(rr))
+		case *dns.A:
+			v4, valid := netip.AddrFromSlice(v.A)
+			if !valid || !dns64Synthesizable(prefix, v4.Unmap()) {
+				continue
+			}
+			ttl := v.Hdr.Ttl
+			if negTTL > 0 && negTTL < ttl {
+				ttl = negTTL
+			}
+			msg.Answer = append(msg.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: v.Hdr.Name, Rrtype: dns.TypeAAAA, Class: v.Hdr.Class, Ttl: ttl},
+				AAAA: synthesizeAAAA(prefix, v4.Unmap()).AsSlice(),
+			})
+			synthesized++
+		}
+	}
+	if synthesized == 0 {
+		return nil, "", false
+	}
+	upstreamAddr = aAddr
+	if upstreamAddr == "" {
+		upstreamAddr = nativeAddr
+	}
+	return msg, upstreamAddr, true
+}
+
+// dns64Lookup resolves question through the cache (when useCache) and upstreams. Upstream
+// answers are cached under the native key, so the normal query path finds them.
+func (r *Resolver) dns64Lookup(ctx context.Context, question dns.Question, useCache bool) (*dns.Msg, string, error) {
+	if r.localRecords != nil {
+		if resp := r.localRecords.Lookup(question); resp != nil {
+			return resp, "", nil
+		}
+	}
+	key := cacheKey(normalizeQueryName(question.Name), question.Qtype, question.Qclass)
+	if useCache {
+		cached, ttl, _, _, err := r.cache.GetWithTTL(ctx, key)
+		if err == nil && cached != nil && ttl > 0 {
+			cp := cached.Copy()
+			r.cache.ReleaseMsg(cached)
+			if r.dnssec != nil {
+				dnssecReply(cp, &dns.Msg{Question: cp.Question})
+			}
+			return cp, "", nil
+		}
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(question.Name, question.Qtype)
+	msg.Question[0].Qclass = question.Qclass
+	validate := r.dnssec != nil
+	if validate {
+		msg = withDNSSEC(msg)
+	}
+	resp, upstreamAddr, err := r.exchangeCoalesced(ctx, key, msg, validate)
+	if err != nil {
+		return nil, upstreamAddr, err
+	}
+	if useCache && (resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError) {
+		authTTL := responseTTL(resp, r.negativeTTL)
+		if ttl := clampTTL(authTTL, r.minTTL, r.maxTTL, r.respectSourceTTL); ttl > 0 {
+			if err := r.cacheSet(ctx, key, resp, ttl, authTTL); err != nil {
+				r.logf(slog.LevelError, "dns64 cache set failed", "err", err)
+			}
+		}
+	}
+	if validate {
+		// The response may be shared with coalesced callers; strip DNSSEC data from a copy.
+		resp = resp.Copy()
+		dnssecReply(resp, &dns.Msg{Question: msg.Question})
+	}
+	return resp, upstreamAddr, nil
+}
+
+// refreshDNS64 re-synthesizes a DNS64 cache entry, or deletes it when the name now has
+// native AAAA records (or no longer resolves).
+func (r *Resolver) refreshDNS64(question dns.Question, key string, prefix netip.Prefix, isHot bool) {
+	ctx, cancel := context.WithTimeout(withRefreshPriority(context.Background()), r.exchangeTimeout()+5*time.Second)
+	defer cancel()
+	synth, upstreamAddr, ok := r.dns64Synthesize(ctx, question, prefix, true)
+	if !ok {
+		r.cache.DeleteCacheKey(ctx, key)
+		return
+	}
+	authTTL := responseTTL(synth, r.negativeTTL)
+	ttl := clampTTL(authTTL, r.minTTL, r.maxTTL, r.respectSourceTTL || isHot)
+	if ttl <= 0 {
+		return
+	}
+	if err := r.cacheSet(ctx, key, synth, ttl, authTTL); err != nil {
+		r.logf(slog.LevelError, "refresh cache set failed", "err", err)
+		return
+	}
+	r.logf(slog.LevelDebug, "refresh completed", "tier", "dns64", "cache_key", key, "qname", question.Name, "upstream", upstreamAddr, "ttl", ttl.String())
+}
+
+// dns64Synthesizable reports whether an A record may be translated with prefix.
+func dns64Synthesizable(prefix netip.Prefix, v4 netip.Addr) bool {
+	if !v4.Is4() {
+		return false
+	}
+	for _, pfx := range dns64ExcludedA {
+		if pfx.Contains(v4) {
+			return false
+		}
+	}
+	if prefix == dns64WellKnownPrefix && (v4.IsPrivate() || cgnatPrefix.Contains(v4)) {
+		return false
+	}
+	return true
+}
+
+// synthesizeAAAA embeds v4 in prefix as specified in RFC 6052 section 2.2: the IPv4 octets
+// follow the prefix, skipping bits 64-71 (the "u" octet), which stay zero.
+func synthesizeAAAA(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := prefix.Masked().Addr().As16()
+	pos := prefix.Bits() / 8
+	for _, octet := range v4.As4() {
+		if pos == 8 {
+			pos++
+		}
+		b[pos] = octet
+		pos++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// embeddedIPv4 extracts the IPv4 address that synthesizeAAAA embedded in addr.
+func embeddedIPv4(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	b := addr.As16()
+	var v4 [4]byte
+	pos := prefix.Bits() / 8
+	for i := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		v4[i] = b[pos]
+		pos++
+	}
+	return netip.AddrFrom4(v4)
+}
+
+// dns64CacheKey returns the cache key of a synthesized answer.
+func dns64CacheKey(baseKey string, prefix netip.Prefix) string {
+	return baseKey + dns64KeySep + prefix.String()
+}
+
+// splitDNS64CacheKey splits a DNS64 cache key into the native key and the prefix.
+// ok is false for other keys.
+func splitDNS64CacheKey(key string) (baseKey string, prefix netip.Prefix, ok bool) {
+	idx := strings.LastIndex(key, dns64KeySep)
+	if idx < 0 {
+		return key, netip.Prefix{}, false
+	}
+	prefix, err := netip.ParsePrefix(key[idx+len(dns64KeySep):])
+	if err != nil {
+		return key, netip.Prefix{}, false
+	}
+	return key[:idx], prefix, true
+}
@@ -0,0 +1,297 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/cache"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+)
+
+func TestSynthesizeAAAA(t *testing.T) {
+	// RFC 6052 section 2.4 examples for 192.0.2.33.
+	v4 := netip.MustParseAddr("192.0.2.33")
+	tests := []struct {
+		prefix, want string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, tt := range tests {
+		got := synthesizeAAAA(netip.MustParsePrefix(tt.prefix), v4)
+		if got != netip.MustParseAddr(tt.want) {
+			t.Errorf("synthesizeAAAA(%s, %s) = %s, want %s", tt.prefix, v4, got, tt.want)
+		}
+	}
+}
+
+func TestEmbeddedIPv4(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.33")
+	for _, prefix := range []string{"2001:db8::/32", "2001:db8:100::/40", "2001:db8:122::/48", "2001:db8:122:300::/56", "2001:db8:122:344::/64", "64:ff9b::/96"} {
+		p := netip.MustParsePrefix(prefix)
+		if got := embeddedIPv4(p, synthesizeAAAA(p, v4)); got != v4 {
+			t.Errorf("embeddedIPv4(%s) = %s, want %s", prefix, got, v4)
+		}
+	}
+}
+
+func TestDNS64Synthesizable(t *testing.T) {
+	wkp := dns64WellKnownPrefix
+	nsp := netip.MustParsePrefix("2001:db8:64::/96")
+	tests := []struct {
+		prefix netip.Prefix
+		addr   string
+		want   bool
+	}{
+		{wkp, "192.0.2.33", true},
+		{wkp, "10.0.0.1", false},
+		{wkp, "100.64.0.1", false},
+		{nsp, "10.0.0.1", true},
+		{nsp, "127.0.0.1", false},
+		{nsp, "169.254.1.1", false},
+		{nsp, "0.1.2.3", false},
+		{nsp, "239.1.1.1", false},
+		{nsp, "255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		if got := dns64Synthesizable(tt.prefix, netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("dns64Synthesizable(%s, %s) = %v, want %v", tt.prefix, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestNewDNS64Policy(t *testing.T) {
+	if p := newDNS64Policy(config.Config{DNS64: config.DNS64Config{Enabled: ptr(false)}}); p != nil {
+		t.Fatalf("expected nil policy when disabled, got %+v", p)
+	}
+
+	p := newDNS64Policy(config.Config{
+		DNS64: config.DNS64Config{Enabled: ptr(false), Prefix: "64:ff9b::/96"},
+		ClientGroups: []config.ClientGroup{
+			{ID: "v6only", DNS64: &config.DNS64Config{Enabled: ptr(true)}},
+			{ID: "lab", DNS64: &config.DNS64Config{Enabled: ptr(true), Prefix: "2001:db8:64::/96"}},
+		},
+	})
+	if p == nil {
+		t.Fatal("expected policy when a group enables DNS64")
+	}
+	if _, ok := p.prefixFor(""); ok {
+		t.Error("DNS64 should be disabled for clients without a group")
+	}
+	if prefix, ok := p.prefixFor("v6only"); !ok || prefix != dns64WellKnownPrefix {
+		t.Errorf("v6only: got %s, %v", prefix, ok)
+	}
+	if prefix, ok := p.prefixFor("lab"); !ok || prefix.String() != "2001:db8:64::/96" {
+		t.Errorf("lab: got %s, %v", prefix, ok)
+	}
+	if !p.excluded(netip.MustParseAddr("::ffff:192.0.2.1")) || p.excluded(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("default exclusion set should be ::ffff:0:0/96")
+	}
+
+	p = newDNS64Policy(config.Config{
+		DNS64:        config.DNS64Config{Enabled: ptr(true), Prefix: "64:ff9b::/96"},
+		ClientGroups: []config.ClientGroup{{ID: "dualstack", DNS64: &config.DNS64Config{Enabled: ptr(false)}}},
+	})
+	if _, ok := p.prefixFor("dualstack"); ok {
+		t.Error("group opt-out should disable DNS64")
+	}
+	if _, ok := p.prefixFor("other"); !ok {
+		t.Error("groups without an override should inherit the global setting")
+	}
+}
+
+func TestDNS64CacheKey(t *testing.T) {
+	prefix := netip.MustParsePrefix("64:ff9b::/96")
+	key := dns64CacheKey(cacheKey("example.com", dns.TypeAAAA, dns.ClassINET), prefix)
+	if key != "dns:example.com:28:1:dns64=64:ff9b::/96" {
+		t.Fatalf("dns64CacheKey = %q", key)
+	}
+	base, got, ok := splitDNS64CacheKey(key)
+	if !ok || base != "dns:example.com:28:1" || got != prefix {
+		t.Errorf("splitDNS64CacheKey = %q, %s, %v", base, got, ok)
+	}
+	if _, _, ok := splitDNS64CacheKey("dns:example.com:28:1"); ok {
+		t.Error("native key should not split")
+	}
+	qname, qtype, qclass, ok := parseCacheKey(key)
+	if !ok || qname != "example.com" || qtype != dns.TypeAAAA || qclass != dns.ClassINET {
+		t.Errorf("parseCacheKey(%q) = %q, %d, %d, %v", key, qname, qtype, qclass, ok)
+	}
+}
+
+// dns64Upstream serves A and AAAA records for a few test names.
+func dns64Upstream(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:  "ns.example.", Mbox: "hostmaster.example.", Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 120,
+	}
+	a := func(name, ip string) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600}, A: net.ParseIP(ip)}
+	}
+	aaaa := func(name, ip string) dns.RR {
+		return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 600}, AAAA: net.ParseIP(ip)}
+	}
+	switch q.Name {
+	case "v4only.example.", "ads.example.":
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, a(q.Name, "192.0.2.33"), a(q.Name, "10.0.0.1"))
+		} else {
+			resp.Ns = append(resp.Ns, soa)
+		}
+	case "alias.example.":
+		resp.Answer = append(resp.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 600}, Target: "v4only.example."})
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, a("v4only.example.", "192.0.2.33"))
+		} else {
+			resp.Ns = append(resp.Ns, soa)
+		}
+	case "dual.example.":
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, a(q.Name, "192.0.2.34"))
+		} else {
+			resp.Answer = append(resp.Answer, aaaa(q.Name, "2001:db8::34"))
+		}
+	case "mapped.example.":
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, a(q.Name, "198.51.100.7"))
+		} else {
+			resp.Answer = append(resp.Answer, aaaa(q.Name, "::ffff:198.51.100.7"))
+		}
+	default:
+		resp.Rcode = dns.RcodeNameError
+		resp.Ns = append(resp.Ns, soa)
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func TestResolverDNS64(t *testing.T) {
+	upstreamAddr := newDNSServerUDP(t, dns.HandlerFunc(dns64Upstream))
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "test", Address: upstreamAddr, Protocol: "udp"}}
+	cfg.DNS64 = config.DNS64Config{Enabled: ptr(false), Prefix: "64:ff9b::/96"}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{IP: "192.168.1.64", Name: "v6 phone", GroupID: "v6only"}},
+	}
+	cfg.ClientGroups = []config.ClientGroup{{ID: "v6only", Name: "IPv6-only", DNS64: &config.DNS64Config{Enabled: ptr(true)}}}
+	cfg.Blocklists.Denylist = []string{"ads.example"}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	mockCache := cache.NewMockCache()
+	resolver := buildTestResolver(t, cfg, mockCache, blMgr, nil)
+
+	query := func(client, name string, cd bool) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeAAAA)
+		req.CheckingDisabled = cd
+		w := &mockResponseWriter{remoteAddr: client}
+		resolver.ServeDNS(w, req)
+		if w.written == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.written
+	}
+	aaaas := func(resp *dns.Msg) []string {
+		var out []string
+		for _, rr := range resp.Answer {
+			if v, ok := rr.(*dns.AAAA); ok {
+				out = append(out, v.AAAA.String())
+			}
+		}
+		return out
+	}
+
+	// Only the global A record is synthesized with the well-known prefix; the TTL is capped
+	// by the SOA minimum of the negative AAAA answer.
+	resp := query("192.168.1.64", "v4only.example.", false)
+	if got := aaaas(resp); len(got) != 1 || got[0] != "64:ff9b::c000:221" {
+		t.Fatalf("v4only: got %v (%v)", got, resp)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 120 {
+		t.Errorf("synthesized TTL = %d, want 120", ttl)
+	}
+	waitForCacheEntry(t, mockCache, "dns:v4only.example:28:1:dns64=64:ff9b::/96")
+
+	// Clients outside the group get the native NODATA, not the cached synthesized answer.
+	if resp := query("192.168.1.2", "v4only.example.", false); len(resp.Answer) != 0 || resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("non-DNS64 client: expected NODATA, got %v", resp)
+	}
+	if cached, _, _, _, _ := mockCache.GetWithTTL(context.Background(), "dns:v4only.example:28:1"); cached == nil || len(cached.Answer) != 0 {
+		t.Errorf("native cache entry should stay NODATA, got %v", cached)
+	}
+	if resp := query("192.168.1.64", "v4only.example.", false); len(aaaas(resp)) != 1 {
+		t.Errorf("cached synthesized answer: got %v", resp)
+	}
+
+	// The CNAME chain is kept.
+	resp = query("192.168.1.64", "alias.example.", false)
+	if len(resp.Answer) != 2 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME || aaaas(resp)[0] != "64:ff9b::c000:221" {
+		t.Errorf("alias: got %v", resp)
+	}
+	// Native AAAA records win; excluded (IPv4-mapped) ones do not.
+	if got := aaaas(query("192.168.1.64", "dual.example.", false)); len(got) != 1 || got[0] != "2001:db8::34" {
+		t.Errorf("dual: got %v", got)
+	}
+	if got := aaaas(query("192.168.1.64", "mapped.example.", false)); len(got) != 1 || got[0] != "64:ff9b::c633:6407" {
+		t.Errorf("mapped: got %v", got)
+	}
+	// NXDOMAIN is returned as is; CD clients get the native answer; blocking wins.
+	if resp := query("192.168.1.64", "missing.example.", false); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("missing: expected NXDOMAIN, got %v", resp)
+	}
+	if resp := query("192.168.1.64", "v4only.example.", true); len(resp.Answer) != 0 {
+		t.Errorf("CD client: expected native NODATA, got %v", resp)
+	}
+	if resp := query("192.168.1.64", "ads.example.", false); resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Errorf("blocked name must not be synthesized, got %v", resp)
+	}
+
+	// Hot-reload: enabling DNS64 globally with a network-specific prefix.
+	cfg.DNS64 = config.DNS64Config{Enabled: ptr(true), Prefix: "2001:db8:64::/96"}
+	cfg.ClientGroups = nil
+	resolver.ApplyDNS64Config(cfg)
+	if got := aaaas(query("192.168.1.2", "v4only.example.", false)); len(got) != 2 || got[0] != "2001:db8:64::c000:221" || got[1] != "2001:db8:64::a00:1" {
+		t.Errorf("network-specific prefix: got %v", got)
+	}
+}
+
+func TestResolverDNS64Refresh(t *testing.T) {
+	upstreamAddr := newDNSServerUDP(t, dns.HandlerFunc(dns64Upstream))
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "test", Address: upstreamAddr, Protocol: "udp"}}
+	cfg.DNS64 = config.DNS64Config{Enabled: ptr(true), Prefix: "64:ff9b::/96"}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	mockCache := cache.NewMockCache()
+	resolver := buildTestResolver(t, cfg, mockCache, blMgr, nil)
+
+	key := "dns:v4only.example:28:1:dns64=64:ff9b::/96"
+	resolver.refreshCache(dns.Question{Name: "v4only.example.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, key, false, false, false)
+	cached, ttl, _, _, _ := mockCache.GetWithTTL(context.Background(), key)
+	if cached == nil || ttl <= 0 || len(cached.Answer) != 1 {
+		t.Fatalf("refresh should store the synthesized answer, got %v", cached)
+	}
+
+	// A name that now has native AAAA records loses its synthesized entry.
+	dualKey := "dns:dual.example:28:1:dns64=64:ff9b::/96"
+	mockCache.SetEntry(dualKey, cached, time.Minute)
+	resolver.refreshCache(dns.Question{Name: "dual.example.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, dualKey, false, false, false)
+	if m, _, _, _, _ := mockCache.GetWithTTL(context.Background(), dualKey); m != nil {
+		t.Errorf("expected stale DNS64 entry to be deleted, got %v", m)
+	}
+}
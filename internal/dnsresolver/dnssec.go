@@ -0,0 +1,847 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnssecState is the result of validating an answer.
+type dnssecState int
+
+const (
+	dnssecInsecure dnssecState = iota // provably unsigned, or no trust anchor covers the name
+	dnssecSecure                      // signatures validated up to a trust anchor
+	dnssecBogus                       // signatures missing or invalid where the chain of trust requires them
+)
+
+func (s dnssecState) String() string {
+	switch s {
+	case dnssecSecure:
+		return "secure"
+	case dnssecBogus:
+		return "bogus"
+	default:
+		return "insecure"
+	}
+}
+
+// rootTrustAnchors are the IANA root zone KSK DS records (KSK-2017 and KSK-2024),
+// used when dnssec.trust_anchors is empty.
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	dnssecMaxDepth        = 16               // max chain of trust length (zones) before giving up
+	dnssecMaxCNAMEChain   = 16               // max CNAMEs followed to find the answer target
+	dnssecMaxCacheTTL     = time.Hour        // cap on how long DS/DNSKEY lookups and validated keys are reused
+	dnssecMinCacheTTL     = 5 * time.Second  // floor so zero-TTL answers do not cause a lookup per query
+	dnssecBogusCacheTTL   = 30 * time.Second // how long a zone with a broken chain of trust stays bogus
+	dnssecMaxCacheEntries = 10000            // lookup and key caches are reset when they grow past this
+)
+
+// dnssecBogusError is returned for answers that fail validation. The reason is reported
+// to the client as Extended DNS Error extra text.
+type dnssecBogusError struct {
+	reason string
+}
+
+func (e *dnssecBogusError) Error() string { return "dnssec validation failed: " + e.reason }
+
+// dnssecValidator validates answers from upstream resolvers against configured trust
+// anchors, fetching DS and DNSKEY records through query as needed. DNSKEY sets that
+// validate, zones proven insecure, and the DS/DNSKEY lookups themselves are cached.
+type dnssecValidator struct {
+	anchors map[string][]*dns.DS // zone -> trusted DS records (DNSKEY anchors converted to DS)
+	query   func(name string, qtype uint16) (*dns.Msg, error)
+	now     func() time.Time
+
+	mu      sync.Mutex
+	lookups map[string]dnssecLookup // "name/qtype" -> upstream response
+	keys    map[string]dnssecZoneKeys
+	cuts    map[string]time.Time // insecure delegation points -> expiry
+}
+
+type dnssecLookup struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+type dnssecZoneKeys struct {
+	keys    []*dns.DNSKEY
+	state   dnssecState
+	reason  string
+	expires time.Time
+}
+
+// rrset is the records of one name and type in a section, with the RRSIGs covering them.
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// newDNSSECValidator parses anchors (DS or DNSKEY records in zone file format; the root
+// KSKs when empty) and returns a validator that fetches DS/DNSKEY records with query.
+func newDNSSECValidator(anchors []string, query func(name string, qtype uint16) (*dns.Msg, error)) (*dnssecValidator, error) {
+	if len(anchors) == 0 {
+		anchors = rootTrustAnchors
+	}
+	v := &dnssecValidator{
+		anchors: make(map[string][]*dns.DS),
+		query:   query,
+		now:     time.Now,
+		lookups: make(map[string]dnssecLookup),
+		keys:    make(map[string]dnssecZoneKeys),
+		cuts:    make(map[string]time.Time),
+	}
+	for _, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %v", s, err)
+		}
+		zone := canonicalName(rr.Header().Name)
+		switch a := rr.(type) {
+		case *dns.DS:
+			v.anchors[zone] = append(v.anchors[zone], a)
+		case *dns.DNSKEY:
+			ds := a.ToDS(dns.SHA256)
+			if ds == nil {
+				return nil, fmt.Errorf("trust anchor %q: unsupported DNSKEY", s)
+			}
+			v.anchors[zone] = append(v.anchors[zone], ds)
+		default:
+			return nil, fmt.Errorf("trust anchor %q must be a DS or DNSKEY record", s)
+		}
+	}
+	return v, nil
+}
+
+// validate returns whether resp, an answer to q fetched with DO set, is secure, insecure
+// or bogus. For bogus answers reason says what failed.
+func (v *dnssecValidator) validate(resp *dns.Msg, q dns.Question) (dnssecState, string) {
+	state := dnssecSecure
+	answerSets := rrsets(resp.Answer)
+
+	// DNAME answers carry a CNAME synthesized by the server, which is never signed.
+	var dnames []string
+	for _, set := range answerSets {
+		if set.rrtype == dns.TypeDNAME && len(set.sigs) > 0 {
+			dnames = append(dnames, set.name)
+		}
+	}
+	for _, set := range answerSets {
+		if set.rrtype == dns.TypeCNAME && len(set.sigs) == 0 && underAny(set.name, dnames) {
+			continue
+		}
+		s, reason := v.verifyRRset(set, 0)
+		if s == dnssecBogus {
+			return s, reason
+		}
+		if s == dnssecInsecure {
+			state = dnssecInsecure
+		}
+	}
+
+	// Authority: SOA and NSEC/NSEC3 prove negative answers. Other records (NS) are not
+	// part of the answer and are not validated.
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range rrsets(resp.Ns) {
+		if set.rrtype != dns.TypeSOA && set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		s, reason := v.verifyRRset(set, 0)
+		if s == dnssecBogus {
+			return s, reason
+		}
+		if s == dnssecInsecure {
+			state = dnssecInsecure
+			continue
+		}
+		for _, rr := range set.rrs {
+			switch d := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, d)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, d)
+			}
+		}
+	}
+
+	target, positive := answerTarget(resp.Answer, q)
+	if positive || state == dnssecInsecure || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return state, ""
+	}
+	// Negative answer (NXDOMAIN or NODATA) for target.
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		s, reason := v.nameStatus(target, 0)
+		if s == dnssecSecure {
+			return dnssecBogus, "missing denial of existence for " + target
+		}
+		return s, reason
+	}
+	if !denialProven(nsecs, nsec3s, target, q.Qtype, resp.Rcode == dns.RcodeNameError) {
+		return dnssecBogus, "denial of existence does not prove " + target
+	}
+	return dnssecSecure, ""
+}
+
+// verifyRRset validates one RRset: it must carry an RRSIG made by a validated key of a
+// zone at or above its owner, unless the owner is under an insecure delegation.
+func (v *dnssecValidator) verifyRRset(set rrset, depth int) (dnssecState, string) {
+	if len(set.sigs) == 0 {
+		s, reason := v.nameStatus(set.name, depth)
+		if s == dnssecSecure {
+			return dnssecBogus, fmt.Sprintf("missing RRSIG for %s %s", set.name, dns.TypeToString[set.rrtype])
+		}
+		return s, reason
+	}
+	reason := fmt.Sprintf("no valid RRSIG for %s %s", set.name, dns.TypeToString[set.rrtype])
+	for _, sig := range set.sigs {
+		signer := canonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, set.name) {
+			continue
+		}
+		keys, s, keysReason := v.zoneKeys(signer, depth+1)
+		switch s {
+		case dnssecInsecure:
+			return dnssecInsecure, ""
+		case dnssecBogus:
+			reason = keysReason
+			continue
+		}
+		if err := verifySignature(sig, keys, set.rrs, v.now()); err != nil {
+			reason = fmt.Sprintf("RRSIG for %s %s: %v", set.name, dns.TypeToString[set.rrtype], err)
+			continue
+		}
+		return dnssecSecure, ""
+	}
+	return dnssecBogus, reason
+}
+
+// verifySignature checks sig over rrs with any of keys matching its key tag and algorithm.
+func verifySignature(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR, now time.Time) error {
+	if !sig.ValidityPeriod(now) {
+		return fmt.Errorf("signature by %s (key %d) expired or not yet valid", sig.SignerName, sig.KeyTag)
+	}
+	err := fmt.Errorf("no DNSKEY %d for signer %s", sig.KeyTag, sig.SignerName)
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err = sig.Verify(key, rrs); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// zoneKeys returns the validated DNSKEYs of zone. The DNSKEY set must be signed by a key
+// matching a trust anchor or a DS record that itself validates in the parent zone.
+func (v *dnssecValidator) zoneKeys(zone string, depth int) ([]*dns.DNSKEY, dnssecState, string) {
+	zone = canonicalName(zone)
+	if depth > dnssecMaxDepth {
+		return nil, dnssecBogus, "chain of trust too long at " + zone
+	}
+	now := v.now()
+	v.mu.Lock()
+	if zk, ok := v.keys[zone]; ok && now.Before(zk.expires) {
+		v.mu.Unlock()
+		return zk.keys, zk.state, zk.reason
+	}
+	v.mu.Unlock()
+
+	keys, state, reason, ttl := v.fetchZoneKeys(zone, depth)
+	if state == dnssecBogus {
+		ttl = dnssecBogusCacheTTL
+	}
+	v.mu.Lock()
+	if len(v.keys) >= dnssecMaxCacheEntries {
+		v.keys = make(map[string]dnssecZoneKeys)
+	}
+	v.keys[zone] = dnssecZoneKeys{keys: keys, state: state, reason: reason, expires: now.Add(ttl)}
+	v.mu.Unlock()
+	return keys, state, reason
+}
+
+func (v *dnssecValidator) fetchZoneKeys(zone string, depth int) ([]*dns.DNSKEY, dnssecState, string, time.Duration) {
+	ttl := dnssecMaxCacheTTL
+	ds, anchored := v.anchors[zone]
+	if !anchored {
+		if v.closestAnchor(zone) == "" {
+			return nil, dnssecInsecure, "", ttl
+		}
+		resp, err := v.lookup(zone, dns.TypeDS)
+		if err != nil {
+			return nil, dnssecBogus, fmt.Sprintf("DS lookup for %s: %v", zone, err), ttl
+		}
+		dsSet, ok := findRRset(resp.Answer, zone, dns.TypeDS)
+		if !ok {
+			// No DS: the parent must prove this is an insecure delegation.
+			switch s, reason := v.noDSStatus(resp, zone, depth); s {
+			case dnssecInsecure:
+				return nil, dnssecInsecure, "", msgTTL(resp)
+			case dnssecSecure:
+				return nil, dnssecBogus, "no DS for " + zone + " and it is not a delegation", ttl
+			default:
+				return nil, dnssecBogus, reason, ttl
+			}
+		}
+		if s, reason := v.verifyRRset(dsSet, depth); s != dnssecSecure {
+			return nil, s, reason, ttl
+		}
+		for _, rr := range dsSet.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		ttl = min(ttl, msgTTL(resp))
+	}
+	if !anySupportedDS(ds) {
+		// RFC 4035 5.2: a zone whose DS records all use unknown algorithms is treated as unsigned.
+		return nil, dnssecInsecure, "", ttl
+	}
+
+	resp, err := v.lookup(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, dnssecBogus, fmt.Sprintf("DNSKEY lookup for %s: %v", zone, err), ttl
+	}
+	keySet, ok := findRRset(resp.Answer, zone, dns.TypeDNSKEY)
+	if !ok {
+		return nil, dnssecBogus, "no DNSKEY for " + zone, ttl
+	}
+	var keys, trusted []*dns.DNSKEY
+	for _, rr := range keySet.rrs {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.ZONE != 0 {
+			keys = append(keys, key)
+		}
+		for _, d := range ds {
+			if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+				continue
+			}
+			if kd := key.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, dnssecBogus, "no DNSKEY for " + zone + " matches its DS", ttl
+	}
+	for _, sig := range keySet.sigs {
+		if canonicalName(sig.SignerName) != zone {
+			continue
+		}
+		if verifySignature(sig, trusted, keySet.rrs, v.now()) == nil {
+			return keys, dnssecSecure, "", min(ttl, msgTTL(resp))
+		}
+	}
+	return nil, dnssecBogus, "DNSKEY set for " + zone + " is not signed by a key matching its DS", ttl
+}
+
+// nameStatus reports whether name lies in a signed zone (secure: unsigned data for it is
+// bogus) or under an insecure delegation. It walks down from the closest trust anchor,
+// asking for the DS of each ancestor until a delegation is proven insecure.
+func (v *dnssecValidator) nameStatus(name string, depth int) (dnssecState, string) {
+	name = canonicalName(name)
+	anchor := v.closestAnchor(name)
+	if anchor == "" {
+		return dnssecInsecure, ""
+	}
+	if v.underInsecureCut(name) {
+		return dnssecInsecure, ""
+	}
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(anchor) - 1; i >= 0; i-- {
+		cut := dns.Fqdn(strings.Join(labels[i:], "."))
+		resp, err := v.lookup(cut, dns.TypeDS)
+		if err != nil {
+			return dnssecBogus, fmt.Sprintf("DS lookup for %s: %v", cut, err)
+		}
+		if _, ok := findRRset(resp.Answer, cut, dns.TypeDS); ok {
+			_, s, reason := v.zoneKeys(cut, depth+1)
+			switch s {
+			case dnssecInsecure:
+				v.addInsecureCut(cut, msgTTL(resp))
+				return dnssecInsecure, ""
+			case dnssecBogus:
+				return dnssecBogus, reason
+			}
+			continue
+		}
+		s, reason := v.noDSStatus(resp, cut, depth)
+		switch s {
+		case dnssecInsecure:
+			v.addInsecureCut(cut, msgTTL(resp))
+			return dnssecInsecure, ""
+		case dnssecBogus:
+			return dnssecBogus, reason
+		}
+	}
+	return dnssecSecure, ""
+}
+
+// noDSStatus checks the signed NSEC/NSEC3 records in resp, a DS query for name without a
+// DS answer. It returns insecure when they prove name is a delegation without DS (or is
+// covered by an NSEC3 opt-out span), secure when they prove name is not a delegation, and
+// bogus when the proof is missing or does not validate.
+func (v *dnssecValidator) noDSStatus(resp *dns.Msg, name string, depth int) (dnssecState, string) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range rrsets(resp.Ns) {
+		if set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		s, reason := v.verifyRRset(set, depth+1)
+		if s != dnssecSecure {
+			// An insecure parent makes everything below it insecure.
+			return s, reason
+		}
+		for _, rr := range set.rrs {
+			switch d := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, d)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, d)
+			}
+		}
+	}
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		return dnssecBogus, "absence of DS for " + name + " is not proven"
+	}
+	for _, n := range nsecs {
+		if canonicalName(n.Hdr.Name) == name {
+			if isInsecureDelegation(n.TypeBitMap) {
+				return dnssecInsecure, ""
+			}
+			return dnssecSecure, ""
+		}
+		if nsecCovers(n, name) {
+			return dnssecSecure, ""
+		}
+	}
+	for _, n := range nsec3s {
+		if n.Match(name) {
+			if isInsecureDelegation(n.TypeBitMap) {
+				return dnssecInsecure, ""
+			}
+			return dnssecSecure, ""
+		}
+	}
+	if _, nextCloser, ok := closestEncloser(nsec3s, name); ok {
+		for _, n := range nsec3s {
+			if n.Cover(nextCloser) {
+				if n.Flags&1 != 0 { // opt-out: unsigned delegations may exist in this span
+					return dnssecInsecure, ""
+				}
+				return dnssecSecure, ""
+			}
+		}
+	}
+	return dnssecBogus, "absence of DS for " + name + " is not proven"
+}
+
+// lookup fetches name/qtype through query, reusing responses until their TTL expires.
+// The returned message is shared and must not be modified.
+func (v *dnssecValidator) lookup(name string, qtype uint16) (*dns.Msg, error) {
+	key := name + "/" + strconv.Itoa(int(qtype))
+	now := v.now()
+	v.mu.Lock()
+	if l, ok := v.lookups[key]; ok && now.Before(l.expires) {
+		v.mu.Unlock()
+		return l.msg, nil
+	}
+	v.mu.Unlock()
+
+	resp, err := v.query(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("no response")
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+	v.mu.Lock()
+	if len(v.lookups) >= dnssecMaxCacheEntries {
+		v.lookups = make(map[string]dnssecLookup)
+	}
+	v.lookups[key] = dnssecLookup{msg: resp, expires: now.Add(msgTTL(resp))}
+	v.mu.Unlock()
+	return resp, nil
+}
+
+func (v *dnssecValidator) closestAnchor(name string) string {
+	for zone := canonicalName(name); ; {
+		if _, ok := v.anchors[zone]; ok {
+			return zone
+		}
+		if zone == "." {
+			return ""
+		}
+		zone = parentZone(zone)
+	}
+}
+
+func (v *dnssecValidator) underInsecureCut(name string) bool {
+	now := v.now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for zone := name; ; zone = parentZone(zone) {
+		if exp, ok := v.cuts[zone]; ok && now.Before(exp) {
+			return true
+		}
+		if zone == "." {
+			return false
+		}
+	}
+}
+
+func (v *dnssecValidator) addInsecureCut(zone string, ttl time.Duration) {
+	v.mu.Lock()
+	if len(v.cuts) >= dnssecMaxCacheEntries {
+		v.cuts = make(map[string]time.Time)
+	}
+	v.cuts[zone] = v.now().Add(ttl)
+	v.mu.Unlock()
+}
+
+// denialProven reports whether the NSEC or NSEC3 records prove that target does not
+// exist (nxdomain) or has no qtype records (NODATA). Wildcard non-existence is not checked.
+func denialProven(nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, target string, qtype uint16, nxdomain bool) bool {
+	for _, n := range nsecs {
+		owner := canonicalName(n.Hdr.Name)
+		if nxdomain {
+			if nsecCovers(n, target) {
+				return true
+			}
+			continue
+		}
+		if owner == target && !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME) {
+			return true
+		}
+		// Empty non-terminal: the NSEC before it points at one of its descendants.
+		if nsecCovers(n, target) && dns.IsSubDomain(target, canonicalName(n.NextDomain)) {
+			return true
+		}
+	}
+	if len(nsec3s) == 0 {
+		return false
+	}
+	if !nxdomain {
+		for _, n := range nsec3s {
+			if n.Match(target) {
+				return !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+		if qtype != dns.TypeDS {
+			return false
+		}
+		// DS NODATA for a name in an opt-out span (RFC 5155 6).
+	}
+	_, nextCloser, ok := closestEncloser(nsec3s, target)
+	if !ok {
+		return false
+	}
+	for _, n := range nsec3s {
+		if n.Cover(nextCloser) {
+			return nxdomain || n.Flags&1 != 0
+		}
+	}
+	return false
+}
+
+// closestEncloser finds the longest ancestor of name that an NSEC3 record matches and
+// returns it with the next closer name (its child on the way to name).
+func closestEncloser(nsec3s []*dns.NSEC3, name string) (encloser, nextCloser string, ok bool) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		ce := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, n := range nsec3s {
+			if n.Match(ce) {
+				return ce, dns.Fqdn(strings.Join(labels[i-1:], ".")), true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// isInsecureDelegation reports whether an NSEC/NSEC3 type bitmap describes a delegation
+// point (NS, no SOA) without a DS record.
+func isInsecureDelegation(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) && !hasType(bitmap, dns.TypeDS)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name falls strictly between the owner and next name of n
+// in canonical order, i.e. n proves name does not exist.
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner, next := canonicalName(n.Hdr.Name), canonicalName(n.NextDomain)
+	afterOwner := canonicalCompare(owner, name) < 0
+	beforeNext := canonicalCompare(name, next) < 0
+	if canonicalCompare(owner, next) < 0 {
+		return afterOwner && beforeNext
+	}
+	// Last NSEC in the zone: next wraps around to the apex.
+	return afterOwner && dns.IsSubDomain(next, name)
+}
+
+// canonicalCompare orders domain names as in RFC 4034 6.1: label by label from the
+// right, comparing lowercase label bytes.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// answerTarget follows CNAMEs in answer from the question name. positive is true when
+// the answer holds records of the question type for the final name.
+func answerTarget(answer []dns.RR, q dns.Question) (target string, positive bool) {
+	target = canonicalName(q.Name)
+	for i := 0; i < dnssecMaxCNAMEChain; i++ {
+		next := ""
+		for _, rr := range answer {
+			h := rr.Header()
+			if canonicalName(h.Name) != target {
+				continue
+			}
+			if h.Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				return target, true
+			}
+			if c, ok := rr.(*dns.CNAME); ok {
+				next = canonicalName(c.Target)
+			}
+		}
+		if next == "" {
+			return target, false
+		}
+		target = next
+	}
+	return target, false
+}
+
+// rrsets groups records by owner and type, attaching the RRSIGs that cover each set.
+// OPT records are skipped.
+func rrsets(rrs []dns.RR) []rrset {
+	var sets []rrset
+	index := make(map[string]int)
+	setFor := func(name string, t uint16) *rrset {
+		key := name + "/" + strconv.Itoa(int(t))
+		i, ok := index[key]
+		if !ok {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, rrset{name: name, rrtype: t})
+		}
+		return &sets[i]
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		name := canonicalName(h.Name)
+		switch r := rr.(type) {
+		case *dns.OPT:
+			continue
+		case *dns.RRSIG:
+			set := setFor(name, r.TypeCovered)
+			set.sigs = append(set.sigs, r)
+		default:
+			set := setFor(name, h.Rrtype)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	// RRSIGs whose covered set is absent leave empty sets behind; drop them.
+	out := sets[:0]
+	for _, s := range sets {
+		if len(s.rrs) > 0 {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func findRRset(rrs []dns.RR, name string, t uint16) (rrset, bool) {
+	for _, set := range rrsets(rrs) {
+		if set.name == name && set.rrtype == t {
+			return set, true
+		}
+	}
+	return rrset{}, false
+}
+
+func anySupportedDS(ds []*dns.DS) bool {
+	for _, d := range ds {
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+		default:
+			continue
+		}
+		switch d.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+			dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+			return true
+		}
+	}
+	return false
+}
+
+// msgTTL is the lowest TTL in msg, clamped to the validator's cache TTL bounds.
+func msgTTL(msg *dns.Msg) time.Duration {
+	ttl := dnssecMaxCacheTTL
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	return max(ttl, dnssecMinCacheTTL)
+}
+
+func underAny(name string, zones []string) bool {
+	for _, z := range zones {
+		if name != z && dns.IsSubDomain(z, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+func parentZone(zone string) string {
+	if zone == "." {
+		return "."
+	}
+	if i, end := dns.NextLabel(zone, 0); !end {
+		return zone[i:]
+	}
+	return "."
+}
+
+// clientDO reports whether req set the DNSSEC OK bit.
+func clientDO(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// dnssecCacheKey appends the client's DO and CD bits to key: a DO client must never get a
+// cached answer without signatures, and an answer fetched with checking disabled must not
+// be served to clients that expect validation.
+func dnssecCacheKey(key string, do, cd bool) string {
+	if do {
+		key += ":do"
+	}
+	if cd {
+		key += ":cd"
+	}
+	return key
+}
+
+// splitDNSSECCacheKey removes the DO/CD suffixes added by dnssecCacheKey.
+func splitDNSSECCacheKey(key string) (base string, do, cd bool) {
+	if strings.HasSuffix(key, ":cd") {
+		key, cd = strings.TrimSuffix(key, ":cd"), true
+	}
+	if strings.HasSuffix(key, ":do") {
+		key, do = strings.TrimSuffix(key, ":do"), true
+	}
+	return key, do, cd
+}
+
+// withDNSSEC returns req with DO and CD set, as sent upstream when validating: CD makes
+// the upstream return data it considers bogus so the validator decides. req is copied
+// only if it changes.
+func withDNSSEC(req *dns.Msg) *dns.Msg {
+	if req.CheckingDisabled && clientDO(req) {
+		return req
+	}
+	out := req.Copy()
+	out.CheckingDisabled = true
+	opt := out.IsEdns0()
+	if opt == nil {
+		out.SetEdns0(ednsUDPSize, true)
+	} else {
+		opt.SetDo()
+	}
+	return out
+}
+
+// dnssecReply shapes a response fetched with DO for the client query req: DNSSEC records
+// are removed unless the client set DO (RFC 4035 3.2.1), AD is kept only for clients that
+// set DO or AD (RFC 6840 5.7), CD echoes the client, and an OPT record the client did not
+// send is dropped. resp is modified in place.
+func dnssecReply(resp, req *dns.Msg) {
+	do := clientDO(req)
+	if !do {
+		var qtype uint16
+		if len(req.Question) > 0 {
+			qtype = req.Question[0].Qtype
+		}
+		resp.Answer = stripDNSSECRecords(resp.Answer, qtype)
+		resp.Ns = stripDNSSECRecords(resp.Ns, 0)
+		resp.Extra = stripDNSSECRecords(resp.Extra, 0)
+		if !req.AuthenticatedData {
+			resp.AuthenticatedData = false
+		}
+	}
+	resp.CheckingDisabled = req.CheckingDisabled
+	if req.IsEdns0() == nil {
+		extra := resp.Extra[:0:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+	} else if opt := resp.IsEdns0(); opt != nil && !do {
+		opt.SetDo(false)
+	}
+}
+
+// stripDNSSECRecords returns rrs without RRSIG, NSEC and NSEC3 records, except those of
+// the type the client asked for.
+func stripDNSSECRecords(rrs []dns.RR, qtype uint16) []dns.RR {
+	out := rrs[:0:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// dnssecBogusReply is the SERVFAIL returned for answers that fail validation, with
+// Extended DNS Error 6 (DNSSEC Bogus) when the client sent EDNS.
+func dnssecBogusReply(req *dns.Msg, reason string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	addEDE(resp, req, dns.ExtendedErrorCodeDNSBogus, reason)
+	return resp
+}
@@ -0,0 +1,397 @@
+package dnsresolver
+
+import (
+	"crypto"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testSignedZones is a locally signed hierarchy for offline validation tests:
+//
+//	example.           signed, trust anchor (DS in anchor)
+//	www.example.       A 192.0.2.1
+//	bad.example.       A 192.0.2.66 with a signature over different data
+//	sub.example.       signed child zone (DS in example.), host.sub.example. A 192.0.2.2
+//	insecure.example.  unsigned delegation (NSEC proves no DS), host.insecure.example. A 192.0.2.3
+//
+// The NSEC chain of example. is example. -> insecure. -> sub. -> www. -> example.
+type testSignedZones struct {
+	anchor  string
+	answers map[string]*dns.Msg // "name/qtype" -> response
+}
+
+type testZoneKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZoneKey(t *testing.T, zone string) testZoneKey {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("generate key for %s: %v", zone, err)
+	}
+	return testZoneKey{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrs followed by their RRSIG, valid from one hour ago for two hours.
+func (k testZoneKey) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		Algorithm:  k.key.Algorithm,
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(k.priv, rrs); err != nil {
+		t.Fatalf("sign %s: %v", rrs[0].Header().Name, err)
+	}
+	return append(append([]dns.RR{}, rrs...), sig)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("NewRR(%q): %v", s, err)
+	}
+	return rr
+}
+
+func newTestSignedZones(t *testing.T) *testSignedZones {
+	t.Helper()
+	example := newTestZoneKey(t, "example.")
+	sub := newTestZoneKey(t, "sub.example.")
+	z := &testSignedZones{
+		anchor:  example.key.ToDS(dns.SHA256).String(),
+		answers: make(map[string]*dns.Msg),
+	}
+	rr := func(s string) dns.RR { return testRR(t, s) }
+	soa := example.sign(t, rr("example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 300"))
+	nsec := func(owner, next string, types ...uint16) []dns.RR {
+		return example.sign(t, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: next,
+			TypeBitMap: types,
+		})
+	}
+	add := func(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.Response = true
+		m.Authoritative = true
+		m.Rcode = rcode
+		m.Answer = answer
+		m.Ns = ns
+		z.answers[fmt.Sprintf("%s/%d", name, qtype)] = m
+	}
+
+	add("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.sign(t, example.key), nil)
+	add("sub.example.", dns.TypeDNSKEY, dns.RcodeSuccess, sub.sign(t, sub.key), nil)
+	subDS := sub.key.ToDS(dns.SHA256)
+	subDS.Hdr.Ttl = 3600
+	add("sub.example.", dns.TypeDS, dns.RcodeSuccess, example.sign(t, subDS), nil)
+	add("insecure.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		append(append([]dns.RR{}, soa...), nsec("insecure.example.", "sub.example.", dns.TypeNS, dns.TypeNSEC, dns.TypeRRSIG)...))
+	add("www.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		append(append([]dns.RR{}, soa...), nsec("www.example.", "example.", dns.TypeA, dns.TypeNSEC, dns.TypeRRSIG)...))
+	add("nope.example.", dns.TypeDS, dns.RcodeNameError, nil,
+		append(append([]dns.RR{}, soa...), nsec("insecure.example.", "sub.example.", dns.TypeNS, dns.TypeNSEC, dns.TypeRRSIG)...))
+	add("host.sub.example.", dns.TypeDS, dns.RcodeSuccess, nil, append(
+		sub.sign(t, rr("sub.example. 300 IN SOA ns.sub.example. admin.example. 1 3600 600 86400 300")),
+		sub.sign(t, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "host.sub.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: "sub.example.",
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeNSEC, dns.TypeRRSIG},
+		})...))
+
+	add("www.example.", dns.TypeA, dns.RcodeSuccess, example.sign(t, rr("www.example. 300 IN A 192.0.2.1")), nil)
+	add("host.sub.example.", dns.TypeA, dns.RcodeSuccess, sub.sign(t, rr("host.sub.example. 300 IN A 192.0.2.2")), nil)
+	add("host.insecure.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{rr("host.insecure.example. 300 IN A 192.0.2.3")}, nil)
+	add("nope.example.", dns.TypeA, dns.RcodeNameError, nil,
+		append(append([]dns.RR{}, soa...), nsec("insecure.example.", "sub.example.", dns.TypeNS, dns.TypeNSEC, dns.TypeRRSIG)...))
+	bad := example.sign(t, rr("bad.example. 300 IN A 192.0.2.1"))
+	bad[0].(*dns.A).A = net.ParseIP("192.0.2.66")
+	add("bad.example.", dns.TypeA, dns.RcodeSuccess, bad, nil)
+	add("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil,
+		append(append([]dns.RR{}, soa...), nsec("www.example.", "example.", dns.TypeA, dns.TypeNSEC, dns.TypeRRSIG)...))
+	return z
+}
+
+// answer returns a copy of the response for name/qtype, or nil.
+func (z *testSignedZones) answer(name string, qtype uint16) *dns.Msg {
+	m, ok := z.answers[fmt.Sprintf("%s/%d", strings.ToLower(dns.Fqdn(name)), qtype)]
+	if !ok {
+		return nil
+	}
+	return m.Copy()
+}
+
+func (z *testSignedZones) query(name string, qtype uint16) (*dns.Msg, error) {
+	if m := z.answer(name, qtype); m != nil {
+		return m, nil
+	}
+	return nil, fmt.Errorf("no test data for %s %s", name, dns.TypeToString[qtype])
+}
+
+// ServeDNS answers from the test zones like a resolver with checking disabled, returning
+// RRSIGs only when the query sets DO.
+func (z *testSignedZones) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	resp := z.answer(q.Name, q.Qtype)
+	if resp == nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		_ = w.WriteMsg(resp)
+		return
+	}
+	rcode := resp.Rcode
+	resp.SetReply(req)
+	resp.Rcode = rcode
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(1232, opt.Do())
+		if !opt.Do() {
+			dnssecReply(resp, req)
+		}
+	} else {
+		dnssecReply(resp, req)
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	z := newTestSignedZones(t)
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		edit  func(*dns.Msg)
+		want  dnssecState
+	}{
+		{"signed answer", "www.example.", dns.TypeA, nil, dnssecSecure},
+		{"signed child zone", "host.sub.example.", dns.TypeA, nil, dnssecSecure},
+		{"unsigned delegation", "host.insecure.example.", dns.TypeA, nil, dnssecInsecure},
+		{"NXDOMAIN with NSEC", "nope.example.", dns.TypeA, nil, dnssecSecure},
+		{"NODATA with NSEC", "www.example.", dns.TypeAAAA, nil, dnssecSecure},
+		{"signature over other data", "bad.example.", dns.TypeA, nil, dnssecBogus},
+		{"tampered answer", "www.example.", dns.TypeA, func(m *dns.Msg) {
+			m.Answer[0].(*dns.A).A = net.ParseIP("198.51.100.1")
+		}, dnssecBogus},
+		{"stripped signature", "www.example.", dns.TypeA, func(m *dns.Msg) {
+			m.Answer = stripDNSSECRecords(m.Answer, 0)
+		}, dnssecBogus},
+		{"stripped child signature", "host.sub.example.", dns.TypeA, func(m *dns.Msg) {
+			m.Answer = stripDNSSECRecords(m.Answer, 0)
+		}, dnssecBogus},
+		{"NXDOMAIN without proof", "nope.example.", dns.TypeA, func(m *dns.Msg) {
+			m.Ns = m.Ns[:2] // SOA and its RRSIG only
+		}, dnssecBogus},
+		{"NODATA with wrong NSEC", "www.example.", dns.TypeA, func(m *dns.Msg) {
+			m.Answer = nil
+			m.Ns = z.answer("www.example.", dns.TypeAAAA).Ns
+		}, dnssecBogus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newDNSSECValidator([]string{z.anchor}, z.query)
+			if err != nil {
+				t.Fatalf("newDNSSECValidator: %v", err)
+			}
+			resp := z.answer(tt.qname, tt.qtype)
+			if tt.edit != nil {
+				tt.edit(resp)
+			}
+			got, reason := v.validate(resp, resp.Question[0])
+			if got != tt.want {
+				t.Errorf("validate = %s (%s), want %s", got, reason, tt.want)
+			}
+			if got == dnssecBogus && reason == "" {
+				t.Error("bogus result should carry a reason")
+			}
+		})
+	}
+}
+
+func TestDNSSECValidator_Anchors(t *testing.T) {
+	z := newTestSignedZones(t)
+	resp := z.answer("www.example.", dns.TypeA)
+
+	other := newTestZoneKey(t, "example.")
+	v, err := newDNSSECValidator([]string{other.key.String()}, z.query)
+	if err != nil {
+		t.Fatalf("newDNSSECValidator: %v", err)
+	}
+	if got, _ := v.validate(resp, resp.Question[0]); got != dnssecBogus {
+		t.Errorf("anchor for a different key: got %s, want bogus", got)
+	}
+
+	unrelated := newTestZoneKey(t, "org.")
+	v, err = newDNSSECValidator([]string{unrelated.key.String()}, z.query)
+	if err != nil {
+		t.Fatalf("newDNSSECValidator: %v", err)
+	}
+	if got, _ := v.validate(resp, resp.Question[0]); got != dnssecInsecure {
+		t.Errorf("no anchor covering the name: got %s, want insecure", got)
+	}
+
+	v, err = newDNSSECValidator([]string{z.anchor}, z.query)
+	if err != nil {
+		t.Fatalf("newDNSSECValidator: %v", err)
+	}
+	v.now = func() time.Time { return time.Now().Add(3 * time.Hour) }
+	if got, _ := v.validate(resp, resp.Question[0]); got != dnssecBogus {
+		t.Errorf("expired signatures: got %s, want bogus", got)
+	}
+
+	if _, err := newDNSSECValidator([]string{"example. IN A 192.0.2.1"}, z.query); err == nil {
+		t.Error("expected error for a trust anchor that is not DS or DNSKEY")
+	}
+	if v, err := newDNSSECValidator(nil, z.query); err != nil || len(v.anchors["."]) != len(rootTrustAnchors) {
+		t.Errorf("empty anchors should default to the root KSKs, got %v, %v", v, err)
+	}
+}
+
+func TestDNSSECValidator_CachesKeys(t *testing.T) {
+	z := newTestSignedZones(t)
+	queries := 0
+	v, err := newDNSSECValidator([]string{z.anchor}, func(name string, qtype uint16) (*dns.Msg, error) {
+		queries++
+		return z.query(name, qtype)
+	})
+	if err != nil {
+		t.Fatalf("newDNSSECValidator: %v", err)
+	}
+	resp := z.answer("host.sub.example.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		if got, reason := v.validate(resp, resp.Question[0]); got != dnssecSecure {
+			t.Fatalf("validate = %s (%s), want secure", got, reason)
+		}
+	}
+	if queries != 3 { // DNSKEY example., DS sub.example., DNSKEY sub.example.
+		t.Errorf("validator made %d queries for three validations, want 3", queries)
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	ordered := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	for i := 0; i < len(ordered)-1; i++ {
+		if canonicalCompare(ordered[i], ordered[i+1]) >= 0 {
+			t.Errorf("%s should sort before %s", ordered[i], ordered[i+1])
+		}
+	}
+	last := &dns.NSEC{Hdr: dns.RR_Header{Name: "www.example."}, NextDomain: "example."}
+	if !nsecCovers(last, "zzz.example.") || nsecCovers(last, "aaa.example.") {
+		t.Error("last NSEC in the zone should cover names after its owner only")
+	}
+}
+
+func TestDNSSECCacheKey(t *testing.T) {
+	base := cacheKey("example.com", dns.TypeA, dns.ClassINET)
+	for _, tc := range []struct{ do, cd bool }{{false, false}, {true, false}, {false, true}, {true, true}} {
+		key := dnssecCacheKey(base, tc.do, tc.cd)
+		gotBase, do, cd := splitDNSSECCacheKey(key)
+		if gotBase != base || do != tc.do || cd != tc.cd {
+			t.Errorf("splitDNSSECCacheKey(%q) = %q, %v, %v", key, gotBase, do, cd)
+		}
+		if name, qtype, _, ok := parseCacheKey(key); !ok || name != "example.com" || qtype != dns.TypeA {
+			t.Errorf("parseCacheKey(%q) = %q, %d, %v", key, name, qtype, ok)
+		}
+	}
+	if dnssecCacheKey(base, true, false) == base {
+		t.Error("DO queries must not share the cache entry of non-DO queries")
+	}
+}
+
+func TestDNSSECReply(t *testing.T) {
+	z := newTestSignedZones(t)
+	signed := z.answer("nope.example.", dns.TypeA)
+	signed.AuthenticatedData = true
+	signed.CheckingDisabled = true
+	signed.SetEdns0(1232, true)
+
+	plain := new(dns.Msg)
+	plain.SetQuestion("nope.example.", dns.TypeA)
+	resp := signed.Copy()
+	dnssecReply(resp, plain)
+	for _, rr := range append(append([]dns.RR{}, resp.Ns...), resp.Extra...) {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeOPT:
+			t.Errorf("non-DO client without EDNS got %s", dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+	if resp.AuthenticatedData || resp.CheckingDisabled {
+		t.Error("AD and CD should be cleared for a client that set neither")
+	}
+
+	do := plain.Copy()
+	do.SetEdns0(1232, true)
+	resp = signed.Copy()
+	dnssecReply(resp, do)
+	if len(resp.Ns) != len(signed.Ns) || !resp.AuthenticatedData || !resp.IsEdns0().Do() {
+		t.Error("DO client should get DNSSEC records, AD and DO")
+	}
+
+	ad := plain.Copy()
+	ad.AuthenticatedData = true
+	resp = signed.Copy()
+	dnssecReply(resp, ad)
+	if !resp.AuthenticatedData {
+		t.Error("client that set AD should get AD")
+	}
+}
+
+func TestWithDNSSEC(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	out := withDNSSEC(req)
+	if !clientDO(out) || !out.CheckingDisabled {
+		t.Error("upstream query should set DO and CD")
+	}
+	if req.IsEdns0() != nil || req.CheckingDisabled {
+		t.Error("original request must not be modified")
+	}
+	if withDNSSEC(out) != out {
+		t.Error("request that already sets DO and CD should be sent as-is")
+	}
+}
+
+func TestDNSSECBogusReply(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("bad.example.", dns.TypeA)
+	if resp := dnssecBogusReply(req, "bad signature"); resp.Rcode != dns.RcodeServerFailure || resp.IsEdns0() != nil {
+		t.Errorf("client without EDNS: rcode %d, OPT %v", resp.Rcode, resp.IsEdns0())
+	}
+	req.SetEdns0(1232, false)
+	resp := dnssecBogusReply(req, "bad signature")
+	ede := findEDE(resp)
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeDNSBogus || ede.ExtraText != "bad signature" {
+		t.Errorf("expected EDE DNSSEC Bogus with reason, got %v", ede)
+	}
+}
+
+func findEDE(m *dns.Msg) *dns.EDNS0_EDE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package dnsresolver
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// ECS modes for edns_client_subnet.mode.
+const (
+	ECSModeStrip       = "strip"
+	ECSModePassthrough = "passthrough"
+	ECSModeSynthesize  = "synthesize"
+)
+
+// ecsKeySep separates the base cache key from the client subnet in subnet-specific
+// cache keys, e.g. "dns:example.com:1:1:ecs=203.0.113.0/24".
+const ecsKeySep = ":ecs="
+
+// ednsUDPSize is the EDNS buffer size advertised when an OPT record is added to an upstream
+// query on behalf of a client that did not send one (to carry ECS or the DO bit).
+const ednsUDPSize = 1232
+
+// cgnatPrefix (RFC 6598) is shared address space; like RFC 1918 it says nothing about
+// where a client is, so it is never synthesized into ECS.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// ecsPolicy is the EDNS Client Subnet handling for upstream queries.
+type ecsPolicy struct {
+	mode              string
+	ipv4Prefix        int
+	ipv6Prefix        int
+	trustedForwarders []netip.Prefix
+}
+
+func newECSPolicy(cfg config.EDNSClientSubnetConfig) *ecsPolicy {
+	p := &ecsPolicy{
+		mode:       strings.ToLower(strings.TrimSpace(cfg.Mode)),
+		ipv4Prefix: cfg.IPv4Prefix,
+		ipv6Prefix: cfg.IPv6Prefix,
+	}
+	if p.mode != ECSModePassthrough && p.mode != ECSModeSynthesize {
+		p.mode = ECSModeStrip
+	}
+	if p.ipv4Prefix <= 0 || p.ipv4Prefix > 32 {
+		p.ipv4Prefix = 24
+	}
+	if p.ipv6Prefix <= 0 || p.ipv6Prefix > 128 {
+		p.ipv6Prefix = 56
+	}
+	for _, s := range cfg.TrustedForwarders {
+		s = strings.TrimSpace(s)
+		if pfx, err := netip.ParsePrefix(s); err == nil {
+			p.trustedForwarders = append(p.trustedForwarders, pfx.Masked())
+		} else if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap()
+			p.trustedForwarders = append(p.trustedForwarders, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return p
+}
+
+// upstreamSubnet returns the client subnet to send upstream for req, or false when the
+// upstream query should carry no ECS option. A nil policy strips ECS.
+func (p *ecsPolicy) upstreamSubnet(req *dns.Msg, clientAddr string) (netip.Prefix, bool) {
+	if p == nil {
+		return netip.Prefix{}, false
+	}
+	switch p.mode {
+	case ECSModePassthrough:
+		if o := findECS(req); o != nil {
+			return ecsPrefix(o)
+		}
+	case ECSModeSynthesize:
+		if o := findECS(req); o != nil {
+			// Honor the client's own option (including a /0 opt-out), never more specific than configured.
+			pfx, ok := ecsPrefix(o)
+			if !ok {
+				return netip.Prefix{}, false
+			}
+			if limit := p.prefixLen(pfx.Addr()); pfx.Bits() > limit {
+				pfx = netip.PrefixFrom(pfx.Addr(), limit).Masked()
+			}
+			return pfx, true
+		}
+		addr, err := netip.ParseAddr(clientAddr)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		addr = addr.Unmap()
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() || cgnatPrefix.Contains(addr) {
+			return netip.Prefix{}, false
+		}
+		return netip.PrefixFrom(addr, p.prefixLen(addr)).Masked(), true
+	}
+	return netip.Prefix{}, false
+}
+
+func (p *ecsPolicy) prefixLen(addr netip.Addr) int {
+	if addr.Is4() {
+		return p.ipv4Prefix
+	}
+	return p.ipv6Prefix
+}
+
+// clientWriter returns w with RemoteAddr replaced by the client address from req's ECS
+// option when the query comes from a trusted forwarder and the option carries a full
+// address (/32 or /128). Group lookups, cache control and logging then see the real client.
+func (p *ecsPolicy) clientWriter(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if p == nil || len(p.trustedForwarders) == 0 {
+		return w
+	}
+	o := findECS(req)
+	if o == nil {
+		return w
+	}
+	pfx, ok := ecsPrefix(o)
+	if !ok || !pfx.IsSingleIP() {
+		return w
+	}
+	fwd, err := netip.ParseAddr(clientIPFromWriter(w))
+	if err != nil {
+		return w
+	}
+	fwd = fwd.Unmap()
+	for _, trusted := range p.trustedForwarders {
+		if trusted.Contains(fwd) {
+			network := "udp"
+			if addr := w.RemoteAddr(); addr != nil {
+				network = addr.Network()
+			}
+			return &ecsClientWriter{ResponseWriter: w, client: ecsClientAddr{network: network, ip: pfx.Addr()}}
+		}
+	}
+	return w
+}
+
+// ecsClientWriter reports the ECS client address as RemoteAddr.
+type ecsClientWriter struct {
+	dns.ResponseWriter
+	client net.Addr
+}
+
+func (w *ecsClientWriter) RemoteAddr() net.Addr { return w.client }
+
+// ecsClientAddr is a client address taken from ECS; it keeps the transport of the
+// forwarder's connection so protocol attribution in logs is unchanged.
+type ecsClientAddr struct {
+	network string
+	ip      netip.Addr
+}
+
+func (a ecsClientAddr) Network() string { return a.network }
+func (a ecsClientAddr) String() string  { return a.ip.String() }
+
+// findECS returns the ECS option from msg's OPT record, or nil.
+func findECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if msg == nil {
+		return nil
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// ecsPrefix returns the subnet of an ECS option, masked to its source prefix length.
+func ecsPrefix(o *dns.EDNS0_SUBNET) (netip.Prefix, bool) {
+	var addr netip.Addr
+	switch o.Family {
+	case 1:
+		ip4 := o.Address.To4()
+		if ip4 == nil || o.SourceNetmask > 32 {
+			return netip.Prefix{}, false
+		}
+		addr = netip.AddrFrom4([4]byte(ip4))
+	case 2:
+		ip16 := o.Address.To16()
+		if ip16 == nil || o.SourceNetmask > 128 {
+			return netip.Prefix{}, false
+		}
+		addr = netip.AddrFrom16([16]byte(ip16))
+	default:
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, int(o.SourceNetmask)).Masked(), true
+}
+
+// newECSOption builds an ECS option for subnet with scope 0, as sent in queries.
+func newECSOption(subnet netip.Prefix) *dns.EDNS0_SUBNET {
+	family := uint16(2)
+	if subnet.Addr().Is4() {
+		family = 1
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(subnet.Bits()),
+		Address:       net.IP(subnet.Addr().AsSlice()),
+	}
+}
+
+// withoutECS returns opt's options without any ECS option, in a new slice.
+func withoutECS(opt *dns.OPT) (options []dns.EDNS0, removed *dns.EDNS0_SUBNET) {
+	options = make([]dns.EDNS0, 0, len(opt.Option))
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			removed = e
+			continue
+		}
+		options = append(options, o)
+	}
+	return options, removed
+}
+
+// withECS returns req as it should be sent upstream: any ECS option from the client is
+// removed and, when send is true, replaced by subnet. A forwarder's EDNS0 MAC option is
+// removed too: client MAC addresses stay on the local network. req is copied only if it changes.
+func withECS(req *dns.Msg, subnet netip.Prefix, send bool) *dns.Msg {
+	if !send && findECS(req) == nil && !hasMACOption(req) {
+		return req
+	}
+	out := req.Copy()
+	opt := out.IsEdns0()
+	if opt == nil {
+		out.SetEdns0(ednsUDPSize, false)
+		opt = out.IsEdns0()
+	}
+	opt.Option, _ = withoutECS(opt)
+	opt.Option = slices.DeleteFunc(opt.Option, isMACOption)
+	if send {
+		opt.Option = append(opt.Option, newECSOption(subnet))
+	}
+	return out
+}
+
+// ecsReply adapts the ECS option of resp, an upstream or cached answer, to the client
+// query req: a client that sent ECS gets its own option echoed with the answer's scope,
+// other clients get no ECS option (and no OPT record if they sent none). resp is
+// modified in place and left unchanged when it carries no ECS option.
+func ecsReply(resp, req *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options, answered := withoutECS(opt)
+	if answered == nil {
+		return
+	}
+	if req.IsEdns0() == nil {
+		extra := make([]dns.RR, 0, len(resp.Extra))
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+		return
+	}
+	if o := findECS(req); o != nil {
+		echo := *o
+		echo.SourceScope = answered.SourceScope
+		options = append(options, &echo)
+	}
+	opt.Option = options
+}
+
+// ecsClientReply returns resp adapted for req (see ecsReply). resp is copied first when
+// it carries an ECS option, so the original keeps its scope for caching.
+func ecsClientReply(resp, req *dns.Msg) *dns.Msg {
+	if findECS(resp) == nil {
+		return resp
+	}
+	reply := resp.Copy()
+	ecsReply(reply, req)
+	return reply
+}
+
+// ecsCacheKey returns the cache key for an answer specific to subnet.
+func ecsCacheKey(baseKey string, subnet netip.Prefix) string {
+	return baseKey + ecsKeySep + subnet.String()
+}
+
+// splitECSCacheKey splits a subnet-specific cache key into its base key and subnet.
+// ok is false for keys without a subnet.
+func splitECSCacheKey(key string) (baseKey string, subnet netip.Prefix, ok bool) {
+	idx := strings.LastIndex(key, ecsKeySep)
+	if idx < 0 {
+		return key, netip.Prefix{}, false
+	}
+	subnet, err := netip.ParsePrefix(key[idx+len(ecsKeySep):])
+	if err != nil {
+		return key, netip.Prefix{}, false
+	}
+	return key[:idx], subnet, true
+}
+
+// ecsStoreKey returns the key to cache resp under. Answers to queries sent with ECS are
+// stored under the subnet-specific key unless the upstream returned an ECS option with
+// scope 0, meaning the answer is valid for every client and goes under the base key. An
+// answer without an ECS option says nothing about its scope and stays subnet-specific.
+func ecsStoreKey(baseKey, key string, resp *dns.Msg) string {
+	if key != baseKey && ecsValidForAll(resp) {
+		return baseKey
+	}
+	return key
+}
+
+// ecsValidForAll reports whether a cached answer may be served to ECS clients of any subnet:
+// only when the upstream answered an ECS query with scope 0. Answers cached for clients that
+// were sent upstream without ECS carry no option and were never checked against a subnet.
+func ecsValidForAll(msg *dns.Msg) bool {
+	o := findECS(msg)
+	return o != nil && o.SourceScope == 0
+}
@@ -0,0 +1,186 @@
+package dnsresolver
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+func queryWithECS(subnet string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	if subnet != "" {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, newECSOption(netip.MustParsePrefix(subnet)))
+	}
+	return req
+}
+
+func TestECSPolicy_UpstreamSubnet(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		clientECS  string
+		clientAddr string
+		want       string // "" = no ECS sent
+	}{
+		{"strip ignores client ECS", ECSModeStrip, "198.51.100.0/24", "198.51.100.7", ""},
+		{"passthrough forwards client ECS", ECSModePassthrough, "198.51.100.0/28", "192.168.1.2", "198.51.100.0/28"},
+		{"passthrough without client ECS", ECSModePassthrough, "", "198.51.100.7", ""},
+		{"synthesize from public IPv4", ECSModeSynthesize, "", "198.51.100.7", "198.51.100.0/24"},
+		{"synthesize from public IPv6", ECSModeSynthesize, "", "2001:db8:1:2:3::1", "2001:db8:1::/56"},
+		{"synthesize from mapped IPv4", ECSModeSynthesize, "", "::ffff:198.51.100.7", "198.51.100.0/24"},
+		{"synthesize skips RFC 1918", ECSModeSynthesize, "", "192.168.1.2", ""},
+		{"synthesize skips CGNAT", ECSModeSynthesize, "", "100.64.1.2", ""},
+		{"synthesize skips loopback", ECSModeSynthesize, "", "127.0.0.1", ""},
+		{"synthesize skips ULA", ECSModeSynthesize, "", "fd00::1", ""},
+		{"synthesize truncates client ECS", ECSModeSynthesize, "203.0.113.77/32", "192.168.1.2", "203.0.113.0/24"},
+		{"synthesize keeps shorter client ECS", ECSModeSynthesize, "203.0.0.0/16", "192.168.1.2", "203.0.0.0/16"},
+		{"synthesize honors client opt-out", ECSModeSynthesize, "0.0.0.0/0", "198.51.100.7", "0.0.0.0/0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newECSPolicy(config.EDNSClientSubnetConfig{Mode: tt.mode, IPv4Prefix: 24, IPv6Prefix: 56})
+			got, ok := p.upstreamSubnet(queryWithECS(tt.clientECS), tt.clientAddr)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("expected no ECS, got %s", got)
+				}
+				return
+			}
+			if !ok || got != netip.MustParsePrefix(tt.want) {
+				t.Fatalf("upstreamSubnet = %s, %v; want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithECS(t *testing.T) {
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	if got := withECS(plain, netip.Prefix{}, false); got != plain {
+		t.Error("request without ECS should be sent as-is when stripping")
+	}
+
+	out := withECS(plain, netip.MustParsePrefix("198.51.100.0/24"), true)
+	if plain.IsEdns0() != nil {
+		t.Error("original request must not be modified")
+	}
+	o := findECS(out)
+	if o == nil || o.Family != 1 || o.SourceNetmask != 24 || !o.Address.Equal(net.ParseIP("198.51.100.0")) {
+		t.Fatalf("expected ECS 198.51.100.0/24, got %v", o)
+	}
+
+	stripped := withECS(queryWithECS("198.51.100.0/24"), netip.Prefix{}, false)
+	if findECS(stripped) != nil {
+		t.Error("ECS should be stripped")
+	}
+	if stripped.IsEdns0() == nil {
+		t.Error("client's OPT record should be kept when stripping ECS")
+	}
+}
+
+func TestECSReply(t *testing.T) {
+	upstream := queryWithECS("198.51.100.0/24")
+	upstream.Response = true
+	findECS(upstream).SourceScope = 20
+
+	// Client that sent ECS gets its own option echoed with the answer's scope.
+	req := queryWithECS("198.51.100.9/32")
+	resp := upstream.Copy()
+	ecsReply(resp, req)
+	o := findECS(resp)
+	if o == nil || o.SourceNetmask != 32 || o.SourceScope != 20 || !o.Address.Equal(net.ParseIP("198.51.100.9")) {
+		t.Fatalf("expected client ECS echo with scope 20, got %v", o)
+	}
+
+	// Client with EDNS but no ECS gets no ECS option.
+	resp = upstream.Copy()
+	ecsReply(resp, queryWithECS(""))
+	if resp.IsEdns0() == nil || findECS(resp) != nil {
+		t.Error("expected OPT without ECS")
+	}
+
+	// Client without EDNS gets no OPT record.
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	resp = ecsClientReply(upstream, plain)
+	if resp.IsEdns0() != nil {
+		t.Error("expected no OPT record for non-EDNS client")
+	}
+	if findECS(upstream) == nil {
+		t.Error("ecsClientReply must not modify the original response")
+	}
+}
+
+func TestECSCacheKey(t *testing.T) {
+	base := cacheKey("example.com", dns.TypeAAAA, dns.ClassINET)
+	for _, subnet := range []string{"198.51.100.0/24", "2001:db8::/56", "0.0.0.0/0"} {
+		key := ecsCacheKey(base, netip.MustParsePrefix(subnet))
+		gotBase, gotSubnet, ok := splitECSCacheKey(key)
+		if !ok || gotBase != base || gotSubnet.String() != subnet {
+			t.Errorf("splitECSCacheKey(%q) = %q, %s, %v", key, gotBase, gotSubnet, ok)
+		}
+		name, qtype, qclass, ok := parseCacheKey(key)
+		if !ok || name != "example.com" || qtype != dns.TypeAAAA || qclass != dns.ClassINET {
+			t.Errorf("parseCacheKey(%q) = %q, %d, %d, %v", key, name, qtype, qclass, ok)
+		}
+	}
+	if _, _, ok := splitECSCacheKey(base); ok {
+		t.Error("base key should not have a subnet")
+	}
+}
+
+func TestECSStoreKey(t *testing.T) {
+	base := cacheKey("example.com", dns.TypeA, dns.ClassINET)
+	key := ecsCacheKey(base, netip.MustParsePrefix("198.51.100.0/24"))
+
+	scoped := queryWithECS("198.51.100.0/24")
+	findECS(scoped).SourceScope = 24
+	if got := ecsStoreKey(base, key, scoped); got != key {
+		t.Errorf("scoped answer stored under %q, want %q", got, key)
+	}
+	global := queryWithECS("198.51.100.0/24")
+	if got := ecsStoreKey(base, key, global); got != base {
+		t.Errorf("scope 0 answer stored under %q, want %q", got, base)
+	}
+	if got := ecsStoreKey(base, key, queryWithECS("")); got != key {
+		t.Errorf("answer without ECS stored under %q, want %q", got, key)
+	}
+	if got := ecsStoreKey(base, base, queryWithECS("")); got != base {
+		t.Errorf("answer to a query without ECS stored under %q, want %q", got, base)
+	}
+}
+
+func TestECSPolicy_ClientWriter(t *testing.T) {
+	p := newECSPolicy(config.EDNSClientSubnetConfig{TrustedForwarders: []string{"192.168.1.1", "10.0.0.0/8"}})
+
+	w := p.clientWriter(&mockResponseWriter{remoteAddr: "192.168.1.1"}, queryWithECS("192.168.1.50/32"))
+	if got := clientIPFromWriter(w); got != "192.168.1.50" {
+		t.Errorf("trusted forwarder: client = %q, want 192.168.1.50", got)
+	}
+	if w.RemoteAddr().Network() != "tcp" {
+		t.Errorf("network = %q, want forwarder's tcp", w.RemoteAddr().Network())
+	}
+	w = p.clientWriter(&mockResponseWriter{remoteAddr: "10.1.2.3"}, queryWithECS("2001:db8::5/128"))
+	if got := clientIPFromWriter(w); got != "2001:db8::5" {
+		t.Errorf("trusted forwarder CIDR: client = %q, want 2001:db8::5", got)
+	}
+
+	for name, tc := range map[string]struct {
+		remote, ecs string
+	}{
+		"untrusted forwarder": {"192.168.1.2", "192.168.1.50/32"},
+		"truncated subnet":    {"192.168.1.1", "192.168.1.0/24"},
+		"no ECS":              {"192.168.1.1", ""},
+	} {
+		w := p.clientWriter(&mockResponseWriter{remoteAddr: tc.remote}, queryWithECS(tc.ecs))
+		if got := clientIPFromWriter(w); got != tc.remote {
+			t.Errorf("%s: client = %q, want %q", name, got, tc.remote)
+		}
+	}
+}
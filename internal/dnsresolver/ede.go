@@ -0,0 +1,31 @@
+package dnsresolver
+
+import (
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+)
+
+// addEDE attaches an Extended DNS Error (RFC 8914) to resp. Clients that did not send OPT
+// get nothing: EDNS is negotiated by the client, and an unsolicited OPT may confuse it. A
+// response without OPT gets one with our buffer size and the client's DO bit.
+func addEDE(resp, req *dns.Msg, code uint16, text string) {
+	if resp == nil || req == nil || req.IsEdns0() == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(ednsUDPSize, clientDO(req))
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// blockEDECode returns the EDE code for a name blocked by blMgr on list: Filtered for a
+// client group's blocklist and family time, which filter on behalf of the client; Blocked
+// for the operator's global blocklist.
+func (r *Resolver) blockEDECode(blMgr *blocklist.Manager, list string) uint16 {
+	if blMgr != r.blocklist || list == "family_time" {
+		return dns.ExtendedErrorCodeFiltered
+	}
+	return dns.ExtendedErrorCodeBlocked
+}
@@ -0,0 +1,167 @@
+package dnsresolver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/cache"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+)
+
+// edeOf returns the Extended DNS Error options in resp.
+func edeOf(resp *dns.Msg) []*dns.EDNS0_EDE {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var out []*dns.EDNS0_EDE
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			out = append(out, ede)
+		}
+	}
+	return out
+}
+
+func TestAddEDE(t *testing.T) {
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(plain)
+	addEDE(resp, plain, dns.ExtendedErrorCodeBlocked, "ads")
+	if resp.IsEdns0() != nil {
+		t.Fatal("client without OPT must not get one")
+	}
+
+	edns := new(dns.Msg)
+	edns.SetQuestion("example.com.", dns.TypeA)
+	edns.SetEdns0(4096, true)
+	resp = new(dns.Msg)
+	resp.SetReply(edns)
+	addEDE(resp, edns, dns.ExtendedErrorCodeBlocked, "ads")
+	opt := resp.IsEdns0()
+	if opt == nil || opt.UDPSize() != ednsUDPSize || !opt.Do() {
+		t.Fatalf("expected OPT with our buffer size and the client's DO bit, got %v", opt)
+	}
+	addEDE(resp, edns, dns.ExtendedErrorCodeStaleAnswer, "")
+	got := edeOf(resp)
+	if len(got) != 2 || got[0].InfoCode != dns.ExtendedErrorCodeBlocked || got[0].ExtraText != "ads" || got[1].InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Fatalf("unexpected EDE options %v", got)
+	}
+}
+
+func TestResolverEDE(t *testing.T) {
+	servfails := func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		_ = w.WriteMsg(resp)
+	}
+	upstreamAddr := newDNSServerUDP(t, dns.HandlerFunc(servfails))
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "test", Address: upstreamAddr, Protocol: "udp"}}
+	cfg.Cache.ServfailBackoff = config.Duration{Duration: time.Minute}
+	cfg.Cache.Refresh = config.RefreshConfig{
+		Enabled:         ptr(true),
+		ServeStale:      ptr(true),
+		StaleTTL:        config.Duration{Duration: time.Hour},
+		ExpiredEntryTTL: config.Duration{Duration: 30 * time.Second},
+		LockTTL:         config.Duration{Duration: 5 * time.Second},
+		MaxInflight:     10,
+		SweepInterval:   config.Duration{Duration: time.Hour},
+		SweepWindow:     config.Duration{Duration: 30 * time.Minute},
+		MaxBatchSize:    100,
+		SweepHitWindow:  config.Duration{Duration: time.Hour},
+	}
+	cfg.Blocklists.Denylist = []string{"ads.example"}
+	cfg.SafeSearch = config.SafeSearchConfig{Enabled: ptr(true), Google: ptr(true)}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{IP: "192.168.1.50", Name: "kids tablet", GroupID: "kids"}},
+	}
+	cfg.ClientGroups = []config.ClientGroup{{
+		ID:        "kids",
+		Name:      "Kids",
+		Blocklist: &config.GroupBlocklistConfig{InheritGlobal: ptr(false), Denylist: []string{"games.example"}},
+	}}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	mockCache := cache.NewMockCache()
+	stale := new(dns.Msg)
+	stale.SetQuestion("stale.example.", dns.TypeA)
+	stale.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "stale.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}}
+	mockCache.SetStaleEntry(cacheKey("stale.example", dns.TypeA, dns.ClassINET), stale)
+	resolver := buildTestResolver(t, cfg, mockCache, blMgr, nil)
+
+	query := func(client, name string, edns bool) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		if edns {
+			req.SetEdns0(1232, false)
+		}
+		w := &mockResponseWriter{remoteAddr: client}
+		resolver.ServeDNS(w, req)
+		if w.written == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.written
+	}
+
+	tests := []struct {
+		name   string
+		client string
+		qname  string
+		code   uint16
+		text   string
+	}{
+		{"global blocklist", "192.168.1.10", "ads.example.", dns.ExtendedErrorCodeBlocked, "denylist"},
+		{"group blocklist", "192.168.1.50", "games.example.", dns.ExtendedErrorCodeFiltered, "denylist"},
+		{"safe search", "192.168.1.10", "www.google.com.", dns.ExtendedErrorCodeCensored, "safe search"},
+		{"stale", "192.168.1.10", "stale.example.", dns.ExtendedErrorCodeStaleAnswer, ""},
+		{"servfail backoff", "192.168.1.10", "broken.example.", dns.ExtendedErrorCodeNoReachableAuthority, ""},
+	}
+	// The first query for broken.example gets the upstream SERVFAIL and starts the backoff.
+	query("192.168.1.10", "broken.example.", true)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := query(tt.client, tt.qname, true)
+			got := edeOf(resp)
+			if len(got) != 1 || got[0].InfoCode != tt.code {
+				t.Fatalf("expected EDE %d, got %v", tt.code, got)
+			}
+			if tt.text != "" && got[0].ExtraText != tt.text {
+				t.Errorf("extra text = %q, want %q", got[0].ExtraText, tt.text)
+			}
+			if resp := query(tt.client, tt.qname, false); resp.IsEdns0() != nil {
+				t.Errorf("client without OPT got %v", resp.IsEdns0())
+			}
+		})
+	}
+}
+
+func TestResolverEDEUpstreamError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	cfg := minimalResolverConfig("https://" + addr + "/dns-query")
+	resolver := buildTestResolver(t, cfg, nil, nil, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	w := &mockResponseWriter{}
+	resolver.ServeDNS(w, req)
+	if w.written == nil || w.written.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %v", w.written)
+	}
+	if got := edeOf(w.written); len(got) != 1 || got[0].InfoCode != dns.ExtendedErrorCodeNetworkError {
+		t.Fatalf("expected Network Error EDE, got %v", got)
+	}
+}
@@ -0,0 +1,97 @@
+package dnsresolver
+
+import (
+	"crypto/tls"
+
+	"github.com/miekg/dns"
+)
+
+// paddingBlockSize is the response block length recommended by RFC 8467.
+const paddingBlockSize = 468
+
+// finalizingWriter passes every reply ServeDNS writes through finalizeResponse, so upstream,
+// cached, local-record, safe-search and blocked answers are sized and padded the same way.
+type finalizingWriter struct {
+	dns.ResponseWriter
+	req       *dns.Msg
+	udp       bool
+	encrypted bool
+}
+
+// finalizeWriter wraps w, the writer of the listener that received req. It must wrap the
+// listener's own writer: the transport is read from its address and TLS state.
+func finalizeWriter(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	fw := &finalizingWriter{ResponseWriter: w, req: req}
+	if addr := w.RemoteAddr(); addr != nil {
+		fw.udp = addr.Network() == "udp"
+	}
+	if cs, ok := w.(dns.ConnectionStater); ok {
+		fw.encrypted = cs.ConnectionState() != nil
+	}
+	return fw
+}
+
+func (w *finalizingWriter) WriteMsg(m *dns.Msg) error {
+	return w.ResponseWriter.WriteMsg(finalizeResponse(m, w.req, w.udp, w.encrypted))
+}
+
+// ConnectionState returns the TLS state of the underlying DoT or DoH connection, or nil.
+func (w *finalizingWriter) ConnectionState() *tls.ConnectionState {
+	if cs, ok := w.ResponseWriter.(dns.ConnectionStater); ok {
+		return cs.ConnectionState()
+	}
+	return nil
+}
+
+// finalizeResponse returns m as it should be sent to the client of req:
+//   - Clients without EDNS get no OPT record, and at most 512 bytes over UDP.
+//   - EDNS clients get one OPT record advertising our buffer size (ednsUDPSize) with their DO
+//     bit. Of the options, only EDE and ECS are kept; the rest (cookies, padding, NSID, ...)
+//     belong to our exchange with the upstream.
+//   - UDP answers larger than the client's buffer size, capped at ednsUDPSize to avoid
+//     fragmentation, are truncated with TC set so the client retries over TCP.
+//   - On DoT and DoH, EDNS answers are padded to a multiple of 468 bytes (RFC 7830, RFC 8467).
+//
+// m is not modified: it may be shared with the cache.
+func finalizeResponse(m, req *dns.Msg, udp, encrypted bool) *dns.Msg {
+	if m == nil || req == nil {
+		return m
+	}
+	out := *m
+	out.Extra = make([]dns.RR, 0, len(m.Extra)+1)
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out.Extra = append(out.Extra, rr)
+		}
+	}
+	size := dns.MinMsgSize
+	reqOpt := req.IsEdns0()
+	var opt *dns.OPT
+	if reqOpt != nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		if orig := m.IsEdns0(); orig != nil {
+			opt.Hdr.Ttl = orig.Hdr.Ttl // extended RCODE
+			for _, o := range orig.Option {
+				switch o.(type) {
+				case *dns.EDNS0_EDE, *dns.EDNS0_SUBNET:
+					opt.Option = append(opt.Option, o)
+				}
+			}
+		}
+		opt.SetVersion(0)
+		opt.SetUDPSize(ednsUDPSize)
+		opt.SetDo(reqOpt.Do())
+		out.Extra = append(out.Extra, opt)
+		size = int(min(max(reqOpt.UDPSize(), dns.MinMsgSize), ednsUDPSize))
+	}
+	if udp {
+		out.Truncate(size)
+	}
+	out.Compress = true
+	if encrypted && opt != nil {
+		// The padding option adds 4 bytes of header to the packed length.
+		n := (paddingBlockSize - (out.Len()+4)%paddingBlockSize) % paddingBlockSize
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, n)})
+	}
+	return &out
+}
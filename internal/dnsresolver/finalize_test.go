@@ -0,0 +1,157 @@
+package dnsresolver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+)
+
+// largeTXTResponse answers req with n 100-byte TXT records and an upstream OPT carrying a
+// cookie and an EDE.
+func largeTXTResponse(req *dns.Msg, n int) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for i := 0; i < n; i++ {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{fmt.Sprintf("%02d%s", i, strings.Repeat("x", 98))},
+		})
+	}
+	resp.SetEdns0(4096, false)
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef0123456789abcdef"},
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: "upstream"},
+	)
+	return resp
+}
+
+func TestFinalizeResponse(t *testing.T) {
+	plain := new(dns.Msg)
+	plain.SetQuestion("big.example.", dns.TypeTXT)
+	edns := plain.Copy()
+	edns.SetEdns0(4096, true)
+	small := plain.Copy()
+	small.SetEdns0(100, false) // below the 512-byte minimum
+
+	tests := []struct {
+		name      string
+		req       *dns.Msg
+		udp       bool
+		maxLen    int
+		truncated bool
+		opt       bool
+	}{
+		{"no edns udp", plain, true, dns.MinMsgSize, true, false},
+		{"no edns tcp", plain, false, dns.MaxMsgSize, false, false},
+		{"edns udp", edns, true, ednsUDPSize, true, true},
+		{"edns small buffer", small, true, dns.MinMsgSize, true, true},
+		{"edns tcp", edns, false, dns.MaxMsgSize, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := largeTXTResponse(tt.req, 30)
+			out := finalizeResponse(upstream, tt.req, tt.udp, false)
+			packed, err := out.Pack()
+			if err != nil {
+				t.Fatalf("Pack: %v", err)
+			}
+			if len(packed) > tt.maxLen {
+				t.Errorf("packed %d bytes, want at most %d", len(packed), tt.maxLen)
+			}
+			if out.Truncated != tt.truncated {
+				t.Errorf("TC = %v, want %v", out.Truncated, tt.truncated)
+			}
+			if !tt.truncated && len(out.Answer) != 30 {
+				t.Errorf("expected all 30 answers, got %d", len(out.Answer))
+			}
+			opt := out.IsEdns0()
+			if (opt != nil) != tt.opt {
+				t.Fatalf("OPT = %v, want present %v", opt, tt.opt)
+			}
+			if opt != nil {
+				if opt.UDPSize() != ednsUDPSize || opt.Do() != tt.req.IsEdns0().Do() {
+					t.Errorf("OPT size %d DO %v, want %d and the client's DO bit", opt.UDPSize(), opt.Do(), ednsUDPSize)
+				}
+				if len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0EDE {
+					t.Errorf("expected only the EDE option, got %v", opt.Option)
+				}
+			}
+			// The upstream message may be shared with the cache and must be left alone.
+			if len(upstream.Answer) != 30 || upstream.Truncated || len(upstream.IsEdns0().Option) != 2 || upstream.IsEdns0().UDPSize() != 4096 {
+				t.Errorf("upstream message was modified: %v", upstream)
+			}
+		})
+	}
+}
+
+func TestFinalizeResponsePadding(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	req.SetEdns0(1232, false)
+	for _, n := range []int{0, 1, 4, 7, 30} {
+		out := finalizeResponse(largeTXTResponse(req, n), req, false, true)
+		packed, err := out.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %v", err)
+		}
+		if len(packed)%paddingBlockSize != 0 {
+			t.Errorf("%d answers: packed %d bytes, not a multiple of %d", n, len(packed), paddingBlockSize)
+		}
+	}
+
+	// Padding needs EDNS, and is not used on plain transports.
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeTXT)
+	if out := finalizeResponse(largeTXTResponse(plain, 1), plain, false, true); out.IsEdns0() != nil {
+		t.Errorf("client without EDNS got OPT %v", out.IsEdns0())
+	}
+	out := finalizeResponse(largeTXTResponse(req, 1), req, false, false)
+	for _, o := range out.IsEdns0().Option {
+		if o.Option() == dns.EDNS0PADDING {
+			t.Error("unencrypted response was padded")
+		}
+	}
+}
+
+// tlsResponseWriter is a mockResponseWriter on a DoT or DoH connection.
+type tlsResponseWriter struct {
+	mockResponseWriter
+}
+
+func (w *tlsResponseWriter) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{Version: tls.VersionTLS13}
+}
+
+func TestResolverFinalizesReplies(t *testing.T) {
+	cfg := minimalResolverConfig("")
+	cfg.Blocklists.Denylist = []string{"ads.example"}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	resolver := buildTestResolver(t, cfg, nil, blMgr, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	w := &tlsResponseWriter{}
+	resolver.ServeDNS(w, req)
+	if w.written == nil {
+		t.Fatal("no response")
+	}
+	packed, err := w.written.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if len(packed)%paddingBlockSize != 0 {
+		t.Errorf("blocked reply over TLS: packed %d bytes, not padded", len(packed))
+	}
+	if opt := w.written.IsEdns0(); opt == nil || opt.UDPSize() != ednsUDPSize {
+		t.Errorf("expected OPT with our buffer size, got %v", opt)
+	}
+}
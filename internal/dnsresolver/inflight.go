@@ -0,0 +1,94 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// inflightCall is a single upstream exchange that other callers for the same
+// cache key can wait on instead of sending their own query.
+type inflightCall struct {
+	done     chan struct{}
+	response *dns.Msg
+	upstream string
+	err      error
+	dups     int // callers that joined this exchange after it started
+}
+
+// inflightGroup coalesces concurrent upstream exchanges for the same cache key.
+// The first caller (leader) performs the exchange; callers arriving while it is
+// in flight wait for it and receive a copy of the response. This prevents a
+// burst of cache misses for a popular name from becoming a burst of identical
+// upstream queries.
+type inflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+
+	leaders   atomic.Uint64 // exchanges actually sent upstream
+	coalesced atomic.Uint64 // callers served by another caller's exchange
+}
+
+func newInflightGroup() *inflightGroup {
+	return &inflightGroup{calls: make(map[string]*inflightCall)}
+}
+
+// Do runs fn for key unless an exchange for key is already in flight, in which case
+// it waits for that exchange and returns its result. shared is true when the result
+// came from another caller's exchange. When the response was shared with waiters,
+// every caller (leader included) receives its own copy so callers can mutate it.
+func (g *inflightGroup) Do(key string, fn func() (*dns.Msg, string, error)) (response *dns.Msg, upstream string, err error, shared bool) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		g.coalesced.Add(1)
+		<-c.done
+		if c.response != nil {
+			return c.response.Copy(), c.upstream, c.err, true
+		}
+		return nil, c.upstream, c.err, true
+	}
+	c := &inflightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+	g.leaders.Add(1)
+
+	// Remove the call and wake waiters even if fn panics, so waiters never block forever.
+	// Waiters of a panicked exchange get an error; the panic goes on in the leader only.
+	defer func() {
+		p := recover()
+		if p != nil {
+			c.response, c.err = nil, fmt.Errorf("upstream exchange panicked: %v", p)
+		}
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		close(c.done)
+		if p != nil {
+			panic(p)
+		}
+	}()
+	c.response, c.upstream, c.err = fn()
+
+	g.mu.Lock()
+	dups := c.dups
+	// Delete before releasing the lock so no new waiter can join after dups is read.
+	delete(g.calls, key)
+	g.mu.Unlock()
+	if dups > 0 && c.response != nil {
+		// Waiters copy c.response after done is closed; hand the leader its own copy.
+		return c.response.Copy(), c.upstream, c.err, false
+	}
+	return c.response, c.upstream, c.err, false
+}
+
+// Stats returns the number of exchanges sent upstream and the number of callers
+// that were served by joining an in-flight exchange.
+func (g *inflightGroup) Stats() (leaders, coalesced uint64) {
+	return g.leaders.Load(), g.coalesced.Load()
+}
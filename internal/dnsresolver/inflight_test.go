@@ -0,0 +1,187 @@
+package dnsresolver
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestInflightGroup_CoalescesConcurrentCalls(t *testing.T) {
+	g := newInflightGroup()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() (*dns.Msg, string, error) {
+		calls.Add(1)
+		<-release
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		return m, "1.1.1.1:53", nil
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	results := make([]*dns.Msg, n)
+	sharedCount := atomic.Int32{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _, _, _ = g.Do("k", fn)
+	}()
+	// Wait for the leader to be in flight before starting waiters.
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var shared bool
+			results[i], _, _, shared = g.Do("k", fn)
+			if shared {
+				sharedCount.Add(1)
+			}
+		}(i)
+	}
+	// Give waiters time to join before releasing the exchange.
+	for {
+		g.mu.Lock()
+		dups := g.calls["k"].dups
+		g.mu.Unlock()
+		if dups == n-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("fn called %d times, want 1", calls.Load())
+	}
+	if sharedCount.Load() != n-1 {
+		t.Errorf("shared results = %d, want %d", sharedCount.Load(), n-1)
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if results[i] == results[j] {
+				t.Fatalf("results %d and %d share the same *dns.Msg; each caller needs its own copy", i, j)
+			}
+		}
+	}
+	leaders, coalesced := g.Stats()
+	if leaders != 1 || coalesced != n-1 {
+		t.Errorf("Stats() = (%d, %d), want (1, %d)", leaders, coalesced, n-1)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("calls map not cleaned up: %d entries", len(g.calls))
+	}
+}
+
+func TestInflightGroup_SequentialCallsNotCoalesced(t *testing.T) {
+	g := newInflightGroup()
+	var calls int
+	want := new(dns.Msg)
+	fn := func() (*dns.Msg, string, error) {
+		calls++
+		return want, "", nil
+	}
+	for i := 0; i < 3; i++ {
+		got, _, _, shared := g.Do("k", fn)
+		if shared {
+			t.Error("sequential call should not be shared")
+		}
+		if got != want {
+			t.Error("leader without waiters should get the original response (no copy)")
+		}
+	}
+	if calls != 3 {
+		t.Errorf("fn called %d times, want 3", calls)
+	}
+}
+
+func TestInflightGroup_ErrorShared(t *testing.T) {
+	g := newInflightGroup()
+	wantErr := errors.New("upstream down")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_, _, _, _ = g.Do("k", func() (*dns.Msg, string, error) {
+			close(started)
+			<-release
+			return nil, "", wantErr
+		})
+	}()
+	<-started
+	done := make(chan error)
+	go func() {
+		_, _, err, _ := g.Do("k", func() (*dns.Msg, string, error) {
+			t.Error("waiter should not run its own exchange")
+			return nil, "", nil
+		})
+		done <- err
+	}()
+	for {
+		g.mu.Lock()
+		dups := g.calls["k"].dups
+		g.mu.Unlock()
+		if dups == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-done; !errors.Is(err, wantErr) {
+		t.Errorf("waiter err = %v, want %v", err, wantErr)
+	}
+}
+
+func TestInflightGroup_PanicWakesWaitersWithError(t *testing.T) {
+	g := newInflightGroup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	leaderPanic := make(chan any, 1)
+	go func() {
+		defer func() { leaderPanic <- recover() }()
+		_, _, _, _ = g.Do("k", func() (*dns.Msg, string, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		msg, _, err, _ := g.Do("k", func() (*dns.Msg, string, error) {
+			t.Error("waiter should not run its own exchange")
+			return nil, "", nil
+		})
+		done <- result{msg, err}
+	}()
+	for {
+		g.mu.Lock()
+		dups := g.calls["k"].dups
+		g.mu.Unlock()
+		if dups == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if res := <-done; res.msg != nil || res.err == nil {
+		t.Errorf("waiter got (%v, %v), want an error", res.msg, res.err)
+	}
+	if p := <-leaderPanic; p != "boom" {
+		t.Errorf("leader recovered %v, want the original panic", p)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("calls map not cleaned up: %d entries", len(g.calls))
+	}
+}
@@ -0,0 +1,398 @@
+package dnsresolver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// pipelineMaxConns is the max number of connections per upstream address.
+	pipelineMaxConns = 4
+	// pipelineMaxInflightPerConn is the number of queries in flight on every connection before
+	// another one is opened (up to pipelineMaxConns).
+	pipelineMaxInflightPerConn = 100
+)
+
+// errPipelineClosed is returned for queries on a pipelined connection that was closed
+// (idle timeout, reload) before they were sent.
+var errPipelineClosed = errors.New("pipelined connection closed")
+
+// streamTransport sends queries to one TCP or TLS upstream: a connPool (one query per
+// connection at a time) or a pipelineTransport (many queries per connection).
+type streamTransport interface {
+	exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error)
+	// drain closes the idle connections; connections in use are closed once their queries are answered.
+	drain()
+}
+
+func (p *connPool) drain() { drainConnPool(p) }
+
+// pipelineTransport sends queries to a TCP or TLS upstream over a few long-lived connections,
+// many at a time per connection (RFC 7766 pipelining). Answers may come in any order; they are
+// matched to queries by message ID and question. Broken connections are replaced on the next
+// query, and connections without queries in flight are closed after the idle timeout.
+type pipelineTransport struct {
+	client      *dns.Client // dials the connections (tcp or tcp-tls)
+	addr        string
+	idleTimeout time.Duration // 0 = no limit
+
+	mu      sync.Mutex
+	conns   []*pipelineConn
+	dialing int
+	dialed  chan struct{} // closed when a dial in progress completes
+	drained bool
+}
+
+func newPipelineTransport(client *dns.Client, addr string, idleTimeout time.Duration) *pipelineTransport {
+	return &pipelineTransport{client: client, addr: addr, idleTimeout: idleTimeout}
+}
+
+// exchange sends req over the least busy connection. When a connection that was already open
+// turns out to be broken (closed by the server while idle, reset), the query is retried once
+// on a new connection.
+func (t *pipelineTransport) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c, reused, err := t.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	resp, err := c.exchange(ctx, req)
+	if err != nil && reused && ctx.Err() == nil && (errors.Is(err, errPipelineClosed) || isRetriableError(err)) {
+		t.mu.Lock()
+		t.startDialLocked()
+		t.mu.Unlock()
+		if c, err = t.dial(ctx); err != nil {
+			return nil, time.Since(start), err
+		}
+		start = time.Now()
+		resp, err = c.exchange(ctx, req)
+	}
+	return resp, time.Since(start), err
+}
+
+// conn returns the open connection with the fewest queries in flight, or a new one when all
+// are busy and there is room for another. While the first connection is being dialed, other
+// queries wait for it rather than each dialing their own. reused is false for a new connection.
+func (t *pipelineTransport) conn(ctx context.Context) (c *pipelineConn, reused bool, err error) {
+	for {
+		t.mu.Lock()
+		var best *pipelineConn
+		bestLoad := 0
+		live := t.conns[:0]
+		for _, pc := range t.conns {
+			load, ok := pc.load()
+			if !ok {
+				continue
+			}
+			live = append(live, pc)
+			if best == nil || load < bestLoad {
+				best, bestLoad = pc, load
+			}
+		}
+		clear(t.conns[len(live):])
+		t.conns = live
+		if best != nil && (bestLoad < pipelineMaxInflightPerConn || len(t.conns)+t.dialing >= pipelineMaxConns) {
+			t.mu.Unlock()
+			return best, true, nil
+		}
+		if best == nil && t.dialing > 0 {
+			dialed := t.dialed
+			t.mu.Unlock()
+			select {
+			case <-dialed:
+				continue
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}
+		t.startDialLocked()
+		t.mu.Unlock()
+		c, err = t.dial(ctx)
+		return c, false, err
+	}
+}
+
+// startDialLocked counts a dial about to start in t.dialing.
+func (t *pipelineTransport) startDialLocked() {
+	t.dialing++
+	if t.dialed == nil {
+		t.dialed = make(chan struct{})
+	}
+}
+
+// dial opens a connection. The caller has counted it with startDialLocked.
+func (t *pipelineTransport) dial(ctx context.Context) (*pipelineConn, error) {
+	conn, err := t.client.DialContext(ctx, t.addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dialing--
+	if t.dialed != nil {
+		close(t.dialed)
+		t.dialed = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// After drain the connection serves only the query it was dialed for.
+	c := newPipelineConn(conn.Conn, t.idleTimeout, t.drained)
+	if !t.drained {
+		t.conns = append(t.conns, c)
+	}
+	return c, nil
+}
+
+func (t *pipelineTransport) drain() {
+	t.mu.Lock()
+	t.drained = true
+	conns := t.conns
+	t.conns = nil
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.drain()
+	}
+}
+
+// pipelineQuery is a query waiting for its answer on a pipelineConn.
+type pipelineQuery struct {
+	question *dns.Question // nil for queries without a question
+	ch       chan pipelineResult
+}
+
+type pipelineResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// pipelineConn is one connection of a pipelineTransport. Each query is sent with an ID unique
+// on the connection (the caller's ID is restored on the answer); a reader goroutine hands the
+// answers to the waiting queries.
+type pipelineConn struct {
+	conn        net.Conn
+	idleTimeout time.Duration
+	writeMu     sync.Mutex
+
+	mu        sync.Mutex
+	pending   map[uint16]*pipelineQuery // by ID on the wire
+	closed    bool
+	draining  bool // close once no query is in flight
+	idleTimer *time.Timer
+}
+
+func newPipelineConn(conn net.Conn, idleTimeout time.Duration, draining bool) *pipelineConn {
+	c := &pipelineConn{
+		conn:        conn,
+		idleTimeout: idleTimeout,
+		pending:     make(map[uint16]*pipelineQuery),
+		draining:    draining,
+	}
+	if !draining {
+		c.mu.Lock()
+		c.idleLocked()
+		c.mu.Unlock()
+	}
+	go c.readLoop()
+	return c
+}
+
+// exchange sends req and waits for its answer or ctx. A write error breaks the stream framing,
+// so it closes the connection and fails the other queries in flight on it.
+func (c *pipelineConn) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	id, q, err := c.register(req)
+	if err != nil {
+		return nil, err
+	}
+	m := *req // shallow copy: only the ID differs on the wire
+	m.Id = id
+	packed, err := m.Pack()
+	if err != nil {
+		c.unregister(id)
+		return nil, err
+	}
+	if err := c.write(ctx, packed); err != nil {
+		c.close(err)
+		return nil, err
+	}
+	select {
+	case res := <-q.ch:
+		if res.msg != nil {
+			res.msg.Id = req.Id
+		}
+		return res.msg, res.err
+	case <-ctx.Done():
+		c.unregister(id)
+		return nil, ctx.Err()
+	}
+}
+
+// register adds a pending query for req under a random ID not in use on the connection.
+func (c *pipelineConn) register(req *dns.Msg) (uint16, *pipelineQuery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, nil, errPipelineClosed
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	id := dns.Id()
+	for c.pending[id] != nil {
+		id = dns.Id()
+	}
+	q := &pipelineQuery{ch: make(chan pipelineResult, 1)}
+	if len(req.Question) > 0 {
+		question := req.Question[0]
+		q.question = &question
+	}
+	c.pending[id] = q
+	return id, q, nil
+}
+
+// unregister drops a query that will not wait for its answer; a late answer is discarded.
+func (c *pipelineConn) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pending[id]; ok {
+		delete(c.pending, id)
+		c.idleLocked()
+	}
+}
+
+func (c *pipelineConn) write(ctx context.Context, packed []byte) error {
+	frame := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+	copy(frame[2:], packed)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, _ := ctx.Deadline()
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readLoop reads length-prefixed answers until the connection fails or is closed.
+func (c *pipelineConn) readLoop() {
+	r := bufio.NewReader(c.conn)
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			c.close(err)
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			c.close(err)
+			return
+		}
+		c.deliver(buf)
+	}
+}
+
+// deliver hands an answer to the query with its ID. Answers for unknown IDs (queries that
+// gave up) or another question are dropped.
+func (c *pipelineConn) deliver(buf []byte) {
+	if len(buf) < 2 {
+		return
+	}
+	id := binary.BigEndian.Uint16(buf)
+	msg := new(dns.Msg)
+	unpackErr := msg.Unpack(buf)
+	c.mu.Lock()
+	q := c.pending[id]
+	if q == nil || (unpackErr == nil && !questionMatches(msg, q.question)) {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.pending, id)
+	c.idleLocked()
+	c.mu.Unlock()
+	if unpackErr != nil {
+		q.ch <- pipelineResult{err: unpackErr}
+		return
+	}
+	q.ch <- pipelineResult{msg: msg}
+}
+
+// questionMatches reports whether resp answers question (nil matches any response).
+func questionMatches(resp *dns.Msg, question *dns.Question) bool {
+	if question == nil {
+		return true
+	}
+	if len(resp.Question) != 1 {
+		return false
+	}
+	got := resp.Question[0]
+	return got.Qtype == question.Qtype && got.Qclass == question.Qclass && strings.EqualFold(got.Name, question.Name)
+}
+
+// load returns the number of queries in flight, and false when the connection is closed.
+func (c *pipelineConn) load() (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending), !c.closed
+}
+
+// idleLocked is called when the connection may have become idle: it is closed when draining,
+// or after the idle timeout.
+func (c *pipelineConn) idleLocked() {
+	if len(c.pending) > 0 || c.closed {
+		return
+	}
+	if c.draining {
+		c.closeLocked(errPipelineClosed)
+		return
+	}
+	if c.idleTimeout > 0 && c.idleTimer == nil {
+		c.idleTimer = time.AfterFunc(c.idleTimeout, c.closeIfIdle)
+	}
+}
+
+func (c *pipelineConn) closeIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idleTimer = nil
+	if len(c.pending) == 0 && !c.closed {
+		c.closeLocked(errPipelineClosed)
+	}
+}
+
+func (c *pipelineConn) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+	c.idleLocked()
+}
+
+// close closes the connection and fails the queries in flight with err.
+func (c *pipelineConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(err)
+}
+
+func (c *pipelineConn) closeLocked(err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	for id, q := range c.pending {
+		q.ch <- pipelineResult{err: err}
+		delete(c.pending, id)
+	}
+	c.conn.Close()
+}
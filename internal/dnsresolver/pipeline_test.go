@@ -0,0 +1,333 @@
+package dnsresolver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// pipelineServer is a TCP DNS server that answers the queries of a connection concurrently,
+// in whatever order handle's delays give, like RFC 7766 resolvers do. miekg's server answers
+// the queries of a connection one at a time.
+type pipelineServer struct {
+	addr     string
+	accepted atomic.Int32
+}
+
+// pipelineServerOptions tune a pipelineServer.
+type pipelineServerOptions struct {
+	closeAfter int           // close connections after this many answers (0 = never)
+	handshake  time.Duration // delay before a new connection is served, like a TLS handshake
+}
+
+// startPipelineServer answers each query with handle's response after its delay.
+func startPipelineServer(tb testing.TB, handle func(req *dns.Msg) (*dns.Msg, time.Duration), opts pipelineServerOptions) *pipelineServer {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Listen: %v", err)
+	}
+	s := &pipelineServer{addr: ln.Addr().String()}
+	var mu sync.Mutex
+	var conns []net.Conn
+	tb.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.accepted.Add(1)
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				time.Sleep(opts.handshake)
+				serveStream(conn, handle, opts.closeAfter)
+			}()
+		}
+	}()
+	return s
+}
+
+func serveStream(conn net.Conn, handle func(req *dns.Msg) (*dns.Msg, time.Duration), closeAfter int) {
+	var writeMu sync.Mutex
+	answered := 0
+	r := bufio.NewReader(conn)
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			return
+		}
+		go func() {
+			resp, delay := handle(req)
+			time.Sleep(delay)
+			packed, err := resp.Pack()
+			if err != nil {
+				return
+			}
+			frame := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_, _ = conn.Write(append(frame, packed...))
+			answered++
+			if closeAfter > 0 && answered >= closeAfter {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// delayedAnswer answers A queries with 192.0.2.1, after the delay given for the name.
+func delayedAnswer(delays map[string]time.Duration) func(req *dns.Msg) (*dns.Msg, time.Duration) {
+	return func(req *dns.Msg) (*dns.Msg, time.Duration) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(192, 0, 2, 1)}}
+		return resp, delays[req.Question[0].Name]
+	}
+}
+
+// openConns returns the transport's connections.
+func (t *pipelineTransport) openConns() []*pipelineConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.conns)
+}
+
+func pipelineQuestion(name string, id uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.Id = id
+	return req
+}
+
+func TestPipelineTransportOutOfOrder(t *testing.T) {
+	srv := startPipelineServer(t, delayedAnswer(map[string]time.Duration{"slow.example.": 300 * time.Millisecond}), pipelineServerOptions{})
+	tr := newPipelineTransport(&dns.Client{Net: "tcp", Timeout: 5 * time.Second}, srv.addr, 0)
+	defer tr.drain()
+	ctx := context.Background()
+
+	// Both queries carry the same client ID; the transport gives each its own on the wire.
+	slowDone := make(chan *dns.Msg, 1)
+	go func() {
+		resp, _, err := tr.exchange(ctx, pipelineQuestion("slow.example.", 42))
+		if err != nil {
+			t.Errorf("slow exchange: %v", err)
+		}
+		slowDone <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+	resp, _, err := tr.exchange(ctx, pipelineQuestion("fast.example.", 42))
+	if err != nil {
+		t.Fatalf("fast exchange: %v", err)
+	}
+	select {
+	case <-slowDone:
+		t.Fatal("fast query answered after the slow one")
+	default:
+	}
+	if resp.Id != 42 || resp.Question[0].Name != "fast.example." {
+		t.Errorf("fast answer id %d question %v", resp.Id, resp.Question)
+	}
+	slow := <-slowDone
+	if slow == nil || slow.Id != 42 || slow.Question[0].Name != "slow.example." {
+		t.Errorf("unexpected slow answer %v", slow)
+	}
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("%d connections opened, want 1", n)
+	}
+}
+
+func TestPipelineTransportDropsMismatchedAndLateAnswers(t *testing.T) {
+	var wrongQuestion atomic.Bool
+	wrongQuestion.Store(true)
+	srv := startPipelineServer(t, func(req *dns.Msg) (*dns.Msg, time.Duration) {
+		resp, delay := delayedAnswer(map[string]time.Duration{"late.example.": 200 * time.Millisecond})(req)
+		if req.Question[0].Name == "spoofed.example." && wrongQuestion.Load() {
+			// Right ID, wrong question: must not be taken as the answer.
+			resp.Question[0].Name = "other.example."
+		}
+		return resp, delay
+	}, pipelineServerOptions{})
+	tr := newPipelineTransport(&dns.Client{Net: "tcp", Timeout: 5 * time.Second}, srv.addr, 0)
+	defer tr.drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, _, err := tr.exchange(ctx, pipelineQuestion("spoofed.example.", 1))
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("answer for another question: err %v, want deadline exceeded", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, _, err = tr.exchange(ctx, pipelineQuestion("late.example.", 2))
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("late answer: err %v, want deadline exceeded", err)
+	}
+	// The late answer arrives while the next query waits; the connection keeps working.
+	wrongQuestion.Store(false)
+	resp, _, err := tr.exchange(context.Background(), pipelineQuestion("spoofed.example.", 3))
+	if err != nil || resp.Question[0].Name != "spoofed.example." {
+		t.Fatalf("exchange after timeouts = %v, %v", resp, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("%d connections opened, want 1", n)
+	}
+}
+
+func TestPipelineTransportReconnects(t *testing.T) {
+	// The server closes every connection after one answer.
+	srv := startPipelineServer(t, delayedAnswer(nil), pipelineServerOptions{closeAfter: 1})
+	tr := newPipelineTransport(&dns.Client{Net: "tcp", Timeout: 5 * time.Second}, srv.addr, 0)
+	defer tr.drain()
+	for i := 0; i < 5; i++ {
+		resp, _, err := tr.exchange(context.Background(), pipelineQuestion("example.com.", uint16(i)))
+		if err != nil || len(resp.Answer) != 1 {
+			t.Fatalf("exchange %d = %v, %v", i, resp, err)
+		}
+	}
+	if n := srv.accepted.Load(); n < 5 {
+		t.Errorf("%d connections opened, want a new one per query", n)
+	}
+}
+
+func TestPipelineTransportIdleTimeout(t *testing.T) {
+	srv := startPipelineServer(t, delayedAnswer(nil), pipelineServerOptions{})
+	tr := newPipelineTransport(&dns.Client{Net: "tcp", Timeout: 5 * time.Second}, srv.addr, 50*time.Millisecond)
+	defer tr.drain()
+	if _, _, err := tr.exchange(context.Background(), pipelineQuestion("example.com.", 1)); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	c := tr.openConns()[0]
+	time.Sleep(150 * time.Millisecond)
+	if _, open := c.load(); open {
+		t.Fatal("idle connection not closed")
+	}
+	if _, _, err := tr.exchange(context.Background(), pipelineQuestion("example.com.", 2)); err != nil {
+		t.Fatalf("exchange after idle close: %v", err)
+	}
+	if n := srv.accepted.Load(); n != 2 {
+		t.Errorf("%d connections opened, want 2", n)
+	}
+}
+
+func TestPipelineTransportDrainWaitsForQueries(t *testing.T) {
+	srv := startPipelineServer(t, delayedAnswer(map[string]time.Duration{"slow.example.": 100 * time.Millisecond}), pipelineServerOptions{})
+	tr := newPipelineTransport(&dns.Client{Net: "tcp", Timeout: 5 * time.Second}, srv.addr, 0)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := tr.exchange(context.Background(), pipelineQuestion("slow.example.", 1))
+		done <- err
+	}()
+	time.Sleep(30 * time.Millisecond)
+	c := tr.openConns()[0]
+	tr.drain()
+	if err := <-done; err != nil {
+		t.Fatalf("query in flight during drain: %v", err)
+	}
+	if _, open := c.load(); open {
+		t.Error("drained connection left open")
+	}
+	// A drained transport still answers, on a connection closed right after.
+	if _, _, err := tr.exchange(context.Background(), pipelineQuestion("example.com.", 2)); err != nil {
+		t.Fatalf("exchange after drain: %v", err)
+	}
+	if n := len(tr.openConns()); n != 0 {
+		t.Errorf("drained transport kept %d connections", n)
+	}
+}
+
+func TestResolverTCPUpstreamPipelined(t *testing.T) {
+	srv := startPipelineServer(t, delayedAnswer(map[string]time.Duration{"example.com.": 20 * time.Millisecond}), pipelineServerOptions{})
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams[0].Address = srv.addr
+	cfg.Upstreams[0].Protocol = "tcp"
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := r.exchange(context.Background(), pipelineQuestion("example.com.", uint16(i))); err != nil {
+				t.Errorf("exchange: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("%d connections opened for 20 concurrent queries, want 1", n)
+	}
+
+	cfg.Network.UpstreamPipelining = ptr(false)
+	r.ApplyUpstreamConfig(cfg)
+	if _, ok := r.tcpConnPoolFor(srv.addr).(*connPool); !ok {
+		t.Error("expected a connection pool with upstream_pipelining off")
+	}
+}
+
+// BenchmarkStreamTransport compares a connection pool with pipelining under concurrent load,
+// against a TCP upstream taking 1ms per answer and 5ms to set up a connection (a TLS
+// handshake on a LAN). conns/op is the connections opened per query.
+func BenchmarkStreamTransport(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		new  func(client *dns.Client, addr string) streamTransport
+	}{
+		{"pool", func(client *dns.Client, addr string) streamTransport {
+			return newConnPool(client, addr, 30*time.Second, false)
+		}},
+		{"pipelined", func(client *dns.Client, addr string) streamTransport {
+			return newPipelineTransport(client, addr, 30*time.Second)
+		}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			srv := startPipelineServer(b, func(req *dns.Msg) (*dns.Msg, time.Duration) {
+				resp, _ := delayedAnswer(nil)(req)
+				return resp, time.Millisecond
+			}, pipelineServerOptions{handshake: 5 * time.Millisecond})
+			tr := tc.new(&dns.Client{Net: "tcp", Timeout: 5 * time.Second}, srv.addr)
+			defer tr.drain()
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				req := pipelineQuestion("example.com.", 1)
+				for pb.Next() {
+					if _, _, err := tr.exchange(context.Background(), req); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(srv.accepted.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package dnsresolver
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// privateReverseTTL is the TTL of synthesized PTR answers and the SOA minimum of negative
+// answers. Kept short because client names and local records can change at any time.
+const privateReverseTTL = 300
+
+// privateReversePrefixes are the address ranges whose reverse zones are served locally:
+// RFC 1918, CGNAT (RFC 6598), IPv4 link-local, ULA (RFC 4193) and IPv6 link-local.
+var privateReversePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// privateReverse answers reverse lookups for private address space locally so they never
+// reach the public upstreams.
+type privateReverse struct {
+	domain string           // appended to client_identification names; "" = bare name
+	mgr    *upstreamManager // local router upstreams; nil = unresolved names get NXDOMAIN
+}
+
+// newPrivateReverse returns the private reverse handling for cfg, or nil when disabled. The
+// upstream manager of prev (the handling being replaced on hot-reload) is kept, so backoff
+// and health of the local router upstreams survive the reload.
+func newPrivateReverse(cfg config.PrivateReverseConfig, netCfg networkConfig, prev *privateReverse) *privateReverse {
+	if cfg.Enabled != nil && !*cfg.Enabled {
+		return nil
+	}
+	p := &privateReverse{domain: normalizeQueryName(strings.TrimPrefix(strings.TrimSpace(cfg.Domain), "."))}
+	if upstreams := parseUpstreams(cfg.Upstreams); len(upstreams) > 0 {
+		if prev != nil && prev.mgr != nil {
+			p.mgr = prev.mgr
+			p.mgr.ApplyConfig(upstreams, StrategyFailover, netCfg.timeout, netCfg.backoff, netCfg.connPoolIdle, netCfg.connPoolValidate)
+		} else {
+			p.mgr = newUpstreamManager(upstreams, StrategyFailover, netCfg.timeout, netCfg.backoff, netCfg.connPoolIdle, netCfg.connPoolValidate)
+		}
+	}
+	return p
+}
+
+// parsePrivateReverse reports whether qname (normalized, see normalizeQueryName) is in the
+// reverse zone of a private range. zone is the locally served zone (the range's reverse
+// name, rounded to whole labels) and addr is the address when qname names exactly one.
+func parsePrivateReverse(qname string) (zone string, addr netip.Addr, ok bool) {
+	var labels []string
+	var v6 bool
+	switch {
+	case strings.HasSuffix(qname, ".in-addr.arpa"):
+		labels = strings.Split(strings.TrimSuffix(qname, ".in-addr.arpa"), ".")
+	case strings.HasSuffix(qname, ".ip6.arpa"):
+		labels = strings.Split(strings.TrimSuffix(qname, ".ip6.arpa"), ".")
+		v6 = true
+	default:
+		return "", netip.Addr{}, false
+	}
+
+	// Labels are least significant first; read from the right until an invalid label.
+	var b [16]byte
+	bits, full := 0, false
+	for i := len(labels) - 1; i >= 0; i-- {
+		if v6 {
+			if bits == 128 || len(labels[i]) != 1 {
+				break
+			}
+			n, err := strconv.ParseUint(labels[i], 16, 4)
+			if err != nil {
+				break
+			}
+			b[bits/8] |= byte(n) << (4 - bits%8)
+			bits += 4
+			full = bits == 128 && i == 0
+		} else {
+			if bits == 32 || labels[i] == "" || (len(labels[i]) > 1 && labels[i][0] == '0') {
+				break
+			}
+			n, err := strconv.ParseUint(labels[i], 10, 8)
+			if err != nil {
+				break
+			}
+			b[bits/8] = byte(n)
+			bits += 8
+			full = bits == 32 && i == 0
+		}
+	}
+	if bits == 0 {
+		return "", netip.Addr{}, false
+	}
+	var prefixAddr netip.Addr
+	if v6 {
+		prefixAddr = netip.AddrFrom16(b)
+	} else {
+		prefixAddr = netip.AddrFrom4([4]byte(b[:4]))
+	}
+	for _, pfx := range privateReversePrefixes {
+		if pfx.Addr().Is6() != v6 || bits < pfx.Bits() || !pfx.Contains(prefixAddr) {
+			continue
+		}
+		labelBits := 8
+		if v6 {
+			labelBits = 4
+		}
+		zoneLabels := (pfx.Bits() + labelBits - 1) / labelBits
+		zone = strings.Join(labels[len(labels)-zoneLabels:], ".")
+		if v6 {
+			zone += ".ip6.arpa"
+		} else {
+			zone += ".in-addr.arpa"
+		}
+		if full {
+			addr = prefixAddr
+		}
+		return zone, addr, true
+	}
+	return "", netip.Addr{}, false
+}
+
+// privateReverseReply answers req locally when qname is a private reverse name. It returns
+// nil when the query should go on to the cache and upstreams instead: private reverse is
+// disabled, qname is not private, a conditional forwarding route covers it, or no name is
+// known and a local router upstream is configured (exchange then routes it there).
+func (r *Resolver) privateReverseReply(req *dns.Msg, question dns.Question, qname string) *dns.Msg {
+	p := r.privateReverse.Load()
+	if p == nil {
+		return nil
+	}
+	zone, addr, ok := parsePrivateReverse(qname)
+	if !ok || r.upstreamRoutes.Load().match(qname) != nil {
+		return nil
+	}
+	var names []string
+	if addr.IsValid() {
+		names = r.privateReverseNames(p, addr)
+	}
+	if len(names) == 0 && p.mgr != nil {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	if len(names) == 0 {
+		resp.Rcode = dns.RcodeNameError
+	} else if question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY {
+		for _, name := range names {
+			resp.Answer = append(resp.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: privateReverseTTL},
+				Ptr: dns.Fqdn(name),
+			})
+		}
+		return resp
+	}
+	// NXDOMAIN, or NODATA for other types: SOA of the locally served zone as in RFC 6303.
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: privateReverseTTL},
+		Ns:      "localhost.",
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  privateReverseTTL,
+	}}
+	return resp
+}
+
+// privateReverseNames returns the names for addr: local A/AAAA records first, then the
+// client_identification name (as a hostname under the configured domain).
+func (r *Resolver) privateReverseNames(p *privateReverse, addr netip.Addr) []string {
+	var names []string
+	if r.localRecords != nil {
+		names = r.localRecords.NamesForAddr(addr)
+	}
+	if r.clientIDEnabled.Load() && r.clientIDResolver != nil {
+		if name, ok := r.clientIDResolver.Name(addr.String()); ok {
+			if host := clientHostname(name, p.domain); host != "" && !containsString(names, host) {
+				names = append(names, host)
+			}
+		}
+	}
+	return names
+}
+
+// clientHostname turns a client display name (e.g. "Kids iPad") into a hostname
+// ("kids-ipad"), with domain appended when set. Returns "" when nothing usable is left.
+func clientHostname(name, domain string) string {
+	var labels []string
+	for _, label := range strings.Split(strings.ToLower(name), ".") {
+		var sb strings.Builder
+		dash := false
+		for _, c := range label {
+			if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+				if dash && sb.Len() > 0 {
+					sb.WriteByte('-')
+				}
+				sb.WriteRune(c)
+				dash = false
+			} else {
+				dash = true
+			}
+		}
+		if l := sb.String(); l != "" {
+			if len(l) > 63 {
+				l = strings.TrimRight(l[:63], "-")
+			}
+			labels = append(labels, l)
+		}
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	host := strings.Join(labels, ".")
+	if domain != "" {
+		host += "." + domain
+	}
+	return host
+}
@@ -0,0 +1,210 @@
+package dnsresolver
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/cache"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/localrecords"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+)
+
+func TestParsePrivateReverse(t *testing.T) {
+	tests := []struct {
+		qname    string
+		wantZone string
+		wantAddr string
+		wantOK   bool
+	}{
+		{"5.0.0.10.in-addr.arpa", "10.in-addr.arpa", "10.0.0.5", true},
+		{"10.in-addr.arpa", "10.in-addr.arpa", "", true},
+		{"1.1.168.192.in-addr.arpa", "168.192.in-addr.arpa", "192.168.1.1", true},
+		{"1.0.20.172.in-addr.arpa", "20.172.in-addr.arpa", "172.20.0.1", true},
+		{"1.0.32.172.in-addr.arpa", "", "", false}, // outside 172.16.0.0/12
+		{"172.in-addr.arpa", "", "", false},        // wider than the private range
+		{"9.0.64.100.in-addr.arpa", "64.100.in-addr.arpa", "100.64.0.9", true},
+		{"9.0.128.100.in-addr.arpa", "", "", false}, // outside 100.64.0.0/10
+		{"1.2.254.169.in-addr.arpa", "254.169.in-addr.arpa", "169.254.2.1", true},
+		{"foo.5.0.0.10.in-addr.arpa", "10.in-addr.arpa", "", true},
+		{"_dns-sd._udp.1.168.192.in-addr.arpa", "168.192.in-addr.arpa", "", true},
+		{"8.8.8.8.in-addr.arpa", "", "", false},
+		{"1.1.1.1.in-addr.arpa", "", "", false},
+		{"1.0.0.010.in-addr.arpa", "", "", false},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", "d.f.ip6.arpa", "fd00::1", true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa", "8.e.f.ip6.arpa", "fe80::1", true},
+		{"d.f.ip6.arpa", "d.f.ip6.arpa", "", true},
+		{"8.b.d.0.1.0.0.2.ip6.arpa", "", "", false},
+		{"example.com", "", "", false},
+		{"in-addr.arpa", "", "", false},
+	}
+	for _, tt := range tests {
+		zone, addr, ok := parsePrivateReverse(tt.qname)
+		gotAddr := ""
+		if addr.IsValid() {
+			gotAddr = addr.String()
+		}
+		if ok != tt.wantOK || zone != tt.wantZone || gotAddr != tt.wantAddr {
+			t.Errorf("parsePrivateReverse(%q) = %q, %q, %v; want %q, %q, %v", tt.qname, zone, gotAddr, ok, tt.wantZone, tt.wantAddr, tt.wantOK)
+		}
+	}
+}
+
+func TestClientHostname(t *testing.T) {
+	tests := []struct {
+		name, domain, want string
+	}{
+		{"Kids iPad", "", "kids-ipad"},
+		{"Kids iPad", "home.arpa", "kids-ipad.home.arpa"},
+		{"  Dad's  Laptop!! ", "lan", "dad-s-laptop.lan"},
+		{"nas.local", "", "nas.local"},
+		{"Büro PC", "", "b-ro-pc"},
+		{"!!!", "lan", ""},
+	}
+	for _, tt := range tests {
+		if got := clientHostname(tt.name, tt.domain); got != tt.want {
+			t.Errorf("clientHostname(%q, %q) = %q, want %q", tt.name, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestResolverPrivateReverse(t *testing.T) {
+	var publicQueries atomic.Int32
+	publicAddr := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		publicQueries.Add(1)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+			Ptr: "public.example.",
+		})
+		_ = w.WriteMsg(resp)
+	}))
+
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "public", Address: publicAddr, Protocol: "udp"}}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{IP: "192.168.1.10", Name: "Kids iPad"}},
+	}
+	cfg.PrivateReverse = config.PrivateReverseConfig{Enabled: ptr(true), Domain: "home.arpa"}
+	localMgr := localrecords.New([]config.LocalRecordEntry{
+		{Name: "nas.home.arpa", Type: "A", Value: "192.168.1.20"},
+		{Name: "printer.home.arpa", Type: "AAAA", Value: "fd00::20"},
+	}, logging.NewDiscardLogger())
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	resolver := buildTestResolver(t, cfg, cache.NewMockCache(), blMgr, localMgr)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &mockResponseWriter{}
+		resolver.ServeDNS(w, req)
+		if w.written == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.written
+	}
+	ptrTarget := func(resp *dns.Msg) string {
+		if len(resp.Answer) == 0 {
+			return ""
+		}
+		ptr, _ := resp.Answer[0].(*dns.PTR)
+		if ptr == nil {
+			return ""
+		}
+		return ptr.Ptr
+	}
+
+	if resp := query("20.1.168.192.in-addr.arpa.", dns.TypePTR); ptrTarget(resp) != "nas.home.arpa." || !resp.Authoritative {
+		t.Errorf("local record PTR: got %v", resp)
+	}
+	if resp := query("10.1.168.192.in-addr.arpa.", dns.TypePTR); ptrTarget(resp) != "kids-ipad.home.arpa." {
+		t.Errorf("client name PTR: got %v", resp)
+	}
+	reverse, _ := dns.ReverseAddr("fd00::20")
+	if resp := query(reverse, dns.TypePTR); ptrTarget(resp) != "printer.home.arpa." {
+		t.Errorf("ULA PTR: got %v", resp)
+	}
+	resp := query("99.1.168.192.in-addr.arpa.", dns.TypePTR)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "168.192.in-addr.arpa." {
+		t.Errorf("unknown private address: expected NXDOMAIN with zone SOA, got %v", resp)
+	}
+	if resp := query("20.1.168.192.in-addr.arpa.", dns.TypeTXT); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Errorf("known address, other type: expected NODATA, got %v", resp)
+	}
+	if publicQueries.Load() != 0 {
+		t.Fatalf("private reverse queries leaked upstream: %d", publicQueries.Load())
+	}
+	if resp := query("8.8.8.8.in-addr.arpa.", dns.TypePTR); ptrTarget(resp) != "public.example." {
+		t.Errorf("public address should be resolved upstream, got %v", resp)
+	}
+
+	// A local router upstream gets the names that cannot be synthesized.
+	routerAddr := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+			Ptr: "dhcp-client.router.lan.",
+		})
+		_ = w.WriteMsg(resp)
+	}))
+	cfg.PrivateReverse.Upstreams = []config.UpstreamConfig{{Name: "router", Address: routerAddr, Protocol: "udp"}}
+	resolver.ApplyUpstreamConfig(cfg)
+	if resp := query("99.1.168.192.in-addr.arpa.", dns.TypePTR); ptrTarget(resp) != "dhcp-client.router.lan." {
+		t.Errorf("router upstream: got %v", resp)
+	}
+	if resp := query("20.1.168.192.in-addr.arpa.", dns.TypePTR); ptrTarget(resp) != "nas.home.arpa." {
+		t.Errorf("synthesized names take precedence over the router, got %v", resp)
+	}
+
+	// Opt-out: private reverse queries go to the public upstreams as before.
+	cfg.PrivateReverse = config.PrivateReverseConfig{Enabled: ptr(false)}
+	resolver.ApplyUpstreamConfig(cfg)
+	if resp := query("98.1.168.192.in-addr.arpa.", dns.TypePTR); ptrTarget(resp) != "public.example." {
+		t.Errorf("disabled: got %v", resp)
+	}
+	if publicQueries.Load() != 2 {
+		t.Errorf("expected 2 public upstream queries, got %d", publicQueries.Load())
+	}
+}
+
+func TestResolverPrivateReverse_RoutePrecedence(t *testing.T) {
+	vpnAddr := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+			Ptr: "host.vpn.example.",
+		})
+		_ = w.WriteMsg(resp)
+	}))
+
+	cfg := minimalResolverConfig("https://invalid.invalid/dns-query")
+	cfg.UpstreamRoutes = []config.UpstreamRouteConfig{
+		{Suffixes: []string{"8.10.in-addr.arpa"}, Upstreams: []config.UpstreamConfig{{Address: vpnAddr, Protocol: "udp"}}},
+	}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	resolver := buildTestResolver(t, cfg, cache.NewMockCache(), blMgr, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("1.0.8.10.in-addr.arpa.", dns.TypePTR)
+	w := &mockResponseWriter{remoteAddr: net.IPv4(192, 168, 1, 2).String()}
+	resolver.ServeDNS(w, req)
+	if w.written == nil || len(w.written.Answer) != 1 || w.written.Answer[0].(*dns.PTR).Ptr != "host.vpn.example." {
+		t.Fatalf("expected conditional forwarding route to answer, got %v", w.written)
+	}
+
+	req.SetQuestion("1.0.9.10.in-addr.arpa.", dns.TypePTR)
+	resolver.ServeDNS(w, req)
+	if w.written.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN outside the route, got %v", w.written)
+	}
+}
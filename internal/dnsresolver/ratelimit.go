@@ -0,0 +1,495 @@
+package dnsresolver
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/metrics"
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateLimitSweepInterval = time.Minute
+	// rateLimitRetention: how long a limited client stays listed (and its bucket kept) after
+	// its last over-limit query.
+	rateLimitRetention = 10 * time.Minute
+	// rateLimitMaxBuckets caps memory under floods from many (possibly spoofed) sources.
+	// Clients beyond the cap are not limited until the next sweep frees buckets.
+	rateLimitMaxBuckets = 100000
+)
+
+// RRL response categories. NXDOMAIN is accounted per zone so random-subdomain floods share
+// one bucket; errors are accounted per client prefix only.
+const (
+	rrlAnswer uint8 = iota
+	rrlNoData
+	rrlNXDomain
+	rrlError
+)
+
+// RateLimitedClient is a client prefix that recently went over its query limit, as exposed
+// to the API/UI.
+type RateLimitedClient struct {
+	Client      string // address prefix sharing the bucket, e.g. 192.168.1.23/32
+	Protocol    string // udp or tcp (TCP, DoT and DoH)
+	GroupID     string // client group whose limits applied; "" for the global limits
+	Action      string // drop, truncate or refuse
+	Limited     uint64 // over-limit queries since the bucket was created
+	LastLimited time.Time
+}
+
+// rateLimitLimits are the query limits for one set of clients (global or a group override).
+type rateLimitLimits struct {
+	udp, tcp           rate.Limit
+	udpBurst, tcpBurst int
+	action             string
+}
+
+type rateLimitKey struct {
+	prefix netip.Prefix
+	tcp    bool
+}
+
+type clientBucket struct {
+	limiter     *rate.Limiter
+	burst       int
+	groupID     string
+	action      string
+	limited     uint64
+	lastLimited time.Time
+}
+
+type rrlKey struct {
+	prefix   netip.Prefix
+	name     string
+	qtype    uint16
+	category uint8
+}
+
+type rrlBucket struct {
+	limiter    *rate.Limiter
+	suppressed uint64
+}
+
+// rrlPolicy is the response rate limiting configuration; nil when RRL is off.
+type rrlPolicy struct {
+	rate           rate.Limit
+	burst          int
+	slip           uint64
+	v4Bits, v6Bits int
+}
+
+// rateLimiter holds per-client query buckets and RRL response buckets. It is built from
+// config and replaced as a whole on hot-reload; see adopt.
+type rateLimiter struct {
+	global         *rateLimitLimits            // nil when per-client limits are off globally
+	groups         map[string]*rateLimitLimits // group overrides; a nil value exempts the group
+	v4Bits, v6Bits int
+	exempt         []netip.Prefix
+	rrl            *rrlPolicy
+
+	mu        sync.Mutex
+	clients   map[rateLimitKey]*clientBucket
+	responses map[rrlKey]*rrlBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter builds the rate limiter from config, or returns nil when neither per-client
+// limits (globally or for any group) nor RRL are enabled.
+func newRateLimiter(cfg config.Config) *rateLimiter {
+	rlc := cfg.RateLimit
+	base := rateLimitLimits{
+		udp:      rate.Limit(rlc.UDPQPS),
+		tcp:      rate.Limit(rlc.TCPQPS),
+		udpBurst: rlc.UDPBurst,
+		tcpBurst: rlc.TCPBurst,
+		action:   rlc.Action,
+	}
+	rl := &rateLimiter{
+		groups:    make(map[string]*rateLimitLimits),
+		v4Bits:    rlc.IPv4PrefixLength,
+		v6Bits:    rlc.IPv6PrefixLength,
+		clients:   make(map[rateLimitKey]*clientBucket),
+		responses: make(map[rrlKey]*rrlBucket),
+	}
+	globalEnabled := rlc.Enabled != nil && *rlc.Enabled
+	if globalEnabled {
+		rl.global = &base
+	}
+	anyEnabled := globalEnabled
+	for _, g := range cfg.ClientGroups {
+		if g.RateLimit == nil {
+			continue
+		}
+		enabled := globalEnabled
+		if g.RateLimit.Enabled != nil {
+			enabled = *g.RateLimit.Enabled
+		}
+		if !enabled {
+			rl.groups[g.ID] = nil
+			continue
+		}
+		anyEnabled = true
+		limits := base
+		if g.RateLimit.UDPQPS > 0 {
+			limits.udp = rate.Limit(g.RateLimit.UDPQPS)
+		}
+		if g.RateLimit.UDPBurst > 0 {
+			limits.udpBurst = g.RateLimit.UDPBurst
+		}
+		if g.RateLimit.TCPQPS > 0 {
+			limits.tcp = rate.Limit(g.RateLimit.TCPQPS)
+		}
+		if g.RateLimit.TCPBurst > 0 {
+			limits.tcpBurst = g.RateLimit.TCPBurst
+		}
+		if g.RateLimit.Action != "" {
+			limits.action = g.RateLimit.Action
+		}
+		rl.groups[g.ID] = &limits
+	}
+	if rlc.RRL.Enabled != nil && *rlc.RRL.Enabled {
+		rl.rrl = &rrlPolicy{
+			rate:   rate.Limit(rlc.RRL.ResponsesPerSecond),
+			burst:  rlc.RRL.Burst,
+			v4Bits: rlc.RRL.IPv4PrefixLength,
+			v6Bits: rlc.RRL.IPv6PrefixLength,
+		}
+		if rlc.RRL.Slip != nil && *rlc.RRL.Slip > 0 {
+			rl.rrl.slip = uint64(*rlc.RRL.Slip)
+		}
+	}
+	if !anyEnabled && rl.rrl == nil {
+		return nil
+	}
+	for _, s := range rlc.Exempt {
+		if pfx, err := netip.ParsePrefix(s); err == nil {
+			rl.exempt = append(rl.exempt, pfx.Masked())
+		} else if addr, err := netip.ParseAddr(s); err == nil {
+			rl.exempt = append(rl.exempt, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		}
+	}
+	return rl
+}
+
+// ApplyRateLimitConfig updates rate limiting at runtime (for hot-reload and sync). Bucket
+// state and the list of limited clients carry over to the new limits.
+func (r *Resolver) ApplyRateLimitConfig(cfg config.Config) {
+	rl := newRateLimiter(cfg)
+	if rl != nil {
+		rl.adopt(r.rateLimit.Load(), time.Now())
+	}
+	r.rateLimit.Store(rl)
+}
+
+// RateLimitedClients returns the clients that went over their query limit within the last
+// rateLimitRetention, most recent first. enabled is false when rate limiting is off.
+func (r *Resolver) RateLimitedClients() (clients []RateLimitedClient, enabled bool) {
+	rl := r.rateLimit.Load()
+	if rl == nil {
+		return nil, false
+	}
+	cutoff := time.Now().Add(-rateLimitRetention)
+	rl.mu.Lock()
+	for key, b := range rl.clients {
+		if b.limited == 0 || b.lastLimited.Before(cutoff) {
+			continue
+		}
+		protocol := "udp"
+		if key.tcp {
+			protocol = "tcp"
+		}
+		clients = append(clients, RateLimitedClient{
+			Client:      key.prefix.String(),
+			Protocol:    protocol,
+			GroupID:     b.groupID,
+			Action:      b.action,
+			Limited:     b.limited,
+			LastLimited: b.lastLimited,
+		})
+	}
+	rl.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].LastLimited.After(clients[j].LastLimited) })
+	return clients, true
+}
+
+// rateLimitReply checks the client's query bucket. When the query is over the limit it
+// returns limited=true, the configured action and the reply to send (nil = drop).
+func (r *Resolver) rateLimitReply(rl *rateLimiter, w dns.ResponseWriter, req *dns.Msg) (reply *dns.Msg, action, protocol string, limited bool) {
+	addr, tcp, ok := rateLimitClient(w)
+	if !ok {
+		return nil, "", "", false
+	}
+	groupID := ""
+	if len(rl.groups) > 0 {
+		groupID = r.clientGroup(w)
+	}
+	action, limited = rl.allow(addr, tcp, groupID, time.Now())
+	if !limited {
+		return nil, "", "", false
+	}
+	protocol = "udp"
+	if tcp {
+		protocol = "tcp"
+		if action == "truncate" {
+			// TC=1 means "retry over TCP"; on TCP it would only make the client retry.
+			action = "drop"
+		}
+	}
+	metrics.RecordRateLimited(protocol, action)
+	switch action {
+	case "truncate":
+		reply = new(dns.Msg)
+		reply.SetReply(req)
+		reply.Truncated = true
+	case "refuse":
+		reply = new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeRefused)
+	}
+	return reply, action, protocol, true
+}
+
+// rateLimitClient returns the client address and whether the query came over a stream
+// transport (TCP, DoT, DoH).
+func rateLimitClient(w dns.ResponseWriter) (netip.Addr, bool, bool) {
+	addr, err := netip.ParseAddr(clientIPFromWriter(w))
+	if err != nil {
+		return netip.Addr{}, false, false
+	}
+	tcp := false
+	if ra := w.RemoteAddr(); ra != nil {
+		tcp = ra.Network() != "udp"
+	}
+	return addr.Unmap(), tcp, true
+}
+
+// limitsFor returns the limits for a client in groupID, or nil when it is not limited.
+func (rl *rateLimiter) limitsFor(groupID string) *rateLimitLimits {
+	if l, ok := rl.groups[groupID]; ok {
+		return l
+	}
+	return rl.global
+}
+
+func (l *rateLimitLimits) bucket(tcp bool) (rate.Limit, int) {
+	if tcp {
+		return l.tcp, l.tcpBurst
+	}
+	return l.udp, l.udpBurst
+}
+
+// adopt copies bucket state from the limiter being replaced, so a reload (which replicas do
+// on every sync) neither hands every client a fresh burst nor clears the limited list. The
+// old limiter may still be in use, so buckets are copied rather than shared.
+func (rl *rateLimiter) adopt(old *rateLimiter, now time.Time) {
+	if old == nil {
+		return
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	for key, b := range old.clients {
+		if key.prefix.Bits() != maskAddr(key.prefix.Addr(), rl.v4Bits, rl.v6Bits).Bits() {
+			continue
+		}
+		limits := rl.limitsFor(b.groupID)
+		if limits == nil {
+			continue
+		}
+		limit, burst := limits.bucket(key.tcp)
+		rl.clients[key] = &clientBucket{
+			limiter:     refilledLimiter(limit, burst, b.limiter.TokensAt(now), now),
+			burst:       burst,
+			groupID:     b.groupID,
+			action:      limits.action,
+			limited:     b.limited,
+			lastLimited: b.lastLimited,
+		}
+	}
+	if rl.rrl == nil || old.rrl == nil || rl.rrl.v4Bits != old.rrl.v4Bits || rl.rrl.v6Bits != old.rrl.v6Bits {
+		return
+	}
+	for key, b := range old.responses {
+		rl.responses[key] = &rrlBucket{
+			limiter:    refilledLimiter(rl.rrl.rate, rl.rrl.burst, b.limiter.TokensAt(now), now),
+			suppressed: b.suppressed,
+		}
+	}
+}
+
+// refilledLimiter returns a limiter holding at most tokens tokens at now.
+func refilledLimiter(limit rate.Limit, burst int, tokens float64, now time.Time) *rate.Limiter {
+	lim := rate.NewLimiter(limit, burst)
+	if used := burst - int(tokens); used > 0 {
+		lim.AllowN(now, used)
+	}
+	return lim
+}
+
+// allow takes a token from the client's bucket. It returns limited=true and the action when
+// the bucket is empty.
+func (rl *rateLimiter) allow(addr netip.Addr, tcp bool, groupID string, now time.Time) (action string, limited bool) {
+	if rl.isExempt(addr) {
+		return "", false
+	}
+	limits := rl.limitsFor(groupID)
+	if limits == nil {
+		return "", false
+	}
+	key := rateLimitKey{prefix: maskAddr(addr, rl.v4Bits, rl.v6Bits), tcp: tcp}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.maybeSweep(now)
+	b := rl.clients[key]
+	if b == nil {
+		if len(rl.clients) >= rateLimitMaxBuckets {
+			return "", false
+		}
+		limit, burst := limits.bucket(tcp)
+		b = &clientBucket{limiter: rate.NewLimiter(limit, burst), burst: burst, groupID: groupID, action: limits.action}
+		rl.clients[key] = b
+	}
+	if b.limiter.AllowN(now, 1) {
+		return "", false
+	}
+	b.limited++
+	b.lastLimited = now
+	return b.action, true
+}
+
+func (rl *rateLimiter) isExempt(addr netip.Addr) bool {
+	for _, pfx := range rl.exempt {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// maybeSweep drops buckets that have refilled and have not been limited recently. Caller
+// must hold rl.mu.
+func (rl *rateLimiter) maybeSweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval && len(rl.clients) < rateLimitMaxBuckets && len(rl.responses) < rateLimitMaxBuckets {
+		return
+	}
+	rl.lastSweep = now
+	cutoff := now.Add(-rateLimitRetention)
+	for key, b := range rl.clients {
+		if b.limiter.TokensAt(now) >= float64(b.burst) && !b.lastLimited.After(cutoff) {
+			delete(rl.clients, key)
+		}
+	}
+	if rl.rrl != nil {
+		for key, b := range rl.responses {
+			if b.limiter.TokensAt(now) >= float64(rl.rrl.burst) {
+				delete(rl.responses, key)
+			}
+		}
+	}
+}
+
+// responseWriter wraps w with response rate limiting for UDP clients. TCP clients cannot
+// spoof their address, so their responses are never limited.
+func (rl *rateLimiter) responseWriter(w dns.ResponseWriter) dns.ResponseWriter {
+	if rl.rrl == nil {
+		return w
+	}
+	addr, tcp, ok := rateLimitClient(w)
+	if !ok || tcp || rl.isExempt(addr) {
+		return w
+	}
+	return &rrlWriter{ResponseWriter: w, rl: rl, prefix: maskAddr(addr, rl.rrl.v4Bits, rl.rrl.v6Bits)}
+}
+
+// rrlWriter drops (or slips as truncated) responses over the RRL limit.
+type rrlWriter struct {
+	dns.ResponseWriter
+	rl     *rateLimiter
+	prefix netip.Prefix
+}
+
+func (w *rrlWriter) WriteMsg(m *dns.Msg) error {
+	allowed, slip := w.rl.allowResponse(rrlResponseKey(w.prefix, m), time.Now())
+	if allowed {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	if !slip {
+		metrics.RecordRRL("drop")
+		return nil
+	}
+	metrics.RecordRRL("slip")
+	tc := new(dns.Msg)
+	tc.MsgHdr = m.MsgHdr
+	tc.Question = m.Question
+	tc.Truncated = true
+	return w.ResponseWriter.WriteMsg(tc)
+}
+
+// allowResponse takes a token from the response bucket. When the bucket is empty it reports
+// whether this suppressed response should slip through truncated.
+func (rl *rateLimiter) allowResponse(key rrlKey, now time.Time) (allowed, slip bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.maybeSweep(now)
+	b := rl.responses[key]
+	if b == nil {
+		if len(rl.responses) >= rateLimitMaxBuckets {
+			return true, false
+		}
+		b = &rrlBucket{limiter: rate.NewLimiter(rl.rrl.rate, rl.rrl.burst)}
+		rl.responses[key] = b
+	}
+	if b.limiter.AllowN(now, 1) {
+		return true, false
+	}
+	b.suppressed++
+	return false, rl.rrl.slip > 0 && b.suppressed%rl.rrl.slip == 0
+}
+
+// rrlResponseKey identifies "identical" responses: same name, type and category. NXDOMAIN
+// is keyed by the zone from the SOA so random-subdomain responses share a bucket.
+func rrlResponseKey(prefix netip.Prefix, m *dns.Msg) rrlKey {
+	key := rrlKey{prefix: prefix}
+	if len(m.Question) > 0 {
+		key.name = strings.ToLower(m.Question[0].Name)
+		key.qtype = m.Question[0].Qtype
+	}
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		key.category = rrlNXDomain
+		key.qtype = 0
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				key.name = strings.ToLower(soa.Hdr.Name)
+				break
+			}
+		}
+	case m.Rcode != dns.RcodeSuccess:
+		key.category = rrlError
+		key.name = ""
+		key.qtype = 0
+	case len(m.Answer) == 0:
+		key.category = rrlNoData
+	default:
+		key.category = rrlAnswer
+	}
+	return key
+}
+
+// maskAddr returns addr truncated to the IPv4 or IPv6 prefix length.
+func maskAddr(addr netip.Addr, v4Bits, v6Bits int) netip.Prefix {
+	bits := v6Bits
+	if addr.Is4() {
+		bits = v4Bits
+	}
+	pfx, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return pfx
+}
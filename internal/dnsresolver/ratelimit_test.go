@@ -0,0 +1,313 @@
+package dnsresolver
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/cache"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/localrecords"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+)
+
+// udpResponseWriter is a mockResponseWriter whose client is ip over UDP.
+type udpResponseWriter struct {
+	mockResponseWriter
+	ip string
+}
+
+func (w *udpResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(w.ip), Port: 12345}
+}
+
+func testRateLimitConfig() config.RateLimitConfig {
+	slip := 2
+	return config.RateLimitConfig{
+		Enabled:          ptr(true),
+		UDPQPS:           1,
+		UDPBurst:         3,
+		TCPQPS:           1,
+		TCPBurst:         5,
+		Action:           "drop",
+		IPv4PrefixLength: 32,
+		IPv6PrefixLength: 64,
+		RRL: config.RRLConfig{
+			Enabled:            ptr(false),
+			ResponsesPerSecond: 1,
+			Burst:              2,
+			Slip:               &slip,
+			IPv4PrefixLength:   24,
+			IPv6PrefixLength:   56,
+		},
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	cfg := config.Config{RateLimit: testRateLimitConfig()}
+	cfg.RateLimit.Enabled = ptr(false)
+	if rl := newRateLimiter(cfg); rl != nil {
+		t.Fatalf("expected nil limiter when disabled, got %+v", rl)
+	}
+
+	cfg.ClientGroups = []config.ClientGroup{{ID: "iot", RateLimit: &config.GroupRateLimitConfig{Enabled: ptr(true), UDPQPS: 5}}}
+	rl := newRateLimiter(cfg)
+	if rl == nil || rl.global != nil {
+		t.Fatalf("expected group-only limiter, got %+v", rl)
+	}
+	if l := rl.limitsFor("iot"); l == nil || l.udp != 5 || l.udpBurst != 3 || l.action != "drop" {
+		t.Errorf("iot limits: got %+v", l)
+	}
+
+	cfg.RateLimit.Enabled = ptr(false)
+	cfg.ClientGroups = nil
+	cfg.RateLimit.RRL.Enabled = ptr(true)
+	if rl := newRateLimiter(cfg); rl == nil || rl.rrl == nil || rl.global != nil {
+		t.Errorf("expected RRL-only limiter, got %+v", rl)
+	}
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	cfg := config.Config{RateLimit: testRateLimitConfig()}
+	cfg.RateLimit.Exempt = []string{"10.0.0.0/8", "192.168.1.1"}
+	cfg.ClientGroups = []config.ClientGroup{
+		{ID: "trusted", RateLimit: &config.GroupRateLimitConfig{Enabled: ptr(false)}},
+		{ID: "iot", RateLimit: &config.GroupRateLimitConfig{UDPBurst: 1, Action: "refuse"}},
+	}
+	rl := newRateLimiter(cfg)
+	now := time.Now()
+	addr := netip.MustParseAddr("192.168.1.50")
+
+	for i := 0; i < 3; i++ {
+		if _, limited := rl.allow(addr, false, "", now); limited {
+			t.Fatalf("query %d within burst was limited", i+1)
+		}
+	}
+	if action, limited := rl.allow(addr, false, "", now); !limited || action != "drop" {
+		t.Fatalf("expected 4th UDP query to be dropped, got %q, %v", action, limited)
+	}
+	// TCP has its own bucket.
+	if _, limited := rl.allow(addr, true, "", now); limited {
+		t.Error("TCP query limited by the UDP bucket")
+	}
+	// The bucket refills at udp_qps.
+	if _, limited := rl.allow(addr, false, "", now.Add(1100*time.Millisecond)); limited {
+		t.Error("expected a token after one second")
+	}
+
+	// Exempt addresses and groups are never limited.
+	for i := 0; i < 10; i++ {
+		if _, limited := rl.allow(netip.MustParseAddr("10.1.2.3"), false, "", now); limited {
+			t.Fatal("exempt CIDR was limited")
+		}
+		if _, limited := rl.allow(netip.MustParseAddr("192.168.1.1"), false, "", now); limited {
+			t.Fatal("exempt IP was limited")
+		}
+		if _, limited := rl.allow(netip.MustParseAddr("192.168.1.60"), false, "trusted", now); limited {
+			t.Fatal("exempt group was limited")
+		}
+	}
+	// Group overrides replace individual fields.
+	iot := netip.MustParseAddr("192.168.1.70")
+	rl.allow(iot, false, "iot", now)
+	if action, limited := rl.allow(iot, false, "iot", now); !limited || action != "refuse" {
+		t.Errorf("iot group: got %q, %v", action, limited)
+	}
+
+	// IPv6 clients in the same /64 share a bucket.
+	for i := 0; i < 3; i++ {
+		rl.allow(netip.MustParseAddr("2001:db8::1"), false, "", now)
+	}
+	if _, limited := rl.allow(netip.MustParseAddr("2001:db8::ffff"), false, "", now); !limited {
+		t.Error("expected addresses in the same /64 to share a bucket")
+	}
+	if _, limited := rl.allow(netip.MustParseAddr("2001:db8:0:1::1"), false, "", now); limited {
+		t.Error("different /64 should have its own bucket")
+	}
+}
+
+func TestRRLResponseKey(t *testing.T) {
+	prefix := netip.MustParsePrefix("192.0.2.0/24")
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "Example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}}
+
+	nx1 := new(dns.Msg)
+	nx1.SetQuestion("abc.example.com.", dns.TypeA)
+	nx1.Rcode = dns.RcodeNameError
+	nx1.Ns = []dns.RR{soa}
+	nx2 := nx1.Copy()
+	nx2.Question[0].Name = "xyz.example.com."
+	nx2.Question[0].Qtype = dns.TypeAAAA
+	if rrlResponseKey(prefix, nx1) != rrlResponseKey(prefix, nx2) {
+		t.Error("NXDOMAIN responses in one zone should share a key")
+	}
+	if k := rrlResponseKey(prefix, nx1); k.name != "example.com." || k.category != rrlNXDomain {
+		t.Errorf("NXDOMAIN key = %+v", k)
+	}
+
+	answer := new(dns.Msg)
+	answer.SetQuestion("example.com.", dns.TypeA)
+	answer.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(192, 0, 2, 1)}}
+	nodata := new(dns.Msg)
+	nodata.SetQuestion("example.com.", dns.TypeA)
+	if rrlResponseKey(prefix, answer) == rrlResponseKey(prefix, nodata) {
+		t.Error("answer and NODATA should have different keys")
+	}
+	servfail := new(dns.Msg)
+	servfail.SetQuestion("a.example.", dns.TypeA)
+	servfail.Rcode = dns.RcodeServerFailure
+	refused := new(dns.Msg)
+	refused.SetQuestion("b.example.", dns.TypeMX)
+	refused.Rcode = dns.RcodeRefused
+	if rrlResponseKey(prefix, servfail) != rrlResponseKey(prefix, refused) {
+		t.Error("errors should be accounted per prefix only")
+	}
+}
+
+func TestRateLimiter_RRL(t *testing.T) {
+	cfg := config.Config{RateLimit: testRateLimitConfig()}
+	cfg.RateLimit.Enabled = ptr(false)
+	cfg.RateLimit.RRL.Enabled = ptr(true)
+	rl := newRateLimiter(cfg)
+
+	// TCP clients are never wrapped.
+	if _, ok := rl.responseWriter(&mockResponseWriter{remoteAddr: "192.0.2.10"}).(*mockResponseWriter); !ok {
+		t.Fatal("expected TCP writer to be returned unchanged")
+	}
+
+	victim := &udpResponseWriter{ip: "192.0.2.10"}
+	neighbour := &udpResponseWriter{ip: "192.0.2.20"}
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeANY)
+	resp.Answer = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"big"}}}
+
+	var results []string
+	for _, w := range []*udpResponseWriter{victim, victim, neighbour, victim, victim} {
+		w.written = nil
+		if err := rl.responseWriter(w).WriteMsg(resp); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case w.written == nil:
+			results = append(results, "drop")
+		case w.written.Truncated:
+			if len(w.written.Answer) != 0 {
+				t.Error("slipped response must be empty")
+			}
+			results = append(results, "slip")
+		default:
+			results = append(results, "ok")
+		}
+	}
+	// Burst 2 for the /24, then every 2nd suppressed response slips.
+	want := []string{"ok", "ok", "drop", "slip", "drop"}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Fatalf("RRL results = %v, want %v", results, want)
+		}
+	}
+
+	// A different response to the same prefix has its own bucket.
+	other := resp.Copy()
+	other.Question[0].Name = "other.example."
+	victim.written = nil
+	_ = rl.responseWriter(victim).WriteMsg(other)
+	if victim.written == nil || victim.written.Truncated {
+		t.Error("different response should not be limited")
+	}
+}
+
+func TestResolverRateLimit(t *testing.T) {
+	cfg := minimalResolverConfig("")
+	cfg.RateLimit = testRateLimitConfig()
+	cfg.RateLimit.Action = "truncate"
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{IP: "192.168.1.99", Name: "camera", GroupID: "iot"}},
+	}
+	cfg.ClientGroups = []config.ClientGroup{{ID: "iot", Name: "IoT", RateLimit: &config.GroupRateLimitConfig{Action: "refuse"}}}
+	localMgr := localrecords.New([]config.LocalRecordEntry{{Name: "nas.lan", Type: "A", Value: "192.168.1.20"}}, logging.NewDiscardLogger())
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	resolver := buildTestResolver(t, cfg, cache.NewMockCache(), blMgr, localMgr)
+
+	query := func(w dns.ResponseWriter) {
+		req := new(dns.Msg)
+		req.SetQuestion("nas.lan.", dns.TypeA)
+		resolver.ServeDNS(w, req)
+	}
+
+	udp := &udpResponseWriter{ip: "192.168.1.50"}
+	for i := 0; i < 3; i++ {
+		udp.written = nil
+		query(udp)
+		if udp.written == nil || len(udp.written.Answer) != 1 {
+			t.Fatalf("query %d: expected answer, got %v", i+1, udp.written)
+		}
+	}
+	udp.written = nil
+	query(udp)
+	if udp.written == nil || !udp.written.Truncated || len(udp.written.Answer) != 0 {
+		t.Fatalf("expected truncated reply over the limit, got %v", udp.written)
+	}
+
+	// Over TCP, truncate falls back to drop.
+	tcp := &mockResponseWriter{remoteAddr: "192.168.1.51"}
+	for i := 0; i < 5; i++ {
+		query(tcp)
+	}
+	tcp.written = nil
+	query(tcp)
+	if tcp.written != nil {
+		t.Fatalf("expected TCP query over the limit to be dropped, got %v", tcp.written)
+	}
+
+	camera := &udpResponseWriter{ip: "192.168.1.99"}
+	for i := 0; i < 4; i++ {
+		camera.written = nil
+		query(camera)
+	}
+	if camera.written == nil || camera.written.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for the iot group, got %v", camera.written)
+	}
+
+	clients, enabled := resolver.RateLimitedClients()
+	if !enabled || len(clients) != 3 {
+		t.Fatalf("expected 3 limited clients, got %v (enabled=%v)", clients, enabled)
+	}
+	byClient := map[string]RateLimitedClient{}
+	for _, c := range clients {
+		byClient[c.Client+"/"+c.Protocol] = c
+	}
+	if c := byClient["192.168.1.99/32/udp"]; c.GroupID != "iot" || c.Action != "refuse" || c.Limited != 1 {
+		t.Errorf("camera entry: %+v", c)
+	}
+	if c := byClient["192.168.1.51/32/tcp"]; c.Action != "truncate" || c.Limited != 1 {
+		t.Errorf("tcp entry: %+v", c)
+	}
+
+	// Reload keeps bucket state: the client is still over its limit and still listed.
+	resolver.ApplyRateLimitConfig(cfg)
+	udp.written = nil
+	query(udp)
+	if udp.written == nil || !udp.written.Truncated {
+		t.Errorf("expected bucket state to survive reload, got %v", udp.written)
+	}
+	if clients, _ := resolver.RateLimitedClients(); len(clients) != 3 {
+		t.Errorf("expected limited clients to survive reload, got %v", clients)
+	}
+
+	cfg.RateLimit.Enabled = ptr(false)
+	cfg.ClientGroups = nil
+	resolver.ApplyRateLimitConfig(cfg)
+	udp.written = nil
+	query(udp)
+	if udp.written == nil || len(udp.written.Answer) != 1 {
+		t.Errorf("expected no limit after disabling, got %v", udp.written)
+	}
+	if _, enabled := resolver.RateLimitedClients(); enabled {
+		t.Error("expected rate limiting to report disabled")
+	}
+}
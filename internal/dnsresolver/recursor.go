@@ -0,0 +1,416 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRootHints are the IANA root server IPv4 addresses (a through m.root-servers.net).
+var defaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10",
+	"192.5.5.241", "192.112.36.4", "198.97.190.53", "192.36.148.17", "192.58.128.30",
+	"193.0.14.129", "199.7.83.42", "202.12.27.33",
+}
+
+const (
+	recursorMaxQueries      = 64              // queries to authoritative servers per client query
+	recursorMaxDepth        = 4               // nested lookups of name server addresses
+	recursorMaxCNAMEs       = 8               // CNAMEs followed across zones
+	recursorServerTimeout   = 2 * time.Second // per authoritative server attempt, at most
+	recursorMinCacheTTL     = 5 * time.Second
+	recursorMaxCacheTTL     = 24 * time.Hour
+	recursorMaxCacheEntries = 10000 // delegation and address caches are reset when they grow past this
+)
+
+var errRecursionLimit = errors.New("recursion limit reached")
+
+// recursor resolves queries iteratively from the root hints instead of forwarding them.
+// Delegations (zone -> name server names) and name server addresses (glue or looked up)
+// are cached until their TTL expires. Queries use QNAME minimisation (RFC 9156) and are
+// retried over TCP when truncated.
+type recursor struct {
+	roots    []string // root server host:port
+	port     string   // port for delegated name servers
+	minimise bool
+	timeout  time.Duration // per authoritative server attempt
+	udp      *dns.Client
+	tcp      *dns.Client
+
+	mu    sync.Mutex
+	zones map[string]recursorZone  // zone -> name servers
+	addrs map[string]recursorAddrs // name server host name -> host:port addresses
+}
+
+type recursorZone struct {
+	nameservers []string
+	expires     time.Time
+}
+
+type recursorAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+// recursion is the state of one client query: a budget of queries shared by the main
+// resolution, CNAME targets and name server address lookups.
+type recursion struct {
+	ctx     context.Context
+	queries int
+	do      bool
+}
+
+// newRecursor returns a recursor starting at hints ("ip" or "ip:port"; the IANA root
+// servers when empty). When every hint has the same non-default port, that port is also
+// used for delegated name servers.
+func newRecursor(hints []string, timeout time.Duration) *recursor {
+	if len(hints) == 0 {
+		hints = defaultRootHints
+	}
+	timeout = min(timeout, recursorServerTimeout)
+	rc := &recursor{
+		port:     "53",
+		minimise: true,
+		timeout:  timeout,
+		udp:      &dns.Client{Net: "udp", Timeout: timeout},
+		tcp:      &dns.Client{Net: "tcp", Timeout: timeout},
+		zones:    make(map[string]recursorZone),
+		addrs:    make(map[string]recursorAddrs),
+	}
+	ports := make(map[string]bool)
+	for _, h := range hints {
+		host, port, err := net.SplitHostPort(h)
+		if err != nil {
+			host, port = h, "53"
+		}
+		ports[port] = true
+		rc.roots = append(rc.roots, net.JoinHostPort(host, port))
+	}
+	if len(ports) == 1 {
+		for port := range ports {
+			rc.port = port
+		}
+	}
+	return rc
+}
+
+// exchange resolves req's question and returns a reply as a recursive resolver would.
+func (rc *recursor) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) == 0 {
+		return nil, errors.New("recursive: no question")
+	}
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil, fmt.Errorf("recursive: unsupported class %s", dns.ClassToString[q.Qclass])
+	}
+	st := &recursion{ctx: ctx, do: clientDO(req)}
+	resp, err := rc.resolve(st, q.Name, q.Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.RecursionAvailable = true
+	reply.Rcode = resp.Rcode
+	reply.Answer = resp.Answer
+	reply.Ns = resp.Ns
+	if req.IsEdns0() != nil {
+		reply.SetEdns0(ednsUDPSize, st.do)
+	}
+	return reply, nil
+}
+
+// resolve walks down from the closest cached delegation to name and returns the
+// authoritative answer, following CNAMEs into other zones.
+func (rc *recursor) resolve(st *recursion, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	name = canonicalName(name)
+	resp, err := rc.resolveOnce(st, name, qtype, depth)
+	if err != nil || qtype == dns.TypeCNAME || qtype == dns.TypeANY || resp.Rcode != dns.RcodeSuccess {
+		return resp, err
+	}
+	answer := resp.Answer
+	for i := 0; i < recursorMaxCNAMEs; i++ {
+		target, positive := answerTarget(answer, dns.Question{Name: name, Qtype: qtype})
+		if positive || target == name {
+			break
+		}
+		next, err := rc.resolveOnce(st, target, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, next.Answer...)
+		resp.Rcode, resp.Ns = next.Rcode, next.Ns
+		if next.Rcode != dns.RcodeSuccess {
+			break
+		}
+	}
+	resp.Answer = answer
+	return resp, nil
+}
+
+func (rc *recursor) resolveOnce(st *recursion, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	// DS records live in the parent zone: start above name and never descend into it.
+	start := name
+	if qtype == dns.TypeDS && name != "." {
+		start = parentZone(name)
+	}
+	zone, servers := rc.closestZone(start)
+	minimise := rc.minimise
+	labels := dns.CountLabel(zone) + 1
+	for {
+		qname, qt := name, qtype
+		if minimise && labels < dns.CountLabel(name) {
+			// RFC 9156: reveal one more label at a time, asking for A.
+			qname, qt = lastLabels(name, labels), dns.TypeA
+		}
+		resp, err := rc.query(st, servers, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+		if child, nameservers, ok := referral(resp, zone, qname); ok {
+			if qt == dns.TypeDS && child == name {
+				return resp, nil // delegation without DS
+			}
+			rc.cacheDelegation(resp, zone, child, nameservers)
+			servers, err = rc.serverAddrs(st, nameservers, depth)
+			if err != nil {
+				return nil, fmt.Errorf("delegation to %s: %w", child, err)
+			}
+			zone, labels = child, dns.CountLabel(child)+1
+			continue
+		}
+		if qname != name {
+			// Not a zone cut. NXDOMAIN here should mean nothing exists below (RFC 8020), but
+			// ask the full question rather than rely on it.
+			if resp.Rcode == dns.RcodeNameError {
+				minimise = false
+			} else {
+				labels++
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// query sends qname/qtype to servers in random order until one answers usefully.
+func (rc *recursor) query(st *recursion, servers []string, qname string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(qname, qtype)
+	msg.RecursionDesired = false
+	msg.SetEdns0(ednsUDPSize, st.do)
+	lastErr := fmt.Errorf("no name servers for %s", qname)
+	for _, i := range rand.Perm(len(servers)) {
+		if st.queries >= recursorMaxQueries {
+			return nil, errRecursionLimit
+		}
+		if err := st.ctx.Err(); err != nil {
+			return nil, err
+		}
+		st.queries++
+		ctx, cancel := context.WithTimeout(st.ctx, rc.timeout)
+		resp, _, err := rc.udp.ExchangeContext(ctx, msg, servers[i])
+		if err == nil && resp.Truncated {
+			resp, _, err = rc.tcp.ExchangeContext(ctx, msg, servers[i])
+		}
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", servers[i], err)
+			continue
+		}
+		switch resp.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			return resp, nil
+		}
+		lastErr = fmt.Errorf("%s: rcode %s for %s", servers[i], dns.RcodeToString[resp.Rcode], qname)
+	}
+	return nil, lastErr
+}
+
+// referral reports whether resp delegates qname from zone to a child zone, returning the
+// child and its name server names.
+func referral(resp *dns.Msg, zone, qname string) (child string, nameservers []string, ok bool) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return "", nil, false
+	}
+	for _, rr := range resp.Ns {
+		ns, isNS := rr.(*dns.NS)
+		if !isNS {
+			continue
+		}
+		owner := canonicalName(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue // lame or upward referral
+		}
+		if child == "" {
+			child = owner
+		}
+		if owner == child {
+			nameservers = append(nameservers, canonicalName(ns.Ns))
+		}
+	}
+	return child, nameservers, child != ""
+}
+
+// cacheDelegation stores the child zone's name servers and any glue within the bailiwick
+// of the zone that sent the referral.
+func (rc *recursor) cacheDelegation(resp *dns.Msg, zone, child string, nameservers []string) {
+	now := time.Now()
+	nsTTL := recursorMaxCacheTTL
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeNS && canonicalName(rr.Header().Name) == child {
+			nsTTL = min(nsTTL, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+	}
+	glue := make(map[string][]string)
+	glueTTL := make(map[string]time.Duration)
+	for _, rr := range resp.Extra {
+		owner := canonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(zone, owner) || !containsString(nameservers, owner) {
+			continue
+		}
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		glue[owner] = append(glue[owner], net.JoinHostPort(ip.String(), rc.port))
+		ttl, ok := glueTTL[owner]
+		if !ok || time.Duration(rr.Header().Ttl)*time.Second < ttl {
+			glueTTL[owner] = time.Duration(rr.Header().Ttl) * time.Second
+		}
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.zones) >= recursorMaxCacheEntries {
+		rc.zones = make(map[string]recursorZone)
+	}
+	if len(rc.addrs) >= recursorMaxCacheEntries {
+		rc.addrs = make(map[string]recursorAddrs)
+	}
+	rc.zones[child] = recursorZone{nameservers: nameservers, expires: now.Add(clampCacheTTL(nsTTL))}
+	for host, addrs := range glue {
+		rc.addrs[host] = recursorAddrs{addrs: preferIPv4(addrs), expires: now.Add(clampCacheTTL(glueTTL[host]))}
+	}
+}
+
+// serverAddrs returns the addresses of nameservers, from the cache or by resolving their
+// names (glueless delegations).
+func (rc *recursor) serverAddrs(st *recursion, nameservers []string, depth int) ([]string, error) {
+	var addrs, missing []string
+	now := time.Now()
+	rc.mu.Lock()
+	for _, ns := range nameservers {
+		if a, ok := rc.addrs[ns]; ok && now.Before(a.expires) {
+			addrs = append(addrs, a.addrs...)
+		} else {
+			missing = append(missing, ns)
+		}
+	}
+	rc.mu.Unlock()
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if depth >= recursorMaxDepth {
+		return nil, errRecursionLimit
+	}
+	lastErr := errors.New("no addresses for name servers")
+	for _, ns := range missing {
+		resp, err := rc.resolve(st, ns, dns.TypeA, depth+1)
+		if err != nil {
+			lastErr = err
+			if errors.Is(err, errRecursionLimit) {
+				return nil, err
+			}
+			continue
+		}
+		ttl := recursorMaxCacheTTL
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), rc.port))
+				ttl = min(ttl, time.Duration(a.Hdr.Ttl)*time.Second)
+			}
+		}
+		if len(addrs) > 0 {
+			rc.mu.Lock()
+			rc.addrs[ns] = recursorAddrs{addrs: addrs, expires: time.Now().Add(clampCacheTTL(ttl))}
+			rc.mu.Unlock()
+			return addrs, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// closestZone returns the deepest cached zone at or above name whose name server
+// addresses are known, or the root.
+func (rc *recursor) closestZone(name string) (string, []string) {
+	now := time.Now()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for zone := name; zone != "."; zone = parentZone(zone) {
+		z, ok := rc.zones[zone]
+		if !ok || !now.Before(z.expires) {
+			continue
+		}
+		var addrs []string
+		for _, ns := range z.nameservers {
+			if a, ok := rc.addrs[ns]; ok && now.Before(a.expires) {
+				addrs = append(addrs, a.addrs...)
+			}
+		}
+		if len(addrs) > 0 {
+			return zone, addrs
+		}
+	}
+	return ".", rc.roots
+}
+
+// lastLabels returns the last n labels of name.
+func lastLabels(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n >= len(labels) {
+		return name
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// preferIPv4 returns the IPv4 addresses in addrs when there are any: hosts without IPv6
+// connectivity would otherwise time out on half the name servers.
+func preferIPv4(addrs []string) []string {
+	var v4 []string
+	for _, a := range addrs {
+		host, _, _ := net.SplitHostPort(a)
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			v4 = append(v4, a)
+		}
+	}
+	if len(v4) > 0 {
+		return v4
+	}
+	return addrs
+}
+
+func clampCacheTTL(ttl time.Duration) time.Duration {
+	return min(max(ttl, recursorMinCacheTTL), recursorMaxCacheTTL)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,329 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/cache"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// fakeAuthServer is a minimal authoritative server for one zone: it answers records it
+// holds, refers queries below delegated children (NS records not at the apex) with glue,
+// and otherwise returns NODATA or NXDOMAIN. Names in truncate are answered with TC=1 over UDP.
+// Every answer is sent after delay.
+type fakeAuthServer struct {
+	zone     string
+	records  []dns.RR
+	truncate map[string]bool
+	delay    time.Duration
+
+	mu      sync.Mutex
+	queries []string // "name type network"
+}
+
+func (s *fakeAuthServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	qname := canonicalName(q.Name)
+	network := w.RemoteAddr().Network()
+	s.mu.Lock()
+	s.queries = append(s.queries, qname+" "+dns.TypeToString[q.Qtype]+" "+network)
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if network == "udp" && s.truncate[qname] {
+		resp.Truncated = true
+		_ = w.WriteMsg(resp)
+		return
+	}
+	var soa dns.RR
+	for _, rr := range s.records {
+		h := rr.Header()
+		owner := canonicalName(h.Name)
+		if h.Rrtype == dns.TypeSOA {
+			soa = rr
+		}
+		if h.Rrtype == dns.TypeNS && owner != s.zone && dns.IsSubDomain(owner, qname) {
+			resp.Ns = append(resp.Ns, rr)
+		}
+	}
+	if len(resp.Ns) > 0 {
+		for _, ns := range resp.Ns {
+			for _, rr := range s.records {
+				if rr.Header().Rrtype == dns.TypeA && canonicalName(rr.Header().Name) == canonicalName(ns.(*dns.NS).Ns) {
+					resp.Extra = append(resp.Extra, rr)
+				}
+			}
+		}
+		_ = w.WriteMsg(resp)
+		return
+	}
+	resp.Authoritative = true
+	exists := false
+	for _, rr := range s.records {
+		h := rr.Header()
+		owner := canonicalName(h.Name)
+		if dns.IsSubDomain(qname, owner) {
+			exists = true
+		}
+		if owner == qname && (h.Rrtype == q.Qtype || h.Rrtype == dns.TypeCNAME) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if len(resp.Answer) == 0 {
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+		}
+		if soa != nil {
+			resp.Ns = []dns.RR{soa}
+		}
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (s *fakeAuthServer) log() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+func (s *fakeAuthServer) reset() {
+	s.mu.Lock()
+	s.queries = nil
+	s.mu.Unlock()
+}
+
+// startFakeAuth serves s over UDP and TCP on ip:port (port "0" picks one) and returns the port.
+func startFakeAuth(t *testing.T, s *fakeAuthServer, ip, port string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", ip, err)
+	}
+	_, port, _ = net.SplitHostPort(pc.LocalAddr().String())
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		pc.Close()
+		t.Skipf("cannot listen on %s: %v", ip, err)
+	}
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: s}, {Listener: l, Handler: s}} {
+		srv := srv
+		go func() { _ = srv.ActivateAndServe() }()
+		t.Cleanup(func() { _ = srv.Shutdown() })
+	}
+	return port
+}
+
+type fakeHierarchy struct {
+	root, tld, leaf, other *fakeAuthServer
+	rootHint               string
+}
+
+// newFakeHierarchy starts a root (127.0.0.1), the "test." TLD (127.0.0.2), "example.test."
+// (127.0.0.3) and "other.test." (127.0.0.4, delegated without glue) on one port.
+func newFakeHierarchy(t *testing.T) *fakeHierarchy {
+	t.Helper()
+	rr := func(s string) dns.RR { return testRR(t, s) }
+	h := &fakeHierarchy{
+		root: &fakeAuthServer{zone: ".", records: []dns.RR{
+			rr(". 86400 IN SOA a.root. admin. 1 3600 600 86400 300"),
+			rr("test. 3600 IN NS ns.test."),
+			rr("ns.test. 3600 IN A 127.0.0.2"),
+		}},
+		tld: &fakeAuthServer{zone: "test.", records: []dns.RR{
+			rr("test. 3600 IN SOA ns.test. admin.test. 1 3600 600 86400 300"),
+			rr("example.test. 3600 IN NS ns1.example.test."),
+			rr("ns1.example.test. 3600 IN A 127.0.0.3"),
+			rr("other.test. 3600 IN NS ns.glueless.example.test."),
+		}},
+		leaf: &fakeAuthServer{zone: "example.test.", records: []dns.RR{
+			rr("example.test. 300 IN SOA ns1.example.test. admin.example.test. 1 3600 600 86400 300"),
+			rr("example.test. 300 IN NS ns1.example.test."),
+			rr("ns1.example.test. 300 IN A 127.0.0.3"),
+			rr("ns.glueless.example.test. 300 IN A 127.0.0.4"),
+			rr("www.example.test. 300 IN A 192.0.2.10"),
+			rr("mail.example.test. 300 IN A 192.0.2.11"),
+			rr("alias.example.test. 300 IN CNAME host.other.test."),
+			rr(`big.example.test. 300 IN TXT "` + strings.Repeat("x", 200) + `"`),
+		}, truncate: map[string]bool{"big.example.test.": true}},
+		other: &fakeAuthServer{zone: "other.test.", records: []dns.RR{
+			rr("other.test. 300 IN SOA ns.glueless.example.test. admin.other.test. 1 3600 600 86400 300"),
+			rr("host.other.test. 300 IN A 192.0.2.20"),
+		}},
+	}
+	port := startFakeAuth(t, h.root, "127.0.0.1", "0")
+	startFakeAuth(t, h.tld, "127.0.0.2", port)
+	startFakeAuth(t, h.leaf, "127.0.0.3", port)
+	startFakeAuth(t, h.other, "127.0.0.4", port)
+	h.rootHint = net.JoinHostPort("127.0.0.1", port)
+	return h
+}
+
+func recursiveQuery(t *testing.T, rc *recursor, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := rc.exchange(ctx, req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", name, dns.TypeToString[qtype], err)
+	}
+	if !resp.RecursionAvailable || resp.Id != req.Id {
+		t.Errorf("%s: reply should have RA and the query ID", name)
+	}
+	return resp
+}
+
+func TestRecursor_FollowsDelegations(t *testing.T) {
+	h := newFakeHierarchy(t)
+	rc := newRecursor([]string{h.rootHint}, 5*time.Second)
+
+	resp := recursiveQuery(t, rc, "www.example.test.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.10" {
+		t.Fatalf("www.example.test: got %v", resp)
+	}
+	// QNAME minimisation: the root and TLD never see the full name.
+	if got := h.root.log(); len(got) != 1 || got[0] != "test. A udp" {
+		t.Errorf("root queries = %v, want [test. A udp]", got)
+	}
+	if got := h.tld.log(); len(got) != 1 || got[0] != "example.test. A udp" {
+		t.Errorf("TLD queries = %v, want [example.test. A udp]", got)
+	}
+
+	// The delegation to example.test. is cached: the next name goes straight to the leaf.
+	h.root.reset()
+	h.tld.reset()
+	if resp := recursiveQuery(t, rc, "mail.example.test.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Fatalf("mail.example.test: got %v", resp)
+	}
+	if len(h.root.log()) != 0 || len(h.tld.log()) != 0 {
+		t.Errorf("cached delegation not used: root %v, TLD %v", h.root.log(), h.tld.log())
+	}
+
+	if resp := recursiveQuery(t, rc, "nope.example.test.", dns.TypeA); resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Errorf("nope.example.test: rcode %d, authority %v; want NXDOMAIN with SOA", resp.Rcode, resp.Ns)
+	}
+}
+
+func TestRecursor_GluelessDelegationAndCNAME(t *testing.T) {
+	h := newFakeHierarchy(t)
+	rc := newRecursor([]string{h.rootHint}, 5*time.Second)
+
+	// alias.example.test -> host.other.test, whose zone is served by a name server
+	// inside example.test without glue in the TLD referral.
+	resp := recursiveQuery(t, rc, "alias.example.test.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Fatalf("alias.example.test: got %v", resp)
+	}
+	if _, ok := resp.Answer[0].(*dns.CNAME); !ok {
+		t.Errorf("first answer should be the CNAME, got %v", resp.Answer[0])
+	}
+	if a, ok := resp.Answer[1].(*dns.A); !ok || a.A.String() != "192.0.2.20" {
+		t.Errorf("second answer should be host.other.test A 192.0.2.20, got %v", resp.Answer[1])
+	}
+	if len(h.other.log()) == 0 {
+		t.Error("other.test name server was not queried")
+	}
+}
+
+func TestRecursor_TCPFallback(t *testing.T) {
+	h := newFakeHierarchy(t)
+	rc := newRecursor([]string{h.rootHint}, 5*time.Second)
+
+	resp := recursiveQuery(t, rc, "big.example.test.", dns.TypeTXT)
+	if len(resp.Answer) != 1 || resp.Truncated {
+		t.Fatalf("big.example.test: got %v", resp)
+	}
+	log := h.leaf.log()
+	if len(log) < 2 || log[len(log)-1] != "big.example.test. TXT tcp" {
+		t.Errorf("leaf queries = %v, want a TCP retry of the truncated answer", log)
+	}
+}
+
+func TestRecursor_DSQueriedAtParent(t *testing.T) {
+	h := newFakeHierarchy(t)
+	rc := newRecursor([]string{h.rootHint}, 5*time.Second)
+	recursiveQuery(t, rc, "www.example.test.", dns.TypeA)
+	h.leaf.reset()
+	h.tld.reset()
+
+	recursiveQuery(t, rc, "example.test.", dns.TypeDS)
+	if got := h.tld.log(); len(got) != 1 || got[0] != "example.test. DS udp" {
+		t.Errorf("TLD queries = %v, want [example.test. DS udp]", got)
+	}
+	if got := h.leaf.log(); len(got) != 0 {
+		t.Errorf("DS query sent to the child zone: %v", got)
+	}
+}
+
+func TestNewRecursor_RootHints(t *testing.T) {
+	rc := newRecursor(nil, time.Second)
+	if len(rc.roots) != len(defaultRootHints) || rc.port != "53" || rc.roots[0] != "198.41.0.4:53" {
+		t.Errorf("default root hints: roots %v, port %s", rc.roots, rc.port)
+	}
+	rc = newRecursor([]string{"192.0.2.1:5353", "192.0.2.2:5353"}, time.Second)
+	if rc.port != "5353" {
+		t.Errorf("port = %s, want 5353 from root hints", rc.port)
+	}
+	rc = newRecursor([]string{"192.0.2.1:5353", "192.0.2.2"}, time.Second)
+	if rc.port != "53" {
+		t.Errorf("port = %s, want 53 for mixed root hint ports", rc.port)
+	}
+}
+
+// TestResolverRecursiveUpstream resolves through ServeDNS with a recursive upstream.
+func TestResolverRecursiveUpstream(t *testing.T) {
+	h := newFakeHierarchy(t)
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "recursive", Protocol: "recursive", RootHints: []string{h.rootHint}}}
+	resolver := buildTestResolver(t, cfg, cache.NewMockCache(), nil, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.test.", dns.TypeA)
+	w := &mockResponseWriter{}
+	resolver.ServeDNS(w, req)
+	if w.written == nil || w.written.Rcode != dns.RcodeSuccess || len(w.written.Answer) != 1 {
+		t.Fatalf("expected one answer via recursion, got %v", w.written)
+	}
+	if got := w.written.Answer[0].(*dns.A).A.String(); got != "192.0.2.10" {
+		t.Errorf("answer = %s, want 192.0.2.10", got)
+	}
+}
+
+// TestResolverRecursionTimeout verifies that a recursive resolution is bounded by
+// recursion_timeout as a whole, not by upstream_timeout, which bounds each authoritative query.
+func TestResolverRecursionTimeout(t *testing.T) {
+	h := newFakeHierarchy(t)
+	for _, s := range []*fakeAuthServer{h.root, h.tld, h.leaf} {
+		s.delay = 100 * time.Millisecond
+	}
+	resolve := func(recursionTimeout time.Duration) *dns.Msg {
+		t.Helper()
+		cfg := minimalResolverConfig("")
+		cfg.Upstreams = []config.UpstreamConfig{{Name: "recursive", Protocol: "recursive", RootHints: []string{h.rootHint}}}
+		cfg.Network.UpstreamTimeout = config.Duration{Duration: 250 * time.Millisecond}
+		cfg.Network.RecursionTimeout = config.Duration{Duration: recursionTimeout}
+		resolver := buildTestResolver(t, cfg, cache.NewMockCache(), nil, nil)
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.test.", dns.TypeA)
+		w := &mockResponseWriter{}
+		resolver.ServeDNS(w, req)
+		return w.written
+	}
+
+	// Root, TLD and leaf take 300ms together: longer than one upstream_timeout.
+	if resp := resolve(5 * time.Second); resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("expected an answer within recursion_timeout, got %v", resp)
+	}
+	if resp := resolve(150 * time.Millisecond); resp == nil || resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL past recursion_timeout, got %v", resp)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"math"
 	"math/rand"
 	"net"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -34,6 +33,7 @@ import (
 
 const (
 	defaultUpstreamTimeout      = 10 * time.Second // fallback when config not set
+	defaultRecursionTimeout     = 30 * time.Second // fallback when network.recursion_timeout not set
 	refreshStatsWindow          = 24 * time.Hour  // rolling window for refresh stats
 	refreshPriorityExpiryWithin = 30 * time.Second // prioritize entries expiring within this
 	refreshReconcileInterval    = 1               // run expiry index reconciliation every sweep (reduces orphans without affecting refresh load)
@@ -46,13 +46,16 @@ const (
 // ResolverStrategy controls how upstreams are selected for DNS queries.
 // - failover: try upstreams in order, use next on error
 // - load_balance: round-robin across upstreams
-// - weighted: prefer faster upstreams using EWMA of response times
+// - weighted: prefer upstreams with the best score (latency EWMA, error and timeout rates), picked by power-of-two-choices
+// - race: query the fastest upstreams (by EWMA) in parallel, or hedged, and take the first answer
 const (
 	StrategyFailover     = "failover"
 	StrategyLoadBalance  = "load_balance"
 	StrategyWeighted     = "weighted"
+	StrategyRace         = "race"
 	weightedEWMAAlpha    = 0.2
 	weightedMinLatencyMS = 1.0
+	defaultRaceCount     = 2
 )
 
 type Resolver struct {
@@ -62,29 +65,43 @@ type Resolver struct {
 	groupBlocklists  map[string]*blocklist.Manager
 	groupBlocklistsMu sync.RWMutex
 	upstreamMgr      *upstreamManager
+	upstreamRoutes   atomic.Pointer[upstreamRouteTable] // conditional forwarding; nil when no routes are configured
+	privateReverse   atomic.Pointer[privateReverse]     // private reverse DNS; nil when disabled
+	dns64            atomic.Pointer[dns64Policy]        // DNS64 synthesis; nil when disabled everywhere
+	rateLimit        atomic.Pointer[rateLimiter]        // per-client limits and RRL; nil when disabled
+	acl              atomic.Pointer[aclPolicy]          // who may query; nil when disabled
+	healthCheck      atomic.Pointer[healthCheckConfig]  // upstream health probing; nil when disabled
 	minTTL           time.Duration
 	maxTTL           time.Duration
 	negativeTTL      time.Duration
 	clientTTLCap     time.Duration // max TTL in client responses when serving from cache (0 = no cap)
 	blockedTTL       time.Duration
-	blockedResponse  string
+	blockPolicy      blockPolicy            // response.blocked
+	groupBlockPolicy map[string]blockPolicy // per-group response.blocked overrides
 	respectSourceTTL bool
 	servfail         *servfailTracker
+	inflight         *inflightGroup // coalesces concurrent upstream exchanges for the same cache key
+	ecs              atomic.Pointer[ecsPolicy] // EDNS Client Subnet handling (hot-reloaded with upstreams)
+	dnssec           *dnssecValidator          // nil unless dnssec.validate is enabled
 	// refresh upstream fail: global rate limit to avoid log flooding when internet is down
 	refreshUpstreamFailLogInterval time.Duration
 	refreshUpstreamFailLastLog     time.Time
 	refreshUpstreamFailLogMu       sync.Mutex
-	udpClient        *dns.Client
 	tcpClient        *dns.Client
-	dohClient        *http.Client
+	dohTransports    map[string]*dohTransport
+	dohTransportsMu  sync.RWMutex
 	tlsClients       map[string]*dns.Client
 	tlsClientsMu     sync.RWMutex
 	doqClients       map[string]doqClient
 	doqClientsMu     sync.RWMutex
-	tlsConnPools     map[string]*connPool
+	tlsConnPools     map[string]streamTransport
 	tlsConnPoolsMu   sync.RWMutex
-	tcpConnPools     map[string]*connPool
+	tcpConnPools     map[string]streamTransport
 	tcpConnPoolsMu   sync.RWMutex
+	pipelining       atomic.Bool // network.upstream_pipelining: TCP/TLS transports pipeline queries
+	recursionTimeout atomic.Int64 // network.recursion_timeout (time.Duration): budget of one recursive resolution
+	recursors        map[string]*recursor // protocol "recursive" upstreams by address
+	recursorsMu      sync.RWMutex
 	logger           *slog.Logger
 	requestLogWriter requestlog.Writer
 	queryStore            querystore.Store
@@ -93,12 +110,13 @@ type Resolver struct {
 	anonymizeClientIP     string
 	clientIDResolver      *clientid.Resolver
 	clientIDEnabled      atomic.Bool
+	neighbors            atomic.Pointer[clientid.Neighbors] // client IP -> MAC; nil unless a client is configured by MAC
 	refresh                   refreshConfig
 	refreshSem                chan struct{}
 	refreshStats              *refreshStats
 	refreshSweepsSinceReconcile       atomic.Uint32
 	refreshDeletionCandidatesSweeps   atomic.Uint32
-	responseMu        sync.RWMutex // protects blockedResponse, blockedTTL for hot-reload
+	responseMu        sync.RWMutex // protects blockPolicy, groupBlockPolicy, blockedTTL for hot-reload
 	webhookOnBlock    []*webhook.Notifier
 	webhookOnError    []*webhook.Notifier
 	safeSearchMu       sync.RWMutex
@@ -239,6 +257,10 @@ type networkConfig struct {
 	backoff          time.Duration
 	connPoolIdle     time.Duration
 	connPoolValidate bool
+	raceCount        int
+	raceHedgeDelay   time.Duration
+	pipelining       bool
+	recursionTimeout time.Duration
 }
 
 // parseUpstream converts a config.UpstreamConfig to Upstream, inferring protocol from address if empty.
@@ -255,7 +277,20 @@ func parseUpstream(u config.UpstreamConfig) Upstream {
 			proto = "udp"
 		}
 	}
-	return Upstream{Name: u.Name, Address: u.Address, Protocol: proto}
+	if proto == "recursive" {
+		address := u.Address
+		if address == "" {
+			address = "recursive"
+		}
+		return Upstream{Name: u.Name, Address: address, Protocol: proto, RootHints: strings.Join(u.RootHints, ","), limit: newUpstreamLimiter(u.MaxInflight, u.MaxQPS)}
+	}
+	upstream := Upstream{Name: u.Name, Address: u.Address, Protocol: proto, Use0x20: u.Use0x20 && proto == "udp", limit: newUpstreamLimiter(u.MaxInflight, u.MaxQPS)}
+	if proto == "https" {
+		upstream.Bootstrap = strings.Join(u.Bootstrap, ",")
+		upstream.DoHMethod = strings.ToUpper(strings.TrimSpace(u.DoHMethod))
+		upstream.HTTP3 = u.HTTP3
+	}
+	return upstream
 }
 
 // parseUpstreams converts config upstreams to resolver Upstreams.
@@ -267,6 +302,17 @@ func parseUpstreams(upstreams []config.UpstreamConfig) []Upstream {
 	return out
 }
 
+// normalizeStrategy returns the resolver strategy for a config value, defaulting to failover.
+func normalizeStrategy(s string) string {
+	strategy := strings.ToLower(strings.TrimSpace(s))
+	switch strategy {
+	case StrategyFailover, StrategyLoadBalance, StrategyWeighted, StrategyRace:
+	default:
+		return StrategyFailover
+	}
+	return strategy
+}
+
 // resolveNetworkConfig extracts timeout, backoff, and connection pool settings from config.
 func resolveNetworkConfig(cfg config.Config) networkConfig {
 	timeout := cfg.Network.UpstreamTimeout.Duration
@@ -296,7 +342,20 @@ func resolveNetworkConfig(cfg config.Config) networkConfig {
 	} else if cfg.UpstreamConnPoolValidateBeforeReuse != nil {
 		connPoolValidate = *cfg.UpstreamConnPoolValidateBeforeReuse
 	}
-	return networkConfig{timeout: timeout, backoff: backoff, connPoolIdle: connPoolIdle, connPoolValidate: connPoolValidate}
+	recursionTimeout := cfg.Network.RecursionTimeout.Duration
+	if recursionTimeout <= 0 {
+		recursionTimeout = defaultRecursionTimeout
+	}
+	return networkConfig{
+		timeout:          timeout,
+		backoff:          backoff,
+		connPoolIdle:     connPoolIdle,
+		connPoolValidate: connPoolValidate,
+		raceCount:        cfg.Network.UpstreamRaceCount,
+		raceHedgeDelay:   cfg.Network.UpstreamHedgeDelay.Duration,
+		pipelining:       cfg.Network.UpstreamPipelining == nil || *cfg.Network.UpstreamPipelining,
+		recursionTimeout: recursionTimeout,
+	}
 }
 
 func New(cfg config.Config, cacheClient cache.DNSCache, localRecordsManager *localrecords.Manager, blocklistManager *blocklist.Manager, logger *slog.Logger, requestLogWriter requestlog.Writer, queryStore querystore.Store) *Resolver {
@@ -361,21 +420,13 @@ func New(cfg config.Config, cacheClient cache.DNSCache, localRecordsManager *loc
 		refreshUpstreamFailLogInterval = cfg.Cache.RefreshUpstreamFailLogInterval.Duration
 	}
 
-	strategy := strings.ToLower(strings.TrimSpace(cfg.ResolverStrategy))
-	if strategy == "" {
-		strategy = StrategyFailover
-	}
-	if strategy != StrategyFailover && strategy != StrategyLoadBalance && strategy != StrategyWeighted {
-		strategy = StrategyFailover
-	}
+	strategy := normalizeStrategy(cfg.ResolverStrategy)
 
 	clientIDEnabled := cfg.ClientIdentification.Enabled != nil && *cfg.ClientIdentification.Enabled
 	var clientIDResolver *clientid.Resolver
 	if clientIDEnabled && len(cfg.ClientIdentification.Clients) > 0 {
-		clientIDResolver = clientid.New(
-			cfg.ClientIdentification.Clients.ToNameMap(),
-			cfg.ClientIdentification.Clients.ToGroupMap(),
-		)
+		clientIDResolver = clientid.New(nil, nil)
+		applyClientIdentification(clientIDResolver, cfg.ClientIdentification)
 	}
 
 	groupBlocklists := make(map[string]*blocklist.Manager)
@@ -399,26 +450,16 @@ func New(cfg config.Config, cacheClient cache.DNSCache, localRecordsManager *loc
 		negativeTTL:     cfg.Cache.NegativeTTL.Duration,
 		clientTTLCap:     cfg.Cache.ClientTTLCap.Duration,
 		blockedTTL:      cfg.Response.BlockedTTL.Duration,
-		blockedResponse: cfg.Response.Blocked,
+		blockPolicy:      newBlockPolicy(cfg.Response.Blocked, cfg.Response.BlockedIPv4, cfg.Response.BlockedIPv6),
+		groupBlockPolicy: buildGroupBlockPolicies(cfg),
 		respectSourceTTL: respectSourceTTL,
 		servfail:         newServfailTracker(sfBackoff, sfRefreshThreshold, sfLogInterval),
+		inflight:         newInflightGroup(),
 		refreshUpstreamFailLogInterval:     refreshUpstreamFailLogInterval,
-		udpClient: &dns.Client{
-			Net:     "udp",
-			Timeout: netCfg.timeout,
-		},
 		tcpClient: &dns.Client{
 			Net:     "tcp",
 			Timeout: netCfg.timeout,
 		},
-		dohClient: &http.Client{
-			Timeout: netCfg.timeout,
-			Transport: &http.Transport{
-				MaxIdleConns:        10,
-				MaxIdleConnsPerHost: 2,
-				IdleConnTimeout:     90 * time.Second,
-			},
-		},
 		logger:              logger,
 		requestLogWriter:    requestLogWriter,
 		queryStore:            queryStore,
@@ -431,6 +472,24 @@ func New(cfg config.Config, cacheClient cache.DNSCache, localRecordsManager *loc
 		refreshStats:          stats,
 	}
 	r.clientIDEnabled.Store(clientIDEnabled)
+	r.upstreamMgr.SetRaceConfig(netCfg.raceCount, netCfg.raceHedgeDelay)
+	r.pipelining.Store(netCfg.pipelining)
+	r.recursionTimeout.Store(int64(netCfg.recursionTimeout))
+	r.upstreamRoutes.Store(newUpstreamRouteTable(cfg.UpstreamRoutes, netCfg, nil))
+	r.privateReverse.Store(newPrivateReverse(cfg.PrivateReverse, netCfg, nil))
+	r.healthCheck.Store(newHealthCheckConfig(cfg.UpstreamHealthCheck))
+	r.ecs.Store(newECSPolicy(cfg.EDNSClientSubnet))
+	r.dns64.Store(newDNS64Policy(cfg))
+	r.rateLimit.Store(newRateLimiter(cfg))
+	r.acl.Store(newACLPolicy(cfg.ACL))
+	if cfg.DNSSEC.Validate != nil && *cfg.DNSSEC.Validate {
+		v, err := newDNSSECValidator(cfg.DNSSEC.TrustAnchors, r.dnssecQuery)
+		if err != nil {
+			logger.Error("dnssec validation disabled", "err", err)
+		} else {
+			r.dnssec = v
+		}
+	}
 	webhookTarget := func(target, format string) string {
 		if strings.TrimSpace(target) != "" {
 			return target
@@ -479,11 +538,32 @@ func New(cfg config.Config, cacheClient cache.DNSCache, localRecordsManager *loc
 	}
 	r.webhookOnError = errorNotifiers
 	r.safeSearchMap, r.groupSafeSearchMap, r.groupNoSafeSearch = buildSafeSearchMaps(cfg)
+	r.syncNeighbors()
 	return r
 }
 
 func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	start := time.Now()
+	// Access control comes before anything else, so a client that may not query gets nothing
+	// but a REFUSED (or silence) out of the server.
+	if acl := r.acl.Load(); acl != nil {
+		if response, denied := r.aclReply(acl, w, req); denied {
+			var question dns.Question
+			if req != nil && len(req.Question) > 0 {
+				question = req.Question[0]
+			}
+			if response != nil {
+				if err := w.WriteMsg(response); err != nil {
+					r.logf(slog.LevelError, "failed to write acl denied response", "err", err)
+				}
+			}
+			r.logRequest(w, question, "acl_denied", response, time.Since(start), "")
+			if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
+				tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", "acl_denied", "qname", normalizeQueryName(question.Name), "client", clientIPFromWriter(w), "duration_ms", time.Since(start).Milliseconds())
+			}
+			return
+		}
+	}
 	if req == nil || len(req.Question) == 0 {
 		dns.HandleFailed(w, req)
 		r.logRequest(w, dns.Question{}, "invalid", nil, time.Since(start), "")
@@ -496,6 +576,29 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	question := req.Question[0]
 	qname := normalizeQueryName(question.Name)
 	qtypeStr := dns.TypeToString[question.Qtype]
+	// Every reply is sized for the client and padded on encrypted transports. This wraps the
+	// listener's writer first so the transport can still be detected.
+	w = finalizeWriter(w, req)
+	ecs := r.ecs.Load()
+	w = ecs.macWriter(w, req)
+	w = ecs.clientWriter(w, req)
+
+	// Rate limiting comes first so an over-limit client costs as little as possible. Limited
+	// queries are not logged to the query store, which would otherwise take the flood too.
+	if rl := r.rateLimit.Load(); rl != nil {
+		if response, action, protocol, limited := r.rateLimitReply(rl, w, req); limited {
+			if response != nil {
+				if err := w.WriteMsg(response); err != nil {
+					r.logf(slog.LevelError, "failed to write rate limited response", "err", err)
+				}
+			}
+			if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
+				tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", "rate_limited", "qname", qname, "qtype", qtypeStr, "client", clientIPFromWriter(w), "protocol", protocol, "action", action, "duration_ms", time.Since(start).Milliseconds())
+			}
+			return
+		}
+		w = rl.responseWriter(w)
+	}
 
 	// Local records are checked first - they work even when internet is down
 	if r.localRecords != nil {
@@ -548,6 +651,19 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}
 
+	// Private reverse DNS: PTR queries for RFC 1918, CGNAT, ULA and link-local addresses are
+	// answered from local records and client names, never sent to the public upstreams.
+	if response := r.privateReverseReply(req, question, qname); response != nil {
+		if err := w.WriteMsg(response); err != nil {
+			r.logf(slog.LevelError, "failed to write private reverse response", "err", err)
+		}
+		r.logRequest(w, question, "private_reverse", response, time.Since(start), "")
+		if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
+			tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", "private_reverse", "qname", qname, "qtype", qtypeStr, "duration_ms", time.Since(start).Milliseconds())
+		}
+		return
+	}
+
 	// Safe search: rewrite search engine domains to force safe search (parental controls).
 	// Phase 4: per-group override when group has SafeSearch; else global.
 	if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
@@ -558,11 +674,7 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		r.safeSearchMu.RUnlock()
 		var effectiveMap map[string]string
 		if len(groupSafeSearchMap) > 0 || len(groupNoSafeSearch) > 0 {
-			clientAddr := clientIPFromWriter(w)
-			groupID := ""
-			if r.clientIDEnabled.Load() && r.clientIDResolver != nil && clientAddr != "" {
-				groupID = r.clientIDResolver.ResolveGroup(clientAddr)
-			}
+			groupID := r.clientGroup(w)
 			if groupNoSafeSearch[groupID] {
 				effectiveMap = nil
 			} else if m := groupSafeSearchMap[groupID]; len(m) > 0 {
@@ -577,6 +689,7 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			if target, ok := effectiveMap[qname]; ok {
 				response := r.safeSearchReply(req, question, target)
 				if response != nil {
+					addEDE(response, req, dns.ExtendedErrorCodeCensored, "safe search")
 					if err := w.WriteMsg(response); err != nil {
 						r.logf(slog.LevelError, "failed to write safe search response", "err", err)
 					}
@@ -591,36 +704,93 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	// Resolve blocklist: use group-specific blocklist when client is in a group with custom blocklist; else global
-	if r.isBlockedForClient(w, qname) {
+	if list, code, blocked := r.blockedForClient(w, qname); blocked {
 		metrics.RecordBlocked()
 		clientAddr := clientIPFromWriter(w)
 		for _, n := range r.webhookOnBlock {
 			n.FireOnBlock(qname, clientAddr)
 		}
-		response := r.blockedReply(req, question)
+		response := r.blockedReply(w, req, question)
+		addEDE(response, req, code, list)
 		if err := w.WriteMsg(response); err != nil {
 			r.logf(slog.LevelError, "failed to write blocked response", "err", err)
 		}
 		r.logRequest(w, question, "blocked", response, time.Since(start), "")
 		if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
-			tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", "blocked", "qname", qname, "qtype", qtypeStr, "duration_ms", time.Since(start).Milliseconds())
+			tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", "blocked", "qname", qname, "qtype", qtypeStr, "list", list, "duration_ms", time.Since(start).Milliseconds())
 		}
 		return
 	}
 
-	cacheKey := cacheKey(qname, question.Qtype, question.Qclass)
+	// DNS64 (RFC 6147): AAAA queries from clients behind NAT64 get AAAA records synthesized
+	// from A records when the name has none. After blocking, so blocked names stay blocked.
+	// Clients that set CD validate themselves and get the native answer (section 5.5).
+	if question.Qtype == dns.TypeAAAA && !req.CheckingDisabled {
+		if prefix, ok := r.dns64PrefixFor(w); ok {
+			if response, outcome, upstreamAddr := r.dns64Reply(req, question, prefix, !r.isCacheDisabledForClient(w)); response != nil {
+				if r.serveBlockedAnswer(w, req, question, response, start, upstreamAddr) {
+					return
+				}
+				if err := w.WriteMsg(response); err != nil {
+					r.logf(slog.LevelError, "failed to write dns64 response", "err", err)
+				}
+				r.logRequest(w, question, outcome, response, time.Since(start), upstreamAddr)
+				if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
+					tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", outcome, "qname", qname, "qtype", qtypeStr, "dns64_prefix", prefix.String(), "duration_ms", time.Since(start).Milliseconds())
+				}
+				return
+			}
+		}
+	}
+
+	// DO and CD are part of the key: DO clients must get answers with signatures, and answers
+	// fetched with checking disabled are not validated.
+	// With ECS, answers the upstream scoped to the client's subnet are cached under a
+	// subnet-specific key; answers it marked valid for every client (scope 0) go under the
+	// base key, shared with clients not sent upstream with ECS.
+	baseKey := dnssecCacheKey(cacheKey(qname, question.Qtype, question.Qclass), clientDO(req), req.CheckingDisabled)
+	cacheKey := baseKey
+	subnet, sendECS := ecs.upstreamSubnet(req, clientIPFromWriter(w))
+	upstreamReq := withECS(req, subnet, sendECS)
+	validate := r.dnssec != nil && !req.CheckingDisabled
+	if validate {
+		upstreamReq = withDNSSEC(upstreamReq)
+	}
+	if sendECS {
+		cacheKey = ecsCacheKey(baseKey, subnet)
+	}
 	cacheDisabled := r.isCacheDisabledForClient(w)
 	if r.cache != nil && !cacheDisabled {
 		cacheLookupStart := time.Now()
-		cached, ttl, storedTTL, authTTL, err := r.cache.GetWithTTL(context.Background(), cacheKey)
+		hitKey := baseKey
+		cached, ttl, storedTTL, authTTL, err := r.cache.GetWithTTL(context.Background(), baseKey)
+		if err == nil && cached != nil && cacheKey != baseKey && !ecsValidForAll(cached) {
+			// Fetched without ECS: not for a client whose subnet is sent upstream.
+			r.cache.ReleaseMsg(cached)
+			cached = nil
+		}
+		if err == nil && cached == nil && cacheKey != baseKey {
+			hitKey = cacheKey
+			cached, ttl, storedTTL, authTTL, err = r.cache.GetWithTTL(context.Background(), cacheKey)
+		}
 		cacheLookupDuration := time.Since(cacheLookupStart)
 
 		if err == nil && cached != nil {
 			serveStale := r.refresh.enabled && r.refresh.serveStale
 			staleWithin := serveStale && r.refresh.staleTTL > 0 && -ttl <= r.refresh.staleTTL
 			if ttl > 0 || staleWithin {
+				// CNAME cloaking and blocked answer addresses are checked on every hit, so
+				// blocklist updates apply to cached answers without clearing the cache.
+				if r.serveBlockedAnswer(w, req, question, cached, start, "") {
+					r.cache.ReleaseMsg(cached)
+					return
+				}
 				cached.Id = req.Id
 				cached.Question = req.Question
+				ecsReply(cached, req)
+				if r.dnssec != nil {
+					dnssecReply(cached, req)
+				}
 				// Two-tier TTL: set client-facing TTL (short) when serving from cache
 				if ttl > 0 && r.clientTTLCap > 0 {
 					clientTTL := ttl
@@ -636,6 +806,11 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 					}
 					setMsgTTL(cached, clientTTL)
 				}
+				outcome := "cached"
+				if ttl <= 0 && staleWithin {
+					outcome = "stale"
+					addEDE(cached, req, dns.ExtendedErrorCodeStaleAnswer, "")
+				}
 				writeStart := time.Now()
 				if err := w.WriteMsg(cached); err != nil {
 					r.logf(slog.LevelError, "failed to write cached response", "err", err)
@@ -646,14 +821,10 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 				// to avoid including Redis latency in client-facing metrics
 				totalDuration := time.Since(start)
 				
-				outcome := "cached"
-				if ttl <= 0 && staleWithin {
-					outcome = "stale"
-				}
 				
 				// Log the request with accurate timing (before slow operations).
 				// Release cached msg to pool after extracting rcode (enables sync.Pool reuse).
-				r.logRequestWithBreakdown(w, question, outcome, cached, totalDuration, cacheLookupDuration, writeDuration, "", func(m *dns.Msg) { r.cache.ReleaseMsg(m) })
+				r.logRequestWithBreakdown(w, question, outcome, cached, totalDuration, cacheLookupDuration, writeDuration, "", "", func(m *dns.Msg) { r.cache.ReleaseMsg(m) })
 				if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
 					tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", outcome, "qname", qname, "qtype", qtypeStr, "duration_ms", totalDuration.Milliseconds(), "cache_lookup_ms", cacheLookupDuration.Milliseconds())
 				}
@@ -665,7 +836,7 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 				if sampleRate < 1.0 && rand.Float64() >= sampleRate {
 					return
 				}
-				key, hitWin, sweepWin := cacheKey, r.refresh.hitWindow, r.refresh.sweepHitWindow
+				key, hitWin, sweepWin := hitKey, r.refresh.hitWindow, r.refresh.sweepHitWindow
 				refreshEnabled := r.refresh.enabled
 				go func() {
 					hitCtx, hitCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
@@ -706,6 +877,7 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 				r.logf(slog.LevelWarn, "servfail backoff active, returning SERVFAIL without retry", "cache_key", cacheKey)
 			}
 			response := r.servfailReply(req)
+			addEDE(response, req, dns.ExtendedErrorCodeNoReachableAuthority, "upstream failed recently; retry after backoff")
 			if err := w.WriteMsg(response); err != nil {
 				r.logf(slog.LevelError, "failed to write servfail response", "err", err)
 			}
@@ -717,10 +889,31 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}
 
-	response, upstreamAddr, err := r.exchange(req)
+	response, upstreamAddr, err := r.exchangeCoalesced(context.Background(), cacheKey, upstreamReq, validate)
+	var bogus *dnssecBogusError
+	if errors.As(err, &bogus) {
+		// Bogus: don't cache, record backoff, return SERVFAIL with the reason as EDE
+		if r.servfail.backoff > 0 {
+			r.servfail.RecordBackoff(cacheKey)
+		}
+		r.logf(slog.LevelWarn, "dnssec validation failed", "qname", qname, "qtype", qtypeStr, "upstream", upstreamAddr, "reason", bogus.reason)
+		response := dnssecBogusReply(req, bogus.reason)
+		if err := w.WriteMsg(response); err != nil {
+			r.logf(slog.LevelError, "failed to write servfail response", "err", err)
+		}
+		r.logRequest(w, question, "dnssec_bogus", response, time.Since(start), upstreamAddr)
+		if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
+			tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", "dnssec_bogus", "qname", qname, "qtype", qtypeStr, "upstream", upstreamAddr, "reason", bogus.reason, "duration_ms", time.Since(start).Milliseconds())
+		}
+		return
+	}
 	if err != nil {
 		r.logf(slog.LevelError, "upstream exchange failed", "err", err)
-		dns.HandleFailed(w, req)
+		response := r.servfailReply(req)
+		addEDE(response, req, dns.ExtendedErrorCodeNetworkError, "upstream unreachable")
+		if err := w.WriteMsg(response); err != nil {
+			r.logf(slog.LevelError, "failed to write servfail response", "err", err)
+		}
 		r.logRequest(w, question, "upstream_error", nil, time.Since(start), "")
 		r.fireErrorWebhook(w, question, "upstream_error", upstreamAddr, err.Error(), time.Since(start))
 		if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
@@ -734,7 +927,7 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		if r.servfail.backoff > 0 {
 			r.servfail.RecordBackoff(cacheKey)
 		}
-		if err := w.WriteMsg(response); err != nil {
+		if err := w.WriteMsg(r.clientReply(response, req)); err != nil {
 			r.logf(slog.LevelError, "failed to write servfail response", "err", err)
 		}
 		r.logRequest(w, question, "servfail", response, time.Since(start), upstreamAddr)
@@ -746,7 +939,7 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	// REFUSED: transient policy/rate-limit response — don't cache, return to client
 	if response.Rcode == dns.RcodeRefused {
-		if err := w.WriteMsg(response); err != nil {
+		if err := w.WriteMsg(r.clientReply(response, req)); err != nil {
 			r.logf(slog.LevelError, "failed to write refused response", "err", err)
 		}
 		r.logRequest(w, question, "refused", response, time.Since(start), upstreamAddr)
@@ -763,16 +956,21 @@ func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	// Cache write (Redis HSet+ZAdd+Expire) typically adds 0.5-2ms; doing it in
 	// background avoids blocking the client. The next request for this key may
 	// hit Redis if the goroutine hasn't finished, but the current request wins.
-	if err := w.WriteMsg(response); err != nil {
-		r.logf(slog.LevelError, "failed to write upstream response", "err", err)
-	}
-	r.logRequest(w, question, "upstream", response, time.Since(start), upstreamAddr)
-	if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
-		tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", "upstream", "qname", qname, "qtype", qtypeStr, "upstream", upstreamAddr, "duration_ms", time.Since(start).Milliseconds())
+	// A CNAME-cloaked answer or one pointing into a blocked range is blocked for this client
+	// but still cached as is: the check runs again on every cache hit, against the blocklist
+	// of that client.
+	if !r.serveBlockedAnswer(w, req, question, response, start, upstreamAddr) {
+		if err := w.WriteMsg(r.clientReply(response, req)); err != nil {
+			r.logf(slog.LevelError, "failed to write upstream response", "err", err)
+		}
+		r.logRequest(w, question, "upstream", response, time.Since(start), upstreamAddr)
+		if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventQueryResolution) {
+			tracelog.Trace(te, r.logger, tracelog.EventQueryResolution, "query resolution", "outcome", "upstream", "qname", qname, "qtype", qtypeStr, "upstream", upstreamAddr, "duration_ms", time.Since(start).Milliseconds())
+		}
 	}
 
 	if r.cache != nil && !cacheDisabled && ttl > 0 {
-		key, resp, ttlVal, authTTLVal := cacheKey, response, ttl, authTTL
+		key, resp, ttlVal, authTTLVal := ecsStoreKey(baseKey, cacheKey, response), response, ttl, authTTL
 		go func() {
 			if err := r.cacheSet(context.Background(), key, resp, ttlVal, authTTLVal); err != nil {
 				r.logf(slog.LevelError, "cache set failed", "err", err)
@@ -855,16 +1053,41 @@ func (r *Resolver) isHotByRate(hits int64, window time.Duration) bool {
 }
 
 func (r *Resolver) refreshCache(question dns.Question, cacheKey string, isHot bool, isWarm bool, requestDriven bool) {
+	if _, prefix, ok := splitDNS64CacheKey(cacheKey); ok {
+		r.refreshDNS64(question, cacheKey, prefix, isHot)
+		return
+	}
 	msg := new(dns.Msg)
 	msg.SetQuestion(question.Name, question.Qtype)
 	if len(msg.Question) > 0 {
 		msg.Question[0].Qclass = question.Qclass
 	}
+	// Subnet-specific entries are refreshed with the same client subnet they were cached for,
+	// and with the DO/CD bits of the clients that populated them.
+	baseKey, subnet, hasSubnet := splitECSCacheKey(cacheKey)
+	_, do, cd := splitDNSSECCacheKey(baseKey)
+	if do {
+		msg.SetEdns0(ednsUDPSize, true)
+	}
+	msg.CheckingDisabled = cd
+	if hasSubnet {
+		msg = withECS(msg, subnet, true)
+	}
+	validate := r.dnssec != nil && !cd
+	if validate {
+		msg = withDNSSEC(msg)
+	}
 	if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventRefreshUpstream) {
 		tracelog.Trace(te, r.logger, tracelog.EventRefreshUpstream, "refresh upstream request", "cache_key", cacheKey, "qname", question.Name, "qtype", dns.TypeToString[question.Qtype])
 	}
-	response, upstreamAddr, err := r.exchange(msg)
+	// Share the exchange with any client query that missed on the same key while refreshing.
+	// Refresh runs at the lower priority, so upstream limits keep room for client queries.
+	response, upstreamAddr, err := r.exchangeCoalesced(withRefreshPriority(context.Background()), cacheKey, msg, validate)
 	if err != nil {
+		var bogus *dnssecBogusError
+		if errors.As(err, &bogus) && r.servfail.backoff > 0 {
+			r.servfail.RecordBackoff(cacheKey)
+		}
 		if r.shouldLogRefreshUpstreamFail() {
 			r.logf(slog.LevelError, "refresh upstream failed", "err", err)
 		}
@@ -909,7 +1132,7 @@ func (r *Resolver) refreshCache(question dns.Question, cacheKey string, isHot bo
 	}
 	if ttl > 0 {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		if err := r.cacheSet(ctx, cacheKey, response, ttl, authTTL); err != nil {
+		if err := r.cacheSet(ctx, ecsStoreKey(baseKey, cacheKey, response), response, ttl, authTTL); err != nil {
 			r.logf(slog.LevelError, "refresh cache set failed", "err", err)
 		} else {
 			ctier := "normal"
@@ -1312,10 +1535,12 @@ func (r *Resolver) RefreshStats() RefreshStats {
 }
 
 func (r *Resolver) CacheStats() cache.CacheStats {
-	if r.cache == nil {
-		return cache.CacheStats{}
+	var stats cache.CacheStats
+	if r.cache != nil {
+		stats = r.cache.GetCacheStats()
 	}
-	return r.cache.GetCacheStats()
+	stats.UpstreamExchanges, stats.Coalesced = r.inflight.Stats()
+	return stats
 }
 
 // ClearCache removes all DNS cache entries from Redis and the L0 LRU cache.
@@ -1352,18 +1577,17 @@ func (r *Resolver) SetTraceEvents(events *tracelog.Events) {
 func (r *Resolver) ApplyUpstreamConfig(cfg config.Config) {
 	upstreams := parseUpstreams(cfg.Upstreams)
 	netCfg := resolveNetworkConfig(cfg)
-	strategy := strings.ToLower(strings.TrimSpace(cfg.ResolverStrategy))
-	if strategy == "" {
-		strategy = StrategyFailover
-	}
-	if strategy != StrategyFailover && strategy != StrategyLoadBalance && strategy != StrategyWeighted {
-		strategy = StrategyFailover
-	}
+	strategy := normalizeStrategy(cfg.ResolverStrategy)
 
 	r.upstreamMgr.ApplyConfig(upstreams, strategy, netCfg.timeout, netCfg.backoff, netCfg.connPoolIdle, netCfg.connPoolValidate)
-
-	// Recreate UDP/TCP clients with new timeout
-	r.udpClient = &dns.Client{Net: "udp", Timeout: netCfg.timeout}
+	r.upstreamMgr.SetRaceConfig(netCfg.raceCount, netCfg.raceHedgeDelay)
+	r.ApplyDNS64Config(cfg)
+	r.upstreamRoutes.Store(newUpstreamRouteTable(cfg.UpstreamRoutes, netCfg, r.upstreamRoutes.Load()))
+	r.privateReverse.Store(newPrivateReverse(cfg.PrivateReverse, netCfg, r.privateReverse.Load()))
+	r.applyHealthCheckConfig(cfg.UpstreamHealthCheck)
+	r.ecs.Store(newECSPolicy(cfg.EDNSClientSubnet))
+
+	// Recreate the TCP client with the new timeout
 	r.tcpClient = &dns.Client{Net: "tcp", Timeout: netCfg.timeout}
 
 	// Clear TLS client cache so new clients use the new timeout
@@ -1378,19 +1602,34 @@ func (r *Resolver) ApplyUpstreamConfig(cfg config.Config) {
 	r.doqClients = nil
 	r.doqClientsMu.Unlock()
 
+	// DoH transports are recreated with the new settings; connections in use finish their requests
+	r.dohTransportsMu.Lock()
+	for _, t := range r.dohTransports {
+		t.closeIdle()
+	}
+	r.dohTransports = nil
+	r.dohTransportsMu.Unlock()
+
 	// Clear connection pools so they are recreated with new clients
+	r.pipelining.Store(netCfg.pipelining)
+	r.recursionTimeout.Store(int64(netCfg.recursionTimeout))
 	r.tlsConnPoolsMu.Lock()
 	for _, p := range r.tlsConnPools {
-		drainConnPool(p)
+		p.drain()
 	}
 	r.tlsConnPools = nil
 	r.tlsConnPoolsMu.Unlock()
 	r.tcpConnPoolsMu.Lock()
 	for _, p := range r.tcpConnPools {
-		drainConnPool(p)
+		p.drain()
 	}
 	r.tcpConnPools = nil
 	r.tcpConnPoolsMu.Unlock()
+
+	// Recursive upstreams are recreated with the new root hints and timeout (their delegation cache is dropped)
+	r.recursorsMu.Lock()
+	r.recursors = nil
+	r.recursorsMu.Unlock()
 }
 
 // UpstreamConfig returns the current upstream configuration for API/UI display.
@@ -1398,36 +1637,51 @@ func (r *Resolver) UpstreamConfig() ([]Upstream, string) {
 	return r.upstreamMgr.Upstreams()
 }
 
-// isBlockedForClient returns true if qname is blocked for the client making the request.
+// UpstreamRaceStats returns the race strategy counters of the global upstreams, by address.
+func (r *Resolver) UpstreamRaceStats() map[string]UpstreamRaceStats {
+	return r.upstreamMgr.RaceStats()
+}
+
+// UpstreamScores returns the weighted strategy scores of the global upstreams, by address.
+func (r *Resolver) UpstreamScores() map[string]UpstreamScore {
+	return r.upstreamMgr.WeightedScores()
+}
+
+// blockedForClient reports whether qname is blocked for the client making the request, with
+// the list that blocked it and the matching EDE code.
 // Uses group-specific blocklist when client is in a group with custom blocklist; else global.
 // Performance: when no group blocklists exist, skips client/group resolution (negligible overhead).
-func (r *Resolver) isBlockedForClient(w dns.ResponseWriter, qname string) bool {
+func (r *Resolver) blockedForClient(w dns.ResponseWriter, qname string) (string, uint16, bool) {
+	blMgr := r.blocklistForClient(w)
+	if blMgr == nil {
+		return "", 0, false
+	}
+	list, blocked := blMgr.BlockedBy(qname)
+	if !blocked {
+		return "", 0, false
+	}
+	return list, r.blockEDECode(blMgr, list), true
+}
+
+// blocklistForClient returns the effective blocklist manager for the client: its group's when
+// the group has a custom blocklist, else the global one. May return nil.
+func (r *Resolver) blocklistForClient(w dns.ResponseWriter) *blocklist.Manager {
 	blMgr := r.blocklist
 	r.groupBlocklistsMu.RLock()
 	hasGroupBlocklists := len(r.groupBlocklists) > 0
 	r.groupBlocklistsMu.RUnlock()
 	if !hasGroupBlocklists {
-		if blMgr == nil {
-			return false
-		}
-		return blMgr.IsBlocked(qname)
+		return blMgr
 	}
-	clientAddr := clientIPFromWriter(w)
-	if r.clientIDEnabled.Load() && r.clientIDResolver != nil && clientAddr != "" {
-		groupID := r.clientIDResolver.ResolveGroup(clientAddr)
-		if groupID != "" {
-			r.groupBlocklistsMu.RLock()
-			grpMgr := r.groupBlocklists[groupID]
-			r.groupBlocklistsMu.RUnlock()
-			if grpMgr != nil {
-				blMgr = grpMgr
-			}
+	if groupID := r.clientGroup(w); groupID != "" {
+		r.groupBlocklistsMu.RLock()
+		grpMgr := r.groupBlocklists[groupID]
+		r.groupBlocklistsMu.RUnlock()
+		if grpMgr != nil {
+			blMgr = grpMgr
 		}
 	}
-	if blMgr == nil {
-		return false
-	}
-	return blMgr.IsBlocked(qname)
+	return blMgr
 }
 
 // buildGroupCacheDisabled returns the set of group IDs whose clients should bypass the DNS cache.
@@ -1451,14 +1705,7 @@ func (r *Resolver) isCacheDisabledForClient(w dns.ResponseWriter) bool {
 	if empty {
 		return false
 	}
-	if !r.clientIDEnabled.Load() || r.clientIDResolver == nil {
-		return false
-	}
-	clientAddr := clientIPFromWriter(w)
-	if clientAddr == "" {
-		return false
-	}
-	groupID := r.clientIDResolver.ResolveGroup(clientAddr)
+	groupID := r.clientGroup(w)
 	if groupID == "" {
 		return false
 	}
@@ -1485,19 +1732,20 @@ func clientIPFromWriter(w dns.ResponseWriter) string {
 	return clientAddr
 }
 
-// ApplyClientIdentificationConfig updates client IP->name and IP->group mappings at runtime (for hot-reload).
+// ApplyClientIdentificationConfig updates client IP, range, MAC and client ID -> name and group
+// mappings at runtime (for hot-reload).
 func (r *Resolver) ApplyClientIdentificationConfig(cfg config.Config) {
 	enabled := cfg.ClientIdentification.Enabled != nil && *cfg.ClientIdentification.Enabled
 	r.clientIDEnabled.Store(enabled)
-	nameMap := cfg.ClientIdentification.Clients.ToNameMap()
-	groupMap := cfg.ClientIdentification.Clients.ToGroupMap()
 	if r.clientIDResolver != nil {
-		r.clientIDResolver.ApplyConfig(nameMap, groupMap)
+		applyClientIdentification(r.clientIDResolver, cfg.ClientIdentification)
 	} else if enabled && len(cfg.ClientIdentification.Clients) > 0 {
-		r.clientIDResolver = clientid.New(nameMap, groupMap)
+		r.clientIDResolver = clientid.New(nil, nil)
+		applyClientIdentification(r.clientIDResolver, cfg.ClientIdentification)
 	} else {
 		r.clientIDResolver = nil
 	}
+	r.syncNeighbors()
 }
 
 // buildSafeSearchMaps builds global and per-group safe search maps from config (Phase 4).
@@ -1555,18 +1803,18 @@ func (r *Resolver) ApplySafeSearchConfig(cfg config.Config) {
 	r.safeSearchMu.Unlock()
 }
 
-// ApplyResponseConfig updates blocked response and TTL at runtime (for hot-reload).
+// ApplyResponseConfig updates the blocked response (global and per group) and TTL at runtime
+// (for hot-reload).
 func (r *Resolver) ApplyResponseConfig(cfg config.Config) {
-	blocked := strings.ToLower(strings.TrimSpace(cfg.Response.Blocked))
-	if blocked == "" {
-		blocked = "nxdomain"
-	}
+	policy := newBlockPolicy(cfg.Response.Blocked, cfg.Response.BlockedIPv4, cfg.Response.BlockedIPv6)
+	groups := buildGroupBlockPolicies(cfg)
 	ttl := cfg.Response.BlockedTTL.Duration
 	if ttl <= 0 {
 		ttl = time.Hour
 	}
 	r.responseMu.Lock()
-	r.blockedResponse = blocked
+	r.blockPolicy = policy
+	r.groupBlockPolicy = groups
 	r.blockedTTL = ttl
 	r.responseMu.Unlock()
 }
@@ -1804,6 +2052,9 @@ func parseCacheKey(key string) (string, uint16, uint16, bool) {
 	if !strings.HasPrefix(key, "dns:") {
 		return "", 0, 0, false
 	}
+	key, _, _ = splitDNS64CacheKey(key)
+	key, _, _ = splitECSCacheKey(key)
+	key, _, _ = splitDNSSECCacheKey(key)
 	parts := strings.Split(key, ":")
 	if len(parts) < 4 {
 		return "", 0, 0, false
@@ -1875,30 +2126,100 @@ func (r *Resolver) resolveTarget(ctx context.Context, question dns.Question) (*d
 	if len(msg.Question) > 0 {
 		msg.Question[0].Qclass = question.Qclass
 	}
-	return r.exchange(msg)
+	validate := r.dnssec != nil
+	if validate {
+		msg = withDNSSEC(msg)
+	}
+	resp, upstreamAddr, err := r.exchangeCoalesced(ctx, key, msg, validate)
+	if err == nil && validate {
+		// The target is merged into a synthesized answer; drop DNSSEC records and flags.
+		dnssecReply(resp, &dns.Msg{Question: msg.Question})
+	}
+	return resp, upstreamAddr, err
+}
+
+// exchangeCoalesced sends req upstream via exchange, sharing the exchange with concurrent
+// callers for the same cache key (client misses and background refresh alike). Callers that
+// joined another caller's exchange get a copy of the response with their own ID and question.
+// With validate, the response is checked with DNSSEC before it is shared: secure answers get
+// AD set and bogus ones are returned as a *dnssecBogusError. The exchange runs with the
+// priority of ctx (see withRefreshPriority) of the caller that started it.
+func (r *Resolver) exchangeCoalesced(ctx context.Context, key string, req *dns.Msg, validate bool) (*dns.Msg, string, error) {
+	response, upstreamAddr, err, shared := r.inflight.Do(key, func() (*dns.Msg, string, error) {
+		response, upstreamAddr, err := r.exchange(ctx, req)
+		if err != nil || !validate || r.dnssec == nil {
+			return response, upstreamAddr, err
+		}
+		if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+			return response, upstreamAddr, nil
+		}
+		state, reason := r.dnssec.validate(response, req.Question[0])
+		metrics.RecordDNSSECValidation(state.String())
+		if state == dnssecBogus {
+			return nil, upstreamAddr, &dnssecBogusError{reason: reason}
+		}
+		response.AuthenticatedData = state == dnssecSecure
+		return response, upstreamAddr, nil
+	})
+	if shared {
+		metrics.RecordUpstreamCoalesced()
+		if response != nil {
+			response.Id = req.Id
+			response.Question = req.Question
+		}
+	}
+	return response, upstreamAddr, err
 }
 
-func (r *Resolver) exchange(req *dns.Msg) (*dns.Msg, string, error) {
-	upstreams, _ := r.upstreamMgr.Upstreams()
+// dnssecQuery fetches DS and DNSKEY records for the DNSSEC validator. These queries are
+// not validated themselves; the validator checks the records it uses.
+func (r *Resolver) dnssecQuery(name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg = withDNSSEC(msg)
+	key := dnssecCacheKey(cacheKey(normalizeQueryName(name), qtype, dns.ClassINET), true, true)
+	response, _, err := r.exchangeCoalesced(context.Background(), key, msg, false)
+	return response, err
+}
 
-	if len(upstreams) == 0 {
-		return nil, "", errors.New("no upstreams configured")
+// clientReply returns an upstream response adapted for the client query req (ECS option,
+// DNSSEC records and flags). The original is left unchanged for caching.
+func (r *Resolver) clientReply(response, req *dns.Msg) *dns.Msg {
+	if r.dnssec == nil {
+		return ecsClientReply(response, req)
 	}
+	reply := response.Copy()
+	ecsReply(reply, req)
+	dnssecReply(reply, req)
+	return reply
+}
 
+// exchange sends req to the upstreams of the matching route (or the global ones) following the
+// resolver strategy. Upstreams at their max_inflight or max_qps limit for the priority of ctx
+// are passed over for the next one.
+func (r *Resolver) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, string, error) {
 	qname, qtypeStr := "", ""
 	if len(req.Question) > 0 {
 		qname = normalizeQueryName(req.Question[0].Name)
 		qtypeStr = dns.TypeToString[req.Question[0].Qtype]
 	}
 
-	order := r.upstreamMgr.Order(upstreams)
+	// Conditional forwarding: the longest matching route's upstreams replace the global ones.
+	mgr := r.upstreamManagerFor(qname)
+	upstreams, _ := mgr.Upstreams()
+
+	if len(upstreams) == 0 {
+		return nil, "", errors.New("no upstreams configured")
+	}
+
+	order := mgr.Order(upstreams)
+	if mgr.Strategy() == StrategyRace {
+		return r.exchangeRace(ctx, req, mgr, upstreams, order, qname, qtypeStr)
+	}
 	var lastErr error
 	for attempt, idx := range order {
 		upstream := upstreams[idx]
-		if r.upstreamMgr.IsInBackoff(upstream.Address) {
-			if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventUpstreamExchange) {
-				tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange skip", "upstream", upstream.Address, "reason", "backoff", "qname", qname, "qtype", qtypeStr, "attempt", attempt+1)
-			}
+		if r.skipUpstream(mgr, upstream, attempt+1, qname, qtypeStr) {
 			continue
 		}
 		// Copy only on retry; first attempt uses req directly to avoid allocation in majority (success) case
@@ -1908,58 +2229,110 @@ func (r *Resolver) exchange(req *dns.Msg) (*dns.Msg, string, error) {
 		} else {
 			msg = req.Copy()
 		}
-		response, elapsed, err := r.exchangeWithUpstream(msg, upstream)
+		response, err := r.exchangeAttempt(ctx, mgr, msg, upstream, attempt+1, qname, qtypeStr)
 		if err != nil {
-			if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventUpstreamExchange) {
-				tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange failed", "upstream", upstream.Address, "err", err, "qname", qname, "qtype", qtypeStr, "attempt", attempt+1)
-			}
-			if r.upstreamMgr.BackoffEnabled() {
-				r.upstreamMgr.RecordBackoff(upstream.Address)
-			}
 			lastErr = err
 			continue
 		}
 		if response == nil {
 			continue
 		}
+		return response, upstream.Address, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstreams reached")
+	}
+	return nil, "", lastErr
+}
 
-		if r.upstreamMgr.BackoffEnabled() {
-			r.upstreamMgr.ClearBackoff(upstream.Address)
-		}
-		// Update weighted latency EWMA on success
-		if r.upstreamMgr.Strategy() == StrategyWeighted {
-			r.upstreamMgr.UpdateWeightedLatency(upstream.Address, elapsed)
-		}
-
-		if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventUpstreamExchange) {
-			tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange ok", "upstream", upstream.Address, "elapsed_ms", elapsed.Milliseconds(), "rcode", response.Rcode, "qname", qname, "qtype", qtypeStr, "attempt", attempt+1)
-		}
+// skipUpstream reports whether upstream is in backoff or marked down by health checks, and
+// should not be tried for this query.
+func (r *Resolver) skipUpstream(mgr *upstreamManager, upstream Upstream, attempt int, qname, qtypeStr string) bool {
+	reason := ""
+	switch {
+	case mgr.IsInBackoff(upstream.Address):
+		reason = "backoff"
+	case mgr.IsDown(upstream.Address):
+		reason = "down"
+	default:
+		return false
+	}
+	if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventUpstreamExchange) {
+		tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange skip", "upstream", upstream.Address, "reason", reason, "qname", qname, "qtype", qtypeStr, "attempt", attempt)
+	}
+	return true
+}
 
-		// SERVFAIL: return immediately without trying other upstreams.
-		// Indicates upstream security issue or misconfiguration; retrying aggressively is unhelpful.
-		if response.Rcode == dns.RcodeServerFailure {
-			return response, upstream.Address, nil
+// exchangeAttempt sends msg to one upstream, retrying truncated UDP answers over TCP, and
+// updates the upstream's backoff and latency. SERVFAIL answers are returned as is: retrying
+// them elsewhere is unhelpful, as they usually point to a problem with the domain. Exchanges
+// cancelled through ctx, or not sent because the upstream is at its limit, do not count as
+// upstream failures.
+func (r *Resolver) exchangeAttempt(ctx context.Context, mgr *upstreamManager, msg *dns.Msg, upstream Upstream, attempt int, qname, qtypeStr string) (*dns.Msg, error) {
+	response, elapsed, err := r.exchangeWithUpstream(ctx, msg, upstream)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
 		}
-		if response.Truncated && upstream.Protocol != "tcp" && upstream.Protocol != "tls" && upstream.Protocol != "https" && upstream.Protocol != "quic" {
-			tcpResponse, _, tcpErr := r.tcpClient.Exchange(msg, upstream.Address)
-			if tcpErr == nil && tcpResponse != nil {
-				return tcpResponse, upstream.Address, nil
+		if errors.Is(err, errUpstreamLimited) {
+			priority := "user"
+			if isRefreshPriority(ctx) {
+				priority = "refresh"
 			}
+			metrics.RecordUpstreamLimited(upstream.Address, priority)
 			if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventUpstreamExchange) {
-				tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange failed", "upstream", upstream.Address, "err", tcpErr, "qname", qname, "qtype", qtypeStr, "attempt", attempt+1, "phase", "tcp_fallback")
-			}
-			if r.upstreamMgr.BackoffEnabled() {
-				r.upstreamMgr.RecordBackoff(upstream.Address)
+				tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange skip", "upstream", upstream.Address, "reason", "limit", "priority", priority, "qname", qname, "qtype", qtypeStr, "attempt", attempt)
 			}
-			lastErr = tcpErr
-			continue
+			return nil, err
 		}
-		return response, upstream.Address, nil
+		if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventUpstreamExchange) {
+			tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange failed", "upstream", upstream.Address, "err", err, "qname", qname, "qtype", qtypeStr, "attempt", attempt)
+		}
+		if mgr.BackoffEnabled() {
+			mgr.RecordBackoff(upstream.Address)
+		}
+		if usesLatency(mgr.Strategy()) {
+			mgr.RecordOutcome(upstream.Address, exchangeOutcomeOf(0, err))
+		}
+		return nil, err
 	}
-	if lastErr == nil {
-		lastErr = errors.New("no upstreams reached")
+	if response == nil {
+		return nil, nil
 	}
-	return nil, "", lastErr
+
+	if mgr.BackoffEnabled() {
+		mgr.ClearBackoff(upstream.Address)
+	}
+	// Update latency EWMA and error rate on success
+	if usesLatency(mgr.Strategy()) {
+		mgr.UpdateWeightedLatency(upstream.Address, elapsed)
+		mgr.RecordOutcome(upstream.Address, exchangeOutcomeOf(response.Rcode, nil))
+	}
+
+	if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventUpstreamExchange) {
+		tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange ok", "upstream", upstream.Address, "elapsed_ms", elapsed.Milliseconds(), "rcode", response.Rcode, "qname", qname, "qtype", qtypeStr, "attempt", attempt)
+	}
+
+	if response.Rcode == dns.RcodeServerFailure {
+		return response, nil
+	}
+	if response.Truncated && upstream.Protocol != "tcp" && upstream.Protocol != "tls" && upstream.Protocol != "https" && upstream.Protocol != "quic" && upstream.Protocol != "recursive" {
+		tcpResponse, _, tcpErr := r.tcpClient.ExchangeContext(ctx, msg, upstream.Address)
+		if tcpErr == nil && tcpResponse != nil {
+			return tcpResponse, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if te := r.traceEvents.Load(); te != nil && te.Enabled(tracelog.EventUpstreamExchange) {
+			tracelog.Trace(te, r.logger, tracelog.EventUpstreamExchange, "upstream exchange failed", "upstream", upstream.Address, "err", tcpErr, "qname", qname, "qtype", qtypeStr, "attempt", attempt, "phase", "tcp_fallback")
+		}
+		if mgr.BackoffEnabled() {
+			mgr.RecordBackoff(upstream.Address)
+		}
+		return nil, tcpErr
+	}
+	return response, nil
 }
 
 
@@ -1982,89 +2355,44 @@ func (r *Resolver) safeSearchReply(req *dns.Msg, question dns.Question, target s
 	return resp
 }
 
-func (r *Resolver) blockedReply(req *dns.Msg, question dns.Question) *dns.Msg {
-	r.responseMu.RLock()
-	blockedResponse := r.blockedResponse
-	blockedTTL := r.blockedTTL
-	r.responseMu.RUnlock()
+// blockedReply builds the answer for a blocked name using the client's block policy. Negative
+// answers (NXDOMAIN and NODATA, including every qtype without an address in address modes)
+// carry a synthesized SOA whose TTL and minimum are the blocked TTL, so clients cache them
+// consistently (RFC 2308). REFUSED has no SOA.
+func (r *Resolver) blockedReply(w dns.ResponseWriter, req *dns.Msg, question dns.Question) *dns.Msg {
+	policy, ttl := r.blockPolicyFor(w)
 
 	resp := new(dns.Msg)
 	resp.SetReply(req)
 	resp.Authoritative = true
-
-	if blockedResponse == "nxdomain" {
-		resp.Rcode = dns.RcodeNameError
-		ttl := uint32(blockedTTL.Seconds())
-		if ttl == 0 {
-			ttl = 3600
-		}
-		zone := question.Name
-		resp.Ns = []dns.RR{
-			&dns.SOA{
-				Hdr: dns.RR_Header{
-					Name:   zone,
-					Rrtype: dns.TypeSOA,
-					Class:  dns.ClassINET,
-					Ttl:    ttl,
-				},
-				Ns:      "ns." + zone,
-				Mbox:    "hostmaster." + zone,
-				Serial:  1,
-				Refresh: 3600,
-				Retry:   600,
-				Expire:  86400,
-				Minttl:  ttl,
-			},
-		}
-		return resp
-	}
-
-	ip := net.ParseIP(blockedResponse)
-	if ip == nil {
-		resp.Rcode = dns.RcodeNameError
+	resp.Rcode = policy.rcode
+	if policy.rcode == dns.RcodeRefused {
+		resp.Authoritative = false
 		return resp
 	}
-	ttl := uint32(blockedTTL.Seconds())
-	if ttl == 0 {
-		ttl = 60
-	}
-	switch question.Qtype {
-	case dns.TypeA:
-		ipv4 := ip.To4()
-		if ipv4 == nil {
-			resp.Rcode = dns.RcodeNameError
-			return resp
-		}
-		resp.Answer = []dns.RR{
-			&dns.A{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    ttl,
-				},
-				A: ipv4,
-			},
-		}
-	case dns.TypeAAAA:
-		ipv6 := ip.To16()
-		if ipv6 == nil || ip.To4() != nil {
-			resp.Rcode = dns.RcodeNameError
+	if policy.rcode == dns.RcodeSuccess {
+		if rr := policy.answer(question, ttl); rr != nil {
+			resp.Answer = []dns.RR{rr}
 			return resp
 		}
-		resp.Answer = []dns.RR{
-			&dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    ttl,
-				},
-				AAAA: ipv6,
+	}
+	zone := question.Name
+	resp.Ns = []dns.RR{
+		&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   zone,
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
 			},
-		}
-	default:
-		resp.Rcode = dns.RcodeNameError
+			Ns:      "ns." + zone,
+			Mbox:    "hostmaster." + zone,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  ttl,
+		},
 	}
 	return resp
 }
@@ -2160,7 +2488,12 @@ func (r *Resolver) logf(level slog.Level, msg string, args ...any) {
 }
 
 func (r *Resolver) logRequest(w dns.ResponseWriter, question dns.Question, outcome string, response *dns.Msg, duration time.Duration, upstreamAddr string) {
-	r.logRequestWithBreakdown(w, question, outcome, response, duration, 0, 0, upstreamAddr, nil)
+	r.logRequestWithBreakdown(w, question, outcome, response, duration, 0, 0, upstreamAddr, "", nil)
+}
+
+// logBlockedRequest logs a blocked query with what matched (blockedBy), e.g. the CNAME link.
+func (r *Resolver) logBlockedRequest(w dns.ResponseWriter, question dns.Question, outcome string, response *dns.Msg, duration time.Duration, upstreamAddr, blockedBy string) {
+	r.logRequestWithBreakdown(w, question, outcome, response, duration, 0, 0, upstreamAddr, blockedBy, nil)
 }
 
 func (r *Resolver) fireErrorWebhook(w dns.ResponseWriter, question dns.Question, outcome string, upstreamAddr string, errMsg string, duration time.Duration) {
@@ -2193,9 +2526,11 @@ func (r *Resolver) fireErrorWebhook(w dns.ResponseWriter, question dns.Question,
 
 // logRequestWithBreakdown runs logging async. If releaseMsg is non-nil, it is called
 // with response after extracting rcode, enabling early release of pooled messages.
-func (r *Resolver) logRequestWithBreakdown(w dns.ResponseWriter, question dns.Question, outcome string, response *dns.Msg, duration time.Duration, cacheLookup time.Duration, networkWrite time.Duration, upstreamAddr string, releaseMsg func(*dns.Msg)) {
+func (r *Resolver) logRequestWithBreakdown(w dns.ResponseWriter, question dns.Question, outcome string, response *dns.Msg, duration time.Duration, cacheLookup time.Duration, networkWrite time.Duration, upstreamAddr, blockedBy string, releaseMsg func(*dns.Msg)) {
 	// Extract client info and rcode before goroutine (w may not be safe after handler returns)
 	clientAddr := clientIPFromWriter(w)
+	clientID := clientIDFromWriter(w)
+	clientMAC := r.clientMAC(w)
 	protocol := ""
 	if w != nil {
 		if addr := w.RemoteAddr(); addr != nil {
@@ -2213,10 +2548,10 @@ func (r *Resolver) logRequestWithBreakdown(w dns.ResponseWriter, question dns.Qu
 		releaseMsg(response)
 	}
 	// Run logging async to avoid blocking the handler after WriteMsg.
-	go r.logRequestData(clientAddr, protocol, question, outcome, rcode, duration, cacheLookup, networkWrite, upstreamAddr)
+	go r.logRequestData(clientAddr, clientID, clientMAC, protocol, question, outcome, rcode, duration, cacheLookup, networkWrite, upstreamAddr, blockedBy)
 }
 
-func (r *Resolver) logRequestData(clientAddr string, protocol string, question dns.Question, outcome string, rcode string, duration time.Duration, cacheLookup time.Duration, networkWrite time.Duration, upstreamAddr string) {
+func (r *Resolver) logRequestData(clientAddr, clientID, clientMAC string, protocol string, question dns.Question, outcome string, rcode string, duration time.Duration, cacheLookup time.Duration, networkWrite time.Duration, upstreamAddr, blockedBy string) {
 	qname := normalizeQueryName(question.Name)
 	if qname == "" {
 		qname = "-"
@@ -2241,6 +2576,7 @@ func (r *Resolver) logRequestData(clientAddr string, protocol string, question d
 			QueryID:         queryID,
 			Timestamp:       requestlog.FormatTimestamp(now),
 			ClientIP:        clientIP,
+			ClientID:        clientID,
 			Protocol:        protocol,
 			QName:           qname,
 			QType:           qtype,
@@ -2251,16 +2587,24 @@ func (r *Resolver) logRequestData(clientAddr string, protocol string, question d
 			CacheLookupMS:   cacheLookupMS,
 			NetworkWriteMS:  networkWriteMS,
 			UpstreamAddress: upstreamAddr,
+			BlockedBy:       blockedBy,
 		})
 	}
 	if r.queryStore != nil && (r.queryStoreSampleRate >= 1.0 || rand.Float64() < r.queryStoreSampleRate) {
 		clientName := ""
 		if r.clientIDEnabled.Load() && r.clientIDResolver != nil {
-			resolved := r.clientIDResolver.Resolve(clientAddr)
-			if resolved != "" && resolved != clientAddr {
+			if name, _, ok := r.clientIDResolver.ResolveID(clientID); ok && name != "" {
+				clientName = name
+			} else if name, _, ok := r.clientIDResolver.ResolveMAC(clientMAC); ok && name != "" {
+				clientName = name
+			} else if resolved := r.clientIDResolver.Resolve(clientAddr); resolved != "" && resolved != clientAddr {
 				clientName = resolved
 			}
 		}
+		if clientName == "" {
+			// An unconfigured client ID still tells devices apart.
+			clientName = clientID
+		}
 		if r.queryStoreExclusion != nil && r.queryStoreExclusion.Excluded(qname, clientAddr, clientName) {
 			return
 		}
@@ -2278,6 +2622,7 @@ func (r *Resolver) logRequestData(clientAddr string, protocol string, question d
 			CacheLookupMS:   cacheLookupMS,
 			NetworkWriteMS:  networkWriteMS,
 			UpstreamAddress: upstreamAddr,
+			BlockedBy:       blockedBy,
 		})
 	}
 }
@@ -9,8 +9,10 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -492,6 +494,8 @@ func TestParseUpstream(t *testing.T) {
 		{"infer quic from address", config.UpstreamConfig{Name: "doq", Address: "quic://dns.example.com:853"}, Upstream{Name: "doq", Address: "quic://dns.example.com:853", Protocol: "quic"}},
 		{"empty protocol defaults to udp", config.UpstreamConfig{Name: "plain", Address: "8.8.8.8:53"}, Upstream{Name: "plain", Address: "8.8.8.8:53", Protocol: "udp"}},
 		{"trim protocol case", config.UpstreamConfig{Name: "x", Address: "1.1.1.1", Protocol: "  TLS  "}, Upstream{Name: "x", Address: "1.1.1.1", Protocol: "tls"}},
+		{"recursive defaults address", config.UpstreamConfig{Name: "r", Protocol: "recursive"}, Upstream{Name: "r", Address: "recursive", Protocol: "recursive"}},
+		{"recursive root hints", config.UpstreamConfig{Name: "r", Protocol: "recursive", RootHints: []string{"192.0.2.1", "192.0.2.2:5353"}}, Upstream{Name: "r", Address: "recursive", Protocol: "recursive", RootHints: "192.0.2.1,192.0.2.2:5353"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -3613,3 +3617,446 @@ func BenchmarkResolverBlocklist_WithGroupBlocklists(b *testing.B) {
 		resolver.ServeDNS(w, req)
 	}
 }
+
+// TestResolverCoalescesConcurrentMisses verifies that concurrent cache misses for the same
+// question send a single upstream query and every client gets a response with its own ID.
+func TestResolverCoalescesConcurrentMisses(t *testing.T) {
+	blCfg := config.BlocklistConfig{
+		RefreshInterval: config.Duration{Duration: time.Hour},
+		Sources:         []config.BlocklistSource{},
+	}
+	blMgr := blocklist.NewManager(blCfg, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+
+	var upstreamCount int32
+	var mu sync.Mutex
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstreamAddr := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		upstreamCount++
+		mu.Unlock()
+		// Hold the exchange open until every client has joined it.
+		started <- struct{}{}
+		<-release
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(93, 184, 216, 34),
+			},
+		}
+		_ = w.WriteMsg(resp)
+	}))
+
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "udp", Address: upstreamAddr, Protocol: "udp"}}
+	cfg.Blocklists = blCfg
+
+	resolver := buildTestResolver(t, cfg, cache.NewMockCache(), blMgr, nil)
+
+	const clients = 50
+	var wg sync.WaitGroup
+	writers := make([]*mockResponseWriter, clients)
+	query := func(i int) {
+		writers[i] = &mockResponseWriter{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("popular.example.com.", dns.TypeA)
+			req.Id = uint16(1000 + i)
+			resolver.ServeDNS(writers[i], req)
+		}()
+	}
+	// The first client's exchange is in flight before the others miss the cache.
+	query(0)
+	<-started
+	for i := 1; i < clients; i++ {
+		query(i)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, coalesced := resolver.inflight.Stats(); coalesced == clients-1 {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	mu.Lock()
+	got := upstreamCount
+	mu.Unlock()
+	if got != 1 {
+		t.Errorf("upstream queries = %d, want 1 (concurrent misses should be coalesced)", got)
+	}
+	for i, w := range writers {
+		if w.written == nil {
+			t.Fatalf("client %d: no response", i)
+		}
+		if w.written.Id != uint16(1000+i) {
+			t.Errorf("client %d: response Id = %d, want %d", i, w.written.Id, 1000+i)
+		}
+		if len(w.written.Answer) != 1 {
+			t.Errorf("client %d: expected 1 answer, got %d", i, len(w.written.Answer))
+		}
+	}
+	stats := resolver.CacheStats()
+	if stats.Coalesced != clients-1 {
+		t.Errorf("CacheStats().Coalesced = %d, want %d", stats.Coalesced, clients-1)
+	}
+	if stats.UpstreamExchanges != 1 {
+		t.Errorf("CacheStats().UpstreamExchanges = %d, want 1", stats.UpstreamExchanges)
+	}
+}
+
+// ecsUpstream starts a UDP upstream that answers with an address inside the query's ECS
+// subnet (x.y.z.1) and the given scope, counting queries.
+func ecsUpstream(t *testing.T, scope uint8, count *atomic.Int32) string {
+	t.Helper()
+	return newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		count.Add(1)
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		ip := net.IPv4(192, 0, 2, 1)
+		if o := findECS(req); o != nil {
+			a := o.Address.To4()
+			ip = net.IPv4(a[0], a[1], a[2], 1)
+			echo := *o
+			echo.SourceScope = scope
+			resp.SetEdns0(1232, false)
+			resp.IsEdns0().Option = []dns.EDNS0{&echo}
+		}
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   ip,
+		}}
+		_ = w.WriteMsg(resp)
+	}))
+}
+
+// TestResolverECSSubnetAwareCache verifies that with synthesized ECS, an answer scoped to
+// one client subnet is cached for that subnet only and never served to another subnet.
+func TestResolverECSSubnetAwareCache(t *testing.T) {
+	var upstreamCount atomic.Int32
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "udp", Address: ecsUpstream(t, 24, &upstreamCount), Protocol: "udp"}}
+	cfg.EDNSClientSubnet = config.EDNSClientSubnetConfig{Mode: "synthesize", IPv4Prefix: 24, IPv6Prefix: 56}
+	mockCache := cache.NewMockCache()
+	resolver := buildTestResolver(t, cfg, mockCache, nil, nil)
+
+	query := func(client string) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("cdn.example.com.", dns.TypeA)
+		w := &mockResponseWriter{remoteAddr: client}
+		resolver.ServeDNS(w, req)
+		if w.written == nil || len(w.written.Answer) != 1 {
+			t.Fatalf("client %s: expected one answer, got %v", client, w.written)
+		}
+		if w.written.IsEdns0() != nil {
+			t.Errorf("client %s sent no EDNS; response must not carry OPT", client)
+		}
+		return w.written
+	}
+	answerIP := func(m *dns.Msg) string { return m.Answer[0].(*dns.A).A.String() }
+
+	if got := answerIP(query("203.0.113.5")); got != "203.0.113.1" {
+		t.Errorf("first subnet answer = %s, want 203.0.113.1", got)
+	}
+	subnetKey := ecsCacheKey(cacheKey("cdn.example.com", dns.TypeA, dns.ClassINET), netip.MustParsePrefix("203.0.113.0/24"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if m, _, _, _, _ := mockCache.GetWithTTL(context.Background(), subnetKey); m != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected answer cached under %q", subnetKey)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got := answerIP(query("203.0.113.77")); got != "203.0.113.1" {
+		t.Errorf("same subnet answer = %s, want cached 203.0.113.1", got)
+	}
+	if n := upstreamCount.Load(); n != 1 {
+		t.Errorf("upstream queries after same-subnet hit = %d, want 1", n)
+	}
+	if got := answerIP(query("198.51.100.9")); got != "198.51.100.1" {
+		t.Errorf("other subnet answer = %s, want 198.51.100.1 (must not reuse 203.0.113.0/24 answer)", got)
+	}
+	if n := upstreamCount.Load(); n != 2 {
+		t.Errorf("upstream queries = %d, want 2", n)
+	}
+}
+
+// TestResolverECSScopeZeroShared verifies that answers returned with scope 0 are cached
+// under the base key and shared by clients in every subnet.
+func TestResolverECSScopeZeroShared(t *testing.T) {
+	var upstreamCount atomic.Int32
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "udp", Address: ecsUpstream(t, 0, &upstreamCount), Protocol: "udp"}}
+	cfg.EDNSClientSubnet = config.EDNSClientSubnetConfig{Mode: "synthesize", IPv4Prefix: 24, IPv6Prefix: 56}
+	mockCache := cache.NewMockCache()
+	resolver := buildTestResolver(t, cfg, mockCache, nil, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("static.example.com.", dns.TypeA)
+	resolver.ServeDNS(&mockResponseWriter{remoteAddr: "203.0.113.5"}, req)
+	baseKey := cacheKey("static.example.com", dns.TypeA, dns.ClassINET)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if m, _, _, _, _ := mockCache.GetWithTTL(context.Background(), baseKey); m != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected scope 0 answer cached under base key %q", baseKey)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Client in another subnet sends its own ECS: served from the shared entry with its option echoed.
+	req2 := new(dns.Msg)
+	req2.SetQuestion("static.example.com.", dns.TypeA)
+	req2.SetEdns0(1232, false)
+	req2.IsEdns0().Option = []dns.EDNS0{newECSOption(netip.MustParsePrefix("198.51.100.0/24"))}
+	w := &mockResponseWriter{remoteAddr: "198.51.100.9"}
+	resolver.ServeDNS(w, req2)
+	if n := upstreamCount.Load(); n != 1 {
+		t.Errorf("upstream queries = %d, want 1 (scope 0 answer should be shared)", n)
+	}
+	o := findECS(w.written)
+	if o == nil || !o.Address.Equal(net.ParseIP("198.51.100.0")) || o.SourceScope != 0 {
+		t.Errorf("expected client's ECS echoed with scope 0, got %v", o)
+	}
+}
+
+// TestResolverECSNonECSAnswerNotShared verifies that an answer fetched without ECS (here for
+// a private-address client) is not served to a client whose subnet is sent upstream.
+func TestResolverECSNonECSAnswerNotShared(t *testing.T) {
+	var upstreamCount atomic.Int32
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "udp", Address: ecsUpstream(t, 24, &upstreamCount), Protocol: "udp"}}
+	cfg.EDNSClientSubnet = config.EDNSClientSubnetConfig{Mode: "synthesize", IPv4Prefix: 24, IPv6Prefix: 56}
+	mockCache := cache.NewMockCache()
+	resolver := buildTestResolver(t, cfg, mockCache, nil, nil)
+
+	query := func(client string) string {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("geo.example.com.", dns.TypeA)
+		w := &mockResponseWriter{remoteAddr: client}
+		resolver.ServeDNS(w, req)
+		if w.written == nil || len(w.written.Answer) != 1 {
+			t.Fatalf("client %s: expected one answer, got %v", client, w.written)
+		}
+		return w.written.Answer[0].(*dns.A).A.String()
+	}
+
+	if got := query("192.168.1.5"); got != "192.0.2.1" {
+		t.Fatalf("private client answer = %s, want 192.0.2.1", got)
+	}
+	baseKey := cacheKey("geo.example.com", dns.TypeA, dns.ClassINET)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if m, _, _, _, _ := mockCache.GetWithTTL(context.Background(), baseKey); m != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected answer without ECS cached under base key %q", baseKey)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got := query("203.0.113.5"); got != "203.0.113.1" {
+		t.Errorf("ECS client answer = %s, want 203.0.113.1 (must not reuse the answer fetched without ECS)", got)
+	}
+	if n := upstreamCount.Load(); n != 2 {
+		t.Errorf("upstream queries = %d, want 2", n)
+	}
+	// Clients not sent upstream with ECS still share the base entry.
+	if got := query("192.168.1.6"); got != "192.0.2.1" {
+		t.Errorf("second private client answer = %s, want cached 192.0.2.1", got)
+	}
+	if n := upstreamCount.Load(); n != 2 {
+		t.Errorf("upstream queries = %d, want 2", n)
+	}
+}
+
+// TestResolverECSForwarderClientIdentity verifies that a trusted forwarder's ECS address is
+// used as the client identity for group policy, and an untrusted source's ECS is ignored.
+func TestResolverECSForwarderClientIdentity(t *testing.T) {
+	kidsBlMgr := blocklist.NewManager(config.BlocklistConfig{
+		RefreshInterval: config.Duration{Duration: time.Hour},
+		Denylist:        []string{"kids-blocked.example.com"},
+	}, logging.NewDiscardLogger())
+	kidsBlMgr.LoadOnce(nil)
+
+	var upstreamCount atomic.Int32
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "udp", Address: ecsUpstream(t, 0, &upstreamCount), Protocol: "udp"}}
+	cfg.EDNSClientSubnet = config.EDNSClientSubnetConfig{Mode: "strip", TrustedForwarders: []string{"192.168.1.1"}}
+	cfg.ClientIdentification = config.ClientIdentificationConfig{
+		Enabled: ptr(true),
+		Clients: config.ClientEntries{{IP: "192.168.1.10", Name: "Kids Tablet", GroupID: "kids"}},
+	}
+	cfg.ClientGroups = []config.ClientGroup{{ID: "kids", Name: "Kids", Blocklist: &config.GroupBlocklistConfig{InheritGlobal: ptr(false)}}}
+	resolver := buildTestResolver(t, cfg, nil, nil, nil)
+	resolver.groupBlocklistsMu.Lock()
+	resolver.groupBlocklists["kids"] = kidsBlMgr
+	resolver.groupBlocklistsMu.Unlock()
+
+	query := func(forwarder string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("kids-blocked.example.com.", dns.TypeA)
+		req.SetEdns0(1232, false)
+		req.IsEdns0().Option = []dns.EDNS0{newECSOption(netip.MustParsePrefix("192.168.1.10/32"))}
+		w := &mockResponseWriter{remoteAddr: forwarder}
+		resolver.ServeDNS(w, req)
+		if w.written == nil {
+			t.Fatalf("forwarder %s: no response", forwarder)
+		}
+		return w.written
+	}
+	if resp := query("192.168.1.1"); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("trusted forwarder: Rcode = %s, want NXDOMAIN (kids group blocklist)", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := query("192.168.1.2"); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("untrusted forwarder: Rcode = %s, want NOERROR (ECS identity ignored)", dns.RcodeToString[resp.Rcode])
+	}
+	if n := upstreamCount.Load(); n != 1 {
+		t.Errorf("upstream queries = %d, want 1", n)
+	}
+}
+
+// TestResolverDNSSECValidation runs the resolver against an upstream serving a locally
+// signed zone: DO clients get AD and signatures, other clients a plain answer, and
+// bogus data is answered with SERVFAIL and Extended DNS Error 6.
+func TestResolverDNSSECValidation(t *testing.T) {
+	z := newTestSignedZones(t)
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "udp", Address: newDNSServerUDP(t, z), Protocol: "udp"}}
+	cfg.DNSSEC = config.DNSSECConfig{Validate: ptr(true), TrustAnchors: []string{z.anchor}}
+	mockCache := cache.NewMockCache()
+	resolver := buildTestResolver(t, cfg, mockCache, nil, nil)
+
+	query := func(name string, do bool) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		if do {
+			req.SetEdns0(1232, true)
+		}
+		w := &mockResponseWriter{}
+		resolver.ServeDNS(w, req)
+		if w.written == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.written
+	}
+	hasRRSIG := func(m *dns.Msg) bool {
+		for _, rr := range m.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < 2; i++ { // upstream, then cache
+		resp := query("www.example.", true)
+		if resp.Rcode != dns.RcodeSuccess || !resp.AuthenticatedData || !hasRRSIG(resp) {
+			t.Errorf("pass %d: DO client: rcode %d, AD %v, RRSIG %v; want NOERROR with AD and RRSIG", i, resp.Rcode, resp.AuthenticatedData, hasRRSIG(resp))
+		}
+		if opt := resp.IsEdns0(); opt == nil || !opt.Do() {
+			t.Errorf("pass %d: DO client should get OPT with DO", i)
+		}
+		waitForCacheEntry(t, mockCache, dnssecCacheKey(cacheKey("www.example", dns.TypeA, dns.ClassINET), true, false))
+	}
+
+	resp := query("www.example.", false)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.AuthenticatedData || resp.IsEdns0() != nil {
+		t.Errorf("non-DO client: got %v; want one A record without AD or OPT", resp)
+	}
+
+	if resp := query("host.insecure.example.", true); resp.Rcode != dns.RcodeSuccess || resp.AuthenticatedData {
+		t.Errorf("insecure answer: rcode %d, AD %v; want NOERROR without AD", resp.Rcode, resp.AuthenticatedData)
+	}
+
+	resp = query("bad.example.", true)
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("bogus answer: rcode %d, want SERVFAIL", resp.Rcode)
+	}
+	if ede := findEDE(resp); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeDNSBogus {
+		t.Errorf("bogus answer: EDE %v, want DNSSEC Bogus", ede)
+	}
+	if resp := query("bad.example.", false); resp.Rcode != dns.RcodeServerFailure || resp.IsEdns0() != nil {
+		t.Errorf("bogus answer for non-EDNS client: rcode %d, OPT %v; want SERVFAIL without OPT", resp.Rcode, resp.IsEdns0())
+	}
+
+	// Checking disabled: the client gets the data as-is.
+	req := new(dns.Msg)
+	req.SetQuestion("bad.example.", dns.TypeA)
+	req.SetEdns0(1232, true)
+	req.CheckingDisabled = true
+	w := &mockResponseWriter{}
+	resolver.ServeDNS(w, req)
+	if w.written == nil || w.written.Rcode != dns.RcodeSuccess || w.written.AuthenticatedData {
+		t.Errorf("CD client: got %v; want unvalidated NOERROR", w.written)
+	}
+}
+
+// TestResolverDOCacheSeparation verifies that without validation, an answer fetched for a
+// DO client (with signatures) is not served to non-DO clients and vice versa.
+func TestResolverDOCacheSeparation(t *testing.T) {
+	z := newTestSignedZones(t)
+	var upstreamCount atomic.Int32
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "udp", Address: newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		upstreamCount.Add(1)
+		z.ServeDNS(w, req)
+	})), Protocol: "udp"}}
+	mockCache := cache.NewMockCache()
+	resolver := buildTestResolver(t, cfg, mockCache, nil, nil)
+
+	query := func(do bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.", dns.TypeA)
+		if do {
+			req.SetEdns0(1232, true)
+		}
+		w := &mockResponseWriter{}
+		resolver.ServeDNS(w, req)
+		return w.written
+	}
+	base := cacheKey("www.example", dns.TypeA, dns.ClassINET)
+
+	if resp := query(true); resp == nil || len(resp.Answer) != 2 {
+		t.Fatalf("DO client: expected A and RRSIG, got %v", resp)
+	}
+	waitForCacheEntry(t, mockCache, dnssecCacheKey(base, true, false))
+	if resp := query(false); resp == nil || len(resp.Answer) != 1 {
+		t.Fatalf("non-DO client: expected A only, got %v", resp)
+	}
+	waitForCacheEntry(t, mockCache, base)
+	if resp := query(true); resp == nil || len(resp.Answer) != 2 {
+		t.Fatalf("cached DO answer: expected A and RRSIG, got %v", resp)
+	}
+	if n := upstreamCount.Load(); n != 2 {
+		t.Errorf("upstream queries = %d, want 2 (one per DO setting)", n)
+	}
+}
+
+func waitForCacheEntry(t *testing.T, c *cache.MockCache, key string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if m, _, _, _, _ := c.GetWithTTL(context.Background(), key); m != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache entry %q not written", key)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -1,7 +1,13 @@
 package dnsresolver
 
 type Upstream struct {
-	Name     string
-	Address  string
-	Protocol string
+	Name      string
+	Address   string
+	Protocol  string
+	RootHints string           // protocol "recursive" only: comma-separated root hints (empty = IANA root servers)
+	Use0x20   bool             // protocol "udp" only: randomize the case of the query name and require it echoed
+	Bootstrap string           // protocol "https" only: comma-separated IPs to connect to instead of resolving the URL host
+	DoHMethod string           // protocol "https" only: GET or POST (default)
+	HTTP3     bool             // protocol "https" only: use HTTP/3 (QUIC) instead of HTTP/2
+	limit     *upstreamLimiter // max_inflight / max_qps (nil = unlimited); recreated on reload
 }
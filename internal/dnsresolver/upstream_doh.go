@@ -0,0 +1,291 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// dohIdleConnTimeout is how long an idle DoH connection is kept for reuse.
+	dohIdleConnTimeout = 90 * time.Second
+	// dohPingInterval is how long an HTTP/2 connection may go without reading a frame before it
+	// is health-checked with a PING, so dead connections are replaced instead of timing out queries.
+	dohPingInterval = 30 * time.Second
+	dohPingTimeout  = 5 * time.Second
+)
+
+// DoHConnStats describes the connections of a DoH upstream, as exposed to the API/UI.
+type DoHConnStats struct {
+	Transport   string   `json:"transport"` // "http2" (HTTP/2, falling back to HTTP/1.1) or "http3"
+	Method      string   `json:"method"`    // GET or POST
+	Bootstrap   []string `json:"bootstrap,omitempty"`
+	Requests    uint64   `json:"requests"`
+	ConnsOpened uint64   `json:"connections_opened"`
+	// Reused is the number of requests sent over an already open connection.
+	Reused uint64 `json:"reused"`
+	// LastProtocol is the HTTP version of the last response, e.g. HTTP/2.0.
+	LastProtocol string `json:"last_protocol,omitempty"`
+}
+
+// dohTransport sends DNS-over-HTTPS (RFC 8484) queries to one upstream URL over reused
+// connections: HTTP/2 (one multiplexed connection, health-checked with PINGs), or HTTP/3 over
+// QUIC when enabled. With bootstrap IPs, connections go to those addresses and the URL host is
+// only used for TLS (SNI and certificate), so the DoH hostname is never resolved through the
+// system resolver, which may be this server itself.
+type dohTransport struct {
+	address   string
+	url       *url.URL
+	method    string   // http.MethodGet or http.MethodPost
+	bootstrap []string // IPs; empty = resolve the URL host
+	http3     bool
+	client    *http.Client
+	closeIdle func()
+
+	requests  atomic.Uint64
+	conns     atomic.Uint64
+	lastProto atomic.Pointer[string]
+}
+
+// newDoHTransport returns the transport for a protocol "https" upstream. tlsConfig is the base
+// client TLS config (nil = system roots).
+func newDoHTransport(upstream Upstream, tlsConfig *tls.Config) (*dohTransport, error) {
+	u, err := url.Parse(upstream.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoH upstream address %q: %w", upstream.Address, err)
+	}
+	t := &dohTransport{address: upstream.Address, url: u, method: http.MethodPost, http3: upstream.HTTP3}
+	if strings.EqualFold(upstream.DoHMethod, http.MethodGet) {
+		t.method = http.MethodGet
+	}
+	if upstream.Bootstrap != "" {
+		t.bootstrap = strings.Split(upstream.Bootstrap, ",")
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+
+	if t.http3 {
+		tr := &http3.Transport{TLSClientConfig: tlsConfig, Dial: t.dialQUIC}
+		t.client = &http.Client{Transport: tr}
+		t.closeIdle = tr.CloseIdleConnections
+		return t, nil
+	}
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	tr := &http.Transport{
+		DialContext:         t.dialTCP,
+		TLSClientConfig:     tlsConfig,
+		Protocols:           &protocols,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     dohIdleConnTimeout,
+		HTTP2: &http.HTTP2Config{
+			SendPingTimeout: dohPingInterval,
+			PingTimeout:     dohPingTimeout,
+		},
+	}
+	t.client = &http.Client{Transport: tr}
+	t.closeIdle = tr.CloseIdleConnections
+	return t, nil
+}
+
+// exchange sends req with POST (the message as body), or with GET (base64url in the dns
+// parameter, ID 0 so that HTTP caches can share answers). The answer gets req's ID.
+func (t *dohTransport) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	m := req
+	if t.method == http.MethodGet {
+		c := *req // shallow copy: only the ID differs on the wire
+		c.Id = 0
+		m = &c
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	var httpReq *http.Request
+	if t.method == http.MethodGet {
+		u := *t.url
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+		u.RawQuery = q.Encode()
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url.String(), bytes.NewReader(packed))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	start := time.Now()
+	t.requests.Add(1)
+	resp, err := t.client.Do(httpReq)
+	elapsed := time.Since(start)
+	if err != nil {
+		return nil, elapsed, err
+	}
+	defer resp.Body.Close()
+	proto := resp.Proto
+	t.lastProto.Store(&proto)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, elapsed, fmt.Errorf("DoH upstream %s returned status %d: %s", t.address, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, elapsed, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, elapsed, fmt.Errorf("DoH response unpack: %w", err)
+	}
+	msg.Id = req.Id
+	return msg, elapsed, nil
+}
+
+// dialAddrs returns the addresses to connect to for addr (host:port): the bootstrap IPs with
+// addr's port, or addr itself.
+func (t *dohTransport) dialAddrs(addr string) []string {
+	if len(t.bootstrap) == 0 {
+		return []string{addr}
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{addr}
+	}
+	out := make([]string, len(t.bootstrap))
+	for i, ip := range t.bootstrap {
+		out[i] = net.JoinHostPort(ip, port)
+	}
+	return out
+}
+
+// dialTCP connects to the first reachable address for addr.
+func (t *dohTransport) dialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	var err error
+	for _, a := range t.dialAddrs(addr) {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, a); err == nil {
+			t.conns.Add(1)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// dialQUIC is dialTCP for HTTP/3. tlsCfg already carries the URL host as server name.
+func (t *dohTransport) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	var err error
+	for _, a := range t.dialAddrs(addr) {
+		var conn *quic.Conn
+		if conn, err = quic.DialAddrEarly(ctx, a, tlsCfg, cfg); err == nil {
+			t.conns.Add(1)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (t *dohTransport) stats() DoHConnStats {
+	s := DoHConnStats{
+		Transport:   "http2",
+		Method:      t.method,
+		Bootstrap:   t.bootstrap,
+		Requests:    t.requests.Load(),
+		ConnsOpened: t.conns.Load(),
+	}
+	if t.http3 {
+		s.Transport = "http3"
+	}
+	s.Reused = s.Requests - min(s.Requests, s.ConnsOpened)
+	if p := t.lastProto.Load(); p != nil {
+		s.LastProtocol = *p
+	}
+	return s
+}
+
+// DoHTransportKey identifies the transport of a DoH upstream, and keys DoHStats; routes may
+// list the same URL with other settings.
+func DoHTransportKey(upstream Upstream) string {
+	return fmt.Sprintf("%s|%s|%s|%t", upstream.Address, upstream.Bootstrap, upstream.DoHMethod, upstream.HTTP3)
+}
+
+// dohTransportFor returns the DoH transport for upstream, creating it on first use.
+func (r *Resolver) dohTransportFor(upstream Upstream) (*dohTransport, error) {
+	key := DoHTransportKey(upstream)
+	r.dohTransportsMu.RLock()
+	t, ok := r.dohTransports[key]
+	r.dohTransportsMu.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	r.dohTransportsMu.Lock()
+	defer r.dohTransportsMu.Unlock()
+	if t, ok := r.dohTransports[key]; ok {
+		return t, nil
+	}
+	t, err := newDoHTransport(upstream, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.dohTransports == nil {
+		r.dohTransports = make(map[string]*dohTransport)
+	}
+	r.dohTransports[key] = t
+	return t, nil
+}
+
+// dohExchange performs a DNS-over-HTTPS (RFC 8484) query, bounded by the upstream timeout.
+func (r *Resolver) dohExchange(ctx context.Context, req *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
+	t, err := r.dohTransportFor(upstream)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.exchangeTimeout())
+	defer cancel()
+	return t.exchange(ctx, req)
+}
+
+// DoHStats returns the connection stats of the DoH upstreams used so far, by DoHTransportKey.
+func (r *Resolver) DoHStats() map[string]DoHConnStats {
+	r.dohTransportsMu.RLock()
+	defer r.dohTransportsMu.RUnlock()
+	out := make(map[string]DoHConnStats, len(r.dohTransports))
+	for key, t := range r.dohTransports {
+		out[key] = t.stats()
+	}
+	return out
+}
@@ -0,0 +1,229 @@
+package dnsresolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// dohTestHandler answers RFC 8484 GET and POST queries with an A record and records the
+// query IDs and methods it saw.
+type dohTestHandler struct {
+	mu      sync.Mutex
+	methods []string
+	ids     []uint16
+}
+
+func (h *dohTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		packed, err = io.ReadAll(r.Body)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err != nil || req.Unpack(packed) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	h.methods = append(h.methods, r.Method)
+	h.ids = append(h.ids, req.Id)
+	h.mu.Unlock()
+	resp := answerA(req, net.IPv4(192, 0, 2, 1))
+	out, _ := resp.Pack()
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(out)
+}
+
+func (h *dohTestHandler) seen() ([]string, []uint16) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.methods...), append([]uint16(nil), h.ids...)
+}
+
+// serverTLSConfig returns a client TLS config trusting srv's certificate, which is valid
+// for example.com and 127.0.0.1.
+func serverTLSConfig(srv *httptest.Server) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	return &tls.Config{RootCAs: roots}
+}
+
+// exampleURL returns an https://example.com URL on the port of addr, so it only reaches the
+// test server through a bootstrap IP.
+func exampleURL(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return "https://example.com:" + port + "/dns-query"
+}
+
+func TestDoHTransportGET(t *testing.T) {
+	h := &dohTestHandler{}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	tr, err := newDoHTransport(Upstream{Address: srv.URL + "/dns-query?tenant=a", Protocol: "https", DoHMethod: "GET"}, nil)
+	if err != nil {
+		t.Fatalf("newDoHTransport: %v", err)
+	}
+	resp, _, err := tr.exchange(context.Background(), udpQuery("www.example.com."))
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.Id != 4242 {
+		t.Errorf("answer id %d, want the client's 4242", resp.Id)
+	}
+	methods, ids := h.seen()
+	if len(methods) != 1 || methods[0] != http.MethodGet || ids[0] != 0 {
+		t.Errorf("server saw %v with ids %v, want one GET with id 0", methods, ids)
+	}
+}
+
+func TestDoHTransportBootstrapHTTP2(t *testing.T) {
+	h := &dohTestHandler{}
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Nothing listens on 127.0.0.2: the dial moves on to the next bootstrap IP.
+	tr, err := newDoHTransport(Upstream{Address: exampleURL(srv.Listener.Addr().String()), Protocol: "https", Bootstrap: "127.0.0.2,127.0.0.1"}, serverTLSConfig(srv))
+	if err != nil {
+		t.Fatalf("newDoHTransport: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// After the first connection, concurrent queries share it.
+	if _, _, err := tr.exchange(ctx, udpQuery("www.example.com.")); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := tr.exchange(ctx, udpQuery("www.example.com.")); err != nil {
+				t.Errorf("exchange: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	stats := tr.stats()
+	if stats.ConnsOpened != 1 || stats.LastProtocol != "HTTP/2.0" || stats.Transport != "http2" || stats.Method != http.MethodPost {
+		t.Errorf("stats = %+v, want 1 HTTP/2 connection", stats)
+	}
+	if stats.Requests < 21 || stats.Reused != stats.Requests-1 {
+		t.Errorf("stats = %+v, want all but the first request reusing the connection", stats)
+	}
+}
+
+func TestDoHTransportHTTP3(t *testing.T) {
+	// The httptest server only provides a certificate trusted by serverTLSConfig.
+	certSrv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	certSrv.StartTLS()
+	defer certSrv.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	h := &dohTestHandler{}
+	h3 := &http3.Server{Handler: h, TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: certSrv.TLS.Certificates})}
+	go func() { _ = h3.Serve(pc) }()
+	defer h3.Close()
+
+	tr, err := newDoHTransport(Upstream{Address: exampleURL(pc.LocalAddr().String()), Protocol: "https", Bootstrap: "127.0.0.1", HTTP3: true}, serverTLSConfig(certSrv))
+	if err != nil {
+		t.Fatalf("newDoHTransport: %v", err)
+	}
+	defer tr.closeIdle()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		resp, _, err := tr.exchange(ctx, udpQuery("www.example.com."))
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("answer = %v", resp.Answer)
+		}
+	}
+	if stats := tr.stats(); stats.Transport != "http3" || stats.LastProtocol != "HTTP/3.0" || stats.ConnsOpened != 1 || stats.Reused != 2 {
+		t.Errorf("stats = %+v, want 3 requests over one HTTP/3 connection", stats)
+	}
+}
+
+func TestDoHTransportErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	tr, err := newDoHTransport(Upstream{Address: srv.URL, Protocol: "https"}, nil)
+	if err != nil {
+		t.Fatalf("newDoHTransport: %v", err)
+	}
+	if _, _, err := tr.exchange(context.Background(), udpQuery("www.example.com.")); err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Fatalf("err = %v, want status 503", err)
+	}
+}
+
+func TestResolverDoHBootstrapAndStats(t *testing.T) {
+	h := &dohTestHandler{}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	// doh.invalid never resolves: queries only work through the bootstrap IP.
+	address := "http://doh.invalid:" + port + "/dns-query"
+
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "doh", Address: address, Protocol: "https", Bootstrap: []string{"127.0.0.1"}, DoHMethod: "get"}}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+	if _, _, err := r.exchange(context.Background(), udpQuery("www.example.com.")); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	upstreams, _ := r.UpstreamConfig()
+	stats, ok := r.DoHStats()[DoHTransportKey(upstreams[0])]
+	if !ok || stats.Method != http.MethodGet || stats.Requests != 1 || len(stats.Bootstrap) != 1 {
+		t.Fatalf("DoHStats = %+v", r.DoHStats())
+	}
+
+	// The same URL with other settings (e.g. in a route) has its own transport and stats.
+	post := upstreams[0]
+	post.DoHMethod = ""
+	if _, _, err := r.dohExchange(context.Background(), udpQuery("www.example.com."), post); err != nil {
+		t.Fatalf("dohExchange: %v", err)
+	}
+	if got := len(r.DoHStats()); got != 2 {
+		t.Fatalf("DoHStats has %d entries, want 2: %+v", got, r.DoHStats())
+	}
+	if stats := r.DoHStats()[DoHTransportKey(post)]; stats.Method != http.MethodPost || stats.Requests != 1 {
+		t.Errorf("POST stats = %+v", stats)
+	}
+	if stats := r.DoHStats()[DoHTransportKey(upstreams[0])]; stats.Requests != 1 {
+		t.Errorf("GET stats = %+v, want 1 request", stats)
+	}
+
+	// Reload drops the transports (and their stats) so new settings apply.
+	r.ApplyUpstreamConfig(cfg)
+	if len(r.DoHStats()) != 0 {
+		t.Errorf("DoHStats after reload = %+v, want empty", r.DoHStats())
+	}
+}
@@ -1,13 +1,10 @@
 package dnsresolver
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
 	"strings"
 	"time"
 
@@ -20,48 +17,6 @@ type doqClient interface {
 	Send(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
 }
 
-// dohExchange performs a DNS-over-HTTPS (RFC 8484) query via HTTP POST.
-// The request body is the raw DNS message (binary).
-func (r *Resolver) dohExchange(req *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
-	packed, err := req.Pack()
-	if err != nil {
-		return nil, 0, err
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), r.exchangeTimeout())
-	defer cancel()
-	start := time.Now()
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.Address, bytes.NewReader(packed))
-	if err != nil {
-		return nil, 0, err
-	}
-	httpReq.Header.Set("Content-Type", "application/dns-message")
-	httpReq.Header.Set("Accept", "application/dns-message")
-
-	resp, err := r.dohClient.Do(httpReq)
-	elapsed := time.Since(start)
-	if err != nil {
-		return nil, elapsed, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, elapsed, fmt.Errorf("DoH upstream %s returned status %d: %s", upstream.Address, resp.StatusCode, strings.TrimSpace(string(body)))
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, elapsed, err
-	}
-
-	msg := new(dns.Msg)
-	if err := msg.Unpack(body); err != nil {
-		return nil, elapsed, fmt.Errorf("DoH response unpack: %w", err)
-	}
-	return msg, elapsed, nil
-}
-
 // tlsClientFor returns a DNS-over-TLS client for the given address.
 // Address format: tls://host:port. The host is used for TLS ServerName (SNI).
 func (r *Resolver) tlsClientFor(address string) *dns.Client {
@@ -145,9 +100,9 @@ func (r *Resolver) doqClientFor(address string) doqClient {
 }
 
 // doqExchange performs a DNS-over-QUIC (RFC 9250) query.
-func (r *Resolver) doqExchange(req *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
+func (r *Resolver) doqExchange(ctx context.Context, req *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
 	client := r.doqClientFor(upstream.Address)
-	ctx, cancel := context.WithTimeout(context.Background(), r.exchangeTimeout())
+	ctx, cancel := context.WithTimeout(ctx, r.exchangeTimeout())
 	defer cancel()
 	start := time.Now()
 	msg, err := client.Send(ctx, req)
@@ -165,8 +120,9 @@ func (r *Resolver) exchangeTimeout() time.Duration {
 	return r.upstreamMgr.GetTimeout()
 }
 
-// tlsConnPoolFor returns the connection pool for the given DoT address, creating it if needed.
-func (r *Resolver) tlsConnPoolFor(address string) *connPool {
+// tlsConnPoolFor returns the transport for the given DoT address, creating it if needed:
+// pipelined connections, or a connection pool when upstream_pipelining is off.
+func (r *Resolver) tlsConnPoolFor(address string) streamTransport {
 	addr := dotAddress(address)
 	r.tlsConnPoolsMu.RLock()
 	if p, ok := r.tlsConnPools[address]; ok {
@@ -184,16 +140,15 @@ func (r *Resolver) tlsConnPoolFor(address string) *connPool {
 		return nil
 	}
 	if r.tlsConnPools == nil {
-		r.tlsConnPools = make(map[string]*connPool)
+		r.tlsConnPools = make(map[string]streamTransport)
 	}
-	idleTimeout, validateBeforeReuse := r.upstreamMgr.GetConnPoolConfig()
-	p := newConnPool(client, addr, idleTimeout, validateBeforeReuse)
+	p := r.newStreamTransport(client, addr)
 	r.tlsConnPools[address] = p
 	return p
 }
 
-// tcpConnPoolFor returns the connection pool for the given TCP address, creating it if needed.
-func (r *Resolver) tcpConnPoolFor(address string) *connPool {
+// tcpConnPoolFor returns the transport for the given TCP address, creating it if needed.
+func (r *Resolver) tcpConnPoolFor(address string) streamTransport {
 	r.tcpConnPoolsMu.RLock()
 	if p, ok := r.tcpConnPools[address]; ok {
 		r.tcpConnPoolsMu.RUnlock()
@@ -206,41 +161,89 @@ func (r *Resolver) tcpConnPoolFor(address string) *connPool {
 		return p
 	}
 	if r.tcpConnPools == nil {
-		r.tcpConnPools = make(map[string]*connPool)
+		r.tcpConnPools = make(map[string]streamTransport)
 	}
-	idleTimeout, validateBeforeReuse := r.upstreamMgr.GetConnPoolConfig()
-	p := newConnPool(r.tcpClient, address, idleTimeout, validateBeforeReuse)
+	p := r.newStreamTransport(r.tcpClient, address)
 	r.tcpConnPools[address] = p
 	return p
 }
 
-// exchangeWithUpstream performs a single upstream exchange for the given protocol.
-// TCP and TLS use connection pooling to reuse connections and reduce handshake overhead.
-func (r *Resolver) exchangeWithUpstream(req *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
+// newStreamTransport returns a pipelineTransport, or a connPool when upstream_pipelining is off.
+func (r *Resolver) newStreamTransport(client *dns.Client, addr string) streamTransport {
+	idleTimeout, validateBeforeReuse := r.upstreamMgr.GetConnPoolConfig()
+	if r.pipelining.Load() {
+		return newPipelineTransport(client, addr, idleTimeout)
+	}
+	return newConnPool(client, addr, idleTimeout, validateBeforeReuse)
+}
+
+// recursorFor returns the iterative resolver for a protocol "recursive" upstream, creating it if needed.
+func (r *Resolver) recursorFor(upstream Upstream) *recursor {
+	r.recursorsMu.RLock()
+	if rc, ok := r.recursors[upstream.Address]; ok {
+		r.recursorsMu.RUnlock()
+		return rc
+	}
+	r.recursorsMu.RUnlock()
+	r.recursorsMu.Lock()
+	defer r.recursorsMu.Unlock()
+	if rc, ok := r.recursors[upstream.Address]; ok {
+		return rc
+	}
+	if r.recursors == nil {
+		r.recursors = make(map[string]*recursor)
+	}
+	var hints []string
+	if upstream.RootHints != "" {
+		hints = strings.Split(upstream.RootHints, ",")
+	}
+	rc := newRecursor(hints, r.upstreamMgr.GetTimeout())
+	r.recursors[upstream.Address] = rc
+	return rc
+}
+
+// exchangeWithUpstream performs a single upstream exchange for the given protocol, bounded by
+// the upstream timeout and ctx (the race strategy cancels the slower upstreams).
+// TCP and TLS reuse connections (pipelined by default) to avoid handshake overhead.
+// When the upstream is at its max_inflight or max_qps limit, errUpstreamLimited is returned
+// without sending anything; refresh traffic (see withRefreshPriority) hits the limit earlier.
+func (r *Resolver) exchangeWithUpstream(ctx context.Context, req *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
+	release, ok := upstream.limit.acquire(isRefreshPriority(ctx))
+	if !ok {
+		return nil, 0, errUpstreamLimited
+	}
+	defer release()
 	switch upstream.Protocol {
 	case "https":
-		return r.dohExchange(req, upstream)
+		return r.dohExchange(ctx, req, upstream)
 	case "quic":
-		return r.doqExchange(req, upstream)
+		return r.doqExchange(ctx, req, upstream)
 	case "tls":
 		pool := r.tlsConnPoolFor(upstream.Address)
 		if pool == nil {
 			return nil, 0, fmt.Errorf("failed to create DoT client for %s", upstream.Address)
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), r.exchangeTimeout())
+		ctx, cancel := context.WithTimeout(ctx, r.exchangeTimeout())
 		defer cancel()
 		return pool.exchange(ctx, req)
 	case "udp":
-		ctx, cancel := context.WithTimeout(context.Background(), r.exchangeTimeout())
+		ctx, cancel := context.WithTimeout(ctx, r.exchangeTimeout())
 		defer cancel()
-		return r.udpClient.ExchangeContext(ctx, req, upstream.Address)
+		return udpExchange(ctx, req, upstream)
 	case "tcp":
 		pool := r.tcpConnPoolFor(upstream.Address)
-		ctx, cancel := context.WithTimeout(context.Background(), r.exchangeTimeout())
+		ctx, cancel := context.WithTimeout(ctx, r.exchangeTimeout())
 		defer cancel()
 		return pool.exchange(ctx, req)
+	case "recursive":
+		// The walk from the root spans many authoritative queries, each bounded by the
+		// upstream timeout; the whole resolution has its own budget.
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(r.recursionTimeout.Load()))
+		defer cancel()
+		start := time.Now()
+		msg, err := r.recursorFor(upstream).exchange(ctx, req)
+		return msg, time.Since(start), err
 	default:
 		return nil, 0, fmt.Errorf("unsupported upstream protocol %q", upstream.Protocol)
 	}
 }
-
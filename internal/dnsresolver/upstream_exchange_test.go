@@ -1,6 +1,7 @@
 package dnsresolver
 
 import (
+	"context"
 	"testing"
 )
 
@@ -55,7 +56,7 @@ func TestExchangeWithUpstream_UnsupportedProtocol(t *testing.T) {
 		Address:  "8.8.8.8:53",
 		Protocol: "grpc", // unsupported
 	}
-	_, _, err := r.exchangeWithUpstream(nil, upstream)
+	_, _, err := r.exchangeWithUpstream(context.Background(), nil, upstream)
 	if err == nil {
 		t.Fatal("expected error for unsupported protocol, got nil")
 	}
@@ -0,0 +1,363 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/metrics"
+	"github.com/tternquist/beyond-ads-dns/internal/webhook"
+)
+
+// healthCheckIdleInterval is how often the prober rechecks its config while health checks are disabled.
+const healthCheckIdleInterval = 10 * time.Second
+
+// healthCheckConfig is the resolved upstream_health_check config. It is immutable and is
+// replaced as a whole on hot-reload.
+type healthCheckConfig struct {
+	interval         time.Duration
+	timeout          time.Duration
+	qname            string
+	qtype            uint16
+	failureThreshold int
+	successThreshold int
+	window           int
+}
+
+// newHealthCheckConfig returns the health check settings, or nil when health checks are disabled.
+func newHealthCheckConfig(cfg config.UpstreamHealthCheckConfig) *healthCheckConfig {
+	if cfg.Enabled == nil || !*cfg.Enabled {
+		return nil
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(cfg.QueryType))]
+	if !ok {
+		qtype = dns.TypeNS
+	}
+	return &healthCheckConfig{
+		interval:         cfg.Interval.Duration,
+		timeout:          cfg.Timeout.Duration,
+		qname:            dns.Fqdn(strings.TrimSpace(cfg.QueryName)),
+		qtype:            qtype,
+		failureThreshold: max(cfg.FailureThreshold, 1),
+		successThreshold: max(cfg.SuccessThreshold, 1),
+		window:           max(cfg.Window, 1),
+	}
+}
+
+// healthProbe is the result of one probe.
+type healthProbe struct {
+	ok      bool
+	latency time.Duration
+}
+
+// upstreamHealth is the probe history of one upstream, guarded by upstreamManager.healthMu.
+type upstreamHealth struct {
+	probes               []healthProbe // the last window probes, oldest first
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	down                 bool
+	lastProbe            time.Time
+	lastError            string
+}
+
+// UpstreamHealth is the health of one upstream as exposed to the API/UI.
+type UpstreamHealth struct {
+	Status              string  `json:"status"`       // up, down, or unknown before the first probe
+	SuccessRate         float64 `json:"success_rate"` // 0-1 over the recent probes
+	LatencyP50Ms        float64 `json:"latency_p50_ms"`
+	LatencyP95Ms        float64 `json:"latency_p95_ms"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	Probes              int     `json:"probes"` // probes in the window
+	LastProbe           string  `json:"last_probe,omitempty"`
+	LastError           string  `json:"last_error,omitempty"`
+}
+
+// record adds a probe result and reports whether the upstream went down or came back up.
+// Hysteresis: an up upstream needs failureThreshold consecutive failures to go down, and a
+// down one successThreshold consecutive successes to come back.
+func (h *upstreamHealth) record(p healthProbe, errMsg string, hc *healthCheckConfig) (changed bool) {
+	h.probes = append(h.probes, p)
+	if len(h.probes) > hc.window {
+		h.probes = h.probes[len(h.probes)-hc.window:]
+	}
+	h.lastProbe = time.Now()
+	h.lastError = errMsg
+	if p.ok {
+		h.consecutiveFailures = 0
+		h.consecutiveSuccesses++
+		if h.down && h.consecutiveSuccesses >= hc.successThreshold {
+			h.down = false
+			return true
+		}
+		return false
+	}
+	h.consecutiveSuccesses = 0
+	h.consecutiveFailures++
+	if !h.down && h.consecutiveFailures >= hc.failureThreshold {
+		h.down = true
+		return true
+	}
+	return false
+}
+
+func (h *upstreamHealth) snapshot() UpstreamHealth {
+	if h == nil || h.lastProbe.IsZero() {
+		return UpstreamHealth{Status: "unknown"}
+	}
+	out := UpstreamHealth{
+		Status:              "up",
+		ConsecutiveFailures: h.consecutiveFailures,
+		Probes:              len(h.probes),
+		LastProbe:           h.lastProbe.UTC().Format(time.RFC3339),
+		LastError:           h.lastError,
+	}
+	if h.down {
+		out.Status = "down"
+	}
+	latencies := make([]time.Duration, 0, len(h.probes))
+	for _, p := range h.probes {
+		if p.ok {
+			latencies = append(latencies, p.latency)
+		}
+	}
+	if len(h.probes) > 0 {
+		out.SuccessRate = float64(len(latencies)) / float64(len(h.probes))
+	}
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		out.LatencyP50Ms = latencyPercentileMs(latencies, 0.50)
+		out.LatencyP95Ms = latencyPercentileMs(latencies, 0.95)
+	}
+	return out
+}
+
+// latencyPercentileMs returns the nearest-rank percentile of sorted, in milliseconds.
+func latencyPercentileMs(sorted []time.Duration, p float64) float64 {
+	idx := int(float64(len(sorted))*p+0.999999) - 1
+	idx = min(max(idx, 0), len(sorted)-1)
+	return float64(sorted[idx].Microseconds()) / 1000
+}
+
+// RecordHealthProbe records a probe of addr (err nil = success) and returns the new health,
+// and whether the upstream went down or came back up.
+func (m *upstreamManager) RecordHealthProbe(addr string, latency time.Duration, err error, hc *healthCheckConfig) (UpstreamHealth, bool) {
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	if m.health == nil {
+		m.health = make(map[string]*upstreamHealth)
+	}
+	h := m.health[addr]
+	if h == nil {
+		h = &upstreamHealth{}
+		m.health[addr] = h
+	}
+	changed := h.record(healthProbe{ok: err == nil, latency: latency}, errMsg, hc)
+	if changed {
+		if h.down {
+			m.healthDown.Add(1)
+		} else {
+			m.healthDown.Add(-1)
+		}
+	}
+	return h.snapshot(), changed
+}
+
+// IsDown reports whether health checks marked addr down. When every upstream is down,
+// none is reported down: trying them beats failing every query.
+func (m *upstreamManager) IsDown(addr string) bool {
+	if m.healthDown.Load() == 0 {
+		return false
+	}
+	upstreams, _ := m.Upstreams()
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	if h := m.health[addr]; h == nil || !h.down {
+		return false
+	}
+	for _, u := range upstreams {
+		if h := m.health[u.Address]; h == nil || !h.down {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthStats returns the health of the current upstreams, by address.
+func (m *upstreamManager) HealthStats() map[string]UpstreamHealth {
+	upstreams, _ := m.Upstreams()
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	out := make(map[string]UpstreamHealth, len(upstreams))
+	for _, u := range upstreams {
+		out[u.Address] = m.health[u.Address].snapshot()
+	}
+	return out
+}
+
+// pruneHealth drops the health of upstreams no longer in upstreams.
+func (m *upstreamManager) pruneHealth(upstreams []Upstream) {
+	keep := make(map[string]bool, len(upstreams))
+	for _, u := range upstreams {
+		keep[u.Address] = true
+	}
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	for addr, h := range m.health {
+		if !keep[addr] {
+			if h.down {
+				m.healthDown.Add(-1)
+			}
+			delete(m.health, addr)
+		}
+	}
+}
+
+// resetHealth drops the health of every upstream, so none stays marked down once health
+// checks are disabled.
+func (m *upstreamManager) resetHealth() {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	m.health = nil
+	m.healthDown.Store(0)
+}
+
+// healthManagers returns the upstream managers whose upstreams are health checked: the global
+// one, the routes' and private reverse's.
+func (r *Resolver) healthManagers() []*upstreamManager {
+	mgrs := []*upstreamManager{r.upstreamMgr}
+	if t := r.upstreamRoutes.Load(); t != nil {
+		for _, route := range t.routes {
+			mgrs = append(mgrs, route.mgr)
+		}
+	}
+	if p := r.privateReverse.Load(); p != nil && p.mgr != nil {
+		mgrs = append(mgrs, p.mgr)
+	}
+	return mgrs
+}
+
+// applyHealthCheckConfig sets the health check config; disabling health checks clears the
+// health of every upstream, since no probe would bring a down upstream back.
+func (r *Resolver) applyHealthCheckConfig(cfg config.UpstreamHealthCheckConfig) {
+	hc := newHealthCheckConfig(cfg)
+	r.healthCheck.Store(hc)
+	if hc != nil {
+		return
+	}
+	for _, mgr := range r.healthManagers() {
+		mgr.resetHealth()
+	}
+}
+
+// StartHealthChecks probes every upstream in the background while upstream_health_check is
+// enabled, until ctx is done. The config is re-read each round, so it can be hot-reloaded.
+func (r *Resolver) StartHealthChecks(ctx context.Context) {
+	go func() {
+		probed := make(map[string]bool)
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			interval := healthCheckIdleInterval
+			current := make(map[string]bool)
+			if hc := r.healthCheck.Load(); hc != nil {
+				current = r.probeUpstreams(ctx, hc)
+				interval = hc.interval
+			}
+			for addr := range probed {
+				if !current[addr] {
+					metrics.DeleteUpstreamHealth(addr)
+				}
+			}
+			probed = current
+			timer.Reset(interval)
+		}
+	}()
+}
+
+// probeUpstreams probes the upstreams of the global list, the routes and private reverse in
+// parallel and returns the addresses probed.
+func (r *Resolver) probeUpstreams(ctx context.Context, hc *healthCheckConfig) map[string]bool {
+	probed := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, mgr := range r.healthManagers() {
+		upstreams, _ := mgr.Upstreams()
+		for _, u := range upstreams {
+			probed[u.Address] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.probeUpstream(ctx, mgr, u, hc)
+			}()
+		}
+	}
+	wg.Wait()
+	return probed
+}
+
+// probeUpstream sends the canary query to upstream and records the result. SERVFAIL and
+// REFUSED answers count as failures. Transitions are logged and sent to the error webhooks.
+// Probes run at refresh priority; a probe not sent because of the upstream's limits is not recorded.
+func (r *Resolver) probeUpstream(ctx context.Context, mgr *upstreamManager, upstream Upstream, hc *healthCheckConfig) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(hc.qname, hc.qtype)
+	probeCtx, cancel := context.WithTimeout(withRefreshPriority(ctx), hc.timeout)
+	resp, elapsed, err := r.exchangeWithUpstream(probeCtx, msg, upstream)
+	cancel()
+	if ctx.Err() != nil || errors.Is(err, errUpstreamLimited) {
+		return
+	}
+	if err == nil && resp == nil {
+		err = errors.New("no response")
+	}
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("probe answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	health, changed := mgr.RecordHealthProbe(upstream.Address, elapsed, err, hc)
+	metrics.SetUpstreamHealth(upstream.Address, health.Status != "down", health.SuccessRate, health.LatencyP50Ms, health.LatencyP95Ms, health.ConsecutiveFailures)
+	if !changed {
+		return
+	}
+	outcome := "upstream_" + health.Status
+	if health.Status == "down" {
+		r.logf(slog.LevelWarn, "upstream marked down by health check", "upstream", upstream.Address, "consecutive_failures", health.ConsecutiveFailures, "err", err)
+	} else {
+		r.logf(slog.LevelInfo, "upstream marked up by health check", "upstream", upstream.Address, "latency_ms", elapsed.Milliseconds())
+	}
+	payload := webhook.OnErrorPayload{
+		QName:           hc.qname,
+		Timestamp:       time.Now().UTC().Format(time.RFC3339),
+		Outcome:         outcome,
+		UpstreamAddress: upstream.Address,
+		QType:           dns.TypeToString[hc.qtype],
+		DurationMs:      elapsed.Seconds() * 1000.0,
+		ErrorMessage:    health.LastError,
+	}
+	for _, n := range r.webhookOnError {
+		n.FireOnError(payload)
+	}
+}
+
+// UpstreamHealth returns the health of the global upstreams by address, or nil when health
+// checks are disabled.
+func (r *Resolver) UpstreamHealth() map[string]UpstreamHealth {
+	if r.healthCheck.Load() == nil {
+		return nil
+	}
+	return r.upstreamMgr.HealthStats()
+}
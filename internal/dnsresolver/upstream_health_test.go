@@ -0,0 +1,226 @@
+package dnsresolver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/webhook"
+)
+
+func TestUpstreamHealthHysteresis(t *testing.T) {
+	hc := &healthCheckConfig{failureThreshold: 3, successThreshold: 2, window: 4}
+	m := newUpstreamManager(makeUpstreams("a:53", "b:53"), StrategyFailover, 0, 0, 0, false)
+	fail := errors.New("timeout")
+
+	if got := m.HealthStats()["a:53"].Status; got != "unknown" {
+		t.Fatalf("status before first probe = %q, want unknown", got)
+	}
+	steps := []struct {
+		err     error
+		status  string
+		changed bool
+	}{
+		{nil, "up", false},
+		{fail, "up", false},
+		{fail, "up", false},
+		{fail, "down", true},
+		{nil, "down", false}, // a lone success does not bring it back
+		{fail, "down", false},
+		{nil, "down", false},
+		{nil, "up", true},
+	}
+	for i, step := range steps {
+		health, changed := m.RecordHealthProbe("a:53", 10*time.Millisecond, step.err, hc)
+		if health.Status != step.status || changed != step.changed {
+			t.Fatalf("probe %d: status %q changed %v, want %q %v", i, health.Status, changed, step.status, step.changed)
+		}
+	}
+	// The window holds the last 4 probes: success, failure, success, success.
+	health := m.HealthStats()["a:53"]
+	if health.Probes != 4 || health.SuccessRate != 0.75 || health.ConsecutiveFailures != 0 {
+		t.Errorf("unexpected health %+v", health)
+	}
+}
+
+func TestUpstreamHealthLatencyPercentiles(t *testing.T) {
+	hc := &healthCheckConfig{failureThreshold: 3, successThreshold: 2, window: 20}
+	m := newUpstreamManager(makeUpstreams("a:53"), StrategyFailover, 0, 0, 0, false)
+	for i := 1; i <= 20; i++ {
+		m.RecordHealthProbe("a:53", time.Duration(i)*time.Millisecond, nil, hc)
+	}
+	health := m.HealthStats()["a:53"]
+	if health.LatencyP50Ms != 10 || health.LatencyP95Ms != 19 {
+		t.Errorf("p50 %v p95 %v, want 10 and 19", health.LatencyP50Ms, health.LatencyP95Ms)
+	}
+	// Failed probes count against the success rate but not the latencies.
+	m.RecordHealthProbe("a:53", time.Second, errors.New("timeout"), hc)
+	health = m.HealthStats()["a:53"]
+	if health.SuccessRate != 0.95 || health.LatencyP95Ms != 20 || health.LastError != "timeout" {
+		t.Errorf("unexpected health %+v", health)
+	}
+}
+
+func TestUpstreamManagerIsDown(t *testing.T) {
+	hc := &healthCheckConfig{failureThreshold: 1, successThreshold: 1, window: 5}
+	m := newUpstreamManager(makeUpstreams("a:53", "b:53"), StrategyFailover, 0, 0, 0, false)
+	fail := errors.New("timeout")
+
+	m.RecordHealthProbe("a:53", 0, fail, hc)
+	if !m.IsDown("a:53") || m.IsDown("b:53") {
+		t.Fatal("expected only a:53 down")
+	}
+	// With every upstream down, none is skipped.
+	m.RecordHealthProbe("b:53", 0, fail, hc)
+	if m.IsDown("a:53") || m.IsDown("b:53") {
+		t.Fatal("expected no upstream skipped when all are down")
+	}
+	// Removing b:53 from the config drops its health; a:53 is the only upstream left.
+	m.ApplyConfig(makeUpstreams("a:53", "c:53"), StrategyFailover, 0, 0, 0, false)
+	if !m.IsDown("a:53") || m.healthDown.Load() != 1 {
+		t.Fatalf("expected a:53 down after reload, down count %d", m.healthDown.Load())
+	}
+	m.RecordHealthProbe("a:53", 0, nil, hc)
+	if m.IsDown("a:53") || m.healthDown.Load() != 0 {
+		t.Fatal("expected a:53 up after a successful probe")
+	}
+}
+
+func TestResolverHealthChecks(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	var badQueries atomic.Int32
+	bad := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		if failing.Load() {
+			resp.SetRcode(req, dns.RcodeServerFailure)
+		} else {
+			resp.SetReply(req)
+		}
+		if req.Question[0].Name == "user.example." {
+			badQueries.Add(1)
+		}
+		_ = w.WriteMsg(resp)
+	}))
+	good := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(192, 0, 2, 1)}}
+		_ = w.WriteMsg(resp)
+	}))
+
+	hooks := make(chan webhook.OnErrorPayload, 4)
+	hookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var p webhook.OnErrorPayload
+		if json.Unmarshal(body, &p) == nil {
+			hooks <- p
+		}
+	}))
+	t.Cleanup(hookSrv.Close)
+
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{
+		{Name: "bad", Address: bad, Protocol: "udp"},
+		{Name: "good", Address: good, Protocol: "udp"},
+	}
+	cfg.UpstreamHealthCheck = config.UpstreamHealthCheckConfig{
+		Enabled:          ptr(true),
+		Interval:         config.Duration{Duration: 10 * time.Millisecond},
+		Timeout:          config.Duration{Duration: time.Second},
+		QueryName:        "health.example",
+		QueryType:        "A",
+		FailureThreshold: 2,
+		SuccessThreshold: 2,
+		Window:           10,
+	}
+	cfg.Webhooks.OnError = &config.WebhookOnErrorConfig{Enabled: ptr(true), URL: hookSrv.URL}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	r.StartHealthChecks(ctx)
+
+	waitHealth := func(addr, status string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if r.UpstreamHealth()[addr].Status == status {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("%s not %s: %+v", addr, status, r.UpstreamHealth()[addr])
+	}
+	waitHook := func(outcome string) {
+		t.Helper()
+		select {
+		case p := <-hooks:
+			if p.Outcome != outcome || p.UpstreamAddress != bad || p.QName != "health.example." {
+				t.Errorf("unexpected webhook %+v, want %s for %s", p, outcome, bad)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s webhook", outcome)
+		}
+	}
+
+	waitHealth(bad, "down")
+	waitHook("upstream_down")
+	if got := r.UpstreamHealth()[good].Status; got != "up" {
+		t.Errorf("good upstream status %q, want up", got)
+	}
+
+	// Queries skip the down upstream instead of getting its SERVFAIL.
+	req := new(dns.Msg)
+	req.SetQuestion("user.example.", dns.TypeA)
+	resp, upstream, err := r.exchange(context.Background(), req)
+	if err != nil || upstream != good || resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("exchange = %v, %s, %v; want an answer from %s", resp, upstream, err, good)
+	}
+	if badQueries.Load() != 0 {
+		t.Errorf("down upstream was queried %d times", badQueries.Load())
+	}
+
+	failing.Store(false)
+	waitHealth(bad, "up")
+	waitHook("upstream_up")
+}
+
+func TestResolverHealthChecksDisabledOnReload(t *testing.T) {
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{
+		{Name: "a", Address: "192.0.2.1:53", Protocol: "udp"},
+		{Name: "b", Address: "192.0.2.2:53", Protocol: "udp"},
+	}
+	cfg.UpstreamHealthCheck = config.UpstreamHealthCheckConfig{Enabled: ptr(true), FailureThreshold: 1, SuccessThreshold: 1, Window: 5}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+	hc := r.healthCheck.Load()
+	r.upstreamMgr.RecordHealthProbe("192.0.2.1:53", 0, errors.New("timeout"), hc)
+	if !r.upstreamMgr.IsDown("192.0.2.1:53") {
+		t.Fatal("expected 192.0.2.1:53 down")
+	}
+
+	// Reloading with health checks still enabled keeps the health.
+	r.ApplyUpstreamConfig(cfg)
+	if !r.upstreamMgr.IsDown("192.0.2.1:53") {
+		t.Fatal("expected 192.0.2.1:53 still down after reload")
+	}
+
+	// No probe would bring the upstream back, so disabling health checks clears it.
+	cfg.UpstreamHealthCheck.Enabled = ptr(false)
+	r.ApplyUpstreamConfig(cfg)
+	if r.upstreamMgr.IsDown("192.0.2.1:53") || r.upstreamMgr.healthDown.Load() != 0 {
+		t.Fatalf("expected no upstream down with health checks disabled, down count %d", r.upstreamMgr.healthDown.Load())
+	}
+	if got := r.upstreamMgr.HealthStats()["192.0.2.1:53"].Status; got != "unknown" {
+		t.Errorf("status %q after disabling health checks, want unknown", got)
+	}
+}
@@ -0,0 +1,113 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// refreshLimitShare is the share of each upstream limit that refresh traffic may use; the
+// rest is kept for user queries.
+const refreshLimitShare = 0.5
+
+// errUpstreamLimited is returned by exchangeWithUpstream when the upstream is at its
+// max_inflight or max_qps limit. It is not an upstream failure: the query spills over to the
+// next upstream, and no backoff or error is recorded.
+var errUpstreamLimited = errors.New("upstream at its concurrency or rate limit")
+
+// upstreamLimiter enforces an upstream's max_inflight and max_qps. Refresh traffic (the cache
+// sweeper, health probes) may only use part of each limit, leaving the rest for user queries.
+type upstreamLimiter struct {
+	maxInflight int64 // 0 = unlimited
+	inflight    atomic.Int64
+	qps         *rate.Limiter // nil = unlimited
+}
+
+// newUpstreamLimiter returns a limiter for the given limits, or nil when both are unset.
+// The QPS bucket holds one second of queries, so short bursts up to max_qps are allowed.
+func newUpstreamLimiter(maxInflight int, maxQPS float64) *upstreamLimiter {
+	if maxInflight <= 0 && maxQPS <= 0 {
+		return nil
+	}
+	l := &upstreamLimiter{maxInflight: int64(max(maxInflight, 0))}
+	if maxQPS > 0 {
+		l.qps = rate.NewLimiter(rate.Limit(maxQPS), max(int(math.Ceil(maxQPS)), 1))
+	}
+	return l
+}
+
+// acquire takes an in-flight slot and a QPS token, and returns the function that releases the
+// slot. It never waits: ok is false when the limit is reached. Refresh traffic is limited to
+// refreshLimitShare of each limit (at least one query).
+func (l *upstreamLimiter) acquire(refresh bool) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	if l.maxInflight > 0 {
+		limit := l.maxInflight
+		if refresh {
+			limit = max(int64(float64(limit)*refreshLimitShare), 1)
+		}
+		if l.inflight.Add(1) > limit {
+			l.inflight.Add(-1)
+			return nil, false
+		}
+	}
+	if l.qps != nil {
+		now := time.Now()
+		// Refresh only takes a token while the bucket holds more than the user reserve.
+		reserve := 0.0
+		if refresh {
+			reserve = float64(l.qps.Burst()) * (1 - refreshLimitShare)
+		}
+		if l.qps.TokensAt(now) < reserve+1 || !l.qps.AllowN(now, 1) {
+			if l.maxInflight > 0 {
+				l.inflight.Add(-1)
+			}
+			return nil, false
+		}
+	}
+	if l.maxInflight == 0 {
+		return func() {}, true
+	}
+	return func() { l.inflight.Add(-1) }, true
+}
+
+// UpstreamLimit is an upstream's configured limits and current use, for the API/UI.
+type UpstreamLimit struct {
+	MaxInflight int     `json:"max_inflight,omitempty"`
+	MaxQPS      float64 `json:"max_qps,omitempty"`
+	Inflight    int     `json:"inflight"` // queries in flight (counted only with max_inflight)
+}
+
+// Limit returns the upstream's limits, or nil when it has none.
+func (u Upstream) Limit() *UpstreamLimit {
+	l := u.limit
+	if l == nil {
+		return nil
+	}
+	out := &UpstreamLimit{MaxInflight: int(l.maxInflight), Inflight: int(l.inflight.Load())}
+	if l.qps != nil {
+		out.MaxQPS = float64(l.qps.Limit())
+	}
+	return out
+}
+
+// exchangePriorityKey marks a context as carrying background (refresh) traffic.
+type exchangePriorityKey struct{}
+
+// withRefreshPriority returns ctx marked as refresh traffic, which gets the lower share of
+// upstream limits.
+func withRefreshPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exchangePriorityKey{}, true)
+}
+
+// isRefreshPriority reports whether ctx carries refresh traffic.
+func isRefreshPriority(ctx context.Context) bool {
+	refresh, _ := ctx.Value(exchangePriorityKey{}).(bool)
+	return refresh
+}
@@ -0,0 +1,161 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+func TestUpstreamLimiterInflight(t *testing.T) {
+	l := newUpstreamLimiter(4, 0)
+	var releases []func()
+	for i := 0; i < 4; i++ {
+		release, ok := l.acquire(false)
+		if !ok {
+			t.Fatalf("acquire %d refused under the limit", i)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := l.acquire(false); ok {
+		t.Fatal("acquire allowed over max_inflight")
+	}
+	releases[0]()
+	releases[1]()
+	// Refresh may only use half the limit: two in flight leaves none for it.
+	if _, ok := l.acquire(true); ok {
+		t.Fatal("refresh allowed over its share")
+	}
+	releases[2]()
+	if _, ok := l.acquire(true); !ok {
+		t.Fatal("refresh refused within its share")
+	}
+	if got := (Upstream{limit: l}).Limit(); got.MaxInflight != 4 || got.MaxQPS != 0 || got.Inflight != 2 {
+		t.Errorf("unexpected limit %+v", got)
+	}
+
+	var unlimited *upstreamLimiter
+	if release, ok := unlimited.acquire(true); !ok {
+		t.Fatal("nil limiter refused")
+	} else {
+		release()
+	}
+	if newUpstreamLimiter(0, 0) != nil {
+		t.Error("expected no limiter without limits")
+	}
+}
+
+func TestUpstreamLimiterQPS(t *testing.T) {
+	l := newUpstreamLimiter(0, 4)
+	// The bucket holds 4 tokens; refresh stops while half of them are left for user queries.
+	refresh := 0
+	for i := 0; i < 4; i++ {
+		if _, ok := l.acquire(true); ok {
+			refresh++
+		}
+	}
+	user := 0
+	for i := 0; i < 4; i++ {
+		if _, ok := l.acquire(false); ok {
+			user++
+		}
+	}
+	if refresh != 2 || user != 2 {
+		t.Fatalf("refresh got %d and user %d queries, want 2 and 2", refresh, user)
+	}
+}
+
+func TestResolverUpstreamLimitSpillsOver(t *testing.T) {
+	hold := make(chan struct{})
+	received := make(chan struct{}, 4)
+	answer := func(w dns.ResponseWriter, req *dns.Msg, ip net.IP) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip}}
+		_ = w.WriteMsg(resp)
+	}
+	limited := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Name == "hold.example." {
+			received <- struct{}{}
+			<-hold
+		}
+		answer(w, req, net.IPv4(192, 0, 2, 1))
+	}))
+	spare := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		answer(w, req, net.IPv4(192, 0, 2, 2))
+	}))
+
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{
+		{Name: "limited", Address: limited, Protocol: "udp", MaxInflight: 2},
+		{Name: "spare", Address: spare, Protocol: "udp"},
+	}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+
+	query := func(ctx context.Context, name string) string {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		resp, upstream, err := r.exchange(ctx, req)
+		if err != nil || resp == nil || len(resp.Answer) == 0 {
+			t.Fatalf("exchange %s = %v, %v", name, resp, err)
+		}
+		return upstream
+	}
+	holds := make(chan string, 2)
+	startHold := func() {
+		go func() {
+			req := new(dns.Msg)
+			req.SetQuestion("hold.example.", dns.TypeA)
+			_, upstream, _ := r.exchange(context.Background(), req)
+			holds <- upstream
+		}()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("held query not received")
+		}
+	}
+
+	// One query in flight: refresh is at its share and spills over, user queries still fit.
+	startHold()
+	if got := query(withRefreshPriority(context.Background()), "refresh.example."); got != spare {
+		t.Errorf("refresh query went to %s, want %s", got, spare)
+	}
+	if got := query(context.Background(), "user.example."); got != limited {
+		t.Errorf("user query went to %s, want %s", got, limited)
+	}
+
+	// Two in flight: user queries spill over instead of waiting.
+	startHold()
+	if got := query(context.Background(), "spill.example."); got != spare {
+		t.Errorf("user query over the limit went to %s, want %s", got, spare)
+	}
+	close(hold)
+	for i := 0; i < 2; i++ {
+		if got := <-holds; got != limited {
+			t.Errorf("held query answered by %s, want %s", got, limited)
+		}
+	}
+	if r.upstreamMgr.IsInBackoff(limited) {
+		t.Error("limited upstream put in backoff")
+	}
+
+	// With every upstream at its limit, the exchange fails rather than queueing.
+	cfg.Upstreams = cfg.Upstreams[:1]
+	cfg.Upstreams[0].MaxInflight = 0
+	cfg.Upstreams[0].MaxQPS = 0.001
+	r = buildTestResolver(t, cfg, nil, nil, nil)
+	req := new(dns.Msg)
+	req.SetQuestion("user.example.", dns.TypeA)
+	if _, _, err := r.exchange(context.Background(), req); err != nil {
+		t.Fatalf("first query: %v", err)
+	}
+	if _, _, err := r.exchange(context.Background(), req.Copy()); !errors.Is(err, errUpstreamLimited) {
+		t.Errorf("query over max_qps: err %v, want errUpstreamLimited", err)
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"time"
 )
 
-// upstreamManager manages upstream server selection, backoff, and weighted latency tracking.
+// upstreamManager manages upstream server selection, backoff, and weighted latency and error tracking.
 // It encapsulates upstream-related state that was previously scattered across the Resolver struct.
 type upstreamManager struct {
 	mu       sync.RWMutex
@@ -24,9 +24,35 @@ type upstreamManager struct {
 	// load_balance: round-robin counter
 	loadBalanceNext uint64
 
-	// weighted: per-upstream EWMA of response time (ms)
+	// weighted and race: per-upstream EWMA of response time (ms) and recent exchange outcomes
 	weightedLatency   map[string]*float64
+	weightedOutcomes  map[string]*outcomeWindow
 	weightedLatencyMu sync.RWMutex
+
+	// race: upstreams queried at once, delay before each hedged query (0 = all at once)
+	raceCount      int
+	raceHedgeDelay time.Duration
+	raceStats      map[string]*raceCounters
+	raceStatsMu    sync.Mutex
+
+	// health checks: probe history by address, and how many upstreams are marked down
+	health     map[string]*upstreamHealth
+	healthMu   sync.Mutex
+	healthDown atomic.Int32
+}
+
+// raceCounters counts race strategy outcomes for one upstream.
+type raceCounters struct {
+	wins      atomic.Uint64
+	hedges    atomic.Uint64
+	hedgeWins atomic.Uint64
+}
+
+// UpstreamRaceStats counts race strategy outcomes for one upstream, for the API/UI.
+type UpstreamRaceStats struct {
+	Wins      uint64 `json:"wins"`       // races this upstream answered first
+	Hedges    uint64 `json:"hedges"`     // queries sent to it after the hedge delay
+	HedgeWins uint64 `json:"hedge_wins"` // races won by one of those hedged queries
 }
 
 func newUpstreamManager(upstreams []Upstream, strategy string, timeout, backoff time.Duration, connPoolIdle time.Duration, connPoolValidate bool) *upstreamManager {
@@ -39,11 +65,14 @@ func newUpstreamManager(upstreams []Upstream, strategy string, timeout, backoff
 		connPoolIdleTimeout:         connPoolIdle,
 		connPoolValidateBeforeReuse: connPoolValidate,
 		weightedLatency:             make(map[string]*float64),
+		weightedOutcomes:            make(map[string]*outcomeWindow),
+		raceCount:                   defaultRaceCount,
 	}
-	if strategy == StrategyWeighted {
+	if usesLatency(strategy) {
 		for _, u := range upstreams {
 			init := 50.0
 			m.weightedLatency[u.Address] = &init
+			m.weightedOutcomes[u.Address] = &outcomeWindow{}
 		}
 	}
 	return m
@@ -95,7 +124,9 @@ func (m *upstreamManager) Order(upstreams []Upstream) []int {
 		}
 		return order
 	case StrategyWeighted:
-		return m.weightedOrder(upstreams)
+		return m.weightedOrder(upstreams, true)
+	case StrategyRace:
+		return m.weightedOrder(upstreams, false)
 	default:
 		order := make([]int, len(upstreams))
 		for i := range order {
@@ -105,35 +136,60 @@ func (m *upstreamManager) Order(upstreams []Upstream) []int {
 	}
 }
 
-func (m *upstreamManager) weightedOrder(upstreams []Upstream) []int {
+// weightedOrder orders upstreams by score (see weightedScore), best first. With pick, the first
+// upstream is chosen by power-of-two-choices (see pickTwoChoices) rather than always the best.
+func (m *upstreamManager) weightedOrder(upstreams []Upstream, pick bool) []int {
+	timeoutMS := m.GetTimeout().Seconds() * 1000
+	order := make([]int, len(upstreams))
+	scores := make([]float64, len(upstreams))
 	m.weightedLatencyMu.RLock()
-	defer m.weightedLatencyMu.RUnlock()
+	for i, u := range upstreams {
+		order[i] = i
+		scores[i] = m.scoreLocked(u.Address, timeoutMS).Score
+	}
+	m.weightedLatencyMu.RUnlock()
+	sortByScore(order, scores)
+	if pick {
+		pickTwoChoices(order, scores)
+	}
+	return order
+}
 
-	type scored struct {
-		idx   int
-		score float64
+// scoreLocked returns the score of addr. The caller holds weightedLatencyMu.
+func (m *upstreamManager) scoreLocked(addr string, timeoutMS float64) UpstreamScore {
+	latency := weightedMinLatencyMS
+	if lat := m.weightedLatency[addr]; lat != nil && *lat > latency {
+		latency = *lat
 	}
-	scores := make([]scored, len(upstreams))
-	for i, u := range upstreams {
-		lat := m.weightedLatency[u.Address]
-		score := weightedMinLatencyMS
-		if lat != nil && *lat > 0 {
-			score = *lat
-		}
-		scores[i] = scored{idx: i, score: score}
+	errorRate, timeoutRate := m.weightedOutcomes[addr].rates()
+	return UpstreamScore{
+		LatencyMs:   latency,
+		ErrorRate:   errorRate,
+		TimeoutRate: timeoutRate,
+		Score:       weightedScore(latency, errorRate, timeoutRate, timeoutMS),
 	}
-	for i := 0; i < len(scores)-1; i++ {
-		for j := i + 1; j < len(scores); j++ {
-			if scores[j].score < scores[i].score {
-				scores[i], scores[j] = scores[j], scores[i]
-			}
-		}
+}
+
+// RecordOutcome adds the outcome of an exchange with addr to its sliding window.
+func (m *upstreamManager) RecordOutcome(addr string, outcome exchangeOutcome) {
+	m.weightedLatencyMu.Lock()
+	defer m.weightedLatencyMu.Unlock()
+	if w := m.weightedOutcomes[addr]; w != nil {
+		w.add(outcome)
 	}
-	order := make([]int, len(upstreams))
-	for i, s := range scores {
-		order[i] = s.idx
+}
+
+// WeightedScores returns the scores of the current upstreams, by address.
+func (m *upstreamManager) WeightedScores() map[string]UpstreamScore {
+	upstreams, _ := m.Upstreams()
+	timeoutMS := m.GetTimeout().Seconds() * 1000
+	m.weightedLatencyMu.RLock()
+	defer m.weightedLatencyMu.RUnlock()
+	out := make(map[string]UpstreamScore, len(upstreams))
+	for _, u := range upstreams {
+		out[u.Address] = m.scoreLocked(u.Address, timeoutMS)
 	}
-	return order
+	return out
 }
 
 // UpdateWeightedLatency records a new response time for the given upstream address.
@@ -203,11 +259,13 @@ func (m *upstreamManager) ApplyConfig(upstreams []Upstream, strategy string, tim
 		}
 	}
 	m.backoffMu.Unlock()
+	m.pruneHealth(upstreams)
 
 	// Update weighted latency map for new upstreams
-	if strategy == StrategyWeighted {
+	if usesLatency(strategy) {
 		m.weightedLatencyMu.Lock()
 		newMap := make(map[string]*float64)
+		newOutcomes := make(map[string]*outcomeWindow)
 		for _, u := range upstreams {
 			if ptr, ok := m.weightedLatency[u.Address]; ok {
 				newMap[u.Address] = ptr
@@ -215,8 +273,14 @@ func (m *upstreamManager) ApplyConfig(upstreams []Upstream, strategy string, tim
 				init := 50.0
 				newMap[u.Address] = &init
 			}
+			if w, ok := m.weightedOutcomes[u.Address]; ok {
+				newOutcomes[u.Address] = w
+			} else {
+				newOutcomes[u.Address] = &outcomeWindow{}
+			}
 		}
 		m.weightedLatency = newMap
+		m.weightedOutcomes = newOutcomes
 		m.weightedLatencyMu.Unlock()
 	}
 }
@@ -234,3 +298,71 @@ func (m *upstreamManager) Strategy() string {
 	defer m.mu.RUnlock()
 	return m.strategy
 }
+
+// usesLatency reports whether strategy orders upstreams by their latency EWMA.
+func usesLatency(strategy string) bool {
+	return strategy == StrategyWeighted || strategy == StrategyRace
+}
+
+// SetRaceConfig sets how many upstreams the race strategy queries and the delay before each
+// hedged query (0 = all at once). A count below 1 uses the default.
+func (m *upstreamManager) SetRaceConfig(count int, hedgeDelay time.Duration) {
+	if count < 1 {
+		count = defaultRaceCount
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.raceCount = count
+	m.raceHedgeDelay = hedgeDelay
+}
+
+// RaceConfig returns the race strategy settings.
+func (m *upstreamManager) RaceConfig() (count int, hedgeDelay time.Duration) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.raceCount, m.raceHedgeDelay
+}
+
+func (m *upstreamManager) raceCountersFor(addr string) *raceCounters {
+	m.raceStatsMu.Lock()
+	defer m.raceStatsMu.Unlock()
+	if m.raceStats == nil {
+		m.raceStats = make(map[string]*raceCounters)
+	}
+	c := m.raceStats[addr]
+	if c == nil {
+		c = &raceCounters{}
+		m.raceStats[addr] = c
+	}
+	return c
+}
+
+// RecordHedge counts a query sent to addr after the hedge delay.
+func (m *upstreamManager) RecordHedge(addr string) {
+	m.raceCountersFor(addr).hedges.Add(1)
+}
+
+// RecordRaceWin counts a race won by addr; hedged reports whether the winning query was a hedge.
+func (m *upstreamManager) RecordRaceWin(addr string, hedged bool) {
+	c := m.raceCountersFor(addr)
+	c.wins.Add(1)
+	if hedged {
+		c.hedgeWins.Add(1)
+	}
+}
+
+// RaceStats returns the race counters of the current upstreams.
+func (m *upstreamManager) RaceStats() map[string]UpstreamRaceStats {
+	upstreams, _ := m.Upstreams()
+	m.raceStatsMu.Lock()
+	defer m.raceStatsMu.Unlock()
+	out := make(map[string]UpstreamRaceStats, len(upstreams))
+	for _, u := range upstreams {
+		var stats UpstreamRaceStats
+		if c := m.raceStats[u.Address]; c != nil {
+			stats = UpstreamRaceStats{Wins: c.wins.Load(), Hedges: c.hedges.Load(), HedgeWins: c.hedgeWins.Load()}
+		}
+		out[u.Address] = stats
+	}
+	return out
+}
@@ -128,10 +128,18 @@ func TestUpstreamManager_Order_Weighted_PrefersLowerLatency(t *testing.T) {
 		m.UpdateWeightedLatency("fast", 10*time.Millisecond)
 	}
 
-	order := m.Order(ups)
-	// "fast" (index 1) should come first
-	if order[0] != 1 {
-		t.Errorf("expected fast upstream (index 1) first, got order %v", order)
+	// "fast" (index 1) should come first most of the time, but not always: the slow one
+	// still gets some queries to keep its latency current.
+	first := make(map[int]int)
+	for i := 0; i < 200; i++ {
+		order := m.Order(ups)
+		if len(order) != 2 {
+			t.Fatalf("expected 2-element order, got %v", order)
+		}
+		first[order[0]]++
+	}
+	if first[1] < 150 || first[0] == 0 {
+		t.Errorf("expected fast upstream first in most orders and slow in some, got %v", first)
 	}
 }
 
@@ -0,0 +1,114 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// raceResult is the outcome of one upstream exchange in a race.
+type raceResult struct {
+	response *dns.Msg
+	upstream Upstream
+	hedged   bool
+	err      error
+}
+
+// exchangeRace implements the race strategy. The fastest upstreams by latency EWMA (order)
+// are queried in parallel, up to the race count: all at once, or one more after each hedge
+// delay. The first answer other than SERVFAIL wins and the other exchanges are cancelled.
+// An upstream that fails is replaced by the next one straight away, so every upstream not in
+// backoff or marked down is tried before giving up, as with failover. A SERVFAIL answer is
+// returned only when no exchange still in flight does better.
+func (r *Resolver) exchangeRace(ctx context.Context, req *dns.Msg, mgr *upstreamManager, upstreams []Upstream, order []int, qname, qtypeStr string) (*dns.Msg, string, error) {
+	candidates := make([]Upstream, 0, len(order))
+	for attempt, idx := range order {
+		upstream := upstreams[idx]
+		if r.skipUpstream(mgr, upstream, attempt+1, qname, qtypeStr) {
+			continue
+		}
+		candidates = append(candidates, upstream)
+	}
+	if len(candidates) == 0 {
+		return nil, "", errors.New("no upstreams reached")
+	}
+	count, hedgeDelay := mgr.RaceConfig()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, len(candidates))
+	launched := 0
+	launch := func(hedged bool) {
+		upstream := candidates[launched]
+		launched++
+		if hedged {
+			mgr.RecordHedge(upstream.Address)
+		}
+		// Each exchange gets its own copy: upstream clients set the message ID.
+		msg := req.Copy()
+		attempt := launched
+		go func() {
+			response, err := r.exchangeAttempt(ctx, mgr, msg, upstream, attempt, qname, qtypeStr)
+			results <- raceResult{response: response, upstream: upstream, hedged: hedged, err: err}
+		}()
+	}
+
+	launch(false)
+	for hedgeDelay <= 0 && launched < count && launched < len(candidates) {
+		launch(false)
+	}
+	var hedge *time.Timer
+	var hedgeC <-chan time.Time
+	if launched < count && launched < len(candidates) {
+		hedge = time.NewTimer(hedgeDelay)
+		defer func() { hedge.Stop() }()
+		hedgeC = hedge.C
+	}
+
+	var servfail *raceResult
+	var lastErr error
+	for done := 0; done < launched; {
+		select {
+		case <-hedgeC:
+			hedgeC = nil
+			if launched >= len(candidates) {
+				// Failed upstreams were replaced before the hedge fired.
+				continue
+			}
+			launch(true)
+			if launched < count && launched < len(candidates) {
+				hedge.Reset(hedgeDelay)
+				hedgeC = hedge.C
+			}
+		case res := <-results:
+			done++
+			switch {
+			case res.err != nil:
+				lastErr = res.err
+			case res.response == nil:
+			case res.response.Rcode == dns.RcodeServerFailure:
+				if servfail == nil {
+					servfail = &res
+				}
+			default:
+				mgr.RecordRaceWin(res.upstream.Address, res.hedged)
+				return res.response, res.upstream.Address, nil
+			}
+			if res.err != nil && launched < len(candidates) {
+				launch(false)
+				if launched >= len(candidates) {
+					hedgeC = nil
+				}
+			}
+		}
+	}
+	if servfail != nil {
+		return servfail.response, servfail.upstream.Address, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstreams reached")
+	}
+	return nil, "", lastErr
+}
@@ -0,0 +1,216 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// raceUpstream answers A queries with addr after delay, or with SERVFAIL when addr is nil,
+// and counts the queries it received.
+func raceUpstream(t *testing.T, delay time.Duration, addr net.IP, queries *atomic.Int32) string {
+	t.Helper()
+	return newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(delay)
+		resp := new(dns.Msg)
+		if addr == nil {
+			resp.SetRcode(req, dns.RcodeServerFailure)
+		} else {
+			resp.SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: addr}}
+		}
+		_ = w.WriteMsg(resp)
+	}))
+}
+
+func raceResolver(t *testing.T, hedgeDelay time.Duration, upstreams ...string) *Resolver {
+	t.Helper()
+	cfg := minimalResolverConfig("")
+	cfg.ResolverStrategy = StrategyRace
+	cfg.Upstreams = nil
+	for i, addr := range upstreams {
+		cfg.Upstreams = append(cfg.Upstreams, config.UpstreamConfig{Name: string(rune('a' + i)), Address: addr, Protocol: "udp"})
+	}
+	cfg.Network = config.NetworkConfig{
+		UpstreamTimeout:    config.Duration{Duration: 2 * time.Second},
+		UpstreamBackoff:    &config.Duration{Duration: time.Minute},
+		UpstreamRaceCount:  2,
+		UpstreamHedgeDelay: config.Duration{Duration: hedgeDelay},
+	}
+	return buildTestResolver(t, cfg, nil, nil, nil)
+}
+
+func raceQuery(t *testing.T, r *Resolver) (*dns.Msg, string, time.Duration) {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion("race.example.", dns.TypeA)
+	start := time.Now()
+	resp, upstream, err := r.exchange(context.Background(), req)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	return resp, upstream, time.Since(start)
+}
+
+func TestExchangeRaceFastestWins(t *testing.T) {
+	var slowQueries, fastQueries atomic.Int32
+	slow := raceUpstream(t, 300*time.Millisecond, net.IPv4(192, 0, 2, 1), &slowQueries)
+	fast := raceUpstream(t, 0, net.IPv4(192, 0, 2, 2), &fastQueries)
+	r := raceResolver(t, 0, slow, fast)
+
+	resp, upstream, elapsed := raceQuery(t, r)
+	if upstream != fast || resp.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("expected the fast upstream to win, got %s %v", upstream, resp)
+	}
+	if elapsed >= 300*time.Millisecond {
+		t.Errorf("race waited for the slow upstream: %v", elapsed)
+	}
+	// The slow upstream may not have been sent its query before the race was won.
+	if slowQueries.Load() > 1 || fastQueries.Load() != 1 {
+		t.Errorf("expected each upstream queried at most once, got slow=%d fast=%d", slowQueries.Load(), fastQueries.Load())
+	}
+	// The cancelled exchange is not an upstream failure.
+	if r.upstreamMgr.IsInBackoff(slow) {
+		t.Error("losing upstream was put in backoff")
+	}
+	stats := r.UpstreamRaceStats()
+	if stats[fast].Wins != 1 || stats[slow].Wins != 0 || stats[fast].Hedges != 0 {
+		t.Errorf("unexpected race stats %+v", stats)
+	}
+}
+
+func TestExchangeRaceHedge(t *testing.T) {
+	var slowQueries, fastQueries atomic.Int32
+	slow := raceUpstream(t, 300*time.Millisecond, net.IPv4(192, 0, 2, 1), &slowQueries)
+	fast := raceUpstream(t, 0, net.IPv4(192, 0, 2, 2), &fastQueries)
+	r := raceResolver(t, 50*time.Millisecond, slow, fast)
+
+	// Both start at the same EWMA, so the first configured upstream goes first.
+	_, upstream, elapsed := raceQuery(t, r)
+	if upstream != fast {
+		t.Fatalf("expected the hedged query to win, got %s", upstream)
+	}
+	if elapsed < 50*time.Millisecond || elapsed >= 300*time.Millisecond {
+		t.Errorf("expected an answer after the hedge delay, took %v", elapsed)
+	}
+	stats := r.UpstreamRaceStats()
+	if stats[fast].Hedges != 1 || stats[fast].HedgeWins != 1 || stats[fast].Wins != 1 {
+		t.Errorf("unexpected race stats %+v", stats)
+	}
+
+	// The winner is now ahead by EWMA, answers within the hedge delay, and the slow
+	// upstream is not queried at all.
+	_, upstream, _ = raceQuery(t, r)
+	if upstream != fast || slowQueries.Load() != 1 {
+		t.Errorf("expected only the fast upstream to be queried, got %s (slow queries %d)", upstream, slowQueries.Load())
+	}
+}
+
+func TestExchangeRaceSkipsServfail(t *testing.T) {
+	var failQueries, okQueries atomic.Int32
+	failing := raceUpstream(t, 0, nil, &failQueries)
+	ok := raceUpstream(t, 50*time.Millisecond, net.IPv4(192, 0, 2, 3), &okQueries)
+	r := raceResolver(t, 0, failing, ok)
+
+	resp, upstream, _ := raceQuery(t, r)
+	if upstream != ok || resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the non-SERVFAIL answer, got %s rcode %d", upstream, resp.Rcode)
+	}
+
+	// With every upstream failing, the SERVFAIL is returned.
+	r = raceResolver(t, 0, failing, failing)
+	if resp, _, _ := raceQuery(t, r); resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got rcode %d", resp.Rcode)
+	}
+}
+
+func TestExchangeRaceBackoff(t *testing.T) {
+	var aQueries, bQueries atomic.Int32
+	a := raceUpstream(t, 0, net.IPv4(192, 0, 2, 1), &aQueries)
+	b := raceUpstream(t, 0, net.IPv4(192, 0, 2, 2), &bQueries)
+	r := raceResolver(t, 0, a, b)
+	r.upstreamMgr.RecordBackoff(a)
+
+	if _, upstream, _ := raceQuery(t, r); upstream != b {
+		t.Fatalf("expected %s, got %s", b, upstream)
+	}
+	if aQueries.Load() != 0 {
+		t.Errorf("upstream in backoff was queried %d times", aQueries.Load())
+	}
+}
+
+func TestExchangeRaceFailureStartsNext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	var queries atomic.Int32
+	ok := raceUpstream(t, 0, net.IPv4(192, 0, 2, 4), &queries)
+
+	cfg := minimalResolverConfig("")
+	cfg.ResolverStrategy = StrategyRace
+	cfg.Upstreams = []config.UpstreamConfig{
+		{Name: "down", Address: closed, Protocol: "tcp"},
+		{Name: "ok", Address: ok, Protocol: "udp"},
+	}
+	cfg.Network = config.NetworkConfig{
+		UpstreamTimeout:    config.Duration{Duration: 2 * time.Second},
+		UpstreamBackoff:    &config.Duration{Duration: time.Minute},
+		UpstreamRaceCount:  1,
+		UpstreamHedgeDelay: config.Duration{Duration: time.Second},
+	}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+
+	_, upstream, elapsed := raceQuery(t, r)
+	if upstream != ok {
+		t.Fatalf("expected %s, got %s", ok, upstream)
+	}
+	if elapsed >= time.Second {
+		t.Errorf("failure waited for the hedge delay: %v", elapsed)
+	}
+	if !r.upstreamMgr.IsInBackoff(closed) {
+		t.Error("failed upstream not put in backoff")
+	}
+}
+
+func TestExchangeRaceHedgeAfterAllLaunched(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	var queries atomic.Int32
+	slow := raceUpstream(t, 200*time.Millisecond, net.IPv4(192, 0, 2, 5), &queries)
+
+	cfg := minimalResolverConfig("")
+	cfg.ResolverStrategy = StrategyRace
+	cfg.Upstreams = []config.UpstreamConfig{
+		{Name: "down", Address: closed, Protocol: "tcp"},
+		{Name: "slow", Address: slow, Protocol: "udp"},
+	}
+	cfg.Network = config.NetworkConfig{
+		UpstreamTimeout:    config.Duration{Duration: 2 * time.Second},
+		UpstreamBackoff:    &config.Duration{Duration: time.Minute},
+		UpstreamRaceCount:  2,
+		UpstreamHedgeDelay: config.Duration{Duration: 50 * time.Millisecond},
+	}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+
+	// The failed upstream is replaced by the slow one before the hedge fires, leaving no
+	// candidate for the hedge to start.
+	if _, upstream, _ := raceQuery(t, r); upstream != slow {
+		t.Fatalf("expected %s, got %s", slow, upstream)
+	}
+	if queries.Load() != 1 {
+		t.Errorf("slow upstream queried %d times, want 1", queries.Load())
+	}
+}
@@ -0,0 +1,155 @@
+package dnsresolver
+
+import (
+	"strings"
+
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// UpstreamRoute is a conditional forwarding route as exposed to the API/UI.
+type UpstreamRoute struct {
+	Suffixes  []string
+	Upstreams []Upstream
+	Strategy  string
+	Race      map[string]UpstreamRaceStats // by upstream address; race strategy only
+	Weighted  map[string]UpstreamScore     // by upstream address; weighted strategy only
+	Health    map[string]UpstreamHealth    // by upstream address; nil when health checks are disabled
+}
+
+// upstreamRoute sends queries at or below its suffixes to its own upstreams. Each route
+// has its own upstreamManager, so strategy state and backoff are tracked per route.
+type upstreamRoute struct {
+	suffixes []string
+	mgr      *upstreamManager
+}
+
+// upstreamRouteTable maps domain suffixes to routes. It is immutable once built and is
+// replaced as a whole on hot-reload; the routes' upstream managers carry over.
+type upstreamRouteTable struct {
+	routes   []*upstreamRoute
+	bySuffix map[string]*upstreamRoute
+}
+
+// newUpstreamRouteTable builds the route table from config, or returns nil when no routes
+// are configured. Routes share the global timeout, backoff and connection pool settings.
+// A route that keeps a suffix of a route in prev (the table being replaced on hot-reload)
+// takes over its upstream manager, so backoff, health and strategy scores survive the reload.
+func newUpstreamRouteTable(routes []config.UpstreamRouteConfig, netCfg networkConfig, prev *upstreamRouteTable) *upstreamRouteTable {
+	if len(routes) == 0 {
+		return nil
+	}
+	t := &upstreamRouteTable{bySuffix: make(map[string]*upstreamRoute)}
+	reused := make(map[*upstreamManager]bool)
+	for _, rc := range routes {
+		upstreams := parseUpstreams(rc.Upstreams)
+		if len(upstreams) == 0 {
+			continue
+		}
+		route := &upstreamRoute{}
+		for _, suffix := range rc.Suffixes {
+			suffix = normalizeQueryName(strings.TrimPrefix(strings.TrimSpace(suffix), "."))
+			if suffix == "" {
+				continue
+			}
+			if _, exists := t.bySuffix[suffix]; exists {
+				continue
+			}
+			t.bySuffix[suffix] = route
+			route.suffixes = append(route.suffixes, suffix)
+			if old := prev.bySuffixRoute(suffix); route.mgr == nil && old != nil && !reused[old.mgr] {
+				route.mgr = old.mgr
+				reused[old.mgr] = true
+			}
+		}
+		strategy := normalizeStrategy(rc.Strategy)
+		if route.mgr != nil {
+			route.mgr.ApplyConfig(upstreams, strategy, netCfg.timeout, netCfg.backoff, netCfg.connPoolIdle, netCfg.connPoolValidate)
+		} else {
+			route.mgr = newUpstreamManager(upstreams, strategy, netCfg.timeout, netCfg.backoff, netCfg.connPoolIdle, netCfg.connPoolValidate)
+		}
+		route.mgr.SetRaceConfig(netCfg.raceCount, netCfg.raceHedgeDelay)
+		if len(route.suffixes) > 0 {
+			t.routes = append(t.routes, route)
+		}
+	}
+	if len(t.routes) == 0 {
+		return nil
+	}
+	return t
+}
+
+// bySuffixRoute returns the route configured for exactly suffix, or nil.
+func (t *upstreamRouteTable) bySuffixRoute(suffix string) *upstreamRoute {
+	if t == nil {
+		return nil
+	}
+	return t.bySuffix[suffix]
+}
+
+// match returns the route with the longest suffix that qname (normalized, see
+// normalizeQueryName) is equal to or below, or nil when no route applies.
+func (t *upstreamRouteTable) match(qname string) *upstreamRoute {
+	if t == nil {
+		return nil
+	}
+	name := qname
+	for name != "" {
+		if route, ok := t.bySuffix[name]; ok {
+			return route
+		}
+		idx := strings.IndexByte(name, '.')
+		if idx < 0 {
+			break
+		}
+		name = name[idx+1:]
+	}
+	return nil
+}
+
+// upstreamManagerFor returns the upstream manager for qname: the longest matching route's,
+// the local router's for private reverse names, or the global one.
+func (r *Resolver) upstreamManagerFor(qname string) *upstreamManager {
+	if route := r.upstreamRoutes.Load().match(qname); route != nil {
+		return route.mgr
+	}
+	if p := r.privateReverse.Load(); p != nil && p.mgr != nil {
+		if _, _, ok := parsePrivateReverse(qname); ok {
+			return p.mgr
+		}
+	}
+	return r.upstreamMgr
+}
+
+// UpstreamRoutes returns the current conditional forwarding routes for API/UI display.
+func (r *Resolver) UpstreamRoutes() []UpstreamRoute {
+	t := r.upstreamRoutes.Load()
+	if t == nil {
+		return nil
+	}
+	healthEnabled := r.healthCheck.Load() != nil
+	out := make([]UpstreamRoute, 0, len(t.routes))
+	for _, route := range t.routes {
+		upstreams, strategy := route.mgr.Upstreams()
+		var race map[string]UpstreamRaceStats
+		if strategy == StrategyRace {
+			race = route.mgr.RaceStats()
+		}
+		var weighted map[string]UpstreamScore
+		if strategy == StrategyWeighted {
+			weighted = route.mgr.WeightedScores()
+		}
+		var health map[string]UpstreamHealth
+		if healthEnabled {
+			health = route.mgr.HealthStats()
+		}
+		out = append(out, UpstreamRoute{
+			Suffixes:  append([]string(nil), route.suffixes...),
+			Upstreams: upstreams,
+			Strategy:  strategy,
+			Race:      race,
+			Weighted:  weighted,
+			Health:    health,
+		})
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/blocklist"
+	"github.com/tternquist/beyond-ads-dns/internal/cache"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+	"github.com/tternquist/beyond-ads-dns/internal/logging"
+)
+
+func TestUpstreamRouteTable_Match(t *testing.T) {
+	table := newUpstreamRouteTable([]config.UpstreamRouteConfig{
+		{Suffixes: []string{"example.com"}, Upstreams: []config.UpstreamConfig{{Address: "10.0.0.1:53"}}},
+		{Suffixes: []string{"corp.example.com", ".Home.Arpa."}, Upstreams: []config.UpstreamConfig{{Address: "10.0.0.2:53"}}},
+		{Suffixes: []string{"10.in-addr.arpa"}, Upstreams: []config.UpstreamConfig{{Address: "10.0.0.3:53"}}, Strategy: "load_balance"},
+	}, networkConfig{}, nil)
+
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"example.com", "10.0.0.1:53"},
+		{"www.example.com", "10.0.0.1:53"},
+		{"corp.example.com", "10.0.0.2:53"},
+		{"host.corp.example.com", "10.0.0.2:53"},
+		{"printer.home.arpa", "10.0.0.2:53"},
+		{"4.3.2.10.in-addr.arpa", "10.0.0.3:53"},
+		{"notexample.com", ""},
+		{"example.org", ""},
+		{"com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		route := table.match(tt.qname)
+		got := ""
+		if route != nil {
+			upstreams, _ := route.mgr.Upstreams()
+			got = upstreams[0].Address
+		}
+		if got != tt.want {
+			t.Errorf("match(%q) = %q, want %q", tt.qname, got, tt.want)
+		}
+	}
+
+	if _, strategy := table.match("1.10.in-addr.arpa").mgr.Upstreams(); strategy != StrategyLoadBalance {
+		t.Errorf("route strategy = %q, want %q", strategy, StrategyLoadBalance)
+	}
+	if newUpstreamRouteTable(nil, networkConfig{}, nil) != nil {
+		t.Error("expected nil table when no routes are configured")
+	}
+	var nilTable *upstreamRouteTable
+	if nilTable.match("example.com") != nil {
+		t.Error("nil table should match nothing")
+	}
+}
+
+func TestResolverUpstreamRoutes(t *testing.T) {
+	answerFrom := func(ip string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(r)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP(ip),
+			})
+			_ = w.WriteMsg(resp)
+		}
+	}
+	publicAddr := newDNSServerUDP(t, answerFrom("192.0.2.1"))
+	corpAddr := newDNSServerUDP(t, answerFrom("10.0.0.1"))
+	labAddr := newDNSServerUDP(t, answerFrom("10.0.0.2"))
+
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "public", Address: publicAddr, Protocol: "udp"}}
+	cfg.UpstreamRoutes = []config.UpstreamRouteConfig{
+		{Suffixes: []string{"corp.example.com"}, Upstreams: []config.UpstreamConfig{{Name: "corp", Address: corpAddr, Protocol: "udp"}}},
+		{Suffixes: []string{"lab.corp.example.com"}, Upstreams: []config.UpstreamConfig{{Name: "lab", Address: labAddr, Protocol: "udp"}}},
+	}
+	blMgr := blocklist.NewManager(cfg.Blocklists, logging.NewDiscardLogger())
+	blMgr.LoadOnce(nil)
+	resolver := buildTestResolver(t, cfg, cache.NewMockCache(), blMgr, nil)
+
+	resolve := func(name string) (string, string) {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		resp, upstream, err := resolver.exchange(context.Background(), req)
+		if err != nil {
+			t.Fatalf("exchange %s: %v", name, err)
+		}
+		return resp.Answer[0].(*dns.A).A.String(), upstream
+	}
+
+	for _, tt := range []struct {
+		name, wantIP, wantUpstream string
+	}{
+		{"www.example.org.", "192.0.2.1", publicAddr},
+		{"intranet.corp.example.com.", "10.0.0.1", corpAddr},
+		{"host.lab.corp.example.com.", "10.0.0.2", labAddr},
+		{"Host.LAB.Corp.Example.com.", "10.0.0.2", labAddr},
+	} {
+		ip, upstream := resolve(tt.name)
+		if ip != tt.wantIP || upstream != tt.wantUpstream {
+			t.Errorf("%s: got %s from %s, want %s from %s", tt.name, ip, upstream, tt.wantIP, tt.wantUpstream)
+		}
+	}
+
+	routes := resolver.UpstreamRoutes()
+	if len(routes) != 2 || routes[0].Suffixes[0] != "corp.example.com" || routes[0].Upstreams[0].Address != corpAddr || routes[0].Strategy != StrategyFailover {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+
+	// Hot-reload: dropping the lab route sends its names to the enclosing corp route.
+	cfg.UpstreamRoutes = cfg.UpstreamRoutes[:1]
+	resolver.ApplyUpstreamConfig(cfg)
+	if ip, upstream := resolve("host.lab.corp.example.com."); ip != "10.0.0.1" || upstream != corpAddr {
+		t.Errorf("after reload: got %s from %s, want 10.0.0.1 from %s", ip, upstream, corpAddr)
+	}
+	cfg.UpstreamRoutes = nil
+	resolver.ApplyUpstreamConfig(cfg)
+	if ip, _ := resolve("intranet.corp.example.com."); ip != "192.0.2.1" {
+		t.Errorf("after removing routes: got %s, want 192.0.2.1", ip)
+	}
+	if routes := resolver.UpstreamRoutes(); routes != nil {
+		t.Errorf("expected no routes after reload, got %+v", routes)
+	}
+}
+
+func TestUpstreamRoutesReloadKeepsState(t *testing.T) {
+	cfg := minimalResolverConfig("")
+	cfg.UpstreamRoutes = []config.UpstreamRouteConfig{
+		{Suffixes: []string{"corp.example.com"}, Upstreams: []config.UpstreamConfig{{Name: "a", Address: "10.0.0.1:53", Protocol: "udp"}, {Name: "b", Address: "10.0.0.2:53", Protocol: "udp"}}},
+	}
+	cfg.PrivateReverse = config.PrivateReverseConfig{Enabled: ptr(true), Upstreams: []config.UpstreamConfig{{Name: "router", Address: "192.168.1.1:53", Protocol: "udp"}}}
+	cfg.Network.UpstreamBackoff = &config.Duration{Duration: time.Minute}
+	resolver := buildTestResolver(t, cfg, nil, nil, nil)
+
+	routeMgr := resolver.upstreamManagerFor("corp.example.com")
+	reverseMgr := resolver.upstreamManagerFor("1.1.168.192.in-addr.arpa")
+	routeMgr.RecordBackoff("10.0.0.1:53")
+	reverseMgr.RecordBackoff("192.168.1.1:53")
+
+	// An unchanged reload keeps the managers and their backoff.
+	resolver.ApplyUpstreamConfig(cfg)
+	if resolver.upstreamManagerFor("corp.example.com") != routeMgr || !routeMgr.IsInBackoff("10.0.0.1:53") {
+		t.Error("route upstream state lost on reload")
+	}
+	if resolver.upstreamManagerFor("1.1.168.192.in-addr.arpa") != reverseMgr || !reverseMgr.IsInBackoff("192.168.1.1:53") {
+		t.Error("private reverse upstream state lost on reload")
+	}
+
+	// A changed route keeps the state of the upstreams it still has.
+	cfg.UpstreamRoutes[0].Suffixes = append(cfg.UpstreamRoutes[0].Suffixes, "home.arpa")
+	cfg.UpstreamRoutes[0].Upstreams = cfg.UpstreamRoutes[0].Upstreams[:1]
+	cfg.UpstreamRoutes[0].Strategy = "load_balance"
+	resolver.ApplyUpstreamConfig(cfg)
+	mgr := resolver.upstreamManagerFor("printer.home.arpa")
+	if mgr != routeMgr || !mgr.IsInBackoff("10.0.0.1:53") {
+		t.Error("route upstream state lost when the route changed")
+	}
+	if upstreams, strategy := mgr.Upstreams(); len(upstreams) != 1 || strategy != StrategyLoadBalance {
+		t.Errorf("route not updated: %d upstreams, strategy %q", len(upstreams), strategy)
+	}
+}
@@ -0,0 +1,144 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// weightedWindowSize is the number of recent exchanges per upstream used for error and timeout rates.
+	weightedWindowSize = 100
+	// weightedErrorPenaltyMS is added to the score per unit of error rate: an upstream answering
+	// SERVFAIL (or failing without a timeout) 10% of the time scores 50ms worse.
+	weightedErrorPenaltyMS = 500.0
+)
+
+// exchangeOutcome classifies one upstream exchange for scoring.
+type exchangeOutcome uint8
+
+const (
+	outcomeOK exchangeOutcome = iota
+	outcomeError
+	outcomeTimeout
+)
+
+// exchangeOutcomeOf classifies the result of an exchange: SERVFAIL and errors other than
+// timeouts are errors.
+func exchangeOutcomeOf(rcode int, err error) exchangeOutcome {
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return outcomeTimeout
+		}
+		return outcomeError
+	}
+	if rcode == dns.RcodeServerFailure {
+		return outcomeError
+	}
+	return outcomeOK
+}
+
+// outcomeWindow counts the outcomes of the last weightedWindowSize exchanges with an upstream.
+type outcomeWindow struct {
+	outcomes [weightedWindowSize]exchangeOutcome
+	n        int
+	next     int
+	errors   int
+	timeouts int
+}
+
+func (w *outcomeWindow) add(o exchangeOutcome) {
+	if w.n == len(w.outcomes) {
+		w.count(w.outcomes[w.next], -1)
+	} else {
+		w.n++
+	}
+	w.outcomes[w.next] = o
+	w.count(o, 1)
+	w.next = (w.next + 1) % len(w.outcomes)
+}
+
+func (w *outcomeWindow) count(o exchangeOutcome, delta int) {
+	switch o {
+	case outcomeError:
+		w.errors += delta
+	case outcomeTimeout:
+		w.timeouts += delta
+	}
+}
+
+// rates returns the share of errors and timeouts in the window (0 when empty).
+func (w *outcomeWindow) rates() (errorRate, timeoutRate float64) {
+	if w == nil || w.n == 0 {
+		return 0, 0
+	}
+	return float64(w.errors) / float64(w.n), float64(w.timeouts) / float64(w.n)
+}
+
+// UpstreamScore is the weighted strategy's view of one upstream, for the API/UI.
+type UpstreamScore struct {
+	LatencyMs   float64 `json:"latency_ms"`   // EWMA of successful exchanges
+	ErrorRate   float64 `json:"error_rate"`   // SERVFAIL and failures over the recent exchanges (0-1)
+	TimeoutRate float64 `json:"timeout_rate"` // timeouts over the recent exchanges (0-1)
+	Score       float64 `json:"score"`        // expected cost in ms; lower is better
+}
+
+// weightedScore estimates the cost of a query to an upstream in milliseconds: its latency, plus
+// the timeout it costs whenever it times out, plus a penalty for SERVFAIL and other errors.
+func weightedScore(latencyMS, errorRate, timeoutRate, timeoutMS float64) float64 {
+	return latencyMS + errorRate*weightedErrorPenaltyMS + timeoutRate*timeoutMS
+}
+
+// pickTwoChoices reorders order, sorted best first by scores (indexed like order), so that a
+// power-of-two-choices pick comes first: two upstreams are drawn at random and one is chosen
+// with probability inversely proportional to the square of its score. The better upstream
+// gets most of the traffic but no upstream is pinned, so every score keeps being refreshed.
+// The rest keep their order for failover.
+func pickTwoChoices(order []int, scores []float64) {
+	n := len(order)
+	if n < 2 {
+		return
+	}
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	wi, wj := 1/(scores[i]*scores[i]), 1/(scores[j]*scores[j])
+	first := i
+	if rand.Float64()*(wi+wj) >= wi {
+		first = j
+	}
+	idx := order[first]
+	copy(order[1:first+1], order[:first])
+	order[0] = idx
+}
+
+// sortByScore sorts order and scores together, best first; ties keep the configured order.
+func sortByScore(order []int, scores []float64) {
+	type scored struct {
+		idx   int
+		score float64
+	}
+	s := make([]scored, len(order))
+	for i := range order {
+		s[i] = scored{order[i], scores[i]}
+	}
+	slices.SortStableFunc(s, func(a, b scored) int {
+		switch {
+		case a.score < b.score:
+			return -1
+		case a.score > b.score:
+			return 1
+		}
+		return 0
+	})
+	for i := range s {
+		order[i], scores[i] = s[i].idx, s[i].score
+	}
+}
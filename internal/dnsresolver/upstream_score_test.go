@@ -0,0 +1,147 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestExchangeOutcomeOf(t *testing.T) {
+	tests := []struct {
+		rcode int
+		err   error
+		want  exchangeOutcome
+	}{
+		{dns.RcodeSuccess, nil, outcomeOK},
+		{dns.RcodeNameError, nil, outcomeOK},
+		{dns.RcodeServerFailure, nil, outcomeError},
+		{0, errors.New("connection refused"), outcomeError},
+		{0, fmt.Errorf("exchange: %w", context.DeadlineExceeded), outcomeTimeout},
+		{0, timeoutError{}, outcomeTimeout},
+	}
+	for _, tt := range tests {
+		if got := exchangeOutcomeOf(tt.rcode, tt.err); got != tt.want {
+			t.Errorf("exchangeOutcomeOf(%d, %v) = %d, want %d", tt.rcode, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestOutcomeWindowSlides(t *testing.T) {
+	var w outcomeWindow
+	if e, to := w.rates(); e != 0 || to != 0 {
+		t.Fatalf("empty window rates %v %v", e, to)
+	}
+	for i := 0; i < weightedWindowSize; i++ {
+		w.add(outcomeError)
+	}
+	w.add(outcomeTimeout)
+	if e, to := w.rates(); e != 0.99 || to != 0.01 {
+		t.Fatalf("rates %v %v, want 0.99 0.01", e, to)
+	}
+	for i := 0; i < weightedWindowSize; i++ {
+		w.add(outcomeOK)
+	}
+	if e, to := w.rates(); e != 0 || to != 0 || w.n != weightedWindowSize {
+		t.Fatalf("rates %v %v over %d outcomes, want 0 0 over %d", e, to, w.n, weightedWindowSize)
+	}
+}
+
+func TestWeightedOrderPenalizesErrors(t *testing.T) {
+	ups := makeUpstreams("flaky", "steady")
+	m := newUpstreamManager(ups, StrategyWeighted, 2*time.Second, 0, 0, false)
+	for i := 0; i < 20; i++ {
+		m.UpdateWeightedLatency("flaky", 10*time.Millisecond)
+		m.UpdateWeightedLatency("steady", 60*time.Millisecond)
+		m.RecordOutcome("steady", outcomeOK)
+		// flaky answers fast but fails half the time
+		if i%2 == 0 {
+			m.RecordOutcome("flaky", outcomeError)
+		} else {
+			m.RecordOutcome("flaky", outcomeOK)
+		}
+	}
+	scores := m.WeightedScores()
+	if flaky := scores["flaky"]; flaky.ErrorRate != 0.5 || flaky.Score < 250 {
+		t.Errorf("unexpected flaky score %+v", flaky)
+	}
+	if order := m.weightedOrder(ups, false); order[0] != 1 {
+		t.Errorf("expected steady upstream first, got %v", order)
+	}
+
+	// Each timeout costs the full upstream timeout (2s here), weighted by the timeout rate.
+	for i := 0; i < 10; i++ {
+		m.RecordOutcome("steady", outcomeTimeout)
+	}
+	steady := m.WeightedScores()["steady"]
+	if want := steady.LatencyMs + 2000*(10.0/30.0); steady.TimeoutRate != 10.0/30.0 || steady.Score != want {
+		t.Errorf("unexpected steady score %+v, want score %v", steady, want)
+	}
+}
+
+func TestPickTwoChoices(t *testing.T) {
+	// Equal scores: every upstream is picked first about a third of the time.
+	first := make(map[int]int)
+	for i := 0; i < 3000; i++ {
+		order := []int{0, 1, 2}
+		pickTwoChoices(order, []float64{10, 10, 10})
+		first[order[0]]++
+		if !slices.IsSorted(order[1:]) {
+			t.Fatalf("failover order not kept: %v", order)
+		}
+	}
+	for idx := 0; idx < 3; idx++ {
+		if first[idx] < 800 || first[idx] > 1200 {
+			t.Errorf("upstream %d first %d times out of 3000, want about 1000", idx, first[idx])
+		}
+	}
+
+	// A much worse upstream is rarely first, but the best is never pinned.
+	first = make(map[int]int)
+	for i := 0; i < 3000; i++ {
+		order := []int{2, 0, 1}
+		pickTwoChoices(order, []float64{10, 20, 1000})
+		first[order[0]]++
+	}
+	if first[1] > 30 || first[0] == 0 || first[2] < first[0] {
+		t.Errorf("unexpected picks %v", first)
+	}
+
+	single := []int{0}
+	pickTwoChoices(single, []float64{5})
+	if single[0] != 0 {
+		t.Errorf("single upstream reordered: %v", single)
+	}
+}
+
+func TestResolverWeightedRecordsOutcomes(t *testing.T) {
+	addr := newDNSServerUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		_ = w.WriteMsg(resp)
+	}))
+	cfg := minimalResolverConfig("")
+	cfg.ResolverStrategy = StrategyWeighted
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "servfail", Address: addr, Protocol: "udp"}}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("fail.example.", dns.TypeA)
+	if _, _, err := r.exchange(context.Background(), req); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if score := r.UpstreamScores()[addr]; score.ErrorRate != 1 {
+		t.Errorf("expected the SERVFAIL counted as an error, got %+v", score)
+	}
+}
@@ -0,0 +1,152 @@
+package dnsresolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/metrics"
+)
+
+// udpCaseMismatchRetries is how many times a use_0x20 query is resent after an answer that did
+// not echo the query name's case.
+const udpCaseMismatchRetries = 1
+
+// errCaseMismatch is returned when every answer to a use_0x20 query changed the name's case.
+var errCaseMismatch = errors.New("upstream answer did not echo the 0x20 query name case")
+
+// udpExchange sends req to a plain UDP upstream, hardened against cache poisoning: each query
+// uses a new socket (so a new random source port from the OS) and a random ID instead of the
+// client's. Datagrams with another ID or question, or that do not parse, are ignored, as a
+// spoofer would send them, and the exchange keeps waiting for the real answer. With Use0x20
+// the query name is also sent in random case; an answer that does not echo it exactly is
+// rejected and the query resent.
+// The answer gets the client's ID and question back.
+func udpExchange(ctx context.Context, req *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	buf := make([]byte, udpResponseBufferSize(req))
+	for attempt := 0; ; attempt++ {
+		resp, err := udpExchangeOnce(ctx, req, upstream, buf)
+		if errors.Is(err, errCaseMismatch) && attempt < udpCaseMismatchRetries && ctx.Err() == nil {
+			continue
+		}
+		return resp, time.Since(start), err
+	}
+}
+
+// udpResponseBufferSize is the largest answer req lets the upstream send over UDP: the EDNS
+// buffer size it advertises, or 512 bytes without EDNS.
+func udpResponseBufferSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil {
+		return max(int(opt.UDPSize()), dns.MinMsgSize)
+	}
+	return dns.MinMsgSize
+}
+
+func udpExchangeOnce(ctx context.Context, req *dns.Msg, upstream Upstream, buf []byte) (*dns.Msg, error) {
+	m := *req // shallow copy: only the ID and question case differ on the wire
+	m.Id = dns.Id()
+	var question *dns.Question
+	if len(req.Question) > 0 {
+		m.Question = slices.Clone(req.Question)
+		if upstream.Use0x20 {
+			m.Question[0].Name = randomizeCase(m.Question[0].Name)
+		}
+		question = &m.Question[0]
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", upstream.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// Cancellation (race strategy) unblocks the read.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if n < 2 || binary.BigEndian.Uint16(buf) != m.Id {
+			metrics.RecordUpstreamRejectedResponse(upstream.Address, "id")
+			continue
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil {
+			// A spoofer who guessed the ID must not end the exchange with garbage.
+			metrics.RecordUpstreamRejectedResponse(upstream.Address, "malformed")
+			continue
+		}
+		if !questionMatches(resp, question) {
+			metrics.RecordUpstreamRejectedResponse(upstream.Address, "question")
+			continue
+		}
+		if upstream.Use0x20 && question != nil && resp.Question[0].Name != question.Name {
+			metrics.RecordUpstreamRejectedResponse(upstream.Address, "case")
+			return nil, errCaseMismatch
+		}
+		resp.Id = req.Id
+		if question != nil {
+			restoreQuestionCase(resp, question.Name, req.Question[0].Name)
+		}
+		return resp, nil
+	}
+}
+
+// randomizeCase returns name with each ASCII letter in random case (DNS 0x20).
+func randomizeCase(name string) string {
+	b := []byte(name)
+	var bits uint64
+	for i, c := range b {
+		if i%64 == 0 {
+			bits = rand.Uint64()
+		}
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if bits&1 == 1 {
+				c ^= 0x20
+			}
+			b[i] = c
+		}
+		bits >>= 1
+	}
+	return string(b)
+}
+
+// restoreQuestionCase puts back the client's spelling of the query name in the question and in
+// the owner names of the records that echo the randomized one.
+func restoreQuestionCase(resp *dns.Msg, sent, orig string) {
+	if sent == orig {
+		return
+	}
+	resp.Question[0].Name = orig
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); strings.EqualFold(h.Name, sent) {
+				h.Name = orig
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/config"
+)
+
+// fakeUDPUpstream is a UDP upstream that lets the test write any datagrams back, including
+// forged ones, to the port each query came from.
+type fakeUDPUpstream struct {
+	addr string
+
+	mu      sync.Mutex
+	queries []*dns.Msg
+	ports   []int
+}
+
+func startFakeUDPUpstream(t *testing.T, reply func(req *dns.Msg) []*dns.Msg) *fakeUDPUpstream {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	f := &fakeUDPUpstream{addr: pc.LocalAddr().String()}
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			f.mu.Lock()
+			f.queries = append(f.queries, req)
+			f.ports = append(f.ports, from.(*net.UDPAddr).Port)
+			f.mu.Unlock()
+			for _, resp := range reply(req) {
+				packed, err := resp.Pack()
+				if err == nil {
+					_, _ = pc.WriteTo(packed, from)
+				}
+			}
+		}
+	}()
+	return f
+}
+
+func (f *fakeUDPUpstream) received() ([]*dns.Msg, []int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*dns.Msg(nil), f.queries...), append([]int(nil), f.ports...)
+}
+
+// answerA answers req (echoing its question as sent) with ip.
+func answerA(req *dns.Msg, ip net.IP) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip}}
+	return resp
+}
+
+func udpQuery(name string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.Id = 4242
+	return req
+}
+
+func TestUDPExchangeIgnoresSpoofedResponses(t *testing.T) {
+	genuine := net.IPv4(192, 0, 2, 1)
+	forged := net.IPv4(203, 0, 113, 66)
+	up := startFakeUDPUpstream(t, func(req *dns.Msg) []*dns.Msg {
+		// Forgeries first: the client's ID (which a spoofer could know), another question,
+		// then the genuine answer.
+		wrongID := answerA(req, forged)
+		wrongID.Id = 4242
+		wrongQuestion := answerA(req, forged)
+		wrongQuestion.Question[0].Name = "evil.example."
+		return []*dns.Msg{wrongID, wrongQuestion, answerA(req, genuine)}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, _, err := udpExchange(ctx, udpQuery("www.example.com."), Upstream{Address: up.addr, Protocol: "udp"})
+	if err != nil {
+		t.Fatalf("udpExchange: %v", err)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || !a.A.Equal(genuine) {
+		t.Fatalf("got answer %v, want the genuine %v", resp.Answer, genuine)
+	}
+	if resp.Id != 4242 {
+		t.Errorf("answer id %d, want the client's 4242", resp.Id)
+	}
+	queries, _ := up.received()
+	if len(queries) != 1 || queries[0].Id == 4242 {
+		t.Errorf("expected one query with a random id, got %d queries", len(queries))
+	}
+}
+
+func TestUDPExchangeIgnoresMalformedResponses(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	genuine := net.IPv4(192, 0, 2, 1)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if req.Unpack(buf[:n]) != nil {
+			return
+		}
+		// A forgery with the right ID that does not parse, then the genuine answer.
+		garbage := []byte{byte(req.Id >> 8), byte(req.Id), 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0, 0xff}
+		_, _ = pc.WriteTo(garbage, from)
+		packed, _ := answerA(req, genuine).Pack()
+		_, _ = pc.WriteTo(packed, from)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, _, err := udpExchange(ctx, udpQuery("www.example.com."), Upstream{Address: pc.LocalAddr().String(), Protocol: "udp"})
+	if err != nil {
+		t.Fatalf("udpExchange: %v", err)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || !a.A.Equal(genuine) {
+		t.Fatalf("got answer %v, want the genuine %v", resp.Answer, genuine)
+	}
+}
+
+func TestUDPExchangeSourcePortPerQuery(t *testing.T) {
+	up := startFakeUDPUpstream(t, func(req *dns.Msg) []*dns.Msg {
+		return []*dns.Msg{answerA(req, net.IPv4(192, 0, 2, 1))}
+	})
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if _, _, err := udpExchange(ctx, udpQuery("www.example.com."), Upstream{Address: up.addr, Protocol: "udp"}); err != nil {
+			t.Fatalf("udpExchange: %v", err)
+		}
+	}
+	queries, ports := up.received()
+	seenPorts, seenIDs := map[int]bool{}, map[uint16]bool{}
+	for i := range queries {
+		seenPorts[ports[i]] = true
+		seenIDs[queries[i].Id] = true
+	}
+	if len(seenPorts) < 4 || len(seenIDs) < 4 {
+		t.Errorf("5 queries used %d source ports and %d ids, want them random per query", len(seenPorts), len(seenIDs))
+	}
+}
+
+func TestUDPExchange0x20(t *testing.T) {
+	up := startFakeUDPUpstream(t, func(req *dns.Msg) []*dns.Msg {
+		return []*dns.Msg{answerA(req, net.IPv4(192, 0, 2, 1))}
+	})
+	const name = "abcdefghijklmnopqrstuvwxyz.example.com."
+	resp, _, err := udpExchange(context.Background(), udpQuery(name), Upstream{Address: up.addr, Protocol: "udp", Use0x20: true})
+	if err != nil {
+		t.Fatalf("udpExchange: %v", err)
+	}
+	queries, _ := up.received()
+	sent := queries[0].Question[0].Name
+	if sent == name || !strings.EqualFold(sent, name) {
+		t.Errorf("query name sent as %q, want %q in random case", sent, name)
+	}
+	// The client sees its own spelling, in the question and the echoed owner names.
+	if resp.Question[0].Name != name || resp.Answer[0].Header().Name != name {
+		t.Errorf("answer question %q owner %q, want %q", resp.Question[0].Name, resp.Answer[0].Header().Name, name)
+	}
+}
+
+func TestUDPExchange0x20RejectsCaseMismatch(t *testing.T) {
+	var mu sync.Mutex
+	lowercase := 1 // answers with the name lowercased, then echoes it
+	up := startFakeUDPUpstream(t, func(req *dns.Msg) []*dns.Msg {
+		resp := answerA(req, net.IPv4(192, 0, 2, 1))
+		mu.Lock()
+		defer mu.Unlock()
+		if lowercase > 0 {
+			lowercase--
+			resp.Question[0].Name = strings.ToLower(resp.Question[0].Name)
+		}
+		return []*dns.Msg{resp}
+	})
+	upstream := Upstream{Address: up.addr, Protocol: "udp", Use0x20: true}
+	const name = "abcdefghijklmnopqrstuvwxyz.example.com."
+
+	// The mismatched answer is rejected and the query resent.
+	if _, _, err := udpExchange(context.Background(), udpQuery(name), upstream); err != nil {
+		t.Fatalf("udpExchange after one mismatch: %v", err)
+	}
+	if queries, _ := up.received(); len(queries) != 2 {
+		t.Fatalf("%d queries sent, want 2", len(queries))
+	}
+
+	// An upstream that never preserves case fails the exchange.
+	mu.Lock()
+	lowercase = 10
+	mu.Unlock()
+	if _, _, err := udpExchange(context.Background(), udpQuery(name), upstream); !errors.Is(err, errCaseMismatch) {
+		t.Fatalf("err %v, want errCaseMismatch", err)
+	}
+	// Without 0x20 the case is not checked.
+	upstream.Use0x20 = false
+	if _, _, err := udpExchange(context.Background(), udpQuery(name), upstream); err != nil {
+		t.Fatalf("udpExchange without 0x20: %v", err)
+	}
+}
+
+func TestUDPExchangeTimesOutOnForgeriesOnly(t *testing.T) {
+	up := startFakeUDPUpstream(t, func(req *dns.Msg) []*dns.Msg {
+		forged := answerA(req, net.IPv4(203, 0, 113, 66))
+		forged.Id = req.Id + 1
+		return []*dns.Msg{forged}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := udpExchange(ctx, udpQuery("www.example.com."), Upstream{Address: up.addr, Protocol: "udp"}); err == nil || exchangeOutcomeOf(0, err) != outcomeTimeout {
+		t.Fatalf("err %v, want a timeout", err)
+	}
+}
+
+func TestResolverUDPUpstream0x20(t *testing.T) {
+	up := startFakeUDPUpstream(t, func(req *dns.Msg) []*dns.Msg {
+		return []*dns.Msg{answerA(req, net.IPv4(192, 0, 2, 1))}
+	})
+	cfg := minimalResolverConfig("")
+	cfg.Upstreams = []config.UpstreamConfig{{Name: "untrusted", Address: up.addr, Protocol: "udp", Use0x20: true}}
+	r := buildTestResolver(t, cfg, nil, nil, nil)
+	resp, _, err := r.exchange(context.Background(), udpQuery("www.example.com."))
+	if err != nil || resp.Question[0].Name != "www.example.com." {
+		t.Fatalf("exchange = %v, %v", resp, err)
+	}
+	if upstreams, _ := r.UpstreamConfig(); !upstreams[0].Use0x20 {
+		t.Error("use_0x20 not carried to the upstream")
+	}
+}
+
+func TestUDPExchangeLargeEDNSAnswer(t *testing.T) {
+	// 30 uncompressed A records: about 900 bytes, more than fits in 512.
+	up := startFakeUDPUpstream(t, func(req *dns.Msg) []*dns.Msg {
+		resp := answerA(req, net.IPv4(192, 0, 2, 1))
+		for i := 2; i <= 30; i++ {
+			resp.Answer = append(resp.Answer, answerA(req, net.IPv4(192, 0, 2, byte(i))).Answer[0])
+		}
+		return []*dns.Msg{resp}
+	})
+	req := udpQuery("large.example.")
+	req.SetEdns0(ednsUDPSize, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, _, err := udpExchange(ctx, req, Upstream{Address: up.addr, Protocol: "udp"})
+	if err != nil {
+		t.Fatalf("udpExchange: %v", err)
+	}
+	if len(resp.Answer) != 30 {
+		t.Errorf("got %d answers, want 30", len(resp.Answer))
+	}
+
+	for _, tc := range []struct {
+		size uint16
+		want int
+	}{{0, dns.MinMsgSize}, {256, dns.MinMsgSize}, {ednsUDPSize, ednsUDPSize}, {4096, 4096}} {
+		req := udpQuery("example.")
+		if tc.size > 0 {
+			req.SetEdns0(tc.size, false)
+		}
+		if got := udpResponseBufferSize(req); got != tc.want {
+			t.Errorf("udpResponseBufferSize(EDNS %d) = %d, want %d", tc.size, got, tc.want)
+		}
+	}
+}
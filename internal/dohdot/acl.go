@@ -0,0 +1,82 @@
+package dohdot
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// AllowFunc reports whether a client address may use the encrypted listeners (the resolver's
+// access control lists). A nil AllowFunc allows every client.
+type AllowFunc func(netip.Addr) bool
+
+// errACLDenied is returned by reads on a connection from a client the ACL denies.
+var errACLDenied = errors.New("client denied by acl")
+
+// allows reports whether allow lets the client at addr in.
+func (allow AllowFunc) allows(addr net.Addr) bool {
+	if allow == nil {
+		return true
+	}
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	case *net.UDPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	default:
+		if addr == nil {
+			return false
+		}
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = ap.Addr()
+	}
+	return allow(ip.Unmap())
+}
+
+// aclListener closes connections from denied clients before the TLS handshake. The check runs
+// on the connection's first read rather than in Accept, because the client address of a
+// PROXY protocol connection is only known once its header has been read.
+type aclListener struct {
+	net.Listener
+	allow AllowFunc
+}
+
+func newACLListener(ln net.Listener, allow AllowFunc) net.Listener {
+	if allow == nil {
+		return ln
+	}
+	return &aclListener{Listener: ln, allow: allow}
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &aclConn{Conn: c, allow: l.allow}, nil
+}
+
+type aclConn struct {
+	net.Conn
+	allow   AllowFunc
+	once    sync.Once
+	allowed bool
+}
+
+func (c *aclConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		c.allowed = c.allow.allows(c.Conn.RemoteAddr())
+		if !c.allowed {
+			c.Conn.Close()
+		}
+	})
+	if !c.allowed {
+		return 0, errACLDenied
+	}
+	return c.Conn.Read(b)
+}
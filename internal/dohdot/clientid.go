@@ -0,0 +1,48 @@
+package dohdot
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/clientid"
+)
+
+// ClientIDFromSNI returns a Handler that identifies clients connecting with TLS server name
+// <id>.<domain> (DoT, DoQ, and DoH without an ID in the path) by client ID <id>, which the
+// resolver reads from the response writer's ClientID method. With an empty domain, handler
+// is returned unchanged.
+func ClientIDFromSNI(handler Handler, domain string) Handler {
+	suffix := "." + strings.Trim(strings.ToLower(domain), ".")
+	if suffix == "." {
+		return handler
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if cw, ok := w.(interface{ ClientID() string }); ok && cw.ClientID() != "" {
+			handler.ServeDNS(w, r)
+			return
+		}
+		if cs, ok := w.(dns.ConnectionStater); ok {
+			if state := cs.ConnectionState(); state != nil {
+				label, ok := strings.CutSuffix(strings.ToLower(state.ServerName), suffix)
+				if id, valid := clientid.NormalizeID(label); ok && valid {
+					w = &sniClientIDWriter{ResponseWriter: w, clientID: id}
+				}
+			}
+		}
+		handler.ServeDNS(w, r)
+	})
+}
+
+// sniClientIDWriter adds the client ID from the server name to a DoT, DoQ or DoH writer.
+type sniClientIDWriter struct {
+	dns.ResponseWriter
+	clientID string
+}
+
+func (w *sniClientIDWriter) ClientID() string { return w.clientID }
+
+// ConnectionState keeps the TLS state visible, so the resolver still pads the responses.
+func (w *sniClientIDWriter) ConnectionState() *tls.ConnectionState {
+	return w.ResponseWriter.(dns.ConnectionStater).ConnectionState()
+}
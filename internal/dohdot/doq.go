@@ -0,0 +1,307 @@
+package dohdot
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ error codes (RFC 9250 section 4.3).
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqInternalError quic.StreamErrorCode      = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+const (
+	doqALPN = "doq"
+	// doqStreamTimeout bounds reading a query and writing its answer on a stream.
+	doqStreamTimeout = 10 * time.Second
+	doqIdleTimeout   = 30 * time.Second
+	// doqMinLinger and doqMaxLinger bound how long Shutdown waits after the last answer before
+	// closing connections, since closing drops stream data that was not yet sent or acknowledged.
+	doqMinLinger = 10 * time.Millisecond
+	doqMaxLinger = time.Second
+)
+
+// DoQServer is a DNS-over-QUIC (RFC 9250) server. Each query arrives on its own stream of a
+// QUIC connection, with a 2-byte length prefix, and is answered on the same stream.
+// Queries with a non-zero message ID are accepted (and the ID echoed), as some clients send one.
+type DoQServer struct {
+	Addr      string
+	TLSConfig *tls.Config
+	Handler   Handler
+	Logger    *slog.Logger
+	// Allow, when set, turns away connections from clients the ACL denies.
+	Allow AllowFunc
+
+	mu        sync.Mutex
+	transport *quic.Transport
+	listener  *quic.Listener
+	conns     map[*quic.Conn]struct{}
+	closing   bool
+	streams   sync.WaitGroup
+}
+
+// NewDoQServer returns a DoQ server for listenAddr using the certificate and key files.
+func NewDoQServer(listenAddr, certFile, keyFile string, handler Handler, logger *slog.Logger) (*DoQServer, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &DoQServer{
+		Addr:      listenAddr,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13},
+		Handler:   handler,
+		Logger:    logger,
+	}, nil
+}
+
+// ListenAndServe listens on s.Addr (UDP) and serves until Shutdown.
+func (s *DoQServer) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if s.Logger != nil {
+		s.Logger.Info("DoQ server listening", "addr", s.Addr)
+	}
+	return s.Serve(conn)
+}
+
+// Serve accepts DoQ connections on conn until Shutdown, then returns nil. conn is closed by
+// Shutdown, once the connections on it are done.
+func (s *DoQServer) Serve(conn net.PacketConn) error {
+	tlsConfig := s.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{doqALPN}
+	// An explicit Transport: closing the listener then leaves established connections open,
+	// so Shutdown can let their queries finish.
+	tr := &quic.Transport{Conn: conn}
+	ln, err := tr.Listen(tlsConfig, &quic.Config{MaxIdleTimeout: doqIdleTimeout})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		tr.Close()
+		conn.Close()
+		return nil
+	}
+	s.transport, s.listener = tr, ln
+	if s.conns == nil {
+		s.conns = make(map[*quic.Conn]struct{})
+	}
+	s.mu.Unlock()
+
+	for {
+		qc, err := ln.Accept(context.Background())
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			tr.Close()
+			conn.Close()
+			return err
+		}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			_ = qc.CloseWithError(doqNoError, "")
+			continue
+		}
+		if !s.Allow.allows(qc.RemoteAddr()) {
+			s.mu.Unlock()
+			_ = qc.CloseWithError(doqNoError, "")
+			continue
+		}
+		s.conns[qc] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(qc)
+	}
+}
+
+// Shutdown stops accepting connections and queries, waits for the queries being answered
+// (or ctx), then closes the connections with DOQ_NO_ERROR. Before closing, it lingers for
+// about one probe timeout of the slowest connection, so the last answers can be delivered
+// (or retransmitted once).
+func (s *DoQServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	ln, tr := s.listener, s.transport
+	s.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+		if linger := s.linger(); linger > 0 {
+			t := time.NewTimer(linger)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+			}
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	for qc := range s.conns {
+		_ = qc.CloseWithError(doqNoError, "")
+	}
+	s.mu.Unlock()
+	if tr != nil {
+		tr.Close()
+		tr.Conn.Close()
+	}
+	return err
+}
+
+// linger returns the time to wait before closing the connections: the largest probe timeout
+// estimate (smoothed RTT plus variation, RFC 9002) among them, within bounds; 0 without connections.
+func (s *DoQServer) linger() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.conns) == 0 {
+		return 0
+	}
+	linger := doqMinLinger
+	for qc := range s.conns {
+		stats := qc.ConnectionStats()
+		linger = max(linger, 2*stats.SmoothedRTT+4*stats.MeanDeviation)
+	}
+	return min(linger, doqMaxLinger)
+}
+
+func (s *DoQServer) serveConn(qc *quic.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, qc)
+		s.mu.Unlock()
+	}()
+	for {
+		stream, err := qc.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		// Streams are counted under mu, so none is added once Shutdown waits for them.
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			stream.CancelRead(quic.StreamErrorCode(doqNoError))
+			stream.CancelWrite(quic.StreamErrorCode(doqNoError))
+			return
+		}
+		s.streams.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.streams.Done()
+			s.serveStream(qc, stream)
+		}()
+	}
+}
+
+// serveStream answers the query on stream. A malformed query is a protocol error that closes
+// the connection (RFC 9250 section 4.3.3); a query the handler does not answer (e.g. dropped
+// by rate limiting) has its stream reset.
+func (s *DoQServer) serveStream(qc *quic.Conn, stream *quic.Stream) {
+	_ = stream.SetDeadline(time.Now().Add(doqStreamTimeout))
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, raw); err != nil {
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(raw); err != nil {
+		_ = qc.CloseWithError(doqProtocolError, "invalid dns message")
+		return
+	}
+
+	state := qc.ConnectionState().TLS
+	rw := &doQResponseWriter{local: qc.LocalAddr(), remote: newDoQAddr(qc.RemoteAddr()), tls: &state}
+	s.Handler.ServeDNS(rw, req)
+	if rw.written == nil {
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	packed, err := rw.written.Pack()
+	if err != nil {
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	frame := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+	copy(frame[2:], packed)
+	_ = stream.SetDeadline(time.Now().Add(doqStreamTimeout))
+	if _, err := stream.Write(frame); err != nil {
+		return
+	}
+	_ = stream.Close()
+}
+
+// doqAddr is a DoQ client address: its UDP address, with network "doq" so that query logs
+// and the query store record the protocol. Like TCP, DoT and DoH, it is a stream transport
+// for rate limiting and response truncation.
+type doqAddr struct {
+	*net.UDPAddr
+}
+
+func (doqAddr) Network() string { return "doq" }
+
+func newDoQAddr(addr net.Addr) net.Addr {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		return doqAddr{ua}
+	}
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return doqAddr{net.UDPAddrFromAddrPort(ap)}
+	}
+	return doqAddr{&net.UDPAddr{}}
+}
+
+// doQResponseWriter is the dns.ResponseWriter of a DoQ stream; it keeps the answer for
+// serveStream to write.
+type doQResponseWriter struct {
+	local   net.Addr
+	remote  net.Addr
+	tls     *tls.ConnectionState
+	written *dns.Msg
+}
+
+// ConnectionState implements dns.ConnectionStater, so the resolver pads DoQ responses like DoT.
+func (w *doQResponseWriter) ConnectionState() *tls.ConnectionState { return w.tls }
+
+func (w *doQResponseWriter) LocalAddr() net.Addr       { return w.local }
+func (w *doQResponseWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *doQResponseWriter) WriteMsg(m *dns.Msg) error { w.written = m; return nil }
+func (w *doQResponseWriter) Write([]byte) (int, error) { return 0, nil }
+func (w *doQResponseWriter) Close() error              { return nil }
+func (w *doQResponseWriter) TsigStatus() error         { return nil }
+func (w *doQResponseWriter) TsigTimersOnly(bool)       {}
+func (w *doQResponseWriter) Hijack()                   {}
@@ -0,0 +1,142 @@
+package dohdot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tantalor93/doq-go/doq"
+)
+
+// startDoQServer serves handler over DoQ on 127.0.0.1 and returns the server, its address
+// and a client TLS config trusting its certificate.
+func startDoQServer(t *testing.T, handler Handler) (*DoQServer, string, *tls.Config) {
+	t.Helper()
+	// The httptest server only provides a certificate valid for 127.0.0.1.
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(certSrv.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(certSrv.Certificate())
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	s := &DoQServer{
+		TLSConfig: &tls.Config{Certificates: certSrv.TLS.Certificates, MinVersion: tls.VersionTLS13},
+		Handler:   handler,
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(pc) }()
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return s, pc.LocalAddr().String(), &tls.Config{RootCAs: roots}
+}
+
+func answer(w dns.ResponseWriter, r *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   []byte{1, 2, 3, 4},
+	})
+	_ = w.WriteMsg(resp)
+}
+
+func TestDoQServer_Query(t *testing.T) {
+	type client struct {
+		addr      net.Addr
+		encrypted bool
+	}
+	seen := make(chan client, 1)
+	_, addr, tlsConfig := startDoQServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		cs, ok := w.(dns.ConnectionStater)
+		seen <- client{addr: w.RemoteAddr(), encrypted: ok && cs.ConnectionState() != nil}
+		answer(w, r)
+	}))
+
+	c := doq.NewClient(addr, doq.WithTLSConfig(tlsConfig))
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.Send(ctx, msg)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Id != 0 {
+		t.Errorf("unexpected answer: %v", resp)
+	}
+	got := <-seen
+	if got.addr.Network() != "doq" || !got.encrypted {
+		t.Errorf("handler saw network %q, encrypted %v; want doq over TLS", got.addr.Network(), got.encrypted)
+	}
+	if host, _, _ := net.SplitHostPort(got.addr.String()); host != "127.0.0.1" {
+		t.Errorf("handler saw client %q, want 127.0.0.1", got.addr)
+	}
+}
+
+func TestDoQServer_UnansweredQueryIsReset(t *testing.T) {
+	_, addr, tlsConfig := startDoQServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {}))
+	c := doq.NewClient(addr, doq.WithTLSConfig(tlsConfig))
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Send(ctx, msg); err == nil || ctx.Err() != nil {
+		t.Fatalf("Send = %v, want a stream reset before the timeout", err)
+	}
+}
+
+func TestDoQServer_ShutdownWaitsForQueries(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s, addr, tlsConfig := startDoQServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		close(started)
+		<-release
+		answer(w, r)
+	}))
+	c := doq.NewClient(addr, doq.WithTLSConfig(tlsConfig))
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	answered := make(chan error, 1)
+	go func() {
+		_, err := c.Send(ctx, msg)
+		answered <- err
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the query was answered", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-answered; err != nil {
+		t.Fatalf("query in flight during shutdown: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// The listener is closed: new clients cannot connect.
+	late := doq.NewClient(addr, doq.WithTLSConfig(tlsConfig), doq.WithConnectTimeout(200*time.Millisecond))
+	if _, err := late.Send(ctx, msg); err == nil {
+		t.Fatal("query after shutdown succeeded")
+	}
+}
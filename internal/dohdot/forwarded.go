@@ -0,0 +1,64 @@
+package dohdot
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/tternquist/beyond-ads-dns/internal/proxyproto"
+)
+
+// forwardedClient returns the client address reported by trusted proxies in the Forwarded
+// (RFC 7239) or, without it, X-Forwarded-For header of a request whose peer is trusted.
+// The chain is walked from the nearest hop: the first address that is not a trusted proxy
+// is the client. An unparseable hop ("unknown", obfuscated identifiers) ends the walk
+// without a result, as anything before it may be forged.
+func forwardedClient(h http.Header, trusted proxyproto.Trusted) (netip.AddrPort, bool) {
+	hops := forwardedFor(h.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, v := range h.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	}
+	var client netip.AddrPort
+	for i := len(hops) - 1; i >= 0; i-- {
+		ap, ok := parseForwardedAddr(hops[i])
+		if !ok {
+			return netip.AddrPort{}, false
+		}
+		client = ap
+		if !trusted.Contains(ap.Addr()) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// forwardedFor returns the for= parameters of Forwarded header values, in order.
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					out = append(out, val)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// parseForwardedAddr parses "ip", "ip:port", "[ipv6]" or "[ipv6]:port", optionally quoted.
+func parseForwardedAddr(s string) (netip.AddrPort, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+	}
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil || ip.Zone() != "" {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip.Unmap(), 0), true
+}
@@ -7,10 +7,14 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/clientid"
+	"github.com/tternquist/beyond-ads-dns/internal/proxyproto"
 	"log/slog"
 )
 
@@ -25,8 +29,9 @@ type Handler interface {
 	ServeDNS(w dns.ResponseWriter, r *dns.Msg)
 }
 
-// DoTServer runs a DNS-over-TLS server on the given address.
-func DoTServer(ctx context.Context, listenAddr, certFile, keyFile string, handler Handler, logger *slog.Logger) error {
+// DoTServer runs a DNS-over-TLS server on the given address. With proxyTrusted, connections
+// from those sources must start with a PROXY protocol header (before the TLS handshake).
+func DoTServer(ctx context.Context, listenAddr, certFile, keyFile string, handler Handler, proxyTrusted proxyproto.Trusted, allow AllowFunc, logger *slog.Logger) error {
 	if listenAddr == "" || certFile == "" || keyFile == "" {
 		return nil
 	}
@@ -44,26 +49,54 @@ func DoTServer(ctx context.Context, listenAddr, certFile, keyFile string, handle
 		TLSConfig: tlsConfig,
 		Handler:   handler,
 	}
+	if len(proxyTrusted) > 0 || allow != nil {
+		ln, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			return err
+		}
+		if len(proxyTrusted) > 0 {
+			ln = proxyproto.NewListener(ln, proxyTrusted)
+		}
+		server.Listener = tls.NewListener(newACLListener(ln, allow), tlsConfig)
+	}
 	go func() {
 		<-ctx.Done()
 		_ = server.Shutdown()
 	}()
 	if logger != nil {
-		logger.Info("DoT server listening", "addr", listenAddr)
+		logger.Info("DoT server listening", "addr", listenAddr, "proxy_protocol", len(proxyTrusted) > 0)
+	}
+	if server.Listener != nil {
+		return server.ActivateAndServe()
 	}
 	return server.ListenAndServe()
 }
 
 // DoHHandler returns an http.Handler for DNS-over-HTTPS (RFC 8484).
 // Supports GET ?dns=<base64url> and POST application/dns-message.
-// Path defaults to /dns-query if empty.
-func DoHHandler(handler Handler, path string) http.Handler {
+// Path defaults to /dns-query if empty; <path>/<client-id> identifies the client by ID.
+// Requests from trustedProxies may report the client address in X-Forwarded-For or Forwarded.
+// Clients that allow denies get 403 Forbidden, as do queries the handler drops without a reply
+// (the ACL drop action, which may depend on the client's group).
+func DoHHandler(handler Handler, path string, trustedProxies proxyproto.Trusted, allow AllowFunc) http.Handler {
 	if path == "" {
 		path = defaultDoHPath
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID := ""
 		if r.URL.Path != path {
-			http.NotFound(w, r)
+			id, ok := strings.CutPrefix(r.URL.Path, path+"/")
+			if ok {
+				clientID, ok = clientid.NormalizeID(id)
+			}
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		rw := &doHResponseWriter{remoteAddr: r.RemoteAddr, header: r.Header, trusted: trustedProxies, tls: r.TLS, clientID: clientID}
+		if !allow.allows(rw.RemoteAddr()) {
+			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
 		if r.Method != http.MethodGet && r.Method != http.MethodPost {
@@ -91,10 +124,10 @@ func DoHHandler(handler Handler, path string) http.Handler {
 			return
 		}
 
-		rw := &doHResponseWriter{req: req, remoteAddr: r.RemoteAddr}
+		rw.req = req
 		handler.ServeDNS(rw, req)
 		if rw.written == nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
+			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
 		packed, err := rw.written.Pack()
@@ -113,10 +146,35 @@ type doHResponseWriter struct {
 	req        *dns.Msg
 	written    *dns.Msg
 	remoteAddr string
+	header     http.Header
+	trusted    proxyproto.Trusted
+	tls        *tls.ConnectionState
+	clientID   string
 }
 
+// ConnectionState implements dns.ConnectionStater, so the resolver pads DoH responses like DoT.
+func (w *doHResponseWriter) ConnectionState() *tls.ConnectionState { return w.tls }
+
+// ClientID returns the client ID from the request path, or "".
+func (w *doHResponseWriter) ClientID() string { return w.clientID }
+
 func (w *doHResponseWriter) LocalAddr() net.Addr { return &net.TCPAddr{} }
+
+// RemoteAddr returns the HTTP client, or the client reported by forwarded headers when the
+// HTTP client is a trusted proxy.
 func (w *doHResponseWriter) RemoteAddr() net.Addr {
+	peer := w.peerAddr()
+	if len(w.trusted) > 0 {
+		if ip, ok := netip.AddrFromSlice(peer.IP); ok && w.trusted.Contains(ip) {
+			if client, ok := forwardedClient(w.header, w.trusted); ok {
+				return net.TCPAddrFromAddrPort(client)
+			}
+		}
+	}
+	return peer
+}
+
+func (w *doHResponseWriter) peerAddr() *net.TCPAddr {
 	if w.remoteAddr == "" {
 		return &net.TCPAddr{}
 	}
@@ -2,13 +2,22 @@ package dohdot
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/tternquist/beyond-ads-dns/internal/proxyproto"
 )
 
 type mockHandler struct {
@@ -28,7 +37,7 @@ func (m *mockHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 func TestDoHHandler_GET_ValidQuery(t *testing.T) {
 	mock := &mockHandler{}
-	handler := DoHHandler(mock, "/dns-query")
+	handler := DoHHandler(mock, "/dns-query", nil, nil)
 
 	msg := new(dns.Msg)
 	msg.SetQuestion("example.com.", dns.TypeA)
@@ -57,7 +66,7 @@ func TestDoHHandler_GET_ValidQuery(t *testing.T) {
 
 func TestDoHHandler_POST_ValidQuery(t *testing.T) {
 	mock := &mockHandler{}
-	handler := DoHHandler(mock, "/dns-query")
+	handler := DoHHandler(mock, "/dns-query", nil, nil)
 
 	msg := new(dns.Msg)
 	msg.SetQuestion("test.example.com.", dns.TypeAAAA)
@@ -78,7 +87,7 @@ func TestDoHHandler_POST_ValidQuery(t *testing.T) {
 
 func TestDoHHandler_DefaultPath(t *testing.T) {
 	mock := &mockHandler{}
-	handler := DoHHandler(mock, "")
+	handler := DoHHandler(mock, "", nil, nil)
 
 	msg := new(dns.Msg)
 	msg.SetQuestion("example.com.", dns.TypeA)
@@ -96,7 +105,7 @@ func TestDoHHandler_DefaultPath(t *testing.T) {
 
 func TestDoHHandler_WrongPath(t *testing.T) {
 	mock := &mockHandler{}
-	handler := DoHHandler(mock, "/dns-query")
+	handler := DoHHandler(mock, "/dns-query", nil, nil)
 
 	req := httptest.NewRequest(http.MethodGet, "/other-path", nil)
 	rec := httptest.NewRecorder()
@@ -112,7 +121,7 @@ func TestDoHHandler_WrongPath(t *testing.T) {
 
 func TestDoHHandler_MethodNotAllowed(t *testing.T) {
 	mock := &mockHandler{}
-	handler := DoHHandler(mock, "/dns-query")
+	handler := DoHHandler(mock, "/dns-query", nil, nil)
 
 	req := httptest.NewRequest(http.MethodPut, "/dns-query", nil)
 	rec := httptest.NewRecorder()
@@ -128,7 +137,7 @@ func TestDoHHandler_MethodNotAllowed(t *testing.T) {
 
 func TestDoHHandler_GET_InvalidBase64(t *testing.T) {
 	mock := &mockHandler{}
-	handler := DoHHandler(mock, "/dns-query")
+	handler := DoHHandler(mock, "/dns-query", nil, nil)
 
 	req := httptest.NewRequest(http.MethodGet, "/dns-query?dns=not-valid-base64!!!", nil)
 	rec := httptest.NewRecorder()
@@ -141,7 +150,7 @@ func TestDoHHandler_GET_InvalidBase64(t *testing.T) {
 
 func TestDoHHandler_GET_EmptyQuery(t *testing.T) {
 	mock := &mockHandler{}
-	handler := DoHHandler(mock, "/dns-query")
+	handler := DoHHandler(mock, "/dns-query", nil, nil)
 
 	req := httptest.NewRequest(http.MethodGet, "/dns-query?dns=", nil)
 	rec := httptest.NewRecorder()
@@ -154,7 +163,7 @@ func TestDoHHandler_GET_EmptyQuery(t *testing.T) {
 
 func TestDoHHandler_POST_InvalidDNS(t *testing.T) {
 	mock := &mockHandler{}
-	handler := DoHHandler(mock, "/dns-query")
+	handler := DoHHandler(mock, "/dns-query", nil, nil)
 
 	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader([]byte{0, 1, 2, 3}))
 	req.Header.Set("Content-Type", "application/dns-message")
@@ -199,3 +208,276 @@ func TestDoHResponseWriter_RemoteAddr_InvalidPort(t *testing.T) {
 		t.Fatal("RemoteAddr returned nil")
 	}
 }
+
+func TestDoHResponseWriter_ConnectionState(t *testing.T) {
+	var got *tls.ConnectionState
+	handler := DoHHandler(handlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		got = w.(dns.ConnectionStater).ConnectionState()
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		_ = w.WriteMsg(resp)
+	}), "/dns-query", nil, nil)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	packed, _ := msg.Pack()
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got == nil || got.Version != tls.VersionTLS13 {
+		t.Fatalf("expected the request's TLS state, got %v", got)
+	}
+}
+
+func TestDoHResponseWriter_RemoteAddr_Forwarded(t *testing.T) {
+	trusted, _ := proxyproto.ParseTrusted([]string{"10.0.0.0/8"})
+	tests := []struct {
+		name   string
+		peer   string
+		header http.Header
+		want   string
+	}{
+		{name: "xff from trusted proxy", peer: "10.0.0.5:4000", header: http.Header{"X-Forwarded-For": {"203.0.113.7"}}, want: "203.0.113.7:0"},
+		{name: "xff chain skips trusted hops", peer: "10.0.0.5:4000", header: http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.9"}}, want: "203.0.113.7:0"},
+		{name: "xff from untrusted peer", peer: "192.0.2.1:4000", header: http.Header{"X-Forwarded-For": {"203.0.113.7"}}, want: "192.0.2.1:4000"},
+		{name: "forwarded preferred", peer: "10.0.0.5:4000", header: http.Header{"Forwarded": {`for="[2001:db8::7]:4711";proto=https`}, "X-Forwarded-For": {"203.0.113.7"}}, want: "[2001:db8::7]:4711"},
+		{name: "forwarded unknown hop", peer: "10.0.0.5:4000", header: http.Header{"Forwarded": {"for=203.0.113.7, for=unknown"}}, want: "10.0.0.5:4000"},
+		{name: "no header", peer: "10.0.0.5:4000", header: http.Header{}, want: "10.0.0.5:4000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &doHResponseWriter{remoteAddr: tt.peer, header: tt.header, trusted: trusted}
+			if got := w.RemoteAddr().String(); got != tt.want {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoHHandler_ClientIDPath(t *testing.T) {
+	var got string
+	handler := DoHHandler(handlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		got = w.(interface{ ClientID() string }).ClientID()
+		answer(w, r)
+	}), "/dns-query", nil, nil)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	packed, _ := msg.Pack()
+	b64 := base64.RawURLEncoding.EncodeToString(packed)
+	for path, want := range map[string]int{
+		"/dns-query/Kids-Phone": http.StatusOK,
+		"/dns-query/":           http.StatusNotFound,
+		"/dns-query/a/b":        http.StatusNotFound,
+		"/dns-query/a.b":        http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?dns="+b64, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", path, rec.Code, want)
+		}
+	}
+	if got != "kids-phone" {
+		t.Errorf("handler saw client ID %q, want kids-phone", got)
+	}
+}
+
+func TestClientIDFromSNI(t *testing.T) {
+	var got string
+	handler := ClientIDFromSNI(handlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		got = ""
+		if cw, ok := w.(interface{ ClientID() string }); ok {
+			got = cw.ClientID()
+		}
+		if cs, ok := w.(dns.ConnectionStater); !ok || cs.ConnectionState() == nil {
+			t.Error("TLS state not visible through the writer")
+		}
+	}), "DNS.example.com.")
+
+	tests := []struct {
+		serverName, pathID, want string
+	}{
+		{serverName: "Phone.dns.example.com", want: "phone"},
+		{serverName: "dns.example.com", want: ""},
+		{serverName: "a.b.dns.example.com", want: ""},
+		{serverName: "phone.dns.example.org", want: ""},
+		{serverName: "phone.dns.example.com", pathID: "laptop", want: "laptop"},
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	for _, tt := range tests {
+		w := &doHResponseWriter{tls: &tls.ConnectionState{ServerName: tt.serverName}, clientID: tt.pathID}
+		handler.ServeDNS(w, msg)
+		if got != tt.want {
+			t.Errorf("server name %q, path ID %q: client ID %q, want %q", tt.serverName, tt.pathID, got, tt.want)
+		}
+	}
+}
+
+type handlerFunc func(w dns.ResponseWriter, r *dns.Msg)
+
+func (f handlerFunc) ServeDNS(w dns.ResponseWriter, r *dns.Msg) { f(w, r) }
+
+// writeCertFiles writes the certificate and key of the httptest server (valid for 127.0.0.1)
+// to files, and returns them with a client TLS config trusting the certificate.
+func writeCertFiles(t *testing.T) (certFile, keyFile string, clientTLS *tls.Config) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	cert := srv.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	return certFile, keyFile, &tls.Config{RootCAs: roots}
+}
+
+func TestDoTServer_ProxyProtocol(t *testing.T) {
+	certFile, keyFile, clientTLS := writeCertFiles(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	seen := make(chan string, 1)
+	trusted, _ := proxyproto.ParseTrusted([]string{"127.0.0.1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- DoTServer(ctx, addr, certFile, keyFile, handlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			seen <- w.RemoteAddr().String()
+			answer(w, r)
+		}), trusted, nil, nil)
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn, err = net.Dial("tcp", addr); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PROXY TCP4 198.51.100.9 127.0.0.1 5353 853\r\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	clientTLS.ServerName = "127.0.0.1"
+	dc := &dns.Conn{Conn: tls.Client(conn, clientTLS)}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	_ = dc.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := dc.WriteMsg(msg); err != nil {
+		t.Fatalf("WriteMsg: %v", err)
+	}
+	if _, err := dc.ReadMsg(); err != nil {
+		t.Fatalf("ReadMsg: %v", err)
+	}
+	if got := <-seen; got != "198.51.100.9:5353" {
+		t.Errorf("handler saw client %s, want the address from the PROXY header", got)
+	}
+}
+
+func TestDoHHandler_ACL(t *testing.T) {
+	mock := &mockHandler{}
+	trusted, _ := proxyproto.ParseTrusted([]string{"10.0.0.0/8"})
+	allow := func(addr netip.Addr) bool { return addr == netip.MustParseAddr("203.0.113.7") }
+	handler := DoHHandler(mock, "/dns-query", trusted, allow)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	packed, _ := msg.Pack()
+	b64 := base64.RawURLEncoding.EncodeToString(packed)
+
+	for _, tc := range []struct {
+		name   string
+		peer   string
+		header http.Header
+		want   int
+	}{
+		{name: "denied peer", peer: "192.0.2.1:4000", want: http.StatusForbidden},
+		{name: "allowed peer", peer: "203.0.113.7:4000", want: http.StatusOK},
+		{name: "allowed client behind trusted proxy", peer: "10.0.0.5:4000", header: http.Header{"X-Forwarded-For": {"203.0.113.7"}}, want: http.StatusOK},
+		{name: "denied client behind trusted proxy", peer: "10.0.0.5:4000", header: http.Header{"X-Forwarded-For": {"192.0.2.1"}}, want: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+b64, nil)
+			req.RemoteAddr = tc.peer
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+	if mock.serveCount != 2 {
+		t.Errorf("handler called %d times, want 2 (denied clients must not reach it)", mock.serveCount)
+	}
+}
+
+func TestDoHHandler_DroppedQuery(t *testing.T) {
+	// The resolver drops ACL-denied queries without writing a reply.
+	handler := DoHHandler(handlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {}), "/dns-query", nil, nil)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	packed, _ := msg.Pack()
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+	req.Header.Set("Content-Type", "application/dns-message")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestACLListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	for _, allowed := range []bool{false, true} {
+		acl := newACLListener(ln, func(netip.Addr) bool { return allowed })
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		_, _ = client.Write([]byte("x"))
+		conn, err := acl.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		_, err = conn.Read(make([]byte, 1))
+		if allowed && err != nil {
+			t.Errorf("allowed client: Read error %v", err)
+		}
+		if !allowed && err != errACLDenied {
+			t.Errorf("denied client: Read error %v, want %v", err, errACLDenied)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log/slog"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
 
@@ -18,6 +19,7 @@ const defaultTTL = 3600 // 1 hour for local records
 type Manager struct {
 	mu      sync.RWMutex
 	records map[string]map[uint16][]dns.RR // key: normalized name, inner key: qtype
+	names   map[netip.Addr][]string        // A/AAAA address -> names (non-wildcard), for reverse lookups
 	logger  *slog.Logger
 }
 
@@ -25,6 +27,7 @@ type Manager struct {
 func New(entries []config.LocalRecordEntry, logger *slog.Logger) *Manager {
 	m := &Manager{
 		records: make(map[string]map[uint16][]dns.RR),
+		names:   make(map[netip.Addr][]string),
 		logger:  logger,
 	}
 	if len(entries) > 0 {
@@ -154,6 +157,7 @@ func (m *Manager) ApplyConfig(ctx context.Context, entries []config.LocalRecordE
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.records = make(map[string]map[uint16][]dns.RR)
+	m.names = make(map[netip.Addr][]string)
 	if len(entries) > 0 {
 		m.applyEntries(entries)
 	}
@@ -178,7 +182,33 @@ func (m *Manager) applyEntries(entries []config.LocalRecordEntry) {
 		}
 		qtype := rr.Header().Rrtype
 		m.records[name][qtype] = append(m.records[name][qtype], rr)
+		if !strings.HasPrefix(name, "*.") {
+			var ip net.IP
+			switch v := rr.(type) {
+			case *dns.A:
+				ip = v.A
+			case *dns.AAAA:
+				ip = v.AAAA
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addr = addr.Unmap()
+				m.names[addr] = append(m.names[addr], name)
+			}
+		}
+	}
+}
+
+// NamesForAddr returns the names of local A/AAAA records pointing at addr, in config order.
+// Wildcard records are not included. Used to synthesize PTR answers.
+func (m *Manager) NamesForAddr(addr netip.Addr) []string {
+	addr = addr.Unmap()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := m.names[addr]
+	if len(names) == 0 {
+		return nil
 	}
+	return append([]string(nil), names...)
 }
 
 func (m *Manager) buildResponse(question dns.Question, answers []dns.RR) *dns.Msg {
@@ -2,6 +2,7 @@ package localrecords
 
 import (
 	"context"
+	"net/netip"
 	"strings"
 	"testing"
 
@@ -170,6 +171,34 @@ func TestManagerPTRRecord(t *testing.T) {
 	}
 }
 
+func TestManagerNamesForAddr(t *testing.T) {
+	m := New([]config.LocalRecordEntry{
+		{Name: "nas.home.arpa", Type: "A", Value: "192.168.1.20"},
+		{Name: "NAS.lan", Type: "A", Value: "192.168.1.20"},
+		{Name: "printer.home.arpa", Type: "AAAA", Value: "fd00::20"},
+		{Name: "*.apps.home.arpa", Type: "A", Value: "192.168.1.30"},
+	}, logging.NewDiscardLogger())
+
+	names := m.NamesForAddr(netip.MustParseAddr("192.168.1.20"))
+	if len(names) != 2 || names[0] != "nas.home.arpa" || names[1] != "nas.lan" {
+		t.Errorf("NamesForAddr(192.168.1.20) = %v", names)
+	}
+	if names := m.NamesForAddr(netip.MustParseAddr("::ffff:192.168.1.20")); len(names) != 2 {
+		t.Errorf("NamesForAddr(mapped) = %v, want 2 names", names)
+	}
+	if names := m.NamesForAddr(netip.MustParseAddr("fd00::20")); len(names) != 1 || names[0] != "printer.home.arpa" {
+		t.Errorf("NamesForAddr(fd00::20) = %v", names)
+	}
+	if names := m.NamesForAddr(netip.MustParseAddr("192.168.1.30")); names != nil {
+		t.Errorf("wildcard records should not be reverse-mapped, got %v", names)
+	}
+
+	_ = m.ApplyConfig(context.Background(), nil)
+	if names := m.NamesForAddr(netip.MustParseAddr("192.168.1.20")); names != nil {
+		t.Errorf("expected no names after ApplyConfig, got %v", names)
+	}
+}
+
 func TestManagerEmptyEntries(t *testing.T) {
 	m := New(nil, nil)
 	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
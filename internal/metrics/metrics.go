@@ -38,6 +38,41 @@ var (
 		Help: "Total number of queries blocked by blocklist or denylist",
 	})
 
+	UpstreamCoalescedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_upstream_coalesced_total",
+		Help: "Total number of queries that shared an in-flight upstream exchange for the same question",
+	})
+
+	DNSSECValidationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_dnssec_validations_total",
+		Help: "Total number of upstream answers validated with DNSSEC, by result (secure, insecure, bogus)",
+	}, []string{"result"})
+
+	RateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rate_limited_total",
+		Help: "Total number of queries over a client's rate limit, by protocol (udp, tcp) and action (drop, truncate, refuse)",
+	}, []string{"protocol", "action"})
+
+	ACLDeniedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_acl_denied_total",
+		Help: "Total number of queries denied by the access control lists, by action (refuse, drop)",
+	}, []string{"action"})
+
+	RRLResponsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rrl_responses_total",
+		Help: "Total number of responses suppressed by response rate limiting, by action (drop, slip)",
+	}, []string{"action"})
+
+	UpstreamLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_upstream_limited_total",
+		Help: "Total number of upstream exchanges skipped because the upstream was at its max_inflight or max_qps limit, by priority (user, refresh)",
+	}, []string{"upstream", "priority"})
+
+	UpstreamRejectedResponsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_upstream_rejected_responses_total",
+		Help: "Total number of UDP upstream responses rejected as possibly spoofed, by reason (id, question, case)",
+	}, []string{"upstream", "reason"})
+
 	RefreshSweepTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "dns_refresh_sweep_total",
 		Help: "Total number of keys refreshed by the sweeper",
@@ -53,6 +88,27 @@ var (
 		Help: "Total number of query events dropped due to full buffer",
 	})
 
+	// Upstream health gauges, set by the health prober after each probe
+	UpstreamUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_upstream_up",
+		Help: "Whether the upstream passes health checks (1) or is marked down (0)",
+	}, []string{"upstream"})
+
+	UpstreamProbeSuccessRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_upstream_probe_success_rate",
+		Help: "Share of recent health probes that succeeded (0-1)",
+	}, []string{"upstream"})
+
+	UpstreamProbeLatencyMs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_upstream_probe_latency_ms",
+		Help: "Latency of recent successful health probes in milliseconds, by quantile (0.5, 0.95)",
+	}, []string{"upstream", "quantile"})
+
+	UpstreamProbeConsecutiveFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_upstream_probe_consecutive_failures",
+		Help: "Number of consecutive failed health probes",
+	}, []string{"upstream"})
+
 	// Gauges set from stats on scrape
 	CacheHitRate = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "dns_cache_hit_rate",
@@ -94,6 +150,17 @@ func Init() *prometheus.Registry {
 			L0HitsTotal,
 			L1HitsTotal,
 			BlockedTotal,
+			UpstreamCoalescedTotal,
+			DNSSECValidationsTotal,
+			RateLimitedTotal,
+			ACLDeniedTotal,
+			RRLResponsesTotal,
+			UpstreamLimitedTotal,
+			UpstreamRejectedResponsesTotal,
+			UpstreamUp,
+			UpstreamProbeSuccessRate,
+			UpstreamProbeLatencyMs,
+			UpstreamProbeConsecutiveFailures,
 			RefreshSweepTotal,
 			QuerystoreRecordedTotal,
 			QuerystoreDroppedTotal,
@@ -133,6 +200,63 @@ func RecordBlocked() {
 	BlockedTotal.Inc()
 }
 
+// RecordUpstreamCoalesced increments the coalesced upstream queries counter
+func RecordUpstreamCoalesced() {
+	UpstreamCoalescedTotal.Inc()
+}
+
+// RecordDNSSECValidation increments the DNSSEC validations counter for result
+func RecordDNSSECValidation(result string) {
+	DNSSECValidationsTotal.WithLabelValues(result).Inc()
+}
+
+// RecordRateLimited increments the rate limited queries counter
+func RecordRateLimited(protocol, action string) {
+	RateLimitedTotal.WithLabelValues(protocol, action).Inc()
+}
+
+// RecordACLDenied increments the ACL denied queries counter for action
+func RecordACLDenied(action string) {
+	ACLDeniedTotal.WithLabelValues(action).Inc()
+}
+
+// RecordRRL increments the RRL suppressed responses counter for action
+func RecordRRL(action string) {
+	RRLResponsesTotal.WithLabelValues(action).Inc()
+}
+
+// RecordUpstreamLimited increments the counter of exchanges skipped by an upstream limit
+func RecordUpstreamLimited(upstream, priority string) {
+	UpstreamLimitedTotal.WithLabelValues(upstream, priority).Inc()
+}
+
+// RecordUpstreamRejectedResponse increments the counter of rejected upstream responses
+func RecordUpstreamRejectedResponse(upstream, reason string) {
+	UpstreamRejectedResponsesTotal.WithLabelValues(upstream, reason).Inc()
+}
+
+// SetUpstreamHealth sets the health gauges for upstream
+func SetUpstreamHealth(upstream string, up bool, successRate, p50Ms, p95Ms float64, consecutiveFailures int) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	UpstreamUp.WithLabelValues(upstream).Set(v)
+	UpstreamProbeSuccessRate.WithLabelValues(upstream).Set(successRate)
+	UpstreamProbeLatencyMs.WithLabelValues(upstream, "0.5").Set(p50Ms)
+	UpstreamProbeLatencyMs.WithLabelValues(upstream, "0.95").Set(p95Ms)
+	UpstreamProbeConsecutiveFailures.WithLabelValues(upstream).Set(float64(consecutiveFailures))
+}
+
+// DeleteUpstreamHealth removes the health gauges of an upstream no longer configured
+func DeleteUpstreamHealth(upstream string) {
+	UpstreamUp.DeleteLabelValues(upstream)
+	UpstreamProbeSuccessRate.DeleteLabelValues(upstream)
+	UpstreamProbeLatencyMs.DeleteLabelValues(upstream, "0.5")
+	UpstreamProbeLatencyMs.DeleteLabelValues(upstream, "0.95")
+	UpstreamProbeConsecutiveFailures.DeleteLabelValues(upstream)
+}
+
 // RecordRefreshSweep adds n to the refresh sweep counter
 func RecordRefreshSweep(n int) {
 	if n > 0 {
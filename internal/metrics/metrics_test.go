@@ -63,6 +63,48 @@ func TestRecordQuerystoreDropped(t *testing.T) {
 	RecordQuerystoreDropped()
 }
 
+func TestRecordUpstreamLimited(t *testing.T) {
+	Init()
+	RecordUpstreamLimited("1.1.1.1:53", "user")
+	RecordUpstreamLimited("1.1.1.1:53", "refresh")
+}
+
+func TestRecordUpstreamRejectedResponse(t *testing.T) {
+	Init()
+	RecordUpstreamRejectedResponse("1.1.1.1:53", "id")
+	RecordUpstreamRejectedResponse("1.1.1.1:53", "case")
+}
+
+func TestSetUpstreamHealth(t *testing.T) {
+	reg := Init()
+	SetUpstreamHealth("192.0.2.1:53", false, 0.25, 12, 40, 3)
+	SetUpstreamHealth("192.0.2.2:53", true, 1, 5, 8, 0)
+	DeleteUpstreamHealth("192.0.2.2:53")
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	found := false
+	for _, mf := range families {
+		if mf.GetName() != "dns_upstream_up" {
+			continue
+		}
+		found = true
+		if len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected 1 dns_upstream_up series after delete, got %d", len(mf.GetMetric()))
+		}
+		m := mf.GetMetric()[0]
+		if m.GetLabel()[0].GetValue() != "192.0.2.1:53" || m.GetGauge().GetValue() != 0 {
+			t.Errorf("unexpected series %v", m)
+		}
+	}
+	if !found {
+		t.Error("dns_upstream_up not registered")
+	}
+	DeleteUpstreamHealth("192.0.2.1:53")
+}
+
 func TestUpdateGauges_NilProvider(t *testing.T) {
 	Init()
 	// Should not panic
@@ -0,0 +1,272 @@
+// Package proxyproto implements the receiving side of the PROXY protocol, versions 1 (text)
+// and 2 (binary), as sent by HAProxy and by cloud and Kubernetes load balancers in front of
+// the DNS listeners, so queries are attributed to the real client instead of the proxy.
+//
+// Only sources in a trusted set may send a PROXY header: anyone else could claim any address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeaderTimeout bounds reading the PROXY header of a connection.
+const DefaultHeaderTimeout = 5 * time.Second
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // including CRLF
+	v2HeaderLen = 16
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errMissingHeader = errors.New("proxyproto: connection from trusted source has no PROXY header")
+
+// Trusted is a set of networks allowed to report client addresses: with a PROXY header, or
+// (for DoH) with X-Forwarded-For and Forwarded.
+type Trusted []netip.Prefix
+
+// ParseTrusted parses IP addresses and CIDRs.
+func ParseTrusted(entries []string) (Trusted, error) {
+	out := make(Trusted, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(e); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", e)
+		}
+		ip = ip.Unmap()
+		out = append(out, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return out, nil
+}
+
+// Contains reports whether ip is in one of the trusted networks.
+func (t Trusted) Contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range t {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr is Contains for the IP of a connection address.
+func (t Trusted) ContainsAddr(addr net.Addr) bool {
+	if len(t) == 0 || addr == nil {
+		return false
+	}
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		ip, ok := netip.AddrFromSlice(ta.IP)
+		return ok && t.Contains(ip)
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	return err == nil && t.Contains(ap.Addr())
+}
+
+// Listener reads the PROXY header at the start of connections from trusted sources, and
+// reports the client address it carries as the connection's RemoteAddr. The header is
+// required from trusted sources (the specification forbids guessing whether one was sent):
+// connections without a valid header are closed. Other connections are passed through.
+type Listener struct {
+	net.Listener
+	Trusted Trusted
+	// HeaderTimeout bounds reading the header (0 = DefaultHeaderTimeout).
+	HeaderTimeout time.Duration
+}
+
+// NewListener wraps ln to accept PROXY headers from trusted.
+func NewListener(ln net.Listener, trusted Trusted) *Listener {
+	return &Listener{Listener: ln, Trusted: trusted}
+}
+
+// Accept returns the next connection. The header is read on the first Read or RemoteAddr
+// call, so a slow proxy does not hold up the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.Trusted.ContainsAddr(c.RemoteAddr()) {
+		return c, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	return &Conn{Conn: c, br: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+// Conn is a connection from a trusted proxy, starting with a PROXY header.
+type Conn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr // client address from the header; nil = the connection's own
+	err    error
+
+	// readDeadline is the caller's deadline, restored after the header is read.
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.mu.Unlock()
+		c.remote, c.err = readHeader(c.br)
+		c.mu.Lock()
+		_ = c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header; the proxy's address for
+// LOCAL (health check) and UNKNOWN headers.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ProxyAddr returns the address of the proxy itself.
+func (c *Conn) ProxyAddr() net.Addr { return c.Conn.RemoteAddr() }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readHeader reads a v1 or v2 header from br and returns the source address it carries,
+// or nil when the connection's own address applies.
+func readHeader(br *bufio.Reader) (net.Addr, error) {
+	// The shortest valid header, "PROXY UNKNOWN\r\n", is longer than the v2 signature.
+	sig, err := br.Peek(len(v2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: reading header: %w", err)
+	}
+	switch {
+	case bytes.Equal(sig, v2Signature):
+		return readV2(br)
+	case bytes.HasPrefix(sig, []byte(v1Prefix)):
+		return readV1(br)
+	}
+	return nil, errMissingHeader
+}
+
+// readV1 parses "PROXY TCP4|TCP6 <src> <dst> <srcport> <dstport>\r\n" or "PROXY UNKNOWN ...\r\n".
+func readV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: reading v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyproto: v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: malformed v1 header %q", line)
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") || ip.Zone() != "" {
+		return nil, fmt.Errorf("proxyproto: invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readV2 parses a binary header: signature, version/command, family/protocol, length, then
+// the addresses and TLVs (ignored).
+func readV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [v2HeaderLen]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("proxyproto: reading v2 header: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, fmt.Errorf("proxyproto: reading v2 addresses: %w", err)
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL: connection made by the proxy itself, e.g. a health check
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported v2 command %d", hdr[12]&0x0f)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET: src addr, dst addr, src port, dst port
+		if len(payload) < 12 {
+			return nil, errors.New("proxyproto: short v2 IPv4 address block")
+		}
+		ip := netip.AddrFrom4([4]byte(payload[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("proxyproto: short v2 IPv6 address block")
+		}
+		ip := netip.AddrFrom16([16]byte(payload[0:16])).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(payload[32:34]))), nil
+	}
+	// AF_UNSPEC and AF_UNIX carry no usable client IP.
+	return nil, nil
+}
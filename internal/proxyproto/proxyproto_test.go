@@ -0,0 +1,153 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	h := append([]byte(nil), v2Signature...)
+	h = append(h, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0, 53}
+	v6 := make([]byte, 36+5) // addresses plus a TLV, which is skipped
+	copy(v6, netip.MustParseAddr("2001:db8::7").AsSlice())
+	binary.BigEndian.PutUint16(v6[32:], 4711)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string // "" = connection address
+		err    bool
+	}{
+		{name: "v1 tcp4", header: "PROXY TCP4 203.0.113.7 10.0.0.1 12345 53\r\n", want: "203.0.113.7:12345"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::7 2001:db8::1 4711 853\r\n", want: "[2001:db8::7]:4711"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 family mismatch", header: "PROXY TCP4 2001:db8::7 10.0.0.1 1 53\r\n", err: true},
+		{name: "v1 bad port", header: "PROXY TCP4 203.0.113.7 10.0.0.1 70000 53\r\n", err: true},
+		{name: "v1 no crlf", header: "PROXY TCP4 203.0.113.7 10.0.0.1 1 53\n", err: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: true},
+		{name: "v2 ipv4", header: string(v2Header(0x1, 0x11, v4)), want: "203.0.113.7:12345"},
+		{name: "v2 ipv6 with tlv", header: string(v2Header(0x1, 0x21, v6)), want: "[2001:db8::7]:4711"},
+		{name: "v2 local", header: string(v2Header(0x0, 0x00, nil))},
+		{name: "v2 unspec", header: string(v2Header(0x1, 0x00, nil))},
+		{name: "v2 short addresses", header: string(v2Header(0x1, 0x11, v4[:6])), err: true},
+		{name: "no header", header: "\x00\x1d\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.header + "query"))
+			addr, err := readHeader(br)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("readHeader = %v, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readHeader: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("address = %q, want %q", got, tt.want)
+			}
+			if rest, _ := io.ReadAll(br); string(rest) != "query" {
+				t.Errorf("data after header = %q, want the query", rest)
+			}
+		})
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	trusted, err := ParseTrusted([]string{"10.0.0.0/8", " 192.0.2.1 ", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("ParseTrusted: %v", err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3": true, "::ffff:10.1.2.3": true, "192.0.2.1": true, "192.0.2.2": false, "2001:db8::1": true, "2001:db9::1": false,
+	} {
+		if got := trusted.Contains(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if _, err := ParseTrusted([]string{"proxy.local"}); err == nil {
+		t.Error("ParseTrusted accepted a hostname")
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	trusted, _ := ParseTrusted([]string{"127.0.0.1"})
+	pl := NewListener(ln, trusted)
+
+	send := func(data string) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		_, _ = c.Write([]byte(data))
+	}
+
+	// The caller's read deadline still applies after the header.
+	send("PROXY TCP4 198.51.100.9 10.0.0.1 5353 53\r\nhello")
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Read = %q, %v", buf, err)
+	}
+	if got := c.RemoteAddr().String(); got != "198.51.100.9:5353" {
+		t.Errorf("RemoteAddr = %s, want the client from the header", got)
+	}
+	if _, err := c.Read(buf); err == nil {
+		t.Error("Read after the deadline succeeded")
+	}
+	c.Close()
+
+	// A trusted source must send a header.
+	send("hello, without a header")
+	c, err = pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if _, err := c.Read(buf); err == nil {
+		t.Error("Read succeeded without a PROXY header")
+	}
+	if got := c.RemoteAddr().String(); !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("RemoteAddr = %s, want the proxy address", got)
+	}
+	c.Close()
+
+	// Untrusted sources are passed through untouched.
+	pl.Trusted = nil
+	send("PROXY TCP4 198.51.100.9 10.0.0.1 5353 53\r\n")
+	c, err = pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer c.Close()
+	if _, ok := c.(*Conn); ok {
+		t.Error("untrusted connection was wrapped")
+	}
+}
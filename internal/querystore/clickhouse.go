@@ -117,6 +117,7 @@ type clickHouseRow struct {
 	CacheLookupMS   float64 `json:"cache_lookup_ms"`
 	NetworkWriteMS  float64 `json:"network_write_ms"`
 	UpstreamAddress string  `json:"upstream_address"`
+	BlockedBy       string  `json:"blocked_by"`
 }
 
 
@@ -288,6 +289,7 @@ func (s *ClickHouseStore) flushInternal(batch []Event, skipReinit bool) {
 			CacheLookupMS:    event.CacheLookupMS,
 			NetworkWriteMS:   event.NetworkWriteMS,
 			UpstreamAddress:  event.UpstreamAddress,
+			BlockedBy:        event.BlockedBy,
 		}
 		if err := encoder.Encode(row); err != nil {
 			s.logf(slog.LevelError, "failed to encode query event", "err", err)
@@ -401,7 +403,8 @@ func (s *ClickHouseStore) ensureSchema(database, table string, retentionHours in
     duration_ms Float64,
     cache_lookup_ms Float64 DEFAULT 0,
     network_write_ms Float64 DEFAULT 0,
-    upstream_address LowCardinality(String) DEFAULT ''
+    upstream_address LowCardinality(String) DEFAULT '',
+    blocked_by String DEFAULT ''
 )
 ENGINE = MergeTree
 PARTITION BY toStartOfHour(ts)
@@ -415,6 +418,10 @@ TTL toStartOfHour(ts) + INTERVAL %d HOUR`, database, table, retentionHours)
 	if err := s.execQuery(alterAddClientName); err != nil {
 		s.logf(slog.LevelWarn, "failed to add client_name column (may already exist)", "err", err)
 	}
+	alterAddBlockedBy := fmt.Sprintf("ALTER TABLE %s.%s ADD COLUMN IF NOT EXISTS blocked_by String DEFAULT ''", database, table)
+	if err := s.execQuery(alterAddBlockedBy); err != nil {
+		s.logf(slog.LevelWarn, "failed to add blocked_by column (may already exist)", "err", err)
+	}
 	return nil
 }
 
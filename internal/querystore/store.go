@@ -16,6 +16,7 @@ type Event struct {
 	CacheLookupMS    float64
 	NetworkWriteMS   float64
 	UpstreamAddress  string // address of upstream used (for outcome=upstream, servfail)
+	BlockedBy        string // what matched for blocked outcomes, e.g. the CNAME link for blocked_cname
 }
 
 type Store interface {
@@ -13,6 +13,7 @@ type Entry struct {
 	QueryID        string  `json:"query_id,omitempty"`
 	Timestamp      string  `json:"timestamp"`
 	ClientIP       string  `json:"client_ip"`
+	ClientID       string  `json:"client_id,omitempty"` // DoH path or DoT/DoQ SNI client ID
 	Protocol       string  `json:"protocol"`
 	QName          string  `json:"qname"`
 	QType          string  `json:"qtype"`
@@ -23,6 +24,7 @@ type Entry struct {
 	CacheLookupMS   float64 `json:"cache_lookup_ms,omitempty"`
 	NetworkWriteMS  float64 `json:"network_write_ms,omitempty"`
 	UpstreamAddress string `json:"upstream_address,omitempty"`
+	BlockedBy       string `json:"blocked_by,omitempty"`
 }
 
 // Writer writes request log entries in text or JSON format.
@@ -54,15 +56,21 @@ func (t *textWriter) Write(entry Entry) {
 	defer t.mu.Unlock()
 	var line string
 	if entry.CacheLookupMS > 0 || entry.NetworkWriteMS > 0 {
-		line = fmt.Sprintf("%s client=%s protocol=%s qname=%s qtype=%s qclass=%s outcome=%s rcode=%s duration_ms=%.3f cache_lookup_ms=%.3f network_write_ms=%.3f upstream=%s\n",
+		line = fmt.Sprintf("%s client=%s protocol=%s qname=%s qtype=%s qclass=%s outcome=%s rcode=%s duration_ms=%.3f cache_lookup_ms=%.3f network_write_ms=%.3f upstream=%s",
 			entry.Timestamp, entry.ClientIP, entry.Protocol, entry.QName, entry.QType, entry.QClass,
 			entry.Outcome, entry.RCode, entry.DurationMS, entry.CacheLookupMS, entry.NetworkWriteMS, entry.UpstreamAddress)
 	} else {
-		line = fmt.Sprintf("%s client=%s protocol=%s qname=%s qtype=%s qclass=%s outcome=%s rcode=%s duration_ms=%.2f upstream=%s\n",
+		line = fmt.Sprintf("%s client=%s protocol=%s qname=%s qtype=%s qclass=%s outcome=%s rcode=%s duration_ms=%.2f upstream=%s",
 			entry.Timestamp, entry.ClientIP, entry.Protocol, entry.QName, entry.QType, entry.QClass,
 			entry.Outcome, entry.RCode, entry.DurationMS, entry.UpstreamAddress)
 	}
-	_, _ = t.writer.Write([]byte(line))
+	if entry.ClientID != "" {
+		line += " client_id=" + entry.ClientID
+	}
+	if entry.BlockedBy != "" {
+		line += fmt.Sprintf(" blocked_by=%q", entry.BlockedBy)
+	}
+	_, _ = t.writer.Write([]byte(line + "\n"))
 }
 
 func (j *jsonWriter) Write(entry Entry) {
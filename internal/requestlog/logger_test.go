@@ -101,6 +101,39 @@ func TestTextWriterWithCacheAndNetworkMetrics(t *testing.T) {
 	}
 }
 
+func TestWriterBlockedBy(t *testing.T) {
+	entry := Entry{
+		Timestamp: "2024-01-15T12:00:00.000Z",
+		ClientIP:  "192.168.1.1",
+		QName:     "metrics.news-site.com",
+		Outcome:   "blocked_cname",
+		RCode:     "NXDOMAIN",
+		BlockedBy: "metrics.news-site.com CNAME news-site.tracker.net",
+	}
+
+	buf := &bytes.Buffer{}
+	NewWriter(buf, "text").Write(entry)
+	line := buf.String()
+	if !strings.HasSuffix(line, ` blocked_by="metrics.news-site.com CNAME news-site.tracker.net"`+"\n") {
+		t.Errorf("expected quoted blocked_by at end of line, got %q", line)
+	}
+	buf.Reset()
+	NewWriter(buf, "text").Write(Entry{Outcome: "upstream"})
+	if strings.Contains(buf.String(), "blocked_by") {
+		t.Errorf("blocked_by should be omitted when empty, got %q", buf.String())
+	}
+
+	buf.Reset()
+	NewWriter(buf, "json").Write(entry)
+	var decoded Entry
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if decoded.BlockedBy != entry.BlockedBy {
+		t.Errorf("blocked_by = %q, want %q", decoded.BlockedBy, entry.BlockedBy)
+	}
+}
+
 func TestJsonWriter(t *testing.T) {
 	buf := &bytes.Buffer{}
 	w := NewWriter(buf, "json")
@@ -163,6 +163,7 @@ func (c *Client) sync(ctx context.Context) error {
 		c.resolver.ApplyClientIdentificationConfig(fullCfg)
 		c.resolver.ApplyBlocklistConfig(ctx, fullCfg)
 		c.resolver.ApplyGroupCacheControl(fullCfg)
+		c.resolver.ApplyRateLimitConfig(fullCfg)
 	}
 
 	c.logger.Debug("sync: config applied successfully")
@@ -364,12 +365,46 @@ func (c *Client) mergeAndWrite(payload config.DNSAffectingConfig) error {
 		"blocked":     payload.Response.Blocked,
 		"blocked_ttl": payload.Response.BlockedTTL,
 	}
+	if payload.Response.BlockedIPv4 != "" {
+		response["blocked_ipv4"] = payload.Response.BlockedIPv4
+	}
+	if payload.Response.BlockedIPv6 != "" {
+		response["blocked_ipv6"] = payload.Response.BlockedIPv6
+	}
 
 	// Only merge DNS-affecting config. query_store (flush intervals, retention_hours, etc.),
 	// server, cache, control remain local—replicas tune them per-instance.
 	override["blocklists"] = blocklists
 	override["upstreams"] = payload.Upstreams
 	override["resolver_strategy"] = payload.ResolverStrategy
+	privateReverse := map[string]any{}
+	if payload.PrivateReverse.Enabled != nil {
+		privateReverse["enabled"] = *payload.PrivateReverse.Enabled
+	}
+	if len(payload.PrivateReverse.Upstreams) > 0 {
+		privateReverse["upstreams"] = payload.PrivateReverse.Upstreams
+	}
+	if payload.PrivateReverse.Domain != "" {
+		privateReverse["domain"] = payload.PrivateReverse.Domain
+	}
+	override["private_reverse"] = privateReverse
+	dns64 := map[string]any{}
+	if payload.DNS64.Enabled != nil {
+		dns64["enabled"] = *payload.DNS64.Enabled
+	}
+	if payload.DNS64.Prefix != "" {
+		dns64["prefix"] = payload.DNS64.Prefix
+	}
+	if payload.DNS64.ExcludeAAAA != nil {
+		dns64["exclude_aaaa"] = payload.DNS64.ExcludeAAAA
+	}
+	override["dns64"] = dns64
+	override["rate_limit"] = payload.RateLimit
+	if len(payload.UpstreamRoutes) > 0 {
+		override["upstream_routes"] = payload.UpstreamRoutes
+	} else {
+		delete(override, "upstream_routes")
+	}
 	if payload.UpstreamTimeout != "" {
 		override["upstream_timeout"] = payload.UpstreamTimeout
 	}
@@ -418,6 +453,15 @@ func (c *Client) mergeAndWrite(payload config.DNSAffectingConfig) error {
 			if g.DisableCache != nil {
 				grp["disable_cache"] = *g.DisableCache
 			}
+			if g.DNS64 != nil {
+				grp["dns64"] = g.DNS64
+			}
+			if g.RateLimit != nil {
+				grp["rate_limit"] = g.RateLimit
+			}
+			if g.Response != nil {
+				grp["response"] = g.Response
+			}
 			clientGroups = append(clientGroups, grp)
 		}
 		override["client_groups"] = clientGroups
@@ -427,13 +471,16 @@ func (c *Client) mergeAndWrite(payload config.DNSAffectingConfig) error {
 		if payload.ClientIdentification.Enabled != nil {
 			ci["enabled"] = *payload.ClientIdentification.Enabled
 		}
+		if payload.ClientIdentification.IPv6PrefixMatch != nil {
+			ci["ipv6_prefix_match"] = *payload.ClientIdentification.IPv6PrefixMatch
+		}
 		if len(payload.ClientIdentification.Clients) > 0 {
 			clients := make([]map[string]any, 0, len(payload.ClientIdentification.Clients))
 			for _, entry := range payload.ClientIdentification.Clients {
 				ip := strings.TrimSpace(entry.IP)
 				name := strings.TrimSpace(entry.Name)
 				groupID := strings.TrimSpace(entry.GroupID)
-				if ip == "" || name == "" {
+				if (ip == "" && len(entry.IDs) == 0 && len(entry.CIDRs) == 0 && len(entry.MACs) == 0) || name == "" {
 					continue
 				}
 				m := map[string]any{
@@ -443,6 +490,15 @@ func (c *Client) mergeAndWrite(payload config.DNSAffectingConfig) error {
 				if groupID != "" {
 					m["group_id"] = groupID
 				}
+				if len(entry.IDs) > 0 {
+					m["ids"] = entry.IDs
+				}
+				if len(entry.CIDRs) > 0 {
+					m["cidrs"] = entry.CIDRs
+				}
+				if len(entry.MACs) > 0 {
+					m["macs"] = entry.MACs
+				}
 				clients = append(clients, m)
 			}
 			if len(clients) > 0 {
@@ -155,6 +155,72 @@ response:
 	}
 }
 
+func TestClient_Sync_UpstreamRoutes(t *testing.T) {
+	primaryCfg := config.Config{
+		Upstreams:        []config.UpstreamConfig{{Name: "doh", Address: "https://dns.example.com/dns-query", Protocol: "https"}},
+		ResolverStrategy: "failover",
+		UpstreamRoutes: []config.UpstreamRouteConfig{{
+			Suffixes:  []string{"corp.example.com", "home.arpa"},
+			Upstreams: []config.UpstreamConfig{{Name: "corp", Address: "10.0.0.53:53", Protocol: "udp"}},
+			Strategy:  "load_balance",
+		}},
+		Response: config.ResponseConfig{Blocked: "nxdomain", BlockedTTL: config.Duration{Duration: time.Hour}},
+	}
+	payload, err := json.Marshal(primaryCfg.DNSAffecting())
+	if err != nil {
+		t.Fatalf("marshal payload: %v", err)
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(payload)
+	}))
+	defer primary.Close()
+
+	dir := t.TempDir()
+	defaultPath := filepath.Join(dir, "default.yaml")
+	overridePath := filepath.Join(dir, "override.yaml")
+	defaultConfig := `
+server:
+  listen: ["127.0.0.1:53"]
+blocklists:
+  refresh_interval: 6h
+  sources: []
+`
+	if err := os.WriteFile(defaultPath, []byte(defaultConfig), 0600); err != nil {
+		t.Fatalf("write default: %v", err)
+	}
+
+	client := NewClient(ClientConfig{
+		PrimaryURL:  primary.URL,
+		SyncToken:   "token-123",
+		Interval:    config.Duration{Duration: 1 * time.Hour},
+		ConfigPath:  overridePath,
+		DefaultPath: defaultPath,
+		Logger:      logging.NewDiscardLogger(),
+	})
+	if err := client.sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	cfg, err := config.LoadWithFiles(defaultPath, overridePath)
+	if err != nil {
+		t.Fatalf("load synced config: %v", err)
+	}
+	if len(cfg.UpstreamRoutes) != 1 {
+		t.Fatalf("expected 1 upstream route after sync, got %+v", cfg.UpstreamRoutes)
+	}
+	route := cfg.UpstreamRoutes[0]
+	if len(route.Suffixes) != 2 || route.Suffixes[0] != "corp.example.com" || route.Suffixes[1] != "home.arpa" {
+		t.Errorf("suffixes = %v", route.Suffixes)
+	}
+	if len(route.Upstreams) != 1 || route.Upstreams[0].Address != "10.0.0.53:53" {
+		t.Errorf("upstreams = %+v", route.Upstreams)
+	}
+	if route.Strategy != "load_balance" {
+		t.Errorf("strategy = %q, want load_balance", route.Strategy)
+	}
+}
+
 func TestClient_Sync_NonOK(t *testing.T) {
 	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "internal error", 500)
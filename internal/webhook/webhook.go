@@ -26,7 +26,7 @@ type OnErrorPayload struct {
 	QName           string         `json:"qname"`
 	ClientIP        string         `json:"client_ip"`
 	Timestamp       string         `json:"timestamp"`
-	Outcome         string         `json:"outcome"`          // upstream_error, servfail, servfail_backoff, invalid
+	Outcome         string         `json:"outcome"`          // upstream_error, servfail, servfail_backoff, invalid; upstream_down, upstream_up for health checks
 	UpstreamAddress string         `json:"upstream_address"` // empty for invalid/upstream_error when unknown
 	QType           string         `json:"qtype"`
 	DurationMs      float64        `json:"duration_ms"`
@@ -134,6 +134,8 @@ func (discordFormatter) FormatError(p OnErrorPayload) ([]byte, error) {
 		"servfail_backoff":   16776960, // yellow
 		"invalid":            10038562, // gray
 		"application_error":  15158332, // red
+		"upstream_down":      15158332, // red
+		"upstream_up":        3066993,  // green
 	}
 	color := 10038562
 	if c, ok := colors[p.Outcome]; ok {
@@ -143,10 +145,21 @@ func (discordFormatter) FormatError(p OnErrorPayload) ([]byte, error) {
 	if upstream == "" {
 		upstream = "-"
 	}
+	client := p.ClientIP
+	if client == "" {
+		client = "-" // health checks have no client
+	}
+	title := "DNS Error"
+	switch p.Outcome {
+	case "upstream_down":
+		title = "Upstream Down"
+	case "upstream_up":
+		title = "Upstream Up"
+	}
 	fields := []map[string]any{
 		{"name": "Query", "value": p.QName, "inline": true},
 		{"name": "Outcome", "value": p.Outcome, "inline": true},
-		{"name": "Client", "value": p.ClientIP, "inline": true},
+		{"name": "Client", "value": client, "inline": true},
 		{"name": "QType", "value": p.QType, "inline": true},
 		{"name": "Duration", "value": formatMs(p.DurationMs), "inline": true},
 		{"name": "Upstream", "value": upstream, "inline": true},
@@ -159,7 +172,7 @@ func (discordFormatter) FormatError(p OnErrorPayload) ([]byte, error) {
 		"content": nil,
 		"embeds": []map[string]any{
 			{
-				"title":     "DNS Error",
+				"title":     title,
 				"color":     color,
 				"fields":    fields,
 				"timestamp": p.Timestamp,
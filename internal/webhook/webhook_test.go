@@ -136,6 +136,28 @@ func TestDiscordFormatterFormatError(t *testing.T) {
 	}
 }
 
+func TestDiscordFormatterFormatErrorUpstreamHealth(t *testing.T) {
+	f := discordFormatter{}
+	data, err := f.FormatError(OnErrorPayload{QName: ".", Outcome: "upstream_down", UpstreamAddress: "8.8.8.8:53", QType: "NS"})
+	if err != nil {
+		t.Fatalf("FormatError: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("FormatError output not valid JSON: %v", err)
+	}
+	embed := decoded["embeds"].([]any)[0].(map[string]any)
+	if embed["title"] != "Upstream Down" {
+		t.Errorf("embed title = %v, want Upstream Down", embed["title"])
+	}
+	for _, field := range embed["fields"].([]any) {
+		f := field.(map[string]any)
+		if f["name"] == "Client" && f["value"] != "-" {
+			t.Errorf("Client = %v, want - for health checks", f["value"])
+		}
+	}
+}
+
 func TestNotifierFireOnBlock(t *testing.T) {
 	var received []byte
 	var mu sync.Mutex
@@ -89,13 +89,16 @@ export default function ClientsPage() {
 
       <h3>Clients</h3>
       <p className="muted" style={{ marginBottom: "0.5rem" }}>
-        Map client IP addresses to friendly names and assign to a group (e.g. Kids, Adults).
+        Map client IP addresses, ranges or MAC addresses to friendly names and assign to a group (e.g. Kids, Adults).
       </p>
       <div className="table-wrapper" style={{ marginBottom: "1rem" }}>
         <table className="table clients-table">
           <thead>
             <tr>
               <th>IP address</th>
+              <th>Client IDs</th>
+              <th>IP ranges</th>
+              <th>MAC addresses</th>
               <th>Name</th>
               <th>Group</th>
               <th></th>
@@ -118,6 +121,51 @@ export default function ClientsPage() {
                     disabled={readOnly}
                   />
                 </td>
+                <td data-label="Client IDs">
+                  <input
+                    className="input"
+                    placeholder="e.g. kids-phone"
+                    title="DoH /dns-query/<id> or DoT server name <id>.<client_id_domain>; comma-separated"
+                    value={Array.isArray(c.ids) ? c.ids.join(", ") : c.ids || ""}
+                    onChange={(e) => {
+                      const clients = [...(systemConfig.client_identification?.clients || [])];
+                      clients[i] = { ...clients[i], ids: e.target.value };
+                      updateSystemConfig("client_identification", "clients", clients);
+                    }}
+                    style={{ width: "100%", minWidth: "120px" }}
+                    disabled={readOnly}
+                  />
+                </td>
+                <td data-label="IP ranges">
+                  <input
+                    className="input"
+                    placeholder="e.g. 192.168.20.0/24"
+                    title="CIDR ranges, e.g. a VLAN or an IPv6 /64; the most specific match wins; comma-separated"
+                    value={Array.isArray(c.cidrs) ? c.cidrs.join(", ") : c.cidrs || ""}
+                    onChange={(e) => {
+                      const clients = [...(systemConfig.client_identification?.clients || [])];
+                      clients[i] = { ...clients[i], cidrs: e.target.value };
+                      updateSystemConfig("client_identification", "clients", clients);
+                    }}
+                    style={{ width: "100%", minWidth: "120px" }}
+                    disabled={readOnly}
+                  />
+                </td>
+                <td data-label="MAC addresses">
+                  <input
+                    className="input"
+                    placeholder="aa:bb:cc:dd:ee:ff"
+                    title="From the neighbor table (same network) or a forwarder's EDNS MAC option; comma-separated"
+                    value={Array.isArray(c.macs) ? c.macs.join(", ") : c.macs || ""}
+                    onChange={(e) => {
+                      const clients = [...(systemConfig.client_identification?.clients || [])];
+                      clients[i] = { ...clients[i], macs: e.target.value };
+                      updateSystemConfig("client_identification", "clients", clients);
+                    }}
+                    style={{ width: "100%", minWidth: "120px" }}
+                    disabled={readOnly}
+                  />
+                </td>
                 <td data-label="Name">
                   <input
                     className="input"
@@ -222,6 +222,7 @@ export default function DnsPage() {
                     <option value="tls">DoT</option>
                     <option value="quic">DoQ</option>
                     <option value="https">DoH</option>
+                    <option value="recursive">Recursive</option>
                   </select>
                   <button
                     className="icon-button"
@@ -386,16 +387,18 @@ export default function DnsPage() {
           </p>
         )}
         <p className="muted">
-          How to respond when a domain is blocked. Use nxdomain (NXDOMAIN) or an IP
-          address (e.g. 0.0.0.0) to sinkhole.
+          How to respond when a domain is blocked. Use nxdomain (NXDOMAIN), nodata,
+          refused, null (0.0.0.0 and ::), or an IP address (e.g. 0.0.0.0) to sinkhole.
         </p>
         <p
           className="muted"
           style={{ fontSize: "0.85rem", marginTop: "0.25rem", marginBottom: "0.5rem" }}
         >
-          Response type: nxdomain returns NXDOMAIN (domain does not exist); 0.0.0.0
-          or another IP sinkholes to that address. Blocked TTL controls how long
-          clients cache the response (e.g. 1h).
+          Response type: nxdomain returns NXDOMAIN (domain does not exist); nodata
+          returns an empty answer; 0.0.0.0 or another IP sinkholes A/AAAA queries to
+          that address, and other record types (HTTPS, MX, TXT) get an empty answer.
+          custom uses blocked_ipv4/blocked_ipv6 from the config file. Blocked TTL
+          controls how long clients cache the response (e.g. 1h).
         </p>
         {responseStatus && <p className="status">{responseStatus}</p>}
         {responseError && <div className="error">{responseError}</div>}
@@ -112,7 +112,8 @@ export const TABS = [
 export const RESOLVER_STRATEGY_OPTIONS = [
   { value: "failover", label: "Failover", desc: "Try upstreams in order, use next on failure" },
   { value: "load_balance", label: "Load Balance", desc: "Round-robin across all upstreams" },
-  { value: "weighted", label: "Weighted (latency)", desc: "Prefer faster upstreams by response time" },
+  { value: "weighted", label: "Weighted (latency + errors)", desc: "Prefer fast, reliable upstreams by latency, error and timeout rate" },
+  { value: "race", label: "Race", desc: "Query the fastest upstreams in parallel, use the first answer" },
 ];
 export const SUPPORTED_LOCAL_RECORD_TYPES = new Set(["A", "AAAA", "CNAME", "TXT", "PTR"]);
 export const DURATION_PATTERN = /^(?:(?:\d+(?:\.\d+)?)(?:ns|us|µs|μs|ms|s|m|h))+$/i;
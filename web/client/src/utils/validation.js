@@ -264,6 +264,19 @@ export function validateUpstreamsForm(upstreams) {
       rowErrors.push(rowError);
       continue;
     }
+    if (protocol === "recursive") {
+      // Iterative resolution from the root servers; the address is only an identifier.
+      const key = `${(address || "recursive").toLowerCase()}|recursive`;
+      if (seen.has(key)) rowError.address = "Duplicate upstream address/protocol.";
+      else {
+        seen.add(key);
+        const out = { name: name || "recursive", address: address || "recursive", protocol };
+        if (Array.isArray(upstream.root_hints) && upstream.root_hints.length > 0) out.root_hints = upstream.root_hints;
+        normalizedUpstreams.push(out);
+      }
+      rowErrors.push(rowError);
+      continue;
+    }
     if (!address) rowError.address = "Address is required.";
     else {
       const addressError = validateUpstreamAddress(address);
@@ -357,9 +370,10 @@ export function validateResponseForm({ blocked, blockedTtl }) {
   const normalizedBlocked = String(blocked ?? "nxdomain").trim().toLowerCase();
   const normalizedBlockedTtl = String(blockedTtl ?? "1h").trim();
   const fieldErrors = { blocked: "", blockedTtl: "" };
-  if (normalizedBlocked !== "nxdomain") {
+  const modes = ["nxdomain", "nodata", "refused", "null", "custom"];
+  if (!modes.includes(normalizedBlocked)) {
     if (!isValidIPv4(normalizedBlocked) && !isValidIPv6(normalizedBlocked)) {
-      fieldErrors.blocked = "Must be nxdomain or a valid IPv4/IPv6 address.";
+      fieldErrors.blocked = "Must be nxdomain, nodata, refused, null, custom or a valid IPv4/IPv6 address.";
     }
   }
   if (!isValidDuration(normalizedBlockedTtl)) {
@@ -372,7 +386,7 @@ export function validateResponseForm({ blocked, blockedTtl }) {
     summary,
     fieldErrors,
     normalized: {
-      blocked: normalizedBlocked === "nxdomain" ? "nxdomain" : normalizedBlocked,
+      blocked: normalizedBlocked,
       blockedTtl: normalizedBlockedTtl,
     },
   };
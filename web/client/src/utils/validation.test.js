@@ -188,6 +188,11 @@ describe("validateUpstreamsForm", () => {
     const r = validateUpstreamsForm([{ name: "google", address: "8.8.8.8:53" }]);
     expect(r.hasErrors).toBe(false);
   });
+  it("accepts recursive upstream without host:port address", () => {
+    const r = validateUpstreamsForm([{ name: "root", address: "", protocol: "recursive" }]);
+    expect(r.hasErrors).toBe(false);
+    expect(r.normalizedUpstreams[0]).toEqual({ name: "root", address: "recursive", protocol: "recursive" });
+  });
 });
 
 describe("validateLocalRecordsForm", () => {
@@ -228,6 +233,13 @@ describe("validateResponseForm", () => {
     const r = validateResponseForm({ blocked: "0.0.0.0", blockedTtl: "1h" });
     expect(r.hasErrors).toBe(false);
   });
+  it("accepts block modes", () => {
+    for (const blocked of ["nodata", "REFUSED", "null", "custom"]) {
+      const r = validateResponseForm({ blocked, blockedTtl: "1h" });
+      expect(r.hasErrors).toBe(false);
+      expect(r.normalized.blocked).toBe(blocked.toLowerCase());
+    }
+  });
   it("rejects invalid blocked value", () => {
     const r = validateResponseForm({ blocked: "not-an-ip", blockedTtl: "1h" });
     expect(r.hasErrors).toBe(true);
@@ -71,7 +71,14 @@ export function registerConfigRoutes(app) {
       const requestLog = merged.request_log || {};
       const clientsRaw = clientId.clients || {};
       const clientsList = Array.isArray(clientsRaw)
-        ? clientsRaw.map((c) => ({ ip: c.ip || "", name: c.name || "", group_id: c.group_id || "" }))
+        ? clientsRaw.map((c) => ({
+          ip: c.ip || "",
+          name: c.name || "",
+          group_id: c.group_id || "",
+          ids: Array.isArray(c.ids) ? c.ids : [],
+          cidrs: Array.isArray(c.cidrs) ? c.cidrs : [],
+          macs: Array.isArray(c.macs) ? c.macs : [],
+        }))
         : Object.entries(clientsRaw).map(([ip, name]) => ({ ip, name, group_id: "" }));
       const clientGroups = merged.client_groups || [];
       const redis = applyRedisEnvOverrides(cache.redis || {});
@@ -504,13 +511,28 @@ export function registerConfigRoutes(app) {
       if (body.client_identification) {
         const clientsList = body.client_identification.clients || [];
         const clients = clientsList
-          .map((entry) => ({
-            ip: String(entry?.ip || "").trim(),
-            name: String(entry?.name || "").trim(),
-            group_id: String(entry?.group_id || "").trim(),
-          }))
-          .filter((e) => e.ip && e.name);
+          .map((entry) => {
+            // ids (DoH path / DoT SNI), cidrs and macs: arrays or comma-separated strings
+            const list = (value) =>
+              (Array.isArray(value) ? value : String(value || "").split(","))
+                .map((v) => String(v).trim())
+                .filter(Boolean);
+            const ids = list(entry?.ids).map((id) => id.toLowerCase());
+            const cidrs = list(entry?.cidrs);
+            const macs = list(entry?.macs).map((mac) => mac.toLowerCase());
+            const client = {
+              ip: String(entry?.ip || "").trim(),
+              name: String(entry?.name || "").trim(),
+              group_id: String(entry?.group_id || "").trim(),
+            };
+            if (ids.length > 0) client.ids = ids;
+            if (cidrs.length > 0) client.cidrs = cidrs;
+            if (macs.length > 0) client.macs = macs;
+            return client;
+          })
+          .filter((e) => (e.ip || e.ids || e.cidrs || e.macs) && e.name);
         overrideConfig.client_identification = {
+          ...(overrideConfig.client_identification || {}),
           enabled: body.client_identification.enabled === true,
           clients,
         };
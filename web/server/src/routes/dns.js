@@ -110,9 +110,9 @@ export function registerDnsRoutes(app) {
     const resolverStrategy = String(req.body?.resolver_strategy || "failover").trim().toLowerCase();
     const upstreamTimeout = String(req.body?.upstream_timeout || "10s").trim();
     const upstreamBackoff = String(req.body?.upstream_backoff || "30s").trim();
-    const validStrategies = ["failover", "load_balance", "weighted"];
+    const validStrategies = ["failover", "load_balance", "weighted", "race"];
     if (!validStrategies.includes(resolverStrategy)) {
-      res.status(400).json({ error: "resolver_strategy must be failover, load_balance, or weighted" });
+      res.status(400).json({ error: "resolver_strategy must be failover, load_balance, weighted, or race" });
       return;
     }
     const durationPattern = /^(?:(?:\d+(?:\.\d+)?)(?:ns|us|µs|μs|ms|s|m|h))+$/i;
@@ -126,11 +126,45 @@ export function registerDnsRoutes(app) {
     }
     const upstreams = upstreamsInput
       .filter((u) => u && (u.name || u.address))
-      .map((u) => ({
-        name: String(u.name || "").trim() || "upstream",
-        address: String(u.address || "").trim(),
-        protocol: String(u.protocol || "udp").trim().toLowerCase() || "udp",
-      }))
+      .map((u) => {
+        const protocol = String(u.protocol || "udp").trim().toLowerCase() || "udp";
+        const out = {
+          name: String(u.name || "").trim() || "upstream",
+          address: String(u.address || "").trim(),
+          protocol,
+        };
+        if (protocol === "recursive") {
+          out.address = out.address || "recursive";
+          if (Array.isArray(u.root_hints) && u.root_hints.length > 0) {
+            out.root_hints = u.root_hints.map((h) => String(h).trim()).filter(Boolean);
+          }
+        }
+        // Optional per-upstream settings (not editable in the UI yet; kept when set in YAML)
+        const maxInflight = Number(u.max_inflight);
+        if (Number.isInteger(maxInflight) && maxInflight > 0) {
+          out.max_inflight = maxInflight;
+        }
+        const maxQps = Number(u.max_qps);
+        if (Number.isFinite(maxQps) && maxQps > 0) {
+          out.max_qps = maxQps;
+        }
+        if (protocol === "udp" && u.use_0x20 === true) {
+          out.use_0x20 = true;
+        }
+        if (protocol === "https") {
+          if (Array.isArray(u.bootstrap) && u.bootstrap.length > 0) {
+            out.bootstrap = u.bootstrap.map((ip) => String(ip).trim()).filter((ip) => net.isIP(ip));
+          }
+          const dohMethod = String(u.doh_method || "").trim().toLowerCase();
+          if (dohMethod === "get" || dohMethod === "post") {
+            out.doh_method = dohMethod;
+          }
+          if (u.http3 === true) {
+            out.http3 = true;
+          }
+        }
+        return out;
+      })
       .filter((u) => u.address);
     if (upstreams.length === 0) {
       res.status(400).json({ error: "At least one upstream with address is required" });
@@ -138,6 +172,10 @@ export function registerDnsRoutes(app) {
     }
     for (const u of upstreams) {
       const addr = u.address;
+      if (u.protocol === "recursive") {
+        // Iterative resolution from root hints; address is only an identifier
+        continue;
+      }
       if (addr.startsWith("tls://")) {
         const hostPort = addr.slice(6);
         const hasPort = /:\d{1,5}$/.test(hostPort);
@@ -237,6 +275,8 @@ export function registerDnsRoutes(app) {
       const response = config.response || {};
       res.json({
         blocked: response.blocked || "nxdomain",
+        blocked_ipv4: response.blocked_ipv4 || "",
+        blocked_ipv6: response.blocked_ipv6 || "",
         blocked_ttl: response.blocked_ttl || "1h",
       });
     } catch (err) {
@@ -256,10 +296,22 @@ export function registerDnsRoutes(app) {
       return;
     }
     const blocked = String(req.body?.blocked ?? "nxdomain").trim().toLowerCase();
+    // custom keeps the configured addresses unless the request sets them
+    const blockedIpv4 = String(req.body?.blocked_ipv4 ?? merged?.response?.blocked_ipv4 ?? "").trim();
+    const blockedIpv6 = String(req.body?.blocked_ipv6 ?? merged?.response?.blocked_ipv6 ?? "").trim();
     const blockedTtl = String(req.body?.blocked_ttl ?? "1h").trim();
-    if (blocked !== "nxdomain") {
-      if (net.isIP(blocked) === 0) {
-        res.status(400).json({ error: "blocked must be nxdomain or a valid IPv4/IPv6 address" });
+    const modes = ["nxdomain", "nodata", "refused", "null", "custom"];
+    if (!modes.includes(blocked) && net.isIP(blocked) === 0) {
+      res.status(400).json({ error: "blocked must be nxdomain, nodata, refused, null, custom or a valid IPv4/IPv6 address" });
+      return;
+    }
+    if (blocked === "custom") {
+      if (!blockedIpv4 && !blockedIpv6) {
+        res.status(400).json({ error: "blocked_ipv4 or blocked_ipv6 is required when blocked is custom" });
+        return;
+      }
+      if ((blockedIpv4 && net.isIP(blockedIpv4) !== 4) || (blockedIpv6 && net.isIP(blockedIpv6) !== 6)) {
+        res.status(400).json({ error: "blocked_ipv4 must be an IPv4 address and blocked_ipv6 an IPv6 address" });
         return;
       }
     }
@@ -272,13 +324,22 @@ export function registerDnsRoutes(app) {
       const overrideConfig = await readOverrideConfig(configPath);
       overrideConfig.response = {
         ...(overrideConfig.response || {}),
-        blocked: blocked === "nxdomain" ? "nxdomain" : blocked,
+        blocked,
         blocked_ttl: blockedTtl,
       };
+      if (blocked === "custom") {
+        overrideConfig.response.blocked_ipv4 = blockedIpv4;
+        overrideConfig.response.blocked_ipv6 = blockedIpv6;
+      } else {
+        delete overrideConfig.response.blocked_ipv4;
+        delete overrideConfig.response.blocked_ipv6;
+      }
       await writeConfig(configPath, overrideConfig);
       res.json({
         ok: true,
         blocked: overrideConfig.response.blocked,
+        blocked_ipv4: overrideConfig.response.blocked_ipv4 || "",
+        blocked_ipv6: overrideConfig.response.blocked_ipv6 || "",
         blocked_ttl: overrideConfig.response.blocked_ttl,
       });
     } catch (err) {
@@ -44,7 +44,7 @@ export function registerQueriesRoutes(app) {
       ${whereClause}
     `;
     const query = `
-      SELECT ts, client_ip, client_name, protocol, qname, qtype, qclass, outcome, rcode, duration_ms
+      SELECT ts, client_ip, client_name, protocol, qname, qtype, qclass, outcome, rcode, duration_ms, blocked_by
       ${baseQuery}
       ORDER BY ${sortBy} ${sortDir}
       LIMIT {limit: UInt32}
@@ -111,7 +111,7 @@ export function registerQueriesRoutes(app) {
       ? `WHERE ${filters.clauses.join(" AND ")}`
       : "";
     const query = `
-      SELECT ts, client_ip, client_name, protocol, qname, qtype, qclass, outcome, rcode, duration_ms
+      SELECT ts, client_ip, client_name, protocol, qname, qtype, qclass, outcome, rcode, duration_ms, blocked_by
       FROM ${clickhouseDatabase}.${clickhouseTable}
       ${whereClause}
       ORDER BY ${sortBy} ${sortDir}
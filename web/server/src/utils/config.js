@@ -270,7 +270,8 @@ export function normalizeSources(sources) {
     }
     seen.add(url);
     const name = String(source?.name || "").trim() || url;
-    result.push({ name, url });
+    const type = String(source?.type || "").trim().toLowerCase();
+    result.push(type === "ip" ? { name, url, type } : { name, url });
   }
   return result;
 }